@@ -0,0 +1,195 @@
+// Package adminlog keeps an append-only log of admin actions. The
+// entries are the leaves of a Merkle tree (as in RFC 6962) so that its
+// root hash can be published elsewhere and any entry can later be
+// proven to be part of the published log.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package adminlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Entry is a single admin action.
+type Entry struct {
+	Time   time.Time
+	Admin  string
+	Action string
+	Target string `json:",omitempty"`
+}
+
+// Log is an append-only list of entries. Each entry is stored as a line
+// of JSON in the log file; the leaf hashes are computed over these
+// lines.
+type Log struct {
+	path    string
+	entries [][]byte
+	leaves  [][]byte
+}
+
+// Open reads the log at path, creating it on the first append if it
+// does not exist. If path is "memory" the log is only kept in memory.
+func Open(path string) (*Log, error) {
+	l := &Log{path: path}
+	if path == "memory" {
+		return l, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		l.entries = append(l.entries, line)
+		l.leaves = append(l.leaves, leafHash(line))
+	}
+
+	return l, nil
+}
+
+// Append adds an entry to the end of the log.
+func (l *Log) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if l.path != "memory" {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	l.entries = append(l.entries, line)
+	l.leaves = append(l.leaves, leafHash(line))
+	return nil
+}
+
+// Size returns the number of entries in the log.
+func (l *Log) Size() int {
+	return len(l.entries)
+}
+
+// Entry returns the stored form of entry i.
+func (l *Log) Entry(i int) ([]byte, error) {
+	if i < 0 || i >= len(l.entries) {
+		return nil, errors.New("Entry not in log")
+	}
+	return l.entries[i], nil
+}
+
+// Root returns the root hash of the log.
+func (l *Log) Root() []byte {
+	return treeHash(l.leaves)
+}
+
+// Proof returns the inclusion proof of entry i in the current log.
+func (l *Log) Proof(i int) ([][]byte, error) {
+	if i < 0 || i >= len(l.leaves) {
+		return nil, errors.New("Entry not in log")
+	}
+	return path(i, l.leaves), nil
+}
+
+// VerifyInclusion checks that entry is at index of a log of the given
+// size with the given root hash.
+func VerifyInclusion(entry []byte, index, size int, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	computed, ok := rootFromPath(leafHash(entry), index, size, proof)
+	return ok && bytes.Equal(computed, root)
+}
+
+func leafHash(entry []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(entry)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// treeHash computes the root of the tree over the given leaf hashes.
+func treeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := split(len(leaves))
+	return nodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+// path returns the sibling hashes from leaf i up to the root.
+func path(i int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := split(len(leaves))
+	if i < k {
+		return append(path(i, leaves[:k]), treeHash(leaves[k:]))
+	}
+	return append(path(i-k, leaves[k:]), treeHash(leaves[:k]))
+}
+
+// rootFromPath recomputes the root from a leaf hash and its path.
+func rootFromPath(leaf []byte, i, n int, proof [][]byte) ([]byte, bool) {
+	if n == 1 {
+		return leaf, len(proof) == 0
+	}
+	if len(proof) == 0 {
+		return nil, false
+	}
+
+	k := split(n)
+	sibling := proof[len(proof)-1]
+	if i < k {
+		sub, ok := rootFromPath(leaf, i, k, proof[:len(proof)-1])
+		return nodeHash(sub, sibling), ok
+	}
+	sub, ok := rootFromPath(leaf, i-k, n-k, proof[:len(proof)-1])
+	return nodeHash(sibling, sub), ok
+}
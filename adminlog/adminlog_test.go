@@ -0,0 +1,89 @@
+// adminlog_test.go: tests for adminlog.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package adminlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInclusion(t *testing.T) {
+	l, err := Open("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var roots [][]byte
+	for i := 0; i < 9; i++ {
+		roots = append(roots, l.Root())
+		if err = l.Append(Entry{Time: time.Now(), Admin: "Alice", Action: "modify", Target: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for i := range roots[1:] {
+		if bytes.Equal(roots[i], roots[i+1]) {
+			t.Fatalf("Root did not change on append %d", i)
+		}
+	}
+
+	root := l.Root()
+	for i := 0; i < l.Size(); i++ {
+		entry, err := l.Entry(i)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		proof, err := l.Proof(i)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if !VerifyInclusion(entry, i, l.Size(), proof, root) {
+			t.Fatalf("Entry %d failed to verify", i)
+		}
+		if VerifyInclusion(entry, (i+1)%l.Size(), l.Size(), proof, root) {
+			t.Fatalf("Entry %d verified at the wrong index", i)
+		}
+		if VerifyInclusion(append([]byte{}, entry[1:]...), i, l.Size(), proof, root) {
+			t.Fatalf("Modified entry %d verified", i)
+		}
+	}
+
+	if _, err = l.Proof(l.Size()); err == nil {
+		t.Fatalf("Proof of missing entry should fail")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	f, err := ioutil.TempFile("", "adminlog")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	defer os.Remove(f.Name())
+
+	l, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, action := range []string{"create", "modify", "merge"} {
+		if err = l.Append(Entry{Time: time.Now(), Admin: "Alice", Action: action}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	reopened, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if reopened.Size() != 3 || !bytes.Equal(reopened.Root(), l.Root()) {
+		t.Fatalf("Reopened log does not match")
+	}
+}
@@ -0,0 +1,206 @@
+// Package anomaly watches the events of the Red October server for
+// unusual activity, such as bursts of decryptions, delegations at odd
+// hours or users appearing from new addresses, and raises alerts about
+// it as events of their own.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package anomaly
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+)
+
+// EventType is the type of the events raised for alerts.
+const EventType = "anomaly"
+
+// The kinds of alert raised by Heuristic.
+const (
+	DecryptBurst   = "decrypt-burst"
+	OffHours       = "off-hours"
+	NewSource      = "new-source"
+	detectorFailed = "detector-failed"
+)
+
+// Alert is unusual activity noticed by a Detector.
+type Alert struct {
+	Kind   string // such as DecryptBurst
+	Name   string // the user the alert is about
+	Detail string
+}
+
+// Detector is fed the events of the server one at a time, in the order
+// they were published, and returns the alerts they raise, if any. Teams
+// can plug in their own models by implementing it.
+type Detector interface {
+	Observe(e events.Event) ([]Alert, error)
+}
+
+// Watch feeds the events published on bus from now on to detector, in a
+// goroutine of its own, and publishes the alerts it raises on bus as
+// events of EventType, until stop is called. A detector that does not
+// keep up misses events (see events.Bus), and one that fails raises an
+// alert saying so.
+func Watch(bus *events.Bus, detector Detector) (stop func()) {
+	ch, cancel := bus.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range ch {
+			if e.Type == EventType {
+				continue
+			}
+			alerts, err := detector.Observe(e)
+			if err != nil {
+				alerts = append(alerts, Alert{Kind: detectorFailed, Name: e.Name, Detail: err.Error()})
+			}
+			for _, a := range alerts {
+				bus.Publish(events.Event{Time: time.Now(), Type: EventType, Name: a.Name, Anomaly: a.Kind, Reason: a.Detail})
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Heuristic is a Detector of simple anomalies: more than BurstCount
+// decryptions requested by a user within BurstWindow, delegations made
+// outside the hours from WorkStart to WorkEnd in Location, and users
+// appearing from an address they were not seen at before. It is not
+// safe to share between goroutines, which Watch does not need.
+type Heuristic struct {
+	BurstCount  int // 0 disables burst alerts
+	BurstWindow time.Duration
+
+	WorkStart, WorkEnd int // hours of the day; equal disables off-hours alerts
+	Location           *time.Location
+
+	NewSources bool
+
+	decrypts map[string][]time.Time     // recent decryptions by user
+	sources  map[string]map[string]bool // addresses seen by user
+}
+
+// NewHeuristic returns a Heuristic alerting on more than 20 decryptions
+// by a user within 10 minutes, delegations outside 7:00 to 20:00 local
+// time, and new addresses.
+func NewHeuristic() *Heuristic {
+	return &Heuristic{
+		BurstCount:  20,
+		BurstWindow: 10 * time.Minute,
+		WorkStart:   7,
+		WorkEnd:     20,
+		Location:    time.Local,
+		NewSources:  true,
+	}
+}
+
+func (h *Heuristic) Observe(e events.Event) ([]Alert, error) {
+	var alerts []Alert
+	if e.Name == "" {
+		return nil, nil
+	}
+
+	switch e.Type {
+	case "decrypt":
+		if a, ok := h.burst(e); ok {
+			alerts = append(alerts, a)
+		}
+	case "delegate":
+		if a, ok := h.offHours(e); ok {
+			alerts = append(alerts, a)
+		}
+	}
+	if a, ok := h.newSource(e); ok {
+		alerts = append(alerts, a)
+	}
+	return alerts, nil
+}
+
+// burst records a decryption, alerting once as the number of recent
+// decryptions of its user goes over BurstCount.
+func (h *Heuristic) burst(e events.Event) (Alert, bool) {
+	if h.BurstCount <= 0 {
+		return Alert{}, false
+	}
+	if h.decrypts == nil {
+		h.decrypts = make(map[string][]time.Time)
+	}
+
+	recent := h.decrypts[e.Name][:0]
+	for _, t := range h.decrypts[e.Name] {
+		if e.Time.Sub(t) < h.BurstWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, e.Time)
+	h.decrypts[e.Name] = recent
+
+	if len(recent) != h.BurstCount+1 {
+		return Alert{}, false
+	}
+	return Alert{
+		Kind:   DecryptBurst,
+		Name:   e.Name,
+		Detail: fmt.Sprintf("%d decryptions within %s", len(recent), h.BurstWindow),
+	}, true
+}
+
+// offHours alerts on a delegation made outside working hours.
+func (h *Heuristic) offHours(e events.Event) (Alert, bool) {
+	if h.WorkStart == h.WorkEnd {
+		return Alert{}, false
+	}
+	loc := h.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	hour := e.Time.In(loc).Hour()
+	inHours := hour >= h.WorkStart && hour < h.WorkEnd
+	if h.WorkStart > h.WorkEnd {
+		// working hours across midnight
+		inHours = hour >= h.WorkStart || hour < h.WorkEnd
+	}
+	if inHours {
+		return Alert{}, false
+	}
+	return Alert{
+		Kind:   OffHours,
+		Name:   e.Name,
+		Detail: fmt.Sprintf("delegation at %s", e.Time.In(loc).Format("15:04 MST")),
+	}, true
+}
+
+// newSource records the address of an event, alerting if its user was
+// seen before, but never from there.
+func (h *Heuristic) newSource(e events.Event) (Alert, bool) {
+	if !h.NewSources || e.Source == "" {
+		return Alert{}, false
+	}
+	if h.sources == nil {
+		h.sources = make(map[string]map[string]bool)
+	}
+
+	host := e.Source
+	if split, _, err := net.SplitHostPort(e.Source); err == nil {
+		host = split
+	}
+	seen, ok := h.sources[e.Name]
+	if !ok {
+		h.sources[e.Name] = map[string]bool{host: true}
+		return Alert{}, false
+	}
+	if seen[host] {
+		return Alert{}, false
+	}
+	seen[host] = true
+	return Alert{Kind: NewSource, Name: e.Name, Detail: "first seen from " + host}, true
+}
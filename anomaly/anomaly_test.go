@@ -0,0 +1,145 @@
+// anomaly_test.go: tests for anomaly.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package anomaly
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+)
+
+func TestBurst(t *testing.T) {
+	h := NewHeuristic()
+	h.BurstCount = 3
+	h.NewSources = false
+
+	start := time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC)
+	var raised int
+	for i := 0; i < 6; i++ {
+		alerts, err := h.Observe(events.Event{Time: start.Add(time.Duration(i) * time.Minute), Type: "decrypt", Name: "Alice"})
+		if err != nil {
+			t.Fatalf("Error observing event: %s", err)
+		}
+		for _, a := range alerts {
+			if a.Kind != DecryptBurst || a.Name != "Alice" {
+				t.Fatalf("Wrong alert: %v", a)
+			}
+			if i != 3 {
+				t.Fatalf("Alert raised after %d decryptions", i+1)
+			}
+			raised++
+		}
+	}
+	if raised != 1 {
+		t.Fatalf("Expected a single burst alert, got %d", raised)
+	}
+
+	// decryptions spread over more than the window are fine
+	alerts, _ := h.Observe(events.Event{Time: start.Add(time.Hour), Type: "decrypt", Name: "Bob"})
+	for i := 1; i < 5; i++ {
+		more, _ := h.Observe(events.Event{Time: start.Add(time.Hour + time.Duration(i)*h.BurstWindow), Type: "decrypt", Name: "Bob"})
+		alerts = append(alerts, more...)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts: %v", alerts)
+	}
+}
+
+func TestOffHours(t *testing.T) {
+	h := NewHeuristic()
+	h.Location = time.UTC
+
+	day := time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC)
+	if alerts, _ := h.Observe(events.Event{Time: day, Type: "delegate", Name: "Alice"}); len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts: %v", alerts)
+	}
+	night := time.Date(2013, 11, 29, 3, 0, 0, 0, time.UTC)
+	if alerts, _ := h.Observe(events.Event{Time: night, Type: "decrypt", Name: "Alice"}); len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts: %v", alerts)
+	}
+	alerts, _ := h.Observe(events.Event{Time: night, Type: "delegate", Name: "Alice"})
+	if len(alerts) != 1 || alerts[0].Kind != OffHours {
+		t.Fatalf("Expected an off-hours alert, got %v", alerts)
+	}
+
+	// working hours across midnight
+	h.WorkStart, h.WorkEnd = 22, 6
+	if alerts, _ := h.Observe(events.Event{Time: night, Type: "delegate", Name: "Alice"}); len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts: %v", alerts)
+	}
+	if alerts, _ := h.Observe(events.Event{Time: day, Type: "delegate", Name: "Alice"}); len(alerts) != 1 {
+		t.Fatalf("Expected an off-hours alert, got %v", alerts)
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	h := NewHeuristic()
+	now := time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC)
+
+	for _, source := range []string{"10.0.0.1:4000", "10.0.0.1:4001", ""} {
+		if alerts, _ := h.Observe(events.Event{Time: now, Type: "decrypt", Name: "Alice", Source: source}); len(alerts) != 0 {
+			t.Fatalf("Unexpected alerts from %s: %v", source, alerts)
+		}
+	}
+	alerts, _ := h.Observe(events.Event{Time: now, Type: "decrypt", Name: "Alice", Source: "192.0.2.7:4000"})
+	if len(alerts) != 1 || alerts[0].Kind != NewSource || alerts[0].Detail != "first seen from 192.0.2.7" {
+		t.Fatalf("Expected a new source alert, got %v", alerts)
+	}
+	if alerts, _ := h.Observe(events.Event{Time: now, Type: "decrypt", Name: "Alice", Source: "192.0.2.7:4002"}); len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts: %v", alerts)
+	}
+	if alerts, _ := h.Observe(events.Event{Time: now, Type: "decrypt", Name: "Bob", Source: "192.0.2.7:4000"}); len(alerts) != 0 {
+		t.Fatalf("Unexpected alerts for a new user: %v", alerts)
+	}
+}
+
+type detectorFunc func(events.Event) ([]Alert, error)
+
+func (f detectorFunc) Observe(e events.Event) ([]Alert, error) { return f(e) }
+
+func TestWatch(t *testing.T) {
+	bus := events.New()
+	ch, cancel := bus.Subscribe()
+	defer cancel()
+
+	stop := Watch(bus, detectorFunc(func(e events.Event) ([]Alert, error) {
+		if e.Type == "delegate" {
+			return nil, errors.New("model unavailable")
+		}
+		return []Alert{{Kind: "test", Name: e.Name, Detail: "seen"}}, nil
+	}))
+
+	expect := func(want events.Event) {
+		select {
+		case e := <-ch:
+			if e.Type != want.Type || e.Name != want.Name || e.Anomaly != want.Anomaly || e.Reason != want.Reason {
+				t.Fatalf("Expected %v, got %v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %v", want)
+		}
+	}
+
+	bus.Publish(events.Event{Type: "decrypt", Name: "Alice"})
+	expect(events.Event{Type: "decrypt", Name: "Alice"})
+	expect(events.Event{Type: EventType, Name: "Alice", Anomaly: "test", Reason: "seen"})
+
+	bus.Publish(events.Event{Type: "delegate", Name: "Bob"})
+	expect(events.Event{Type: "delegate", Name: "Bob"})
+	expect(events.Event{Type: EventType, Name: "Bob", Anomaly: detectorFailed, Reason: "model unavailable"})
+
+	// alerts are not fed back to the detector, and none are raised
+	// once it is stopped
+	stop()
+	bus.Publish(events.Event{Type: "decrypt", Name: "Alice"})
+	<-ch
+	select {
+	case e := <-ch:
+		t.Fatalf("Unexpected event: %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,157 @@
+// Package approvals asks external approval systems, such as change
+// management systems, to approve decryptions. The approval system is
+// sent the context of the decryption and must answer with a decision
+// signed by its key, so that a forged or replayed answer is refused.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package approvals
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Approve is the decision approving a decryption.
+const Approve = "approve"
+
+// maxResponse is the largest response read from an approval system.
+const maxResponse = 64 << 10
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Request is POSTed as JSON to the approval system for each decryption
+// it is asked to approve.
+type Request struct {
+	Nonce       string // to be returned in the decision
+	Name        string // the user asking for the decryption
+	Label       string // the label whose policy asks for approval
+	Reason      string `json:",omitempty"`
+	Fingerprint string // of the encrypted data
+	Time        time.Time
+}
+
+// Decision is the answer of the approval system to a request.
+type Decision struct {
+	Nonce    string
+	Decision string // "approve" to approve the decryption
+}
+
+// Response is the body of the response of the approval system.
+// Decision is a JSON encoded Decision and Signature is its signature by
+// the key of the approval system: an ASN.1 ECDSA signature of its
+// SHA-256 hash, or an Ed25519 signature.
+type Response struct {
+	Decision  []byte
+	Signature []byte
+}
+
+// ParseKey parses the PKIX encoded public key of an approval system,
+// which must be an ECDSA or Ed25519 key.
+func ParseKey(der []byte) (interface{}, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	default:
+		return nil, errors.New("Approval keys must be ECDSA or Ed25519 keys")
+	}
+}
+
+// CheckURL returns an error if rawURL cannot be the URL of an approval
+// system.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Invalid approval URL %s", rawURL)
+	}
+	return nil
+}
+
+// verify checks the signature of a decision by pub.
+func verify(pub interface{}, decision, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(decision)
+		return ecdsa.VerifyASN1(pub, hash[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, decision, sig)
+	default:
+		return false
+	}
+}
+
+// Ask asks the approval system at rawURL, whose PKIX encoded public key
+// is key, to approve a decryption. It returns nil only if the system
+// answered with an approval of this request signed by the key.
+func Ask(ctx context.Context, rawURL string, key []byte, req Request) error {
+	pub, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	req.Nonce = hex.EncodeToString(nonce)
+	req.Time = time.Now().UTC()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Approval system returned %s", httpResp.Status)
+	}
+
+	var resp Response
+	if err = json.NewDecoder(io.LimitReader(httpResp.Body, maxResponse)).Decode(&resp); err != nil {
+		return err
+	}
+	if !verify(pub, resp.Decision, resp.Signature) {
+		return errors.New("Invalid signature on approval")
+	}
+
+	var decision Decision
+	if err = json.Unmarshal(resp.Decision, &decision); err != nil {
+		return err
+	}
+	if decision.Nonce != req.Nonce {
+		return errors.New("Approval is for another request")
+	}
+	if decision.Decision != Approve {
+		return errors.New("Decryption not approved")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// approvals_test.go: tests for approvals.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package approvals
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAsk(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	var replay []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if replay != nil {
+			w.Write(replay)
+			return
+		}
+
+		decision := Decision{Nonce: req.Nonce, Decision: Approve}
+		signer := priv
+		switch req.Name {
+		case "mallory":
+			decision.Decision = "deny"
+		case "eve":
+			signer = otherPriv
+		}
+		d, _ := json.Marshal(decision)
+		out, _ := json.Marshal(Response{Decision: d, Signature: ed25519.Sign(signer, d)})
+		w.Write(out)
+	}))
+	defer ts.Close()
+
+	ask := func(name string) error {
+		return Ask(context.Background(), ts.URL, key, Request{Name: name, Label: "red", Fingerprint: "9d3c"})
+	}
+	if err = ask("alice"); err != nil {
+		t.Fatalf("Approval refused: %v", err)
+	}
+	if err = ask("mallory"); err == nil {
+		t.Fatalf("Denial taken for an approval")
+	}
+	if err = ask("eve"); err == nil {
+		t.Fatalf("Approval signed by another key accepted")
+	}
+
+	// an approval of an earlier request is refused
+	d, _ := json.Marshal(Decision{Nonce: "00", Decision: Approve})
+	replay, _ = json.Marshal(Response{Decision: d, Signature: ed25519.Sign(priv, d)})
+	if err = ask("alice"); err == nil {
+		t.Fatalf("Replayed approval accepted")
+	}
+
+	if err = CheckURL("ftp://approvals.example.com"); err == nil {
+		t.Fatalf("Invalid approval URL accepted")
+	}
+	if _, err = ParseKey([]byte("not a key")); err == nil {
+		t.Fatalf("Invalid approval key accepted")
+	}
+}
@@ -0,0 +1,195 @@
+// Package archive packs a directory into a tar with an index of its
+// files in front, so that the directory can be encrypted as a single
+// piece of data and one of its files read back without reading the
+// rest. An archive is
+//
+//	"ROARCHV1" | length of the index (4 bytes, big endian) | index | tar
+//
+// where the index is the JSON encoding of the entries of the files, with
+// their offsets in the tar.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	magic      = "ROARCHV1"
+	headerSize = len(magic) + 4
+)
+
+var (
+	ErrNotArchive = errors.New("Data is not an archive")
+	ErrNotFound   = errors.New("File not found in archive")
+	ErrCorrupt    = errors.New("Archive index is corrupt")
+)
+
+// Entry describes a file of an archive.
+type Entry struct {
+	Name    string // slash separated, relative to the directory packed
+	Offset  int64  // of the content in the tar
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// Pack returns an archive of the regular files and directories under
+// dir. Other kinds of files, such as symbolic links, are refused.
+func Pack(dir string) ([]byte, error) {
+	var body bytes.Buffer
+	var index []Entry
+	tw := tar.NewWriter(&body)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return errors.New(name + ": only regular files and directories can be archived")
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		index = append(index, Entry{
+			Name:    name,
+			Offset:  int64(body.Len()),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		})
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		if err == nil && n != fi.Size() {
+			err = errors.New(name + ": changed while being archived")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, headerSize, headerSize+len(indexBytes)+body.Len())
+	copy(out, magic)
+	binary.BigEndian.PutUint32(out[len(magic):], uint32(len(indexBytes)))
+	out = append(out, indexBytes...)
+	return append(out, body.Bytes()...), nil
+}
+
+// IsArchive returns true if data starts as an archive does.
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Reader reads the files of an archive. Only the index and the files
+// read are read from the underlying reader.
+type Reader struct {
+	r     io.ReaderAt
+	tar   int64 // offset of the tar
+	size  int64
+	index []Entry
+}
+
+// NewReader reads the index of the archive of size bytes in r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	header := make([]byte, headerSize)
+	if size < int64(headerSize) {
+		return nil, ErrNotArchive
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !IsArchive(header) {
+		return nil, ErrNotArchive
+	}
+
+	n := int64(binary.BigEndian.Uint32(header[len(magic):]))
+	if n > size-int64(headerSize) {
+		return nil, ErrCorrupt
+	}
+	indexBytes := make([]byte, n)
+	if _, err := r.ReadAt(indexBytes, int64(headerSize)); err != nil {
+		return nil, err
+	}
+
+	ar := &Reader{r: r, tar: int64(headerSize) + n, size: size}
+	if err := json.Unmarshal(indexBytes, &ar.index); err != nil {
+		return nil, ErrCorrupt
+	}
+	for _, e := range ar.index {
+		if e.Offset < 0 || e.Size < 0 || e.Offset > size-ar.tar-e.Size {
+			return nil, ErrCorrupt
+		}
+	}
+	return ar, nil
+}
+
+// Files returns the entries of the files in the archive, in the order
+// they were packed.
+func (ar *Reader) Files() []Entry {
+	return ar.index
+}
+
+// ReadFile returns the content of the file called name, given as it
+// is in the index, with or without a leading "./".
+func (ar *Reader) ReadFile(name string) ([]byte, error) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	for _, e := range ar.index {
+		if e.Name != name {
+			continue
+		}
+		data := make([]byte, e.Size)
+		if _, err := ar.r.ReadAt(data, ar.tar+e.Offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Tar returns a reader of the tar of the archive, which can be
+// extracted with tar.
+func (ar *Reader) Tar() io.Reader {
+	return io.NewSectionReader(ar.r, ar.tar, ar.size-ar.tar)
+}
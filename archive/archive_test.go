@@ -0,0 +1,124 @@
+// archive_test.go: tests for archive.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	*bytes.Reader
+	read int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	r.read += n
+	return n, err
+}
+
+func TestPack(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a.txt":         []byte("hello"),
+		"conf/db.json":  []byte(`{"password":"s3cret"}`),
+		"conf/big.bin":  bytes.Repeat([]byte{7}, 100000),
+		"conf/empty":    nil,
+		"conf/sub/tls":  []byte("key"),
+		"unicode-ü.txt": []byte("ü"),
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	data, err := Pack(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !IsArchive(data) {
+		t.Fatalf("Not an archive")
+	}
+
+	r := &countingReader{Reader: bytes.NewReader(data)}
+	ar, err := NewReader(r, int64(len(data)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(ar.Files()) != len(files) {
+		t.Fatalf("Wrong index: %v", ar.Files())
+	}
+	for name, want := range files {
+		before := r.read
+		got, err := ar.ReadFile(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: wrong content", name)
+		}
+		if r.read-before != len(want) {
+			t.Fatalf("%s: read %d bytes for %d", name, r.read-before, len(want))
+		}
+	}
+	if _, err = ar.ReadFile("./a.txt"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = ar.ReadFile("missing"); err != ErrNotFound {
+		t.Fatalf("Missing file found: %v", err)
+	}
+
+	// the tar holds the directories too
+	tr := tar.NewReader(ar.Tar())
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if want, ok := files[hdr.Name]; ok {
+			got, _ := io.ReadAll(tr)
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: wrong content in tar", hdr.Name)
+			}
+			seen++
+		}
+	}
+	if seen != len(files) {
+		t.Fatalf("Found %d files in tar", seen)
+	}
+
+	if _, err = NewReader(bytes.NewReader([]byte("hello")), 5); err != ErrNotArchive {
+		t.Fatalf("Data taken for an archive: %v", err)
+	}
+	data[len(magic)] = 0xff
+	if _, err = NewReader(bytes.NewReader(data), int64(len(data))); err != ErrCorrupt {
+		t.Fatalf("Corrupt archive read: %v", err)
+	}
+}
+
+func TestPackSymlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("/etc/passwd", filepath.Join(dir, "link")); err != nil {
+		t.Skip("no symlinks:", err)
+	}
+	if _, err := Pack(dir); err == nil {
+		t.Fatalf("Symlink archived")
+	}
+}
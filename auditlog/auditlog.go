@@ -0,0 +1,202 @@
+// Package auditlog keeps a persistent record of every request made to
+// the server: who asked for what, when, and whether it succeeded. Each
+// entry holds the hash of the entry before it, so that changing or
+// removing an entry breaks the chain from there on. Entries can also be
+// copied to other sinks, such as a log collector, as they are written.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Entry is a request made to the server.
+type Entry struct {
+	Seq      int
+	Time     time.Time
+	Endpoint string // such as "/decrypt"
+	Name     string `json:",omitempty"` // the user making the request
+	Status   string // "ok" or why the request failed
+	Source   string `json:",omitempty"` // the address of the client
+
+	// Target is the user or setting changed by an admin.
+	Target      string   `json:",omitempty"`
+	Fingerprint string   `json:",omitempty"` // of the data decrypted
+	Labels      []string `json:",omitempty"`
+
+	// Delegates are the owners whose delegated keys were consumed by a
+	// decryption.
+	Delegates []string `json:",omitempty"`
+
+	Prev []byte // the hash of the previous entry, nil for the first
+	Hash []byte // the hash of this entry, see Log.Verify
+}
+
+// Sink receives a copy of each entry written to a log.
+type Sink interface {
+	Write(e Entry) error
+}
+
+// jsonSink writes entries as lines of JSON.
+type jsonSink struct {
+	w io.Writer
+}
+
+// NewJSONSink returns a sink writing entries to w as lines of JSON.
+func NewJSONSink(w io.Writer) Sink {
+	return jsonSink{w}
+}
+
+func (s jsonSink) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Log is an append-only list of entries. Each entry is stored as a line
+// of JSON in the log file.
+type Log struct {
+	path    string
+	entries []Entry
+	sinks   []Sink
+}
+
+// Open reads the log at path, creating it on the first append if it
+// does not exist. If path is "memory" the log is only kept in memory.
+// Entries appended are also written to sinks.
+func Open(path string, sinks ...Sink) (*Log, error) {
+	l := &Log{path: path, sinks: sinks}
+	if path == "memory" {
+		return l, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("entry %d: %s", len(l.entries), err)
+		}
+		l.entries = append(l.entries, e)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// SetSinks sets the sinks entries appended from now on are written to.
+func (l *Log) SetSinks(sinks ...Sink) {
+	l.sinks = sinks
+}
+
+// Append chains e to the end of the log, setting its sequence number
+// and hashes, and writes it to the log file and then to the sinks. The
+// entry is in the log once written to the file, even if a sink fails.
+func (l *Log) Append(e Entry) (Entry, error) {
+	e.Seq = len(l.entries)
+	e.Prev = l.Head()
+	e.Hash = hash(e)
+
+	if l.path != "memory" {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return e, err
+		}
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return e, err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+	l.entries = append(l.entries, e)
+
+	var sinkErr error
+	for _, s := range l.sinks {
+		if err := s.Write(e); err != nil && sinkErr == nil {
+			sinkErr = err
+		}
+	}
+	return e, sinkErr
+}
+
+// Size returns the number of entries in the log.
+func (l *Log) Size() int {
+	return len(l.entries)
+}
+
+// Head returns the hash of the last entry of the log, which commits to
+// the whole log. It is nil for an empty log.
+func (l *Log) Head() []byte {
+	if len(l.entries) == 0 {
+		return nil
+	}
+	return l.entries[len(l.entries)-1].Hash
+}
+
+// Entries returns at most limit entries from sequence number from on.
+func (l *Log) Entries(from, limit int) []Entry {
+	if from < 0 || from >= len(l.entries) || limit <= 0 {
+		return nil
+	}
+	to := from + limit
+	if to > len(l.entries) {
+		to = len(l.entries)
+	}
+	return append([]Entry{}, l.entries[from:to]...)
+}
+
+// Verify checks the chain of hashes of the log, returning an error
+// naming the first entry that was changed, removed or inserted. The
+// end of the log can only be checked against a head kept elsewhere.
+func (l *Log) Verify() error {
+	var prev []byte
+	for i, e := range l.entries {
+		if e.Seq != i || !bytes.Equal(e.Prev, prev) || !bytes.Equal(e.Hash, hash(e)) {
+			return fmt.Errorf("Audit log entry %d does not match the chain", i)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// hash returns the SHA-256 hash of the JSON encoding of e without its
+// own hash, which covers the hash of the previous entry.
+func hash(e Entry) []byte {
+	e.Hash = nil
+	line, _ := json.Marshal(e)
+	h := sha256.Sum256(line)
+	return h[:]
+}
@@ -0,0 +1,113 @@
+// auditlog_test.go: tests for auditlog.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(Entry) error { return errors.New("sink down") }
+
+func TestChain(t *testing.T) {
+	var copied bytes.Buffer
+	l, err := Open("memory", NewJSONSink(&copied))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if l.Head() != nil || l.Verify() != nil {
+		t.Fatalf("Empty log should have no head and verify")
+	}
+
+	for _, endpoint := range []string{"/create", "/delegate", "/decrypt"} {
+		if _, err = l.Append(Entry{Time: time.Now(), Endpoint: endpoint, Name: "Alice", Status: "ok"}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err = l.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	entries := l.Entries(1, 5)
+	if len(entries) != 2 || entries[0].Seq != 1 || entries[1].Endpoint != "/decrypt" {
+		t.Fatalf("Wrong entries: %v", entries)
+	}
+	if !bytes.Equal(entries[0].Prev, l.Entries(0, 1)[0].Hash) || !bytes.Equal(l.Head(), entries[1].Hash) {
+		t.Fatalf("Entries are not chained")
+	}
+	if l.Entries(3, 1) != nil || l.Entries(-1, 1) != nil {
+		t.Fatalf("Entries returned out of range")
+	}
+
+	lines := strings.Split(strings.TrimSpace(copied.String()), "\n")
+	var last Entry
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &last) != nil || !bytes.Equal(last.Hash, l.Head()) {
+		t.Fatalf("Wrong entries copied to the sink: %s", copied.String())
+	}
+
+	// the entry is kept when a sink fails
+	l.SetSinks(failingSink{})
+	if _, err = l.Append(Entry{Time: time.Now(), Endpoint: "/summary", Status: "ok"}); err == nil {
+		t.Fatalf("Sink error not returned")
+	}
+	if l.Size() != 4 {
+		t.Fatalf("Entry lost on sink error")
+	}
+
+	l.entries[1].Name = "Mallory"
+	if err = l.Verify(); err == nil || !strings.Contains(err.Error(), "entry 1") {
+		t.Fatalf("Changed entry not caught: %v", err)
+	}
+	l.entries[1].Name = "Alice"
+	l.entries = append(l.entries[:1], l.entries[2:]...)
+	if err = l.Verify(); err == nil {
+		t.Fatalf("Removed entry not caught")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	f, err := ioutil.TempFile("", "auditlog")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	defer os.Remove(f.Name())
+
+	l, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, endpoint := range []string{"/create", "/modify", "/decrypt"} {
+		if _, err = l.Append(Entry{Time: time.Now(), Endpoint: endpoint, Name: "Alice", Status: "ok", Delegates: []string{"Bob"}}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	reopened, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if reopened.Size() != 3 || !bytes.Equal(reopened.Head(), l.Head()) {
+		t.Fatalf("Reopened log does not match")
+	}
+	if err = reopened.Verify(); err != nil {
+		t.Fatalf("Reopened log does not verify: %v", err)
+	}
+	if _, err = reopened.Append(Entry{Time: time.Now(), Endpoint: "/summary", Status: "ok"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = reopened.Verify(); err != nil {
+		t.Fatalf("Appended log does not verify: %v", err)
+	}
+}
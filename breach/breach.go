@@ -0,0 +1,187 @@
+// Package breach checks passwords against lists of passwords known from
+// data breaches, either offline with a Bloom filter of their SHA-1
+// hashes or with a k-anonymity range API such as that of Have I Been
+// Pwned, which is only sent the first five hex digits of the hash.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Checker tells whether a password is known from a data breach.
+type Checker interface {
+	Breached(password string) (bool, error)
+}
+
+// hash returns the SHA-1 hash of password, by which breached passwords
+// are listed.
+func hash(password string) [sha1.Size]byte {
+	return sha1.Sum([]byte(password))
+}
+
+// Filter is a Bloom filter of the SHA-1 hashes of breached passwords.
+// It can report a password that is not in the list as breached, at the
+// false positive rate it was sized for, but never misses one that is.
+type Filter struct {
+	bits []uint64
+	k    uint64
+}
+
+// NewFilter returns an empty filter sized for n hashes at the false
+// positive rate p.
+func NewFilter(n int, p float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{bits: make([]uint64, (uint64(m)+63)/64), k: uint64(k)}
+}
+
+// indexes calls f with the k bit positions of a hash, derived from two
+// halves of it by double hashing.
+func (f *Filter) indexes(h [sha1.Size]byte, fn func(i uint64)) {
+	m := uint64(len(f.bits)) * 64
+	a := binary.BigEndian.Uint64(h[0:8])
+	b := binary.BigEndian.Uint64(h[8:16])
+	for i := uint64(0); i < f.k; i++ {
+		fn((a + i*b) % m)
+	}
+}
+
+// Add adds the SHA-1 hash of a breached password to the filter.
+func (f *Filter) Add(h [sha1.Size]byte) {
+	f.indexes(h, func(i uint64) {
+		f.bits[i/64] |= 1 << (i % 64)
+	})
+}
+
+// Breached implements Checker.
+func (f *Filter) Breached(password string) (bool, error) {
+	found := true
+	f.indexes(hash(password), func(i uint64) {
+		found = found && f.bits[i/64]&(1<<(i%64)) != 0
+	})
+	return found, nil
+}
+
+// parseLine parses a line of a list of breached password hashes: the
+// hash in hex, optionally followed by a colon and the number of times
+// it was seen, as in the downloads of Have I Been Pwned.
+func parseLine(line string) (h [sha1.Size]byte, err error) {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil || len(b) != sha1.Size {
+		return h, errors.New("Invalid SHA-1 hash")
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// LoadFile reads a list of breached password hashes, one per line, into
+// a filter with a false positive rate of one in a million. Blank lines
+// are skipped.
+func LoadFile(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the filter is sized on a first pass over the list
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			n++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	f := NewFilter(n, 1e-6)
+	scanner = bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		h, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		f.Add(h)
+	}
+	return f, scanner.Err()
+}
+
+// Range checks passwords with a k-anonymity range API: it is sent the
+// first five hex digits of the SHA-1 hash of a password, and returns
+// the suffixes of the breached hashes starting with them.
+type Range struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewRange returns a Checker using the range API at baseURL, such as
+// https://api.pwnedpasswords.com.
+func NewRange(baseURL string) *Range {
+	return &Range{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Breached implements Checker.
+func (r *Range) Breached(password string) (bool, error) {
+	h := hash(password)
+	digest := strings.ToUpper(hex.EncodeToString(h[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	req, err := http.NewRequest("GET", r.baseURL+"/range/"+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// padded responses hide the number of suffixes from observers
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Breach check returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		// padding entries have a count of zero
+		if strings.EqualFold(fields[0], suffix) && (len(fields) < 2 || fields[1] != "0") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,86 @@
+// breach_test.go: tests for breach.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package breach
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func hexHash(password string) string {
+	h := hash(password)
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+func TestLoadFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "breach")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(hexHash("password") + ":3861493\n\n" + strings.ToLower(hexHash("hunter2")) + "\n")
+	file.Close()
+
+	f, err := LoadFile(file.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for password, breached := range map[string]bool{
+		"password":                     true,
+		"hunter2":                      true,
+		"Hello":                        false,
+		"correct horse battery staple": false,
+	} {
+		if got, _ := f.Breached(password); got != breached {
+			t.Fatalf("Wrong result for %q: %v", password, got)
+		}
+	}
+
+	ioutil.WriteFile(file.Name(), []byte("not a hash\n"), 0600)
+	if _, err = LoadFile(file.Name()); err == nil {
+		t.Fatalf("Invalid list loaded")
+	}
+}
+
+func TestRange(t *testing.T) {
+	digest := hexHash("password")
+	padded := hexHash("hunter2")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/range/" + digest[:5]:
+			w.Write([]byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + digest[5:] + ":3861493\r\n"))
+		case "/range/" + padded[:5]:
+			w.Write([]byte(padded[5:] + ":0\r\n"))
+		default:
+			w.Write([]byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n"))
+		}
+	}))
+	defer ts.Close()
+
+	r := NewRange(ts.URL + "/")
+	for password, breached := range map[string]bool{
+		"password": true,
+		"hunter2":  false, // padding only
+		"Hello":    false,
+	} {
+		got, err := r.Breached(password)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if got != breached {
+			t.Fatalf("Wrong result for %q: %v", password, got)
+		}
+	}
+
+	ts.Close()
+	if _, err := r.Breached("password"); err == nil {
+		t.Fatalf("Failed request not reported")
+	}
+}
@@ -0,0 +1,111 @@
+//go:build chaos
+// +build chaos
+
+// chaos.go: failure injection, for builds with the chaos tag.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enabled is true in builds that can inject failures.
+const Enabled = true
+
+// Failures are the failures to inject.
+type Failures struct {
+	VaultWrite bool          // writing the vault fails
+	KDFTimeout time.Duration // key derivation stalls this long, then fails
+	ClockSkew  time.Duration // added to the time returned by Now
+}
+
+var (
+	mu      sync.Mutex
+	current Failures
+)
+
+func init() {
+	f, err := Parse(os.Getenv("RO_CHAOS"))
+	if err != nil {
+		log.Fatalf("chaos: RO_CHAOS: %v", err)
+	}
+	Inject(f)
+}
+
+// Parse reads a list of failures in the format of RO_CHAOS.
+func Parse(spec string) (f Failures, err error) {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			name, value = item[:i], item[i+1:]
+		}
+
+		switch name {
+		case "vaultwrite":
+			f.VaultWrite = true
+		case "kdftimeout":
+			if f.KDFTimeout, err = time.ParseDuration(value); err != nil {
+				return
+			}
+		case "clockskew":
+			if f.ClockSkew, err = time.ParseDuration(value); err != nil {
+				return
+			}
+		default:
+			return f, fmt.Errorf("unknown failure %s", name)
+		}
+	}
+	return
+}
+
+// Inject replaces the failures being injected.
+func Inject(f Failures) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = f
+	if f != (Failures{}) {
+		log.Printf("chaos: injecting %+v", f)
+	}
+}
+
+func failures() Failures {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// VaultWrite returns the error to fail writing the vault with.
+func VaultWrite() error {
+	if failures().VaultWrite {
+		return errors.New("chaos: vault write failed")
+	}
+	return nil
+}
+
+// KDF returns the error to fail deriving a key from a password with,
+// after stalling for the injected timeout.
+func KDF() error {
+	if timeout := failures().KDFTimeout; timeout > 0 {
+		time.Sleep(timeout)
+		return errors.New("chaos: key derivation timed out")
+	}
+	return nil
+}
+
+// Now returns the current time, off by the injected clock skew.
+func Now() time.Time {
+	return time.Now().Add(failures().ClockSkew)
+}
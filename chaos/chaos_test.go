@@ -0,0 +1,49 @@
+//go:build chaos
+// +build chaos
+
+// chaos_test.go: tests for chaos.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package chaos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse("vaultwrite, kdftimeout=10ms,clockskew=-2h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if f != (Failures{VaultWrite: true, KDFTimeout: 10 * time.Millisecond, ClockSkew: -2 * time.Hour}) {
+		t.Fatalf("Wrong failures: %+v", f)
+	}
+
+	for _, spec := range []string{"diskfull", "kdftimeout", "clockskew=soon"} {
+		if _, err = Parse(spec); err == nil {
+			t.Fatalf("Invalid spec %q accepted", spec)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	defer Inject(Failures{})
+
+	Inject(Failures{})
+	if VaultWrite() != nil || KDF() != nil {
+		t.Fatalf("Failure injected without being asked for")
+	}
+
+	Inject(Failures{VaultWrite: true, KDFTimeout: time.Millisecond, ClockSkew: time.Hour})
+	if VaultWrite() == nil {
+		t.Fatalf("Vault write did not fail")
+	}
+	if KDF() == nil {
+		t.Fatalf("Key derivation did not fail")
+	}
+	if Now().Sub(time.Now()) < 59*time.Minute {
+		t.Fatalf("Clock not skewed")
+	}
+}
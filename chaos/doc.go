@@ -0,0 +1,18 @@
+// Package chaos injects failures into the server, so that operators and
+// continuous integration can check that it fails safe. Failures are only
+// injected by binaries built with the chaos build tag:
+//
+//	go build -tags chaos github.com/cloudflare/redoctober
+//
+// and are chosen with the RO_CHAOS environment variable, a
+// comma-separated list of:
+//
+//	vaultwrite            writing the vault fails
+//	kdftimeout=<duration> deriving a key from a password stalls, then fails
+//	clockskew=<duration>  the clock of the key cache is off by duration
+//
+// In other builds the hooks do nothing.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package chaos
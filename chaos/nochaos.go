@@ -0,0 +1,23 @@
+//go:build !chaos
+// +build !chaos
+
+// nochaos.go: hooks that inject no failures, for builds without the
+// chaos tag.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package chaos
+
+import "time"
+
+// Enabled is true in builds that can inject failures.
+const Enabled = false
+
+// VaultWrite returns the error to fail writing the vault with.
+func VaultWrite() error { return nil }
+
+// KDF returns the error to fail deriving a key from a password with.
+func KDF() error { return nil }
+
+// Now returns the current time.
+func Now() time.Time { return time.Now() }
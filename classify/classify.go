@@ -0,0 +1,72 @@
+// Package classify recognizes sensitive kinds of data, such as private
+// keys and payment card numbers, so that the server can require data
+// of these classes to be encrypted under labels whose policy allows
+// them.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package classify
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// The classes recognized by Default.
+const (
+	PrivateKey = "private-key"
+	CardNumber = "card-number"
+)
+
+// Classifier returns the classes of a piece of data, if any.
+type Classifier interface {
+	Classify(data []byte) ([]string, error)
+}
+
+// Default is a Classifier recognizing PEM and OpenSSH private keys and
+// payment card numbers.
+var Default Classifier = defaultClassifier{}
+
+type defaultClassifier struct{}
+
+var (
+	privateKeyRe = regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)
+	cardNumberRe = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+func (defaultClassifier) Classify(data []byte) ([]string, error) {
+	var classes []string
+	if privateKeyRe.Match(data) {
+		classes = append(classes, PrivateKey)
+	}
+	for _, match := range cardNumberRe.FindAll(data, -1) {
+		if luhn(match) {
+			classes = append(classes, CardNumber)
+			break
+		}
+	}
+	return classes, nil
+}
+
+// luhn returns true if the digits of number, ignoring spaces and
+// dashes, pass the Luhn check of payment card numbers.
+func luhn(number []byte) bool {
+	digits := bytes.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -2,23 +2,60 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/derive"
+	"github.com/cloudflare/redoctober/ecdh"
+	"github.com/cloudflare/redoctober/keycache"
 )
 
 // RemoteServer represents a remote RedOctober server.
 type RemoteServer struct {
 	client        *http.Client
 	serverAddress string
+
+	// endorsed holds the hashes of the certificates endorsed by a
+	// pinned server identity. Once set, connections presenting any
+	// other certificate are refused.
+	endorsed map[string]bool
+
+	// sealTo is the server identity key requests are encrypted to,
+	// if set by Seal.
+	sealTo *ecdsa.PublicKey
+
+	// agent is set if requests go to a local ro-agent instead.
+	agent bool
+
+	// compress is set if large requests are compressed with gzip.
+	compress bool
+
+	// backoff is set by SetBackoff.
+	backoff *Backoff
 }
 
+// compressMinSize is the size from which requests are compressed when
+// compression is on.
+const compressMinSize = 1024
+
 // NewRemoteServer generates a RemoteServer with the server address and
 // the root CA the server uses to authenticate itself.
 func NewRemoteServer(serverAddress, CAFile string) (*RemoteServer, error) {
@@ -38,28 +75,307 @@ func NewRemoteServer(serverAddress, CAFile string) (*RemoteServer, error) {
 		}
 	}
 
+	server := &RemoteServer{serverAddress: serverAddress}
+
+	config := &tls.Config{
+		RootCAs: rootCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if server.endorsed == nil || len(rawCerts) == 0 {
+				return nil
+			}
+			hash := sha256.Sum256(rawCerts[0])
+			if !server.endorsed[string(hash[:])] {
+				return errors.New("server certificate is not endorsed by the pinned identity")
+			}
+			return nil
+		},
+	}
 	tr := &http.Transport{
-		TLSClientConfig:    &tls.Config{RootCAs: rootCAs},
+		TLSClientConfig:    config,
 		DisableCompression: true,
 	}
-	server := &RemoteServer{
+	server.client = &http.Client{Transport: tr}
+	return server, nil
+}
+
+// SetCertificate sets the client certificate presented to the server.
+// Delegations bound to a device are only used by decryptions requested
+// with the same certificate key.
+func (c *RemoteServer) SetCertificate(cert tls.Certificate) error {
+	tr, ok := c.client.Transport.(*http.Transport)
+	if !ok || c.agent {
+		return errors.New("client certificates cannot be used through an agent")
+	}
+	tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// SetCompression turns on or off the compression with gzip of large
+// requests and of the responses of the server. Servers that predate
+// compression refuse compressed requests.
+func (c *RemoteServer) SetCompression(on bool) error {
+	tr, ok := c.client.Transport.(*http.Transport)
+	if !ok || c.agent {
+		return errors.New("compression cannot be used through an agent")
+	}
+	tr.DisableCompression = !on
+	c.compress = on
+	return nil
+}
+
+// NewAgentServer generates a RemoteServer that sends its requests to
+// the ro-agent listening on the given Unix socket. The agent fills in
+// the user name and password of each request and forwards it to the
+// server it was started for.
+func NewAgentServer(socketPath string) *RemoteServer {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+		DisableCompression: true,
+	}
+	return &RemoteServer{
 		client:        &http.Client{Transport: tr},
-		serverAddress: serverAddress,
+		serverAddress: "ro-agent",
+		agent:         true,
 	}
-	return server, nil
+}
+
+// ID fetches the identity of the remote server and checks that the
+// identity key endorses the certificate the server presented.
+func (c *RemoteServer) ID() (*core.IDData, error) {
+	id, resp, err := c.fetchID()
+	if err != nil {
+		return nil, err
+	}
+
+	ecPub, err := identityKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(bytes.Join(id.Certificates, nil))
+	if !ecdsa.VerifyASN1(ecPub, hash[:], id.Signature) {
+		return nil, errors.New("server identity signature mismatch")
+	}
+
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("server did not present a certificate")
+	}
+	peer := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+	found := false
+	for _, cert := range id.Certificates {
+		if bytes.Equal(cert, peer[:]) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("server certificate is not endorsed by its identity")
+	}
+
+	return id, nil
+}
+
+// Version fetches the build of the remote server and checks its
+// signature by the identity key of the server, which is checked as by
+// ID.
+func (c *RemoteServer) Version() (*core.BuildInfo, error) {
+	id, err := c.ID()
+	if err != nil {
+		return nil, err
+	}
+	ecPub, err := identityKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("version", []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+
+	var response core.ResponseData
+	if err = json.Unmarshal(respBytes, &response); err != nil {
+		return nil, err
+	}
+	if response.Status != "ok" {
+		return nil, errors.New(response.Status)
+	}
+
+	hash := sha256.Sum256(response.Response)
+	if !ecdsa.VerifyASN1(ecPub, hash[:], response.Signature) {
+		return nil, errors.New("server version signature mismatch")
+	}
+
+	info := new(core.BuildInfo)
+	if err = json.Unmarshal(response.Response, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// fetchID fetches the identity of the remote server without checking it.
+func (c *RemoteServer) fetchID() (*core.IDData, *http.Response, error) {
+	resp, err := c.client.Post(c.getURL("/id"), "application/json", bytes.NewBufferString("{}"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New(string(body))
+	}
+
+	id := new(core.IDData)
+	if err = json.Unmarshal(body, id); err != nil {
+		return nil, nil, err
+	}
+	if id.Status != "ok" {
+		return nil, nil, errors.New(id.Status)
+	}
+	return id, resp, nil
+}
+
+// identityKey parses the identity key of a server and checks it against
+// the fingerprint given with it.
+func identityKey(id *core.IDData) (*ecdsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(id.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("server identity is not an ECDSA key")
+	}
+	if core.Fingerprint(id.PublicKey) != id.Fingerprint {
+		return nil, errors.New("server identity fingerprint mismatch")
+	}
+	return ecPub, nil
+}
+
+// Seal encrypts all later requests to the server identity with the
+// given fingerprint, and has the server encrypt its responses to a key
+// only known to the client. Passwords and data are then hidden from
+// proxies or load balancers that terminate TLS in front of the server.
+// Unlike Pin, the certificate presented by the server is not checked.
+func (c *RemoteServer) Seal(fingerprint string) error {
+	id, _, err := c.fetchID()
+	if err != nil {
+		return err
+	}
+	pub, err := identityKey(id)
+	if err != nil {
+		return err
+	}
+	if id.Fingerprint != fingerprint {
+		return fmt.Errorf("server identity %s does not match pinned %s", id.Fingerprint, fingerprint)
+	}
+
+	c.sealTo = pub
+	return nil
+}
+
+// Pin checks that the remote server has the identity with the given
+// fingerprint. Afterwards, only certificates endorsed by that identity
+// are accepted from the server.
+func (c *RemoteServer) Pin(fingerprint string) error {
+	id, err := c.ID()
+	if err != nil {
+		return err
+	}
+	if id.Fingerprint != fingerprint {
+		return fmt.Errorf("server identity %s does not match pinned %s", id.Fingerprint, fingerprint)
+	}
+
+	c.endorsed = make(map[string]bool)
+	for _, cert := range id.Certificates {
+		c.endorsed[string(cert)] = true
+	}
+	return nil
+}
+
+// PinFile pins the server identity recorded in the file at path. If
+// the file does not exist, the identity of the server is trusted and
+// recorded there for later connections.
+func (c *RemoteServer) PinFile(path string) error {
+	pinned, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		var id *core.IDData
+		if id, err = c.ID(); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path, []byte(id.Fingerprint+"\n"), 0600); err != nil {
+			return err
+		}
+		pinned = []byte(id.Fingerprint)
+	} else if err != nil {
+		return err
+	}
+
+	return c.Pin(strings.TrimSpace(string(pinned)))
 }
 
 // getURL creates URL for a specific path of the RemoteServer
 func (c *RemoteServer) getURL(path string) string {
+	if c.agent {
+		// the agent is reached over a local socket
+		return fmt.Sprintf("http://%s%s", c.serverAddress, path)
+	}
 	return fmt.Sprintf("https://%s%s", c.serverAddress, path)
 
 }
 
 // doAction sends req to the remote server and returns the response
 func (c *RemoteServer) doAction(action string, req []byte) ([]byte, error) {
-	buf := bytes.NewBuffer(req)
-	url := c.getURL("/" + action)
-	resp, err := c.client.Post(url, "application/json", buf)
+	return c.doActionContext(context.Background(), action, req)
+}
+
+// doActionContext is doAction, giving up once ctx is done.
+func (c *RemoteServer) doActionContext(ctx context.Context, action string, req []byte) ([]byte, error) {
+	if c.sealTo != nil {
+		return c.doSealedAction(ctx, action, req)
+	}
+	return c.post(ctx, action, req)
+}
+
+// Do sends the JSON request req to the named endpoint of the remote
+// server (e.g. "delegate") and returns the JSON response as is.
+func (c *RemoteServer) Do(action string, req []byte) ([]byte, error) {
+	return c.doAction(action, req)
+}
+
+// DoContext is Do, giving up once ctx is done.
+func (c *RemoteServer) DoContext(ctx context.Context, action string, req []byte) ([]byte, error) {
+	return c.doActionContext(ctx, action, req)
+}
+
+// post sends req to the given endpoint of the remote server as is.
+func (c *RemoteServer) post(ctx context.Context, action string, req []byte) ([]byte, error) {
+	compressed := c.compress && len(req) >= compressMinSize
+	if compressed {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(req)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		req = buf.Bytes()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.getURL("/"+action), bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if compressed {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := c.client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +395,58 @@ func (c *RemoteServer) doAction(action string, req []byte) ([]byte, error) {
 
 }
 
+// doSealedAction sends req to the remote server encrypted to its
+// identity key, and decrypts the response.
+func (c *RemoteServer) doSealedAction(ctx context.Context, action string, req []byte) ([]byte, error) {
+	reply, err := ecdsa.GenerateKey(ecdh.Curve(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	replyKey, err := x509.MarshalPKIXPublicKey(&reply.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(core.SealedBody{
+		Endpoint: "/" + action,
+		Body:     req,
+		ReplyKey: replyKey,
+		Nonce:    hex.EncodeToString(nonce),
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := ecdh.Encrypt(c.sealTo, body)
+	if err != nil {
+		return nil, err
+	}
+	reqBytes, err := json.Marshal(core.SealedRequest{Request: sealed})
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.post(ctx, "sealed", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// errors in handling the sealed request itself are not encrypted
+	resp := new(core.ResponseData)
+	if err = json.Unmarshal(respBytes, resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "ok" {
+		return respBytes, nil
+	}
+	return ecdh.Decrypt(reply, resp.Response)
+}
+
 // unmarshalResponseData is a helper function that unmarshal response bytes
 // into ResponseData object.
 func unmarshalResponseData(respBytes []byte) (*core.ResponseData, error) {
@@ -149,6 +517,194 @@ func (c *RemoteServer) Delegate(req core.DelegateRequest) (*core.ResponseData, e
 	return unmarshalResponseData(respBytes)
 }
 
+// RevokeDelegation issues a revoke-delegation request to the remote server
+func (c *RemoteServer) RevokeDelegation(req core.RevokeDelegationRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("revoke-delegation", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// Template issues a template request to the remote server
+func (c *RemoteServer) Template(req core.TemplateRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("template", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// LabelPolicy issues a label-policy request to the remote server
+func (c *RemoteServer) LabelPolicy(req core.LabelPolicyRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("label-policy", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// Absence issues an absence request to the remote server
+func (c *RemoteServer) Absence(req core.AbsenceRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("absence", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// Veto issues a veto request to the remote server, placing or lifting
+// a veto.
+func (c *RemoteServer) Veto(req core.VetoRequest) (*core.VetoData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("veto", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	veto := new(core.VetoData)
+	if err = json.Unmarshal(respBytes, veto); err != nil {
+		return nil, err
+	}
+	if veto.Status != "ok" {
+		return nil, errors.New(veto.Status)
+	}
+	return veto, nil
+}
+
+// ApproveDecrypt issues an approve-decrypt request to the remote server,
+// approving or withdrawing the approval of decryptions of a piece of
+// encrypted data.
+func (c *RemoteServer) ApproveDecrypt(req core.ApproveDecryptRequest) (*core.ApproveDecryptData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("approve-decrypt", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	approval := new(core.ApproveDecryptData)
+	if err = json.Unmarshal(respBytes, approval); err != nil {
+		return nil, err
+	}
+	if approval.Status != "ok" {
+		return nil, errors.New(approval.Status)
+	}
+	return approval, nil
+}
+
+// WrappedKey issues a wrapped-key request to the remote server,
+// returning the key of a piece of encrypted data wrapped for the user.
+func (c *RemoteServer) WrappedKey(req core.WrappedKeyRequest) (*core.WrappedKeyData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("wrapped-key", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := new(core.WrappedKeyData)
+	if err = json.Unmarshal(respBytes, wrapped); err != nil {
+		return nil, err
+	}
+	if wrapped.Status != "ok" {
+		return nil, errors.New(wrapped.Status)
+	}
+	return wrapped, nil
+}
+
+// UnwrapKey unwraps a key wrapped for an HSM record with the private key
+// of its user, such as a crypto.Decrypter backed by a smart card.
+func UnwrapKey(priv crypto.Decrypter, wrapped []byte) ([]byte, error) {
+	return priv.Decrypt(rand.Reader, wrapped, &rsa.OAEPOptions{Hash: crypto.SHA1})
+}
+
+// DelegateHSM delegates the key of an HSM record for each piece of
+// encrypted data in data. Their keys are fetched with WrappedKey and
+// unwrapped on the client by unwrap, such as UnwrapKey with the private
+// key of the user, which never leaves the client.
+func (c *RemoteServer) DelegateHSM(req core.DelegateRequest, data [][]byte, unwrap func(wrapped []byte) ([]byte, error)) (*core.ResponseData, error) {
+	req.Unwrapped = nil
+	defer func() {
+		for _, key := range req.Unwrapped {
+			for i := range key.Key {
+				key.Key[i] = 0
+			}
+		}
+	}()
+
+	for _, in := range data {
+		wrapped, err := c.WrappedKey(core.WrappedKeyRequest{Name: req.Name, Password: req.Password, Data: in})
+		if err != nil {
+			return nil, err
+		}
+		key, err := unwrap(wrapped.Wrapped)
+		if err != nil {
+			return nil, err
+		}
+		req.Unwrapped = append(req.Unwrapped, keycache.ClientKey{Wrapped: wrapped.Wrapped, Key: key})
+	}
+
+	return c.Delegate(req)
+}
+
+// Promote approves the promotion of a standby server to be the active
+// server.
+func (c *RemoteServer) Promote(req core.PromoteRequest) (*core.PromoteData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("promote", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	promote := new(core.PromoteData)
+	if err = json.Unmarshal(respBytes, promote); err != nil {
+		return nil, err
+	}
+	if promote.Status != "ok" {
+		return nil, errors.New(promote.Status)
+	}
+	return promote, nil
+}
+
 // CreateUser issues a create-user request to the remote server
 func (c *RemoteServer) CreateUser(req core.CreateUserRequest) (*core.ResponseData, error) {
 	reqBytes, err := json.Marshal(req)
@@ -240,6 +796,167 @@ func (c *RemoteServer) Decrypt(req core.DecryptRequest) (*core.ResponseData, err
 
 }
 
+// Audit fetches an audit report from the remote server.
+func (c *RemoteServer) Audit(req core.AuditRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("audit", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// Watermark asks the remote server who decrypted a piece of
+// watermarked text.
+func (c *RemoteServer) Watermark(req core.WatermarkRequest) (*core.WatermarkData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("watermark", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	mark := new(core.WatermarkData)
+	if err = json.Unmarshal(respBytes, mark); err != nil {
+		return nil, err
+	}
+	if mark.Status != "ok" {
+		return nil, errors.New(mark.Status)
+	}
+	return mark, nil
+}
+
+// Changelog fetches a page of the changes to the vault of the remote
+// server, starting with the sequence number req.Since.
+func (c *RemoteServer) Changelog(req core.ChangelogRequest) (*core.ChangelogData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("changelog", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := new(core.ChangelogData)
+	if err = json.Unmarshal(respBytes, changes); err != nil {
+		return nil, err
+	}
+	if changes.Status != "ok" {
+		return nil, errors.New(changes.Status)
+	}
+	return changes, nil
+}
+
+// AuditLog fetches a page of the audit log of the remote server,
+// starting with the sequence number req.Since.
+func (c *RemoteServer) AuditLog(req core.AuditLogRequest) (*core.AuditLogData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("auditlog", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := new(core.AuditLogData)
+	if err = json.Unmarshal(respBytes, entries); err != nil {
+		return nil, err
+	}
+	if entries.Status != "ok" {
+		return nil, errors.New(entries.Status)
+	}
+	return entries, nil
+}
+
+// PlaceOrder orders the decryption of a piece of encrypted data on the
+// remote server, which tells its owners to delegate.
+func (c *RemoteServer) PlaceOrder(req core.OrderRequest) (*core.Order, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("order", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(core.OrderData)
+	if err = json.Unmarshal(respBytes, response); err != nil {
+		return nil, err
+	}
+	if response.Status != "ok" {
+		return nil, errors.New(response.Status)
+	}
+	return &response.Order, nil
+}
+
+// Orders lists the open orders of the remote server placed by the user
+// or waiting for their delegations.
+func (c *RemoteServer) Orders(req core.OrdersRequest) ([]core.Order, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("orders", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(core.OrdersData)
+	if err = json.Unmarshal(respBytes, response); err != nil {
+		return nil, err
+	}
+	if response.Status != "ok" {
+		return nil, errors.New(response.Status)
+	}
+	return response.Orders, nil
+}
+
+// OrderOut fulfills an order on the remote server, returning the
+// response of the decryption, or cancels it.
+func (c *RemoteServer) OrderOut(req core.OrderOutRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("orderout", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
+// DecryptBatch issues a decrypt-batch request to the remote server
+func (c *RemoteServer) DecryptBatch(req core.DecryptBatchRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("decrypt-batch", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalResponseData(respBytes)
+}
+
 // DecryptIntoData issues an decrypt request to the remote server and extract
 // the decrypted data from the response
 func (c *RemoteServer) DecryptIntoData(req core.DecryptRequest) ([]byte, error) {
@@ -258,6 +975,133 @@ func (c *RemoteServer) DecryptIntoData(req core.DecryptRequest) ([]byte, error)
 
 }
 
+// DeriveCredential issues a decrypt request minting a credential from
+// the data, given by the derivation spec req.Derive, and extracts it
+// from the response.
+func (c *RemoteServer) DeriveCredential(req core.DecryptRequest) (*derive.Credential, error) {
+	if req.Derive == "" {
+		return nil, errors.New("no derivation requested")
+	}
+	responseData, err := c.Decrypt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(core.DecryptWithDelegates)
+	if err = json.Unmarshal(responseData.Response, d); err != nil {
+		return nil, err
+	}
+	if d.Credential == nil {
+		return nil, errors.New("no credential in the response")
+	}
+	return d.Credential, nil
+}
+
+// Merge issues a merge request to the remote server
+func (c *RemoteServer) Merge(req core.MergeRequest) (*core.MergeData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("merge", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(core.MergeData)
+	err = json.Unmarshal(respBytes, response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Status != "ok" {
+		return nil, errors.New(response.Status)
+	}
+	return response, nil
+}
+
+// Restore issues a restore request to the remote server
+func (c *RemoteServer) Restore(req core.RestoreRequest) (*core.RestoreData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doAction("restore", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(core.RestoreData)
+	err = json.Unmarshal(respBytes, response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Status != "ok" {
+		return nil, errors.New(response.Status)
+	}
+	return response, nil
+}
+
+// DecryptDryRun issues a dry run decrypt request to the remote server and
+// extracts the delegations that the decryption would consume
+func (c *RemoteServer) DecryptDryRun(req core.DecryptRequest) ([]core.DelegationUse, error) {
+	req.DryRun = true
+	responseData, err := c.Decrypt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(core.DecryptDryRun)
+	err = json.Unmarshal(responseData.Response, d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Delegations, nil
+}
+
+// list issues a listing request to the remote server and decodes the
+// returned list into v.
+func (c *RemoteServer) list(action string, req core.SummaryRequest, v interface{}) error {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	respBytes, err := c.doAction(action, reqBytes)
+	if err != nil {
+		return err
+	}
+
+	responseData, err := unmarshalResponseData(respBytes)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(responseData.Response, v)
+}
+
+// Users lists the user records on the remote server
+func (c *RemoteServer) Users(req core.SummaryRequest) (users []core.UserInfo, err error) {
+	err = c.list("users", req, &users)
+	return
+}
+
+// Delegations lists the live delegations on the remote server
+func (c *RemoteServer) Delegations(req core.SummaryRequest) (delegations []core.DelegationInfo, err error) {
+	err = c.list("delegations", req, &delegations)
+	return
+}
+
+// LabelPolicies lists the label policies on the remote server
+func (c *RemoteServer) LabelPolicies(req core.SummaryRequest) (policies []core.LabelPolicyInfo, err error) {
+	err = c.list("label-policies", req, &policies)
+	return
+}
+
 // Password issues an password request to the remote server
 func (c *RemoteServer) Password(req []byte) (*core.ResponseData, error) {
 	reqBytes, err := json.Marshal(req)
@@ -0,0 +1,82 @@
+// restore.go: restoring a vault from a snapshot in chunks
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/redoctober/core"
+)
+
+// DefaultChunkSize is the size of the chunks RestoreSnapshot sends if
+// not given one.
+const DefaultChunkSize = 1 << 20
+
+// restoreAttempts is how many times RestoreSnapshot sends a chunk
+// before giving up.
+const restoreAttempts = 3
+
+// RestoreSnapshot uploads snapshot, as returned by /snapshot, to the
+// remote server in chunks of chunkSize bytes, each sent again if it
+// fails, and has the server verify it. The vault is replaced once
+// another admin approves the restore with ApproveRestore. The restore
+// is aborted if a chunk cannot be sent or the snapshot does not
+// verify, leaving the vault as it was.
+func (c *RemoteServer) RestoreSnapshot(name, password string, snapshot []byte, chunkSize int) (*core.RestoreData, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if len(snapshot) == 0 {
+		return nil, errors.New("snapshot is empty")
+	}
+
+	var chunks [][]byte
+	var hashes []string
+	for i := 0; i < len(snapshot); i += chunkSize {
+		end := i + chunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+		hash := sha256.Sum256(snapshot[i:end])
+		chunks = append(chunks, snapshot[i:end])
+		hashes = append(hashes, hex.EncodeToString(hash[:]))
+	}
+
+	begun, err := c.Restore(core.RestoreRequest{Name: name, Password: password, Command: "begin", Chunks: hashes})
+	if err != nil {
+		return nil, err
+	}
+	abort := func(err error) (*core.RestoreData, error) {
+		c.Restore(core.RestoreRequest{Name: name, Password: password, Command: "abort", ID: begun.ID})
+		return nil, err
+	}
+
+	for i, chunk := range chunks {
+		req := core.RestoreRequest{Name: name, Password: password, Command: "chunk", ID: begun.ID, Index: i, Data: chunk}
+		for attempt := 1; ; attempt++ {
+			if _, err = c.Restore(req); err == nil {
+				break
+			}
+			if attempt == restoreAttempts {
+				return abort(fmt.Errorf("chunk %d: %v", i, err))
+			}
+		}
+	}
+
+	done, err := c.Restore(core.RestoreRequest{Name: name, Password: password, Command: "finish", ID: begun.ID})
+	if err != nil {
+		return abort(err)
+	}
+	return done, nil
+}
+
+// ApproveRestore replaces the vault of the remote server with the
+// snapshot of the restore id, uploaded by another admin.
+func (c *RemoteServer) ApproveRestore(name, password, id string) (*core.RestoreData, error) {
+	return c.Restore(core.RestoreRequest{Name: name, Password: password, Command: "approve", ID: id})
+}
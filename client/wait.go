@@ -0,0 +1,160 @@
+// wait.go: waiting for enough delegations to decrypt
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/cloudflare/redoctober/core"
+)
+
+// Backoff is how long WaitForQuorum waits between its attempts: from
+// Initial, doubling up to Max. Each wait is shortened by a random part
+// of up to half of it, so that clients waiting for the same delegations
+// do not poll the server in step.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// DefaultBackoff is the backoff used unless set by SetBackoff.
+var DefaultBackoff = Backoff{Initial: time.Second, Max: time.Minute}
+
+// SetBackoff sets the backoff of WaitForQuorum and DecryptWhenReady.
+func (c *RemoteServer) SetBackoff(b Backoff) error {
+	if b.Initial <= 0 || b.Max < b.Initial {
+		return errors.New("backoff must be positive and no more than its maximum")
+	}
+	c.backoff = &b
+	return nil
+}
+
+// QuorumError is returned when waiting for delegations is given up,
+// with why the data could not be decrypted at the last attempt.
+type QuorumError struct {
+	Err    error // why waiting was given up, such as context.DeadlineExceeded
+	Status string
+	Denial *core.DecryptDenial
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Status)
+}
+
+func (e *QuorumError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForQuorum waits until the delegations on the remote server allow
+// the decrypt request, polling it with dry runs, and returns the
+// delegations the decryption would use. It only waits on a denial that
+// more delegations can lift (see core.DecryptDenial); other errors,
+// such as a wrong password, are returned at once. Once ctx is done, it
+// gives up with a QuorumError.
+func (c *RemoteServer) WaitForQuorum(ctx context.Context, req core.DecryptRequest) ([]core.DelegationUse, error) {
+	req.DryRun = true
+	resp, err := c.poll(ctx, func() (*core.ResponseData, error) {
+		return c.tryDecrypt(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(core.DecryptDryRun)
+	if err = json.Unmarshal(resp.Response, d); err != nil {
+		return nil, err
+	}
+	return d.Delegations, nil
+}
+
+// DecryptWhenReady waits as WaitForQuorum does, then decrypts the data,
+// for automation that must not fail while the owners delegate. A
+// decryption that is denied anyway, such as when a delegation expires
+// in the meantime, goes back to waiting.
+func (c *RemoteServer) DecryptWhenReady(ctx context.Context, req core.DecryptRequest) ([]byte, error) {
+	resp, err := c.poll(ctx, func() (*core.ResponseData, error) {
+		dryRun := req
+		dryRun.DryRun = true
+		resp, err := c.tryDecrypt(ctx, dryRun)
+		if err != nil || resp.Status != "ok" {
+			return resp, err
+		}
+
+		req.DryRun = false
+		return c.tryDecrypt(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(core.DecryptWithDelegates)
+	if err = json.Unmarshal(resp.Response, d); err != nil {
+		return nil, err
+	}
+	return d.Data, nil
+}
+
+// tryDecrypt sends a decrypt request, returning the response whatever
+// its status.
+func (c *RemoteServer) tryDecrypt(ctx context.Context, req core.DecryptRequest) (*core.ResponseData, error) {
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := c.doActionContext(ctx, "decrypt", reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(core.ResponseData)
+	if err = json.Unmarshal(respBytes, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// poll calls try with backoff until it succeeds, fails for a reason
+// other than a denial, or ctx is done.
+func (c *RemoteServer) poll(ctx context.Context, try func() (*core.ResponseData, error)) (*core.ResponseData, error) {
+	backoff := DefaultBackoff
+	if c.backoff != nil {
+		backoff = *c.backoff
+	}
+
+	wait := backoff.Initial
+	for {
+		resp, err := try()
+		if err != nil && ctx.Err() != nil {
+			return nil, &QuorumError{Err: ctx.Err(), Status: err.Error()}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status == "ok" {
+			return resp, nil
+		}
+		if resp.Denial == nil {
+			return nil, errors.New(resp.Status)
+		}
+
+		timer := time.NewTimer(wait - time.Duration(rand.Int63n(int64(wait/2)+1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &QuorumError{Err: ctx.Err(), Status: resp.Status, Denial: resp.Denial}
+		case <-timer.C:
+		}
+
+		if wait *= 2; wait > backoff.Max {
+			wait = backoff.Max
+		}
+	}
+}
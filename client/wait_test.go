@@ -0,0 +1,252 @@
+// wait_test.go: tests for wait.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/cryptor"
+)
+
+// denied is the response of a decryption waiting for Bob to delegate.
+var denied = core.ResponseData{
+	Status: "Need more delegated keys",
+	Denial: &core.DecryptDenial{Denial: cryptor.Denial{Owners: map[string]string{"Bob": "missing"}}},
+}
+
+// decryptServer is a server answering decrypt requests with answer,
+// which is given the number of the request, from 1.
+type decryptServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []core.DecryptRequest
+	times    []time.Time
+}
+
+func newDecryptServer(t *testing.T, answer func(n int, req core.DecryptRequest) core.ResponseData) (*decryptServer, *RemoteServer) {
+	s := new(decryptServer)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/decrypt" {
+			http.NotFound(w, r)
+			return
+		}
+		var req core.DecryptRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.times = append(s.times, time.Now())
+		n := len(s.requests)
+		s.mu.Unlock()
+
+		out, _ := json.Marshal(answer(n, req))
+		w.Write(out)
+	}))
+	t.Cleanup(s.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c, err := NewRemoteServer(strings.TrimPrefix(s.URL, "https://"), caFile)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = c.SetBackoff(Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return s, c
+}
+
+func (s *decryptServer) received() []core.DecryptRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]core.DecryptRequest{}, s.requests...)
+}
+
+func respond(t *testing.T, v interface{}) core.ResponseData {
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	return core.ResponseData{Status: "ok", Response: out}
+}
+
+func TestWaitForQuorum(t *testing.T) {
+	dryRun := core.DecryptDryRun{Delegations: []core.DelegationUse{{Name: "Bob", Uses: 1}}}
+	s, c := newDecryptServer(t, func(n int, req core.DecryptRequest) core.ResponseData {
+		if n < 3 {
+			return denied
+		}
+		return respond(t, dryRun)
+	})
+
+	uses, err := c.WaitForQuorum(context.Background(), core.DecryptRequest{Name: "Alice", Password: "Hello"})
+	if err != nil {
+		t.Fatalf("Error waiting for quorum: %v", err)
+	}
+	if len(uses) != 1 || uses[0].Name != "Bob" {
+		t.Fatalf("Wrong delegations: %v", uses)
+	}
+
+	reqs := s.received()
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(reqs))
+	}
+	for _, req := range reqs {
+		if !req.DryRun || req.Name != "Alice" {
+			t.Fatalf("Expected a dry run by Alice, got %+v", req)
+		}
+	}
+}
+
+func TestDecryptWhenReady(t *testing.T) {
+	// a dry run is denied, then allowed, but Bob's delegation expires
+	// before the decryption, which waits again
+	s, c := newDecryptServer(t, func(n int, req core.DecryptRequest) core.ResponseData {
+		switch {
+		case n == 2 && req.DryRun:
+			return respond(t, core.DecryptDryRun{})
+		case n == 4 && req.DryRun:
+			return respond(t, core.DecryptDryRun{})
+		case n == 5 && !req.DryRun:
+			return respond(t, core.DecryptWithDelegates{Data: []byte("secret")})
+		}
+		return denied
+	})
+
+	data, err := c.DecryptWhenReady(context.Background(), core.DecryptRequest{Name: "Alice", Password: "Hello"})
+	if err != nil {
+		t.Fatalf("Error decrypting: %v", err)
+	}
+	if string(data) != "secret" {
+		t.Fatalf("Wrong data: %q", data)
+	}
+
+	var dryRuns []bool
+	for _, req := range s.received() {
+		dryRuns = append(dryRuns, req.DryRun)
+	}
+	if want := []bool{true, true, false, true, false}; len(dryRuns) != len(want) {
+		t.Fatalf("Expected dry runs %v, got %v", want, dryRuns)
+	} else {
+		for i := range want {
+			if dryRuns[i] != want[i] {
+				t.Fatalf("Expected dry runs %v, got %v", want, dryRuns)
+			}
+		}
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	_, c := newDecryptServer(t, func(int, core.DecryptRequest) core.ResponseData {
+		return denied
+	})
+	// the deadline is reached while waiting, not during an attempt
+	if err := c.SetBackoff(Backoff{Initial: time.Hour, Max: time.Hour}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := c.WaitForQuorum(ctx, core.DecryptRequest{Name: "Alice", Password: "Hello"})
+
+	var qerr *QuorumError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("Expected a QuorumError, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", qerr.Err)
+	}
+	if qerr.Status != denied.Status || qerr.Denial == nil || qerr.Denial.Owners["Bob"] != "missing" {
+		t.Fatalf("Expected the last denial, got %+v", qerr)
+	}
+
+	// a context done before the first attempt gives up at once
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.DecryptWhenReady(ctx, core.DecryptRequest{Name: "Alice", Password: "Hello"})
+	if !errors.As(err, &qerr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a canceled QuorumError, got %v", err)
+	}
+}
+
+func TestWaitNotRetryable(t *testing.T) {
+	s, c := newDecryptServer(t, func(int, core.DecryptRequest) core.ResponseData {
+		return core.ResponseData{Status: "Wrong Password"}
+	})
+
+	_, err := c.WaitForQuorum(context.Background(), core.DecryptRequest{Name: "Alice", Password: "Bad"})
+	if err == nil || err.Error() != "Wrong Password" {
+		t.Fatalf("Expected a wrong password, got %v", err)
+	}
+	var qerr *QuorumError
+	if errors.As(err, &qerr) {
+		t.Fatalf("Expected the error as is, got %v", err)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Fatalf("Expected 1 request, got %d", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := new(RemoteServer)
+	for _, b := range []Backoff{
+		{},
+		{Initial: -time.Second, Max: time.Second},
+		{Initial: time.Second, Max: time.Millisecond},
+	} {
+		if err := c.SetBackoff(b); err == nil {
+			t.Fatalf("Expected backoff %v to be refused", b)
+		}
+	}
+
+	// unbounded, the waits before the 9th attempt would add up to more
+	// than a second even shortened by half; bounded, to 150ms
+	const attempts = 9
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+	s, c := newDecryptServer(t, func(n int, req core.DecryptRequest) core.ResponseData {
+		if n < attempts {
+			return denied
+		}
+		return respond(t, core.DecryptDryRun{})
+	})
+	if err := c.SetBackoff(b); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	start := time.Now()
+	if _, err := c.WaitForQuorum(context.Background(), core.DecryptRequest{Name: "Alice", Password: "Hello"}); err != nil {
+		t.Fatalf("Error waiting for quorum: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Backoff is not bounded: waited %v", elapsed)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.times) != attempts {
+		t.Fatalf("Expected %d requests, got %d", attempts, len(s.times))
+	}
+	for i := 1; i < len(s.times); i++ {
+		if gap := s.times[i].Sub(s.times[i-1]); gap < b.Initial/2 {
+			t.Fatalf("Attempt %d came %v after the previous one", i+1, gap)
+		}
+	}
+}
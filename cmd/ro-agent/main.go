@@ -0,0 +1,248 @@
+// Command ro-agent keeps the Red October password of an operator in
+// memory for a limited time, so that the ro client can delegate and
+// decrypt without asking for it every time, in the manner of ssh-agent.
+//
+// The agent listens on a Unix socket only accessible to its user. Each
+// request received on it is forwarded to the Red October server the
+// agent was started for, with the user name and password filled in.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/redoctober/client"
+	"github.com/cloudflare/redoctober/cmd/ro/gopass"
+)
+
+var server, caPath, fingerprint, socketPath, user, timeout, devicePath string
+
+var seal bool
+
+// credentials holds the cached user name and password. The password is
+// cleared when the timeout expires.
+var credentials struct {
+	sync.Mutex
+	name, password string
+}
+
+func registerFlags() {
+	flag.StringVar(&server, "server", "localhost:8080", "server address")
+	flag.StringVar(&caPath, "ca", "", "ca file path")
+	flag.StringVar(&fingerprint, "fingerprint", "", "required fingerprint of the server identity")
+	flag.BoolVar(&seal, "seal", false, "encrypt requests end-to-end to the server identity given by -fingerprint")
+	flag.StringVar(&socketPath, "socket", "", "path of the agent socket (default $RO_AGENT_SOCK or a new private directory)")
+	flag.StringVar(&user, "user", os.Getenv("RO_USER"), "username")
+	flag.StringVar(&timeout, "timeout", "1h", "time after which the password is forgotten")
+	flag.StringVar(&devicePath, "device", "", "key file identifying this device to the server, created if missing")
+}
+
+func processError(err error) {
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+}
+
+// deviceCertificate returns a self-signed client certificate for the
+// device key at path, generating the key first if the file does not
+// exist. The server identifies the device by the key alone, so a new
+// certificate is made each time.
+func deviceCertificate(path string) (tls.Certificate, error) {
+	var priv *ecdsa.PrivateKey
+	if pemKey, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(pemKey)
+		if block == nil {
+			return tls.Certificate{}, errors.New("No PEM data was found in the device key file")
+		}
+		if priv, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return tls.Certificate{}, err
+		}
+	} else if os.IsNotExist(err) {
+		if priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return tls.Certificate{}, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		pemKey = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(path, pemKey, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+	} else {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ro-agent " + user},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// listen creates the agent socket, in a new directory only accessible
+// to the user unless a path is given.
+func listen() (net.Listener, error) {
+	if socketPath == "" {
+		socketPath = os.Getenv("RO_AGENT_SOCK")
+	}
+	if socketPath == "" {
+		dir, err := ioutil.TempDir("", "ro-agent")
+		if err != nil {
+			return nil, err
+		}
+		socketPath = filepath.Join(dir, "agent.sock")
+	}
+
+	// a socket left over by an agent that did not exit cleanly
+	if fi, err := os.Stat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	oldMask := syscall.Umask(0077)
+	l, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	return l, err
+}
+
+// forward fills in the credentials of a request from the ro client and
+// sends it to the server.
+func forward(roServer *client.RemoteServer, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := make(map[string]json.RawMessage)
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	credentials.Lock()
+	name, password := credentials.name, credentials.password
+	credentials.Unlock()
+	if password == "" {
+		http.Error(w, "ro-agent: password has expired, restart the agent", http.StatusForbidden)
+		return
+	}
+
+	req["Name"], _ = json.Marshal(name)
+	req["Password"], _ = json.Marshal(password)
+	if body, err = json.Marshal(req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/")
+	log.Printf("ro-agent: forwarding %s", action)
+	resp, err := roServer.Do(action, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage of ro-agent:\n")
+		flag.PrintDefaults()
+	}
+	registerFlags()
+	flag.Parse()
+
+	lifetime, err := time.ParseDuration(timeout)
+	processError(err)
+
+	roServer, err := client.NewRemoteServer(server, caPath)
+	processError(err)
+	if seal {
+		if fingerprint == "" {
+			log.Fatal("error: -seal requires -fingerprint")
+		}
+		processError(roServer.Seal(fingerprint))
+	} else if fingerprint != "" {
+		processError(roServer.Pin(fingerprint))
+	}
+
+	if user == "" {
+		fmt.Print("Username:")
+		fmt.Scan(&user)
+	}
+
+	if devicePath != "" {
+		cert, err := deviceCertificate(devicePath)
+		processError(err)
+		processError(roServer.SetCertificate(cert))
+	}
+
+	password, err := gopass.GetPass("Password:")
+	processError(err)
+
+	credentials.name, credentials.password = user, password
+	time.AfterFunc(lifetime, func() {
+		credentials.Lock()
+		credentials.password = ""
+		credentials.Unlock()
+		log.Printf("ro-agent: password forgotten after %s", lifetime)
+	})
+
+	l, err := listen()
+	processError(err)
+
+	// remove the socket when stopped
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sig
+		l.Close()
+		os.Exit(0)
+	}()
+
+	// in the format of ssh-agent, for the shells of the user
+	fmt.Printf("RO_AGENT_SOCK=%s; export RO_AGENT_SOCK;\n", socketPath)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		forward(roServer, w, r)
+	})
+	processError(http.Serve(l, nil))
+}
@@ -0,0 +1,371 @@
+// Command ro-template renders templates that refer to data encrypted
+// with Red October, in the manner of consul-template, and tells the
+// service using the rendered files to reload.
+//
+// The templates are watched, along with the encrypted files they refer
+// to, and rendered again when they change. Data that cannot be
+// decrypted yet, because too few owners have delegated, is waited for.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/cloudflare/redoctober/client"
+	"github.com/cloudflare/redoctober/core"
+)
+
+var server, caPath, fingerprint, pinFile, certPath, keyPath, user, pswd, userEnv, pswdEnv, reason, pidFile, signalName, command string
+
+var seal, once bool
+
+var retry int
+
+var interval time.Duration
+
+var roServer *client.RemoteServer
+
+// signals are the signals -signal can name. More are added on Unix.
+var signals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+}
+
+// decrypted holds the data decrypted by the SHA-256 hash of the
+// encrypted data, so that templates rendered again do not use up
+// delegations for data they already decrypted.
+var decrypted = map[[sha256.Size]byte][]byte{}
+
+func registerFlags() {
+	flag.StringVar(&server, "server", "localhost:8080", "server address")
+	flag.StringVar(&caPath, "ca", "", "ca file path")
+	flag.StringVar(&certPath, "cert", "", "client certificate file path, identifying this device")
+	flag.StringVar(&keyPath, "key", "", "client certificate key file path")
+	flag.StringVar(&fingerprint, "fingerprint", "", "required fingerprint of the server identity")
+	flag.StringVar(&pinFile, "pinfile", "", "file pinning the server identity, recorded on first use")
+	flag.BoolVar(&seal, "seal", false, "encrypt requests end-to-end to the server identity given by -fingerprint")
+	flag.StringVar(&userEnv, "userenv", "RO_USER", "env variable for user name")
+	flag.StringVar(&pswdEnv, "pswdenv", "RO_PASS", "env variable for user password")
+	flag.StringVar(&reason, "reason", "ro-template", "reason given for decrypting")
+	flag.IntVar(&retry, "retry", 10, "seconds between decryption attempts")
+	flag.DurationVar(&interval, "interval", 5*time.Second, "time between checks of the templates and encrypted files for changes")
+	flag.BoolVar(&once, "once", false, "render the templates once and exit")
+	flag.StringVar(&pidFile, "pidfile", "", "file holding the process ID of the service to signal after rendering")
+	flag.StringVar(&signalName, "signal", "HUP", "signal sent to the service given by -pidfile")
+	flag.StringVar(&command, "command", "", "command to run after rendering, such as one reloading the service")
+}
+
+func processError(err error) {
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+}
+
+// decrypt returns the decryption of the encrypted data in, retrying
+// every -retry seconds until enough owners have delegated.
+func decrypt(in []byte) []byte {
+	hash := sha256.Sum256(in)
+	if data, ok := decrypted[hash]; ok {
+		return data
+	}
+
+	req := core.DecryptRequest{
+		Name:     user,
+		Password: pswd,
+		Data:     in,
+		Reason:   reason,
+	}
+	for {
+		resp, err := roServer.Decrypt(req)
+		if err == nil && resp.Status == "ok" {
+			var msg core.DecryptWithDelegates
+			processError(json.Unmarshal(resp.Response, &msg))
+			decrypted[hash] = msg.Data
+			return msg.Data
+		}
+
+		if err == nil {
+			log.Println("waiting for decryption:", resp.Status)
+		} else {
+			log.Println("waiting for decryption:", err)
+		}
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+}
+
+// decode returns encrypted data read from a file, which is base64
+// encoded as written by ro or raw.
+func decode(in []byte) []byte {
+	if out, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(in))); err == nil {
+		return out
+	}
+	return in
+}
+
+// roTemplate is a template rendered to a file.
+type roTemplate struct {
+	src, dest string
+
+	// deps holds the modification times of the template and the
+	// encrypted files it read when last rendered, nil if it has not
+	// been rendered.
+	deps map[string]time.Time
+}
+
+// stale returns true if the template or the encrypted files it read
+// changed since it was last rendered.
+func (t *roTemplate) stale() bool {
+	if t.deps == nil {
+		return true
+	}
+	for path, modTime := range t.deps {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// render renders the template, returning true if the output changed.
+//
+// In the template, {{secret "path"}} is the decryption of the encrypted
+// file at path, relative to the template, and {{blob "..."}} that of
+// base64 encoded encrypted data. {{base64 .}} and {{trim .}} encode and
+// trim the result.
+func (t *roTemplate) render() (bool, error) {
+	deps := make(map[string]time.Time)
+	read := func(path string) ([]byte, error) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		deps[path] = fi.ModTime()
+		return ioutil.ReadFile(path)
+	}
+
+	text, err := read(t.src)
+	if err != nil {
+		return false, err
+	}
+
+	funcs := template.FuncMap{
+		"secret": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(t.src), path)
+			}
+			in, err := read(path)
+			if err != nil {
+				return "", err
+			}
+			return string(decrypt(decode(in))), nil
+		},
+		"blob": func(encoded string) (string, error) {
+			in, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return "", err
+			}
+			return string(decrypt(in)), nil
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"trim": strings.TrimSpace,
+	}
+	parsed, err := template.New(filepath.Base(t.src)).Funcs(funcs).Parse(string(text))
+	if err != nil {
+		return false, err
+	}
+	var out bytes.Buffer
+	if err = parsed.Execute(&out, nil); err != nil {
+		return false, err
+	}
+	t.deps = deps
+
+	if old, err := ioutil.ReadFile(t.dest); err == nil && bytes.Equal(old, out.Bytes()) {
+		return false, nil
+	}
+	return true, writeFile(t.dest, out.Bytes())
+}
+
+// writeFile replaces the file at path with data, readable only by the
+// owner, so that the service never reads a partly written file.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reload tells the service to reload the rendered files, with -signal
+// and/or -command.
+func reload() error {
+	if pidFile != "" {
+		pidBytes, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+		if err != nil {
+			return err
+		}
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		if err = proc.Signal(signals[signalName]); err != nil {
+			return err
+		}
+		log.Printf("ro-template: sent SIG%s to %d", signalName, pid)
+	}
+
+	if command != "" {
+		args := strings.Fields(command)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", command, err)
+		}
+	}
+	return nil
+}
+
+// parseTemplates parses the SRC:DEST arguments, separated by ; instead
+// on Windows.
+func parseTemplates(args []string) ([]*roTemplate, error) {
+	var templates []*roTemplate
+	for _, arg := range args {
+		i := strings.IndexRune(arg, filepath.ListSeparator)
+		if i <= 0 || i == len(arg)-1 {
+			return nil, fmt.Errorf("template %q is not in the form SRC%cDEST", arg, filepath.ListSeparator)
+		}
+		templates = append(templates, &roTemplate{src: arg[:i], dest: arg[i+1:]})
+	}
+	return templates, nil
+}
+
+// connect sets up roServer and the credentials, from an ro-agent if
+// RO_AGENT_SOCK is set and no password is given.
+func connect() error {
+	user = os.Getenv(userEnv)
+	pswd = os.Getenv(pswdEnv)
+	if sock := os.Getenv("RO_AGENT_SOCK"); sock != "" && pswd == "" {
+		roServer = client.NewAgentServer(sock)
+		return nil
+	}
+	if user == "" || pswd == "" {
+		return fmt.Errorf("%s and %s, or RO_AGENT_SOCK, must be set", userEnv, pswdEnv)
+	}
+
+	var err error
+	if roServer, err = client.NewRemoteServer(server, caPath); err != nil {
+		return err
+	}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return err
+		}
+		if err = roServer.SetCertificate(cert); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case seal && fingerprint == "":
+		return errors.New("-seal requires -fingerprint")
+	case seal:
+		err = roServer.Seal(fingerprint)
+	case fingerprint != "":
+		err = roServer.Pin(fingerprint)
+	case pinFile != "":
+		err = roServer.PinFile(pinFile)
+	}
+	return err
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ro-template [options] SRC%cDEST [SRC%cDEST...]\n", filepath.ListSeparator, filepath.ListSeparator)
+		flag.PrintDefaults()
+	}
+	registerFlags()
+	flag.Parse()
+
+	templates, err := parseTemplates(flag.Args())
+	processError(err)
+	if len(templates) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, ok := signals[signalName]; !ok {
+		log.Fatalf("error: unknown signal %s", signalName)
+	}
+
+	processError(connect())
+
+	for {
+		changed := false
+		for _, t := range templates {
+			if !t.stale() {
+				continue
+			}
+			rendered, err := t.render()
+			if err != nil {
+				if once {
+					log.Fatalf("error: %s: %v", t.src, err)
+				}
+				log.Printf("ro-template: %s: %v", t.src, err)
+				t.deps = nil
+				continue
+			}
+			if rendered {
+				log.Printf("ro-template: rendered %s", t.dest)
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := reload(); err != nil {
+				log.Printf("ro-template: reload failed: %v", err)
+			}
+		}
+		if once {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+// signals_unix.go: the signals only found on Unix
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package main
+
+import "syscall"
+
+func init() {
+	signals["USR1"] = syscall.SIGUSR1
+	signals["USR2"] = syscall.SIGUSR2
+}
@@ -1,27 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cloudflare/redoctober/archive"
 	"github.com/cloudflare/redoctober/client"
 	"github.com/cloudflare/redoctober/cmd/ro/gopass"
 	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/passvault"
 )
 
-var action, user, pswd, userEnv, pswdEnv, server, caPath string
+var action, user, pswd, userEnv, pswdEnv, server, caPath, fingerprint, pinFile string
 
-var owners, lefters, righters, inPath, labels, outPath, outEnv string
+var certPath, keyPath string
 
-var uses int
+var owners, lefters, righters, approvers, inPath, labels, outPath, outEnv, file string
 
-var time, users string
+var uses, approvals int
+
+var dryRun, seal, bind, convergent bool
+
+var duration, users, template, reason string
+
+var report, format string
+
+var pubKeyPath, unwrapCmd string
+
+var retry int
 
 type command struct {
 	Run  func()
@@ -32,30 +52,55 @@ var roServer *client.RemoteServer
 
 var commandSet = map[string]command{
 	"create":     command{Run: runCreate, Desc: "create a user account"},
+	"create-hsm": command{Run: runCreateHSM, Desc: "create a user account whose RSA key, given by -pubkey, is held in hardware"},
 	"summary":    command{Run: runSummary, Desc: "list the user and delegation summary"},
 	"delegate":   command{Run: runDelegate, Desc: "do decryption delegation"},
-	"encrypt":    command{Run: runEncrypt, Desc: "encrypt a file"},
-	"decrypt":    command{Run: runDecrypt, Desc: "decrypt a file"},
+	"encrypt":    command{Run: runEncrypt, Desc: "encrypt a file or directory"},
+	"decrypt":    command{Run: runDecrypt, Desc: "decrypt a file, or a file of an encrypted directory given by -file"},
 	"re-encrypt": command{Run: runReEncrypt, Desc: "re-encrypt a file"},
+	"env":        command{Run: runEnv, Desc: "wait until a file can be decrypted, then run a command with it"},
+	"secrets":    command{Run: runSecrets, Desc: "wait until files can be decrypted, then write them as Docker secrets"},
+	"approve":    command{Run: runApprove, Desc: "approve the decryptions of a file for -time, as one of its approvers"},
+	"watermark":  command{Run: runWatermark, Desc: "find who decrypted a watermarked file"},
+	"audit":      command{Run: runAudit, Desc: "fetch the audit report given by -report"},
+	"version":    command{Run: runVersion, Desc: "show the signed build of the server"},
 }
 
 func registerFlags() {
 	flag.StringVar(&server, "server", "localhost:8080", "server address")
 	flag.StringVar(&caPath, "ca", "", "ca file path")
+	flag.StringVar(&certPath, "cert", "", "client certificate file path, identifying this device")
+	flag.StringVar(&keyPath, "key", "", "client certificate key file path")
+	flag.BoolVar(&bind, "bind", false, "only use the delegation for decryptions from this device, given by -cert")
+	flag.StringVar(&fingerprint, "fingerprint", "", "required fingerprint of the server identity")
+	flag.StringVar(&pinFile, "pinfile", "", "file pinning the server identity, recorded on first use")
+	flag.BoolVar(&seal, "seal", false, "encrypt requests end-to-end to the server identity given by -fingerprint")
 	flag.StringVar(&owners, "owners", "", "comma separated owner list")
 	flag.StringVar(&users, "users", "", "comma separated user list")
 	flag.IntVar(&uses, "uses", 0, "number of delegated key uses")
-	flag.StringVar(&time, "time", "0h", "duration of delegated key uses")
+	flag.StringVar(&duration, "time", "0h", "duration of delegated key uses, or of an approval")
+	flag.StringVar(&template, "template", "", "name of the delegation template to use")
+	flag.StringVar(&reason, "reason", "", "reason for delegating or decrypting")
+	flag.StringVar(&report, "report", "users", "audit report: delegations, decryptions, policies or users")
+	flag.StringVar(&format, "format", "json", "format of the audit report: json or csv")
 	flag.StringVar(&lefters, "left", "", "comma separated left owners")
 	flag.StringVar(&righters, "right", "", "comma separated right owners")
+	flag.StringVar(&approvers, "approvers", "", "comma separated users who must approve decryptions")
+	flag.IntVar(&approvals, "approvals", 1, "number of approvers who must approve decryptions")
 	flag.StringVar(&labels, "labels", "", "comma separated labels")
+	flag.BoolVar(&convergent, "convergent", false, "encrypt so that the same data always gives the same output, for deduplication; gives away which files are the same")
 	flag.StringVar(&inPath, "in", "", "input data file")
 	flag.StringVar(&outPath, "out", "", "output data file")
 	flag.StringVar(&outEnv, "outenv", "", "env variable for output data")
+	flag.StringVar(&file, "file", "", "file to decrypt alone from an encrypted directory")
 	flag.StringVar(&user, "user", "", "username")
 	flag.StringVar(&pswd, "password", "", "password")
 	flag.StringVar(&userEnv, "userenv", "RO_USER", "env variable for user name")
 	flag.StringVar(&pswdEnv, "pswdenv", "RO_PASS", "env variable for user password")
+	flag.BoolVar(&dryRun, "dryrun", false, "only report the delegations a decryption would use")
+	flag.IntVar(&retry, "retry", 10, "seconds between decryption attempts")
+	flag.StringVar(&pubKeyPath, "pubkey", "", "PEM public key file of a key held in hardware")
+	flag.StringVar(&unwrapCmd, "unwrap", "", "command unwrapping a key from standard input with a key held in hardware (RSA-OAEP, SHA-1), to delegate for the comma separated -in files")
 }
 
 func getUserCredentials() {
@@ -94,16 +139,66 @@ func runCreate() {
 	fmt.Println(resp.Status)
 }
 
+func runCreateHSM() {
+	pemBytes, err := ioutil.ReadFile(pubKeyPath)
+	processError(err)
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		log.Fatal("error: no PEM public key in ", pubKeyPath)
+	}
+
+	req := core.CreateUserRequest{
+		Name:      user,
+		Password:  pswd,
+		UserType:  passvault.HSMRecord,
+		PublicKey: block.Bytes,
+	}
+	resp, err := roServer.CreateUser(req)
+	processError(err)
+	fmt.Println(resp.Status)
+}
+
+// unwrapWithCommand unwraps a key with the -unwrap command, which reads
+// the wrapped key on standard input and writes the key to standard
+// output.
+func unwrapWithCommand(wrapped []byte) ([]byte, error) {
+	cmd := exec.Command("sh", "-c", unwrapCmd)
+	cmd.Stdin = bytes.NewReader(wrapped)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
 func runDelegate() {
 	req := core.DelegateRequest{
 		Name:     user,
 		Password: pswd,
 		Uses:     uses,
-		Time:     time,
+		Time:     duration,
 		Users:    processCSL(users),
 		Labels:   processCSL(labels),
+		Reason:   reason,
+
+		BindDevice: bind,
+	}
+	if template != "" {
+		req = core.DelegateRequest{
+			Name:     user,
+			Password: pswd,
+			Template: template,
+			Reason:   reason,
+		}
+	}
+	var resp *core.ResponseData
+	var err error
+	if unwrapCmd != "" {
+		var data [][]byte
+		for _, path := range processCSL(inPath) {
+			data = append(data, readEncrypted(path))
+		}
+		resp, err = roServer.DelegateHSM(req, data, unwrapWithCommand)
+	} else {
+		resp, err = roServer.Delegate(req)
 	}
-	resp, err := roServer.Delegate(req)
 	processError(err)
 	fmt.Println(resp.Status)
 }
@@ -119,8 +214,39 @@ func runSummary() {
 	fmt.Println(resp)
 }
 
+func runVersion() {
+	resp, err := roServer.Version()
+	processError(err)
+	fmt.Printf("%+v\n", *resp)
+}
+
+func runAudit() {
+	req := core.AuditRequest{
+		Name:     user,
+		Password: pswd,
+		Report:   report,
+		Format:   format,
+	}
+	resp, err := roServer.Audit(req)
+	processError(err)
+	if outPath == "" {
+		os.Stdout.Write(resp.Response)
+		return
+	}
+	processError(ioutil.WriteFile(outPath, resp.Response, 0644))
+}
+
 func runEncrypt() {
-	inBytes, err := ioutil.ReadFile(inPath)
+	// a directory is encrypted as an archive, from which single files
+	// can be decrypted with -file
+	var inBytes []byte
+	fi, err := os.Stat(inPath)
+	processError(err)
+	if fi.IsDir() {
+		inBytes, err = archive.Pack(inPath)
+	} else {
+		inBytes, err = ioutil.ReadFile(inPath)
+	}
 	processError(err)
 	req := core.EncryptRequest{
 		Name:        user,
@@ -130,6 +256,11 @@ func runEncrypt() {
 		RightOwners: processCSL(righters),
 		Labels:      processCSL(labels),
 		Data:        inBytes,
+		Convergent:  convergent,
+	}
+	if approvers != "" {
+		req.Approvers = processCSL(approvers)
+		req.ApprovalMinimum = approvals
 	}
 
 	resp, err := roServer.Encrypt(req)
@@ -162,6 +293,7 @@ func runReEncrypt() {
 		RightOwners: processCSL(righters),
 		Labels:      processCSL(labels),
 		Data:        encBytes,
+		Reason:      reason,
 	}
 
 	resp, err := roServer.ReEncrypt(req)
@@ -190,6 +322,17 @@ func runDecrypt() {
 		Name:     user,
 		Password: pswd,
 		Data:     encBytes,
+		Reason:   reason,
+		File:     file,
+	}
+
+	if dryRun {
+		delegations, err := roServer.DecryptDryRun(req)
+		processError(err)
+		for _, d := range delegations {
+			fmt.Printf("%s: %d uses left after decryption, expires %s\n", d.ID, d.UsesAfter, d.Expiry)
+		}
+		return
 	}
 
 	resp, err := roServer.Decrypt(req)
@@ -204,12 +347,183 @@ func runDecrypt() {
 	processError(err)
 	fmt.Println("Secure:", msg.Secure)
 	fmt.Println("Delegates:", msg.Delegates)
+	if msg.Watermarked {
+		fmt.Println("Watermarked: true")
+	}
+
+	// a whole encrypted directory is written as a tar
+	if file == "" && archive.IsArchive(msg.Data) {
+		ar, err := archive.NewReader(bytes.NewReader(msg.Data), int64(len(msg.Data)))
+		processError(err)
+		msg.Data, err = ioutil.ReadAll(ar.Tar())
+		processError(err)
+	}
 	ioutil.WriteFile(outPath, msg.Data, 0644)
 }
 
+func runWatermark() {
+	inBytes, err := ioutil.ReadFile(inPath)
+	processError(err)
+
+	req := core.WatermarkRequest{
+		Name:     user,
+		Password: pswd,
+		Data:     inBytes,
+	}
+
+	mark, err := roServer.Watermark(req)
+	processError(err)
+	fmt.Printf("Decrypted by %s at %s\n", mark.Name, mark.Time)
+}
+
+func runApprove() {
+	req := core.ApproveDecryptRequest{
+		Name:     user,
+		Password: pswd,
+		Data:     readEncrypted(inPath),
+		Time:     duration,
+		Reason:   reason,
+	}
+	if duration == "0h" {
+		req.Time = ""
+	}
+
+	approval, err := roServer.ApproveDecrypt(req)
+	processError(err)
+	fmt.Println("Approved until", approval.Expiry)
+}
+
+// readEncrypted reads an encrypted file, which may be base64 encoded.
+func readEncrypted(path string) []byte {
+	inBytes, err := ioutil.ReadFile(path)
+	processError(err)
+
+	// base64 decode the input
+	encBytes, err := base64.StdEncoding.DecodeString(string(inBytes))
+	if err != nil {
+		log.Println("fail to base64 decode the data, proceed with raw data")
+		encBytes = inBytes
+	}
+	return encBytes
+}
+
+// waitDecrypt retries decrypting the data every -retry seconds until it
+// succeeds, as long as it is refused for want of delegations. Other
+// errors, such as a wrong password, are fatal.
+func waitDecrypt(encBytes []byte) []byte {
+	req := core.DecryptRequest{
+		Name:     user,
+		Password: pswd,
+		Data:     encBytes,
+		Reason:   reason,
+	}
+
+	for {
+		resp, err := roServer.Decrypt(req)
+		processError(err)
+		if resp.Status == "ok" {
+			var msg core.DecryptWithDelegates
+			err = json.Unmarshal(resp.Response, &msg)
+			processError(err)
+			return msg.Data
+		}
+		if resp.Denial == nil && resp.Status != "Need more delegated keys" {
+			processError(errors.New(resp.Status))
+		}
+
+		log.Println("waiting for decryption:", resp.Status)
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+}
+
+// runEnv blocks until the input file can be decrypted and then
+// replaces this process with the command given after the subcommand,
+// passing the plaintext in the -outenv variable and/or the -out file.
+func runEnv() {
+	args := flag.Args()[1:]
+	if len(args) == 0 {
+		log.Fatal("env requires a command to run")
+	}
+	if outEnv == "" && outPath == "" {
+		log.Fatal("env requires -outenv or -out")
+	}
+
+	path, err := exec.LookPath(args[0])
+	processError(err)
+
+	data := waitDecrypt(readEncrypted(inPath))
+
+	if outPath != "" {
+		err = ioutil.WriteFile(outPath, data, 0600)
+		processError(err)
+	}
+
+	// Don't hand the Red October credentials to the child.
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, userEnv+"=") || strings.HasPrefix(kv, pswdEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	if outEnv != "" {
+		env = append(env, outEnv+"="+string(data))
+	}
+
+	processError(syscall.Exec(path, args, env))
+}
+
+// runSecrets blocks until each of the files given after the subcommand
+// can be decrypted and writes them to the Docker secrets directory (or
+// -out), named after the file without its extension.
+func runSecrets() {
+	files := flag.Args()[1:]
+	if len(files) == 0 {
+		log.Fatal("secrets requires at least one file")
+	}
+
+	dir := outPath
+	if dir == "" {
+		dir = "/run/secrets"
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+
+		data := waitDecrypt(readEncrypted(file))
+		processError(writeSecret(dir, name, data))
+		fmt.Println("Wrote secret:", name)
+	}
+}
+
+// writeSecret writes a read-only file in dir through a temporary file
+// renamed into place, so that it replaces one written by an earlier
+// run.
+func writeSecret(dir, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0400); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Println("Usage: ro [options] subcommand")
+		fmt.Println("Usage: ro [options] subcommand [args...]")
 		fmt.Println("Currently supported subcommands are:")
 		for key := range commandSet {
 			fmt.Println("\t", key, ":", commandSet[key].Desc)
@@ -222,10 +536,13 @@ func main() {
 	registerFlags()
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if flag.NArg() == 0 || (flag.NArg() > 1 && flag.Arg(0) != "env" && flag.Arg(0) != "secrets") {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if retry <= 0 {
+		processError(errors.New("-retry must be positive"))
+	}
 
 	action := flag.Arg(0)
 
@@ -235,10 +552,34 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	} else {
+		// an ro-agent knows the server and the credentials to use
+		if sock := os.Getenv("RO_AGENT_SOCK"); sock != "" && os.Getenv(pswdEnv) == "" && pswd == "" {
+			roServer = client.NewAgentServer(sock)
+			cmd.Run()
+			return
+		}
+
 		var err error
 		roServer, err = client.NewRemoteServer(server, caPath)
 		processError(err)
 
+		if certPath != "" {
+			cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+			processError(err)
+			processError(roServer.SetCertificate(cert))
+		}
+
+		if seal {
+			if fingerprint == "" {
+				processError(errors.New("-seal requires -fingerprint"))
+			}
+			processError(roServer.Seal(fingerprint))
+		} else if fingerprint != "" {
+			processError(roServer.Pin(fingerprint))
+		} else if pinFile != "" {
+			processError(roServer.PinFile(pinFile))
+		}
+
 		getUserCredentials()
 		cmd.Run()
 	}
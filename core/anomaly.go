@@ -0,0 +1,35 @@
+// anomaly.go: watching the event stream for unusual activity
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"context"
+
+	"github.com/cloudflare/redoctober/anomaly"
+)
+
+type sourceKey struct{}
+
+// stopDetectors stops the detectors set by SetDetectors.
+var stopDetectors []func()
+
+// WithSource returns a context for the requests of the client at addr,
+// which the events they cause are stamped with.
+func WithSource(c context.Context, addr string) context.Context {
+	return context.WithValue(c, sourceKey{}, addr)
+}
+
+// SetDetectors sets the anomaly detectors fed the events of the server,
+// whose alerts are published as events of type anomaly.EventType. The
+// detectors set before are stopped. None disables anomaly detection.
+func SetDetectors(detectors ...anomaly.Detector) {
+	for _, stop := range stopDetectors {
+		stop()
+	}
+	stopDetectors = nil
+	for _, d := range detectors {
+		stopDetectors = append(stopDetectors, anomaly.Watch(bus, d))
+	}
+}
@@ -0,0 +1,139 @@
+// approve.go: approvals of decryptions by the approvers of the data
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+)
+
+// defaultApproval is how long an approval lasts if the request does not
+// say.
+const defaultApproval = time.Hour
+
+// ApproveDecryptRequest approves the decryptions of a piece of encrypted
+// data, given by Data or by its Fingerprint, by one of its approvers
+// (see EncryptRequest.Approvers).
+type ApproveDecryptRequest struct {
+	Name     string
+	Password string
+
+	Fingerprint string
+	Data        []byte
+	Time        string // how long the approval lasts, 1h if not set
+	Reason      string
+
+	Withdraw bool // withdraws the approval instead
+}
+
+type ApproveDecryptData struct {
+	Status string
+	ID     string    `json:",omitempty"`
+	Expiry time.Time `json:",omitempty"`
+}
+
+// ApproveDecrypt processes a request by an approver of a piece of
+// encrypted data to approve its decryptions for a time. Given Data, the
+// user must be one of its approvers; given only a Fingerprint, the
+// approval only counts if they are.
+func ApproveDecrypt(jsonIn []byte) ([]byte, error) {
+	var s ApproveDecryptRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.approve-decrypt failed: user=%s withdraw=%v %v", s.Name, s.Withdraw, err)
+		} else {
+			log.Printf("core.approve-decrypt success: user=%s fingerprint=%s withdraw=%v reason=%q", s.Name, s.Fingerprint, s.Withdraw, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("approve-decrypt", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if len(s.Data) > 0 {
+		var approvers []string
+		if approvers, _, err = crypt.GetApprovers(s.Data); err != nil {
+			return jsonStatusError(err)
+		}
+		if !containsString(approvers, s.Name) {
+			err = errors.New("User is not an approver of the data")
+			return jsonStatusError(err)
+		}
+		if s.Fingerprint, err = crypt.GetFingerprint(s.Data); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	if s.Withdraw {
+		if err = records.WithdrawApproval(s.Name, s.Fingerprint); err != nil {
+			return jsonStatusError(err)
+		}
+		publish(events.Event{Type: "withdraw-approval", Name: s.Name, Fingerprint: s.Fingerprint})
+		return json.Marshal(ApproveDecryptData{Status: "ok"})
+	}
+
+	duration := defaultApproval
+	if s.Time != "" {
+		if duration, err = time.ParseDuration(s.Time); err != nil {
+			return jsonStatusError(err)
+		}
+		if duration <= 0 {
+			err = errors.New("Approval time must be positive")
+			return jsonStatusError(err)
+		}
+	}
+
+	approval, err := records.AddApproval(s.Name, s.Fingerprint, time.Now().Add(duration))
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "approve-decrypt", Name: s.Name, Reason: s.Reason, Fingerprint: s.Fingerprint})
+
+	return json.Marshal(ApproveDecryptData{Status: "ok", ID: approval.ID, Expiry: approval.Expiry})
+}
+
+// checkApprovers returns an error unless enough approvers of the data,
+// other than the user name decrypting it, have approved its decryption.
+func checkApprovers(in []byte, name string) error {
+	approvers, minimum, err := crypt.GetApprovers(in)
+	if err != nil || minimum == 0 {
+		return err
+	}
+	fingerprint, err := crypt.GetFingerprint(in)
+	if err != nil {
+		return err
+	}
+
+	approvals := records.GetApprovals(fingerprint)
+	approved := 0
+	var missing []string
+	for _, approver := range approvers {
+		if approver == name {
+			continue
+		}
+		if _, ok := approvals[approver]; ok {
+			approved++
+		} else {
+			missing = append(missing, approver)
+		}
+	}
+
+	if approved < minimum {
+		return fmt.Errorf("Need %d more approvals from %s", minimum-approved, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// audit.go: read-only reports for auditors
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+)
+
+// maxHistory is the number of delegations and decryptions kept for the
+// audit reports.
+const maxHistory = 10000
+
+// history holds the latest delegations and decryptions, oldest first.
+var history []events.Event
+
+// recordHistory keeps delegations and decryptions for the audit reports.
+func recordHistory(e events.Event) {
+	if e.Type != "delegate" && e.Type != "decrypt" {
+		return
+	}
+	if len(history) >= maxHistory {
+		history = append(history[:0], history[len(history)-maxHistory+1:]...)
+	}
+	history = append(history, e)
+}
+
+type AuditRequest struct {
+	Name     string
+	Password string
+
+	Report string    // "delegations", "decryptions", "policies", "users" or "unlabeled"
+	Format string    // "json" (the default) or "csv"
+	Since  time.Time // only report delegations and decryptions after this
+}
+
+// AuditDelegation is a delegation in the delegations report.
+type AuditDelegation struct {
+	Time   time.Time
+	Name   string
+	Labels []string
+	Uses   int
+	Reason string
+}
+
+// AuditDecryption is a decryption in the decryptions report.
+type AuditDecryption struct {
+	Time      time.Time
+	Name      string
+	Labels    []string
+	Delegates []string
+	Reason    string
+}
+
+// AuditUser is a user in the users report. Key material, password
+// hashes and the keys of absences are left out.
+type AuditUser struct {
+	ID             string
+	Name           string
+	Role           string
+	Type           string
+	Vetoer         bool
+	Attributes     map[string]string
+	LastAuth       time.Time
+	LastDelegation time.Time
+	Substitute     string // substitute during a planned absence
+}
+
+// auditReport returns the rows of a report, and the same rows as
+// records for CSV with their header.
+func auditReport(report string, since time.Time) (rows interface{}, table [][]string, err error) {
+	switch report {
+	case "delegations":
+		list := []AuditDelegation{}
+		table = [][]string{{"Time", "Name", "Labels", "Uses", "Reason"}}
+		for _, e := range history {
+			if e.Type != "delegate" || e.Time.Before(since) {
+				continue
+			}
+			list = append(list, AuditDelegation{e.Time, e.Name, e.Labels, e.Uses, e.Reason})
+			table = append(table, []string{e.Time.Format(time.RFC3339), e.Name, strings.Join(e.Labels, ";"), strconv.Itoa(e.Uses), e.Reason})
+		}
+		return list, table, nil
+
+	case "decryptions":
+		list := []AuditDecryption{}
+		table = [][]string{{"Time", "Name", "Labels", "Delegates", "Reason"}}
+		for _, e := range history {
+			if e.Type != "decrypt" || e.Time.Before(since) {
+				continue
+			}
+			list = append(list, AuditDecryption{e.Time, e.Name, e.Labels, e.Delegates, e.Reason})
+			table = append(table, []string{e.Time.Format(time.RFC3339), e.Name, strings.Join(e.Labels, ";"), strings.Join(e.Delegates, ";"), e.Reason})
+		}
+		return list, table, nil
+
+	case "policies":
+		var labels []string
+		for label := range records.Policies {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		list := []LabelPolicyInfo{}
+		table = [][]string{{"ID", "Label", "OwnersInclude", "RequireReason", "RequireTicket", "Watermark"}}
+		for _, label := range labels {
+			policy, _ := records.GetLabelPolicy(label)
+			list = append(list, LabelPolicyInfo{ID: policy.ID, Label: label, OwnersInclude: policy.OwnersInclude, RequireReason: policy.RequireReason, RequireTicket: policy.RequireTicket, Watermark: policy.Watermark})
+			table = append(table, []string{policy.ID, label, strings.Join(policy.OwnersInclude, ";"),
+				strconv.FormatBool(policy.RequireReason), strconv.FormatBool(policy.RequireTicket), strconv.FormatBool(policy.Watermark)})
+		}
+		return list, table, nil
+
+	case "users":
+		list := []AuditUser{}
+		table = [][]string{{"ID", "Name", "Role", "Type", "Vetoer", "Attributes", "LastAuth", "LastDelegation", "Substitute"}}
+		for _, name := range records.Names() {
+			pr, _ := records.GetRecord(name)
+			u := AuditUser{
+				ID:             pr.ID,
+				Name:           name,
+				Role:           pr.GetRole(),
+				Type:           pr.Type,
+				Vetoer:         pr.Vetoer,
+				Attributes:     pr.Attributes,
+				LastAuth:       pr.LastAuth,
+				LastDelegation: pr.LastDelegation,
+			}
+			if pr.Absence != nil {
+				u.Substitute = pr.Absence.Substitute
+			}
+			list = append(list, u)
+
+			var attributes []string
+			for key, value := range pr.Attributes {
+				attributes = append(attributes, key+"="+value)
+			}
+			sort.Strings(attributes)
+			table = append(table, []string{u.ID, u.Name, u.Role, u.Type, strconv.FormatBool(u.Vetoer), strings.Join(attributes, ";"),
+				u.LastAuth.Format(time.RFC3339), u.LastDelegation.Format(time.RFC3339), u.Substitute})
+		}
+		return list, table, nil
+
+	case "unlabeled":
+		list := []ForensicsData{}
+		table = [][]string{{"Fingerprint", "Decryptions", "First", "Last"}}
+		for _, d := range dataSeen(since) {
+			if len(d.Labels) != 0 {
+				continue
+			}
+			list = append(list, d)
+			table = append(table, []string{d.Fingerprint, strconv.Itoa(d.Decryptions), d.First.Format(time.RFC3339), d.Last.Format(time.RFC3339)})
+		}
+		return list, table, nil
+	}
+
+	return nil, nil, fmt.Errorf("Unknown report %s", report)
+}
+
+// Audit processes a request for an audit report.
+func Audit(jsonIn []byte) ([]byte, error) {
+	var s AuditRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.audit failed: user=%s report=%s %v", s.Name, s.Report, err)
+		} else {
+			log.Printf("core.audit success: user=%s report=%s format=%s", s.Name, s.Report, s.Format)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("audit", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	rows, table, err := auditReport(s.Report, s.Since)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	var out []byte
+	switch s.Format {
+	case "", "json":
+		out, err = json.Marshal(rows)
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		err = w.WriteAll(table)
+		out = buf.Bytes()
+	default:
+		err = errors.New("Format must be json or csv")
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonResponse(out)
+}
@@ -0,0 +1,181 @@
+// auditlog.go: the persistent record of every request
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cloudflare/redoctober/auditlog"
+	"github.com/cloudflare/redoctober/events"
+)
+
+var (
+	auditLog   *auditlog.Log
+	auditSinks []auditlog.Sink
+
+	// pending is the audit log entry of the request being processed,
+	// set by WithContext for requests with an endpoint.
+	pending *auditlog.Entry
+)
+
+type endpointKey struct{}
+
+// The number of entries returned by AuditLog by default and at most.
+const (
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+)
+
+type AuditLogRequest struct {
+	Name     string
+	Password string
+
+	Since  int  // sequence number of the first entry returned
+	Limit  int  // number of entries returned (0 for the default)
+	Verify bool // checks the hash chain of the whole log first
+}
+
+type AuditLogData struct {
+	Status  string
+	Entries []auditlog.Entry
+	Next    int    // sequence number to ask for the next page with
+	Head    []byte // hash of the last entry of the log
+}
+
+// WithEndpoint returns a context for requests to endpoint, such as
+// "/decrypt", which they are recorded under in the audit log. Requests
+// processed without one are not recorded.
+func WithEndpoint(c context.Context, endpoint string) context.Context {
+	return context.WithValue(c, endpointKey{}, endpoint)
+}
+
+// SetAuditSinks sets the sinks the entries of the audit log are copied
+// to as they are written, in addition to the log file. None disables
+// copying.
+func SetAuditSinks(sinks ...auditlog.Sink) {
+	auditSinks = sinks
+	if auditLog != nil {
+		auditLog.SetSinks(sinks...)
+	}
+}
+
+// beginAudit starts the audit log entry of a request.
+func beginAudit(c context.Context, jsonIn []byte) {
+	endpoint, _ := c.Value(endpointKey{}).(string)
+	if endpoint == "" || auditLog == nil {
+		pending = nil
+		return
+	}
+
+	source, _ := c.Value(sourceKey{}).(string)
+	pending = &auditlog.Entry{Time: time.Now(), Endpoint: endpoint, Name: requestName(jsonIn), Source: source}
+}
+
+// unsealAudit records a sealed request under the endpoint and user
+// inside it.
+func unsealAudit(body SealedBody) {
+	if pending != nil {
+		pending.Endpoint = body.Endpoint
+		pending.Name = requestName(body.Body)
+	}
+}
+
+// annotateAudit adds the details of an event to the audit log entry of
+// the request that caused it.
+func annotateAudit(e events.Event) {
+	if pending == nil {
+		return
+	}
+	if e.Fingerprint != "" {
+		pending.Fingerprint = e.Fingerprint
+	}
+	if len(e.Labels) > 0 {
+		pending.Labels = e.Labels
+	}
+	if len(e.Delegates) > 0 {
+		pending.Delegates = e.Delegates
+	}
+}
+
+// endAudit writes the audit log entry of a request, given its response
+// or the error processing it.
+func endAudit(out []byte, err error) {
+	e := pending
+	pending = nil
+	if e == nil {
+		return
+	}
+
+	if err != nil {
+		e.Status = err.Error()
+	} else if e.Status == "" {
+		var resp struct{ Status string }
+		json.Unmarshal(out, &resp)
+		e.Status = resp.Status
+	}
+	if _, err = auditLog.Append(*e); err != nil {
+		log.Printf("core.audit-log failed: endpoint=%s user=%s %v", e.Endpoint, e.Name, err)
+	}
+}
+
+// requestName returns the user named by a JSON request, if any.
+func requestName(jsonIn []byte) string {
+	var s struct{ Name string }
+	json.Unmarshal(jsonIn, &s)
+	return s.Name
+}
+
+// AuditLog returns the entries of the audit log from the sequence
+// number Since on, at most Limit at a time, along with the hash of the
+// last entry. With Verify, the request fails if the hash chain of the
+// log is broken.
+func AuditLog(jsonIn []byte) ([]byte, error) {
+	var s AuditLogRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.audit-log failed: user=%s since=%d %v", s.Name, s.Since, err)
+		} else {
+			log.Printf("core.audit-log success: user=%s since=%d verify=%v", s.Name, s.Since, s.Verify)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("audit-log", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Since < 0 || s.Limit < 0 {
+		err = errors.New("Since and Limit must not be negative")
+		return jsonStatusError(err)
+	}
+	if s.Limit == 0 {
+		s.Limit = defaultAuditLogLimit
+	} else if s.Limit > maxAuditLogLimit {
+		s.Limit = maxAuditLogLimit
+	}
+
+	if s.Verify {
+		if err = auditLog.Verify(); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	resp := AuditLogData{Status: "ok", Entries: auditLog.Entries(s.Since, s.Limit), Head: auditLog.Head()}
+	if resp.Entries == nil {
+		resp.Entries = []auditlog.Entry{}
+	}
+	resp.Next = s.Since + len(resp.Entries)
+
+	return json.Marshal(resp)
+}
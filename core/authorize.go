@@ -0,0 +1,101 @@
+// authorize.go: the roles allowed to perform each action
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+var (
+	readers  = []string{passvault.AdminRole, passvault.OperatorRole, passvault.AuditorRole}
+	cryptors = []string{passvault.AdminRole, passvault.OperatorRole, passvault.ServiceRole}
+	auditors = []string{passvault.AdminRole, passvault.AuditorRole}
+	admins   = []string{passvault.AdminRole}
+)
+
+// permissions lists the roles allowed to perform each action that
+// needs an authenticated user. Actions missing from it are refused.
+var permissions = map[string][]string{
+	"summary":         readers,
+	"users":           readers,
+	"delegations":     readers,
+	"label-policies":  readers,
+	"admin-log":       readers,
+	"events":          readers,
+	"veto":            readers,
+	"approve-decrypt": readers,
+	"watermark":       auditors,
+	"audit":           auditors,
+	"changelog":       auditors,
+	"audit-log":       auditors,
+
+	"delegate":          cryptors,
+	"wrapped-key":       cryptors,
+	"revoke-delegation": cryptors,
+	"encrypt":           cryptors,
+	"decrypt":           cryptors,
+	"decrypt-batch":     cryptors,
+	"re-encrypt":        cryptors,
+	"absence":           cryptors,
+	"share":             cryptors,
+	"receive":           cryptors,
+	"order":             cryptors,
+	"orders":            cryptors,
+	"orderout":          cryptors,
+
+	"approve-absence": admins,
+	"approve-change":  admins,
+	"approve-share":   admins,
+	"purge":           admins,
+	"template":        admins,
+	"label-policy":    admins,
+	"modify":          admins,
+	"export":          admins,
+	"merge":           admins,
+	"promote":         admins,
+	"snapshot":        admins,
+	"forensics":       admins,
+	"recover":         admins,
+	"restore":         admins,
+	"escrow-export":   admins,
+	"selftest":        admins,
+	"import":          admins,
+	"rekey":           admins,
+}
+
+// authorize checks that the username and password passed in are
+// correct, and that the role of the user allows the action.
+func authorize(action, name, password string) error {
+	if records.NumRecords() == 0 {
+		return errors.New("Vault is not created yet")
+	}
+
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("User not present")
+	}
+
+	if err := checkPassword(name, password, pr); err != nil {
+		return err
+	}
+
+	allowed := permissions[action]
+	if role := pr.GetRole(); !containsString(allowed, role) {
+		if len(allowed) == 1 && allowed[0] == passvault.AdminRole {
+			return errors.New("Admin required")
+		}
+		return fmt.Errorf("Role %s may not %s", role, action)
+	}
+
+	if err := records.SetLastAuth(name, time.Now()); err != nil {
+		return err
+	}
+	rekeyRecord(name, password)
+	return nil
+}
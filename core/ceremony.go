@@ -0,0 +1,79 @@
+// ceremony.go: creation of a vault by several founding admins
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"errors"
+
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// ceremony holds the founding admins of a vault being created in a key
+// ceremony (see SetCeremony). Their records are kept in memory until
+// the last of them has created theirs.
+var ceremony struct {
+	size     int
+	founders []string
+	records  map[string]passvault.PasswordRecord
+}
+
+// CreateData is returned by Create during a key ceremony. Until the
+// vault is created, Founders lists the founding admins so far; once it
+// is, Fingerprints gives the key fingerprint of each of them, to be
+// printed and checked by all.
+type CreateData struct {
+	Status       string
+	Founders     []string
+	Remaining    int
+	Fingerprints map[string]string `json:",omitempty"`
+}
+
+// SetCeremony sets the number of founding admins who must each create
+// their record before an empty vault is created. Until the last of them
+// has, nothing is written and the vault cannot be used. Zero or one
+// creates the vault with the first admin, as usual.
+func SetCeremony(size int) {
+	ceremony.size = size
+	ceremony.founders = nil
+	ceremony.records = nil
+}
+
+// createFounder adds a founding admin to the key ceremony, and creates
+// the vault with all of them once they are all present.
+func createFounder(s CreateRequest) (resp CreateData, err error) {
+	if _, ok := ceremony.records[s.Name]; ok {
+		return resp, errors.New("Founder already present")
+	}
+
+	pr, err := passvault.NewRecord(s.Password, true, passvault.DefaultRecordType)
+	if err != nil {
+		return resp, err
+	}
+	if ceremony.records == nil {
+		ceremony.records = make(map[string]passvault.PasswordRecord)
+	}
+	ceremony.records[s.Name] = pr
+	ceremony.founders = append(ceremony.founders, s.Name)
+
+	resp = CreateData{Status: "ok", Founders: ceremony.founders, Remaining: ceremony.size - len(ceremony.founders)}
+	if resp.Remaining > 0 {
+		return resp, nil
+	}
+
+	if err = records.AddRecords(ceremony.records); err != nil {
+		return resp, err
+	}
+	resp.Fingerprints = make(map[string]string)
+	for _, name := range ceremony.founders {
+		pr := ceremony.records[name]
+		resp.Fingerprints[name] = pr.KeyFingerprint()
+		if err = logAdmin(name, "create", name); err != nil {
+			return resp, err
+		}
+	}
+	ceremony.founders, ceremony.records = nil, nil
+
+	return resp, nil
+}
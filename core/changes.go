@@ -0,0 +1,107 @@
+// changes.go: two-person approval of configuration changes
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// stageChanges is set if changes to label policies and delegation
+// templates must be approved by a second admin.
+var stageChanges bool
+
+type ChangeRequest struct {
+	Name     string
+	Password string
+
+	ID     string
+	Reject bool
+}
+
+type ChangeData struct {
+	Status string
+	ID     string // of the staged change
+}
+
+// SetStageChanges sets whether changes to label policies and delegation
+// templates are staged until a second admin approves them, instead of
+// taking effect at once.
+func SetStageChanges(on bool) {
+	stageChanges = on
+}
+
+// stage stages a configuration change requested by the admin name and
+// returns the response giving its ID.
+func stage(change passvault.Change, name string) ([]byte, error) {
+	change, err := records.StageChange(change, name)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	target := change.Label
+	if target == "" {
+		target = change.Template
+	}
+	if err = logAdmin(name, "stage-change", target+" "+change.ID); err != nil {
+		return jsonStatusError(err)
+	}
+	changed()
+
+	return json.Marshal(ChangeData{Status: "ok", ID: change.ID})
+}
+
+// changeLabels returns the label whose policy a change is to.
+func changeLabels(change passvault.Change) []string {
+	if change.Label == "" {
+		return nil
+	}
+	return []string{change.Label}
+}
+
+// ApproveChange processes a request by an admin to approve or reject a
+// staged configuration change. An approved change takes effect at once.
+func ApproveChange(jsonIn []byte) ([]byte, error) {
+	var s ChangeRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.approve-change failed: user=%s id=%s %v", s.Name, s.ID, err)
+		} else {
+			log.Printf("core.approve-change success: user=%s id=%s reject=%v", s.Name, s.ID, s.Reject)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("approve-change", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	var change passvault.Change
+	action := "approve-change"
+	if s.Reject {
+		action = "reject-change"
+		change, err = records.RejectChange(s.ID, s.Name)
+	} else {
+		change, err = records.ApproveChange(s.ID, s.Name)
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = logAdmin(s.Name, action, s.ID); err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: action, Name: s.Name, Labels: changeLabels(change)})
+
+	return json.Marshal(ChangeData{Status: "ok", ID: s.ID})
+}
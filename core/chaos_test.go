@@ -0,0 +1,79 @@
+//go:build chaos
+// +build chaos
+
+// chaos_test.go: tests that core fails safe when failures are injected
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/redoctober/chaos"
+)
+
+// chaosSetup creates Alice, delegates Bob and Carol and returns data
+// that needs both of them to decrypt.
+func chaosSetup(t *testing.T) []byte {
+	Init("memory")
+
+	checkStatus(t, Create, []byte(`{"Name":"Alice","Password":"Hello"}`), true)
+	checkStatus(t, Delegate, []byte(`{"Name":"Bob","Password":"Hello","Time":"1h","Uses":5}`), true)
+	checkStatus(t, Delegate, []byte(`{"Name":"Carol","Password":"Hello","Time":"1h","Uses":5}`), true)
+	s := checkStatus(t, Encrypt, []byte(`{"Name":"Alice","Password":"Hello","Minimum":2,"Owners":["Bob","Carol"],"Data":"SGVsbG8gSmVsbG8="}`), true)
+
+	decryptJson, _ := json.Marshal(DecryptRequest{Name: "Alice", Password: "Hello", Data: s.Response})
+	return decryptJson
+}
+
+func TestVaultWriteFailure(t *testing.T) {
+	decryptJson := chaosSetup(t)
+	checkStatus(t, Decrypt, decryptJson, true)
+
+	chaos.Inject(chaos.Failures{VaultWrite: true})
+	defer chaos.Inject(chaos.Failures{})
+
+	// A delegation that cannot be recorded is not kept.
+	checkStatus(t, Delegate, []byte(`{"Name":"Carol","Password":"Hello","Time":"1h","Uses":5,"Slot":"spare"}`), false)
+	if len(cache.UserKeys) != 2 {
+		t.Fatalf("Unrecorded delegation kept: %v", cache.GetSummary())
+	}
+
+	// Nor are the delegations of a user whose deletion is not written.
+	checkStatus(t, Modify, []byte(`{"Name":"Alice","Password":"Hello","ToModify":"Bob","Command":"delete"}`), false)
+	checkStatus(t, Decrypt, decryptJson, false)
+}
+
+func TestKDFTimeout(t *testing.T) {
+	decryptJson := chaosSetup(t)
+
+	chaos.Inject(chaos.Failures{KDFTimeout: 10 * time.Millisecond})
+	defer chaos.Inject(chaos.Failures{})
+
+	checkStatus(t, Delegate, []byte(`{"Name":"Carol","Password":"Hello","Time":"1h","Uses":5,"Slot":"spare"}`), false)
+	checkStatus(t, Summary, []byte(`{"Name":"Alice","Password":"Hello"}`), false)
+	if len(cache.UserKeys) != 2 {
+		t.Fatalf("Delegation added without its key: %v", cache.GetSummary())
+	}
+
+	checkStatus(t, Decrypt, decryptJson, false)
+
+	// the delegations are still there once passwords can be checked
+	chaos.Inject(chaos.Failures{})
+	checkStatus(t, Decrypt, decryptJson, true)
+}
+
+func TestClockSkew(t *testing.T) {
+	decryptJson := chaosSetup(t)
+
+	chaos.Inject(chaos.Failures{ClockSkew: 2 * time.Hour})
+	defer chaos.Inject(chaos.Failures{})
+
+	checkStatus(t, Decrypt, decryptJson, false)
+	if len(cache.UserKeys) != 0 {
+		t.Fatalf("Expired delegations kept: %v", cache.GetSummary())
+	}
+}
@@ -5,22 +5,81 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/redoctober/adminlog"
+	"github.com/cloudflare/redoctober/approvals"
+	"github.com/cloudflare/redoctober/auditlog"
+	"github.com/cloudflare/redoctober/breach"
+	"github.com/cloudflare/redoctober/classify"
 	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/derive"
+	"github.com/cloudflare/redoctober/ecdh"
+	"github.com/cloudflare/redoctober/events"
 	"github.com/cloudflare/redoctober/keycache"
 	"github.com/cloudflare/redoctober/passvault"
+	"github.com/cloudflare/redoctober/tickets"
+	"github.com/cloudflare/redoctober/transform"
+	"github.com/cloudflare/redoctober/watermark"
+	"github.com/cloudflare/redoctober/window"
 )
 
 var (
 	crypt   cryptor.Cryptor
 	records passvault.Records
 	cache   keycache.Cache
+
+	adminLog    *adminlog.Log
+	staleAfter  time.Duration
+	certHashes  [][]byte
+	bus         = events.New()
+	ticketCheck tickets.Checker
+	breachCheck breach.Checker
+	classifier  classify.Classifier
+
+	// see SetRequireLabels
+	requireLabels   bool
+	requirePolicies bool
+
+	// see SetAdminLimits
+	minAdmins int
+	maxAdmins int
+
+	// ctx is the context of the request being processed, set by
+	// WithContext.
+	ctx = context.Background()
 )
 
+// WithContext calls the request processing function f, such as Decrypt,
+// with the context of the request: password checks and decryptions
+// are given up once it is done. Requests with an endpoint (see
+// WithEndpoint) are recorded in the audit log.
+func WithContext(c context.Context, f func([]byte) ([]byte, error), jsonIn []byte) (out []byte, err error) {
+	ctx = c
+	beginAudit(c, jsonIn)
+	defer func() {
+		endAudit(out, err)
+		ctx = context.Background()
+	}()
+
+	if err := c.Err(); err != nil {
+		return jsonStatusError(err)
+	}
+	return f(jsonIn)
+}
+
 // Each of these structures corresponds to the JSON expected on the
 // correspondingly named URI (e.g. the delegate structure maps to the
 // JSON that should be sent on the /delegate URI and it is handled by
@@ -34,6 +93,8 @@ type CreateRequest struct {
 type SummaryRequest struct {
 	Name     string
 	Password string
+
+	Signed bool
 }
 
 type PurgeRequest struct {
@@ -45,9 +106,41 @@ type DelegateRequest struct {
 	Name     string
 	Password string
 
+	Uses      int
+	LabelUses map[string]int
+	Time      string
+	Slot      string
+	Users     []string
+	Labels    []string
+	Template  string
+	Reason    string // justification, required by some label policies
+
+	// BindDevice restricts the delegation to decryptions requested
+	// from the device making it.
+	BindDevice bool
+	Device     string // set by the server from the client certificate
+
+	// Unwrapped holds the keys of the data an HSM record delegates
+	// for, unwrapped by its client (see WrappedKey).
+	Unwrapped []keycache.ClientKey `json:",omitempty"`
+}
+
+type RevokeDelegationRequest struct {
+	Name     string
+	Password string
+
+	Slots []string // the slots to revoke, or all of them if empty
+}
+
+type TemplateRequest struct {
+	Name     string
+	Password string
+
+	Template string
+	Delete   bool
+
 	Uses   int
 	Time   string
-	Slot   string
 	Users  []string
 	Labels []string
 }
@@ -56,6 +149,8 @@ type CreateUserRequest struct {
 	Name     string
 	Password string
 	UserType string
+
+	PublicKey []byte `json:",omitempty"` // PKIX RSA public key of an HSM record
 }
 
 type PasswordRequest struct {
@@ -73,10 +168,35 @@ type EncryptRequest struct {
 	LeftOwners  []string
 	RightOwners []string
 	Predicate   string
+	Constraints []cryptor.Constraint
+
+	// MaxDelegationAge limits decryption to delegations made within
+	// this duration, e.g. "15m".
+	MaxDelegationAge string
+
+	// Escrow is an armored OpenPGP key ring whose public keys the
+	// data key is also encrypted to, for offline recovery.
+	Escrow string
+
+	// Approvers are users of whom ApprovalMinimum (1 if not set) must
+	// approve decryptions with ApproveDecrypt, as well as the owners
+	// delegating. They need not be owners.
+	Approvers       []string
+	ApprovalMinimum int
 
 	Data []byte
 
 	Labels []string
+
+	// Convergent encrypts the data so that the same data encrypted
+	// the same way gives the same envelope, for deduplication. It
+	// gives away which envelopes hold the same data, so the policies
+	// of the labels must allow it (see cryptor.EncryptConvergent).
+	Convergent bool
+
+	Reason   string // justifies the decryption done by a re-encryption
+	Override bool   // lets an admin re-encrypt outside time windows, see DecryptRequest
+	Device   string // set by the server from the client certificate
 }
 
 type ReEncryptRequest EncryptRequest
@@ -85,7 +205,39 @@ type DecryptRequest struct {
 	Name     string
 	Password string
 
-	Data []byte
+	Data   []byte
+	DryRun bool
+	Reason string
+	Device string // set by the server from the client certificate
+
+	// Transform, the name of a transform of a label of the data or a
+	// transform spec, returns only the part of the data needed.
+	Transform string
+
+	// Override lets an admin decrypt data outside the time windows of
+	// its labels. Overrides need a reason and are logged.
+	Override bool
+
+	// File, the name of a file of an encrypted directory (see
+	// archive), returns only that file, decrypting no more of the data
+	// than the index of the directory and the file.
+	File string
+
+	// Derive, a derivation spec (see package derive), returns a
+	// credential derived from the data, lasting DeriveTTL (15m if not
+	// set), instead of the data itself.
+	Derive    string
+	DeriveTTL string
+}
+
+type DecryptBatchRequest struct {
+	Name     string
+	Password string
+
+	Data     [][]byte
+	Reason   string
+	Device   string // set by the server from the client certificate
+	Override bool   // see DecryptRequest
 }
 
 type OwnersRequest struct {
@@ -98,6 +250,86 @@ type ModifyRequest struct {
 
 	ToModify string
 	Command  string
+
+	Attribute string
+	Value     string
+}
+
+type AbsenceRequest struct {
+	Name     string
+	Password string
+
+	Substitute string
+	Start      time.Time
+	End        time.Time
+	Delete     bool
+	Approve    string
+}
+
+type VetoRequest struct {
+	Name     string
+	Password string
+
+	// The veto is placed on the data with this fingerprint (or on Data
+	// itself), or on every piece of data under Label.
+	Fingerprint string
+	Data        []byte
+	Label       string
+
+	Lift string // ID of a veto to lift
+}
+
+type WatermarkRequest struct {
+	Name     string
+	Password string
+
+	Data []byte // decrypted text that may carry a watermark
+}
+
+type LabelPolicyRequest struct {
+	Name     string
+	Password string
+
+	Label  string
+	Delete bool
+	Policy passvault.LabelPolicy
+}
+
+// SealedRequest is a request whose content is hidden from anything
+// between the client and the server, even if TLS is terminated before
+// the server. Request is a SealedBody encrypted with ecdh.Encrypt to the
+// server identity key.
+type SealedRequest struct {
+	Request []byte
+}
+
+// SealedBody is the content of a sealed request: the endpoint called,
+// its JSON request, and a PKIX encoded P-256 public key from the client
+// that the response is encrypted to. Nonce, unique to the request, and
+// Time, when it was sealed, keep it from being sent again.
+type SealedBody struct {
+	Endpoint string
+	Body     []byte
+	ReplyKey []byte
+	Nonce    string
+	Time     time.Time
+}
+
+const (
+	// sealedWindow is how far from the server's clock a sealed request
+	// may have been sealed.
+	sealedWindow = 5 * time.Minute
+	// maxNonce is the longest nonce of a sealed request.
+	maxNonce = 64
+)
+
+// sealedNonces holds the nonces of the sealed requests received, with
+// the time they were sealed, until they are too old to be accepted.
+var sealedNonces map[string]time.Time
+
+type EventsRequest struct {
+	Name     string
+	Password string
 }
 
 type ExportRequest struct {
@@ -105,29 +337,207 @@ type ExportRequest struct {
 	Password string
 }
 
+type MergeRequest struct {
+	Name     string
+	Password string
+
+	Vault  []byte
+	DryRun bool
+}
+
 // These structures map the JSON responses that will be sent from the API
 
 type ResponseData struct {
-	Status   string
-	Response []byte `json:",omitempty"`
+	Status    string
+	Response  []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+
+	// Fingerprint identifies encrypted data returned in Response, see
+	// Fingerprint.
+	Fingerprint string `json:",omitempty"`
+
+	// Denial explains a failed decryption, see DecryptDenial.
+	Denial *DecryptDenial `json:",omitempty"`
+
+	// PasswordError is set when a password is rejected.
+	PasswordError *PasswordError `json:",omitempty"`
+}
+
+// PasswordError rejects a new password. Reason is "breached" for a
+// password known from a data breach.
+type PasswordError struct {
+	Reason string
+}
+
+func (e *PasswordError) Error() string {
+	return "Password is known from a data breach"
 }
 
 type SummaryData struct {
+	Status    string
+	Live      map[string]keycache.ActiveUser
+	All       map[string]passvault.Summary
+	Templates map[string]passvault.DelegationTemplate `json:",omitempty"`
+	Policies  map[string]passvault.LabelPolicy        `json:",omitempty"`
+	Changes   map[string]passvault.Change             `json:",omitempty"` // staged
+	Usage     UsageStats
+	Admins    AdminCount
+	Orders    map[string]Order `json:",omitempty"` // open, by ID
+}
+
+// AdminCount is the number of admins, against the limits set by
+// SetAdminLimits. OverMax flags more admins than the maximum.
+type AdminCount struct {
+	Count   int
+	Min     int  `json:",omitempty"`
+	Max     int  `json:",omitempty"`
+	OverMax bool `json:",omitempty"`
+}
+
+type UserInfo struct {
+	ID    string
+	Name  string
+	Admin bool
+	Role  string
+	Type  string
+}
+
+type DelegationInfo struct {
+	ID     string
+	Name   string
+	Slot   string
+	Uses   int
+	Expiry time.Time
+	Users  []string
+	Labels []string
+}
+
+type LabelPolicyInfo struct {
+	ID            string
+	Label         string
+	OwnersInclude []string
+	RequireReason bool
+	RequireTicket bool
+	Watermark     bool
+}
+
+type AdminLogRequest struct {
+	Name     string
+	Password string
+
+	Index int
+}
+
+type AdminLogData struct {
 	Status string
-	Live   map[string]keycache.ActiveUser
-	All    map[string]passvault.Summary
+	Size   int
+	Root   []byte
+	Entry  []byte   `json:",omitempty"`
+	Proof  [][]byte `json:",omitempty"`
+}
+
+// The number of changes returned by Changelog by default and at most.
+const (
+	defaultChangelogLimit = 100
+	maxChangelogLimit     = 1000
+)
+
+type ChangelogRequest struct {
+	Name     string
+	Password string
+
+	Since int // sequence number of the first change returned
+	Limit int // number of changes returned (0 for the default)
+}
+
+// ChangelogEntry is a change to the vault with its sequence number,
+// which is its index in the admin log.
+type ChangelogEntry struct {
+	Seq int
+	adminlog.Entry
+}
+
+type ChangelogData struct {
+	Status  string
+	Changes []ChangelogEntry
+	Next    int // sequence number to ask for the next page with
+}
+
+type IDData struct {
+	Status       string
+	PublicKey    []byte
+	Fingerprint  string
+	Certificates [][]byte
+	Signature    []byte
 }
 
 type DecryptWithDelegates struct {
-	Data      []byte
-	Secure    bool
-	Delegates []string
+	Data        []byte
+	Secure      bool
+	Delegates   []string
+	Watermarked bool `json:",omitempty"`
+
+	// Delegations are the delegations consumed by the decryption.
+	Delegations []DelegationUse `json:",omitempty"`
+
+	// Credential is minted from the data, which is then not returned,
+	// for requests with DecryptRequest.Derive.
+	Credential *derive.Credential `json:",omitempty"`
+}
+
+type MergeData struct {
+	Status    string
+	Added     []string
+	Conflicts []string
+}
+
+// DelegationUse describes a delegation that a decryption consumes.
+type DelegationUse struct {
+	ID        string
+	Name      string
+	Slot      string
+	Uses      int
+	UsesAfter int
+	Expiry    time.Time
+	Created   time.Time
+	Labels    []string `json:",omitempty"`
+}
+
+type DecryptDryRun struct {
+	Delegations []DelegationUse
+}
+
+// DecryptDenial explains why a decryption was denied: which owners have
+// not delegated, or whose delegations have expired or do not cover the
+// labels or the user, whether the quorum constraints are broken, and
+// which labels are outside their time windows.
+type DecryptDenial struct {
+	cryptor.Denial
+	Windows []string `json:",omitempty"`
 }
 
 type OwnersData struct {
 	Status    string
 	Owners    []string
 	Predicate string
+	Vetoes    []passvault.Veto `json:",omitempty"`
+	Escrow    []string         `json:",omitempty"`
+
+	Approvers       []string `json:",omitempty"`
+	ApprovalMinimum int      `json:",omitempty"`
+	Approved        []string `json:",omitempty"` // approvers whose approvals are current
+}
+
+type VetoData struct {
+	Status string
+	ID     string
+	Lifted bool `json:",omitempty"`
+}
+
+type WatermarkData struct {
+	Status string
+	Name   string    // user who decrypted the text
+	Time   time.Time // time of the decryption
 }
 
 // Helper functions that create JSON responses sent by core
@@ -136,36 +546,61 @@ func jsonStatusOk() ([]byte, error) {
 	return json.Marshal(ResponseData{Status: "ok"})
 }
 func jsonStatusError(err error) ([]byte, error) {
-	return json.Marshal(ResponseData{Status: err.Error()})
+	resp := ResponseData{Status: err.Error()}
+	if pwErr, ok := err.(*PasswordError); ok {
+		resp.PasswordError = pwErr
+	}
+	return json.Marshal(resp)
 }
 func jsonSummary() ([]byte, error) {
-	return json.Marshal(SummaryData{Status: "ok", Live: cache.GetSummary(), All: records.GetSummary()})
+	return json.Marshal(SummaryData{Status: "ok", Live: cache.GetSummary(), All: records.GetSummary(), Templates: records.Templates, Policies: records.Policies, Changes: records.Changes, Usage: usageStats(time.Now()), Admins: adminCount(), Orders: summaryOrders()})
+}
+func jsonDenied(err error, denial *DecryptDenial) ([]byte, error) {
+	return json.Marshal(ResponseData{Status: err.Error(), Denial: denial})
 }
 func jsonResponse(resp []byte) ([]byte, error) {
 	return json.Marshal(ResponseData{Status: "ok", Response: resp})
 }
-
-// validateUser checks that the username and password passed in are
-// correct. If admin is true, the user must be an admin as well.
-func validateUser(name, password string, admin bool) error {
-	if records.NumRecords() == 0 {
-		return errors.New("Vault is not created yet")
+func jsonEncrypted(resp []byte) ([]byte, error) {
+	fingerprint, err := crypt.GetFingerprint(resp)
+	if err != nil {
+		return jsonStatusError(err)
 	}
-
-	pr, ok := records.GetRecord(name)
-	if !ok {
-		return errors.New("User not present")
+	return json.Marshal(ResponseData{Status: "ok", Response: resp, Fingerprint: fingerprint})
+}
+func jsonSignedResponse(resp []byte) ([]byte, error) {
+	sig, err := records.Sign(resp)
+	if err != nil {
+		return jsonStatusError(err)
 	}
+	return json.Marshal(ResponseData{Status: "ok", Response: resp, Signature: sig})
+}
 
-	if err := pr.ValidatePassword(password); err != nil {
-		return err
+// publish stamps an event with the current time and passes it to the
+// subscribers of the event stream.
+func publish(e events.Event) {
+	changed()
+	e.Time = time.Now()
+	if e.Source == "" {
+		e.Source, _ = ctx.Value(sourceKey{}).(string)
 	}
+	recordHistory(e)
+	annotateAudit(e)
+	bus.Publish(e)
+}
 
-	if admin && !pr.IsAdmin() {
-		return errors.New("Admin required")
+// logAdmin appends an admin action to the admin log.
+func logAdmin(admin, action, target string) error {
+	changed()
+	if pending != nil && target != "" {
+		pending.Target = target
 	}
-
-	return nil
+	return adminLog.Append(adminlog.Entry{
+		Time:   time.Now(),
+		Admin:  admin,
+		Action: action,
+		Target: target,
+	})
 }
 
 // validateName checks that the username and password pass the minimal
@@ -181,133 +616,1488 @@ func validateName(name, password string) error {
 	return nil
 }
 
-// Init reads the records from disk from a given path
-func Init(path string) error {
-	var err error
-
-	defer func() {
-		if err != nil {
-			log.Printf("core.init failed: %v", err)
-		} else {
-			log.Printf("core.init success: path=%s", path)
-		}
-	}()
-
-	if records, err = passvault.InitFrom(path); err != nil {
-		err = fmt.Errorf("failed to load password vault %s: %s", path, err)
+// checkBreached checks a new password against the breached passwords
+// set by SetBreachChecker. A password is rejected if it cannot be
+// checked.
+func checkBreached(password string) error {
+	if breachCheck == nil {
+		return nil
+	}
+	breached, err := breachCheck.Breached(password)
+	if err != nil {
+		return fmt.Errorf("Password could not be checked: %v", err)
 	}
+	if breached {
+		return &PasswordError{Reason: "breached"}
+	}
+	return nil
+}
 
-	cache = keycache.Cache{UserKeys: make(map[keycache.DelegateIndex]keycache.ActiveUser)}
-	crypt = cryptor.New(&records, &cache)
+// Group selectors may be given instead of user names in the Users of a
+// delegation: adminsGroup for every admin, and teamPrefix followed by a
+// team for the users whose "team" attribute names it.
+const (
+	adminsGroup = "admins"
+	teamPrefix  = "team:"
+)
 
-	return err
+// memberOf returns true if user belongs to the group given by a group
+// selector. It is checked when a delegation is used, not when it is
+// made.
+func memberOf(user, group string) bool {
+	pr, ok := records.GetRecord(user)
+	if !ok {
+		return false
+	}
+	switch {
+	case group == adminsGroup:
+		return pr.IsAdmin()
+	case strings.HasPrefix(group, teamPrefix):
+		return pr.HasAttribute("team", strings.TrimPrefix(group, teamPrefix))
+	}
+	return false
 }
 
-// Create processes a create request.
-func Create(jsonIn []byte) ([]byte, error) {
-	var s CreateRequest
-	var err error
-
-	defer func() {
-		if err != nil {
-			log.Printf("core.create failed: user=%s %v", s.Name, err)
-		} else {
-			log.Printf("core.create success: user=%s", s.Name)
+// checkUsers checks that the users a delegation is limited to are users
+// of the vault or group selectors.
+func checkUsers(users []string) error {
+	for _, user := range users {
+		if user == adminsGroup {
+			continue
+		}
+		if strings.HasPrefix(user, teamPrefix) {
+			if user == teamPrefix {
+				return errors.New("Team selector must name a team")
+			}
+			continue
+		}
+		if _, ok := records.GetRecord(user); !ok {
+			return errors.New("User not present")
 		}
-	}()
-
-	if err = json.Unmarshal(jsonIn, &s); err != nil {
-		return jsonStatusError(err)
 	}
+	return nil
+}
 
-	if records.NumRecords() != 0 {
-		err = errors.New("Vault is already created")
-		return jsonStatusError(err)
+// parseSelector splits an attribute selector of the form "key=value".
+func parseSelector(selector string) (key, value string, err error) {
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid attribute selector '%s'", selector)
 	}
+	return parts[0], parts[1], nil
+}
 
-	// Validate the Name and Password as valid
-	if err = validateName(s.Name, s.Password); err != nil {
-		return jsonStatusError(err)
+// containsString returns true if s is one of the strings in list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
+	return false
+}
 
-	if _, err = records.AddNewRecord(s.Name, s.Password, true, passvault.DefaultRecordType); err != nil {
-		return jsonStatusError(err)
+// checkLabelPolicies checks that the owners of data encrypted under the
+// given labels satisfy the policies of those labels.
+func checkLabelPolicies(labels, owners []string) error {
+	for _, label := range labels {
+		policy, ok := records.GetLabelPolicy(label)
+		if !ok {
+			continue
+		}
+
+		for _, selector := range policy.OwnersInclude {
+			key, value, err := parseSelector(selector)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for _, owner := range owners {
+				if pr, ok := records.GetRecord(owner); ok && pr.HasAttribute(key, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("Label %s requires an owner with %s", label, selector)
+			}
+		}
 	}
 
-	return jsonStatusOk()
+	return nil
 }
 
-// Summary processes a summary request.
-func Summary(jsonIn []byte) ([]byte, error) {
-	var s SummaryRequest
-	var err error
-	cache.Refresh()
-
-	defer func() {
-		if err != nil {
-			log.Printf("core.summary failed: user=%s %v", s.Name, err)
-		} else {
-			log.Printf("core.summary success: user=%s", s.Name)
+// checkConvergent returns an error unless data under the labels may be
+// encrypted convergently: it must have labels, and the policies of all
+// of them must set AllowConvergent.
+func checkConvergent(labels []string) error {
+	if len(labels) == 0 {
+		return errors.New("Convergent encryption requires labels that allow it")
+	}
+	for _, label := range labels {
+		if policy, ok := records.GetLabelPolicy(label); !ok || !policy.AllowConvergent {
+			return fmt.Errorf("Label %s does not allow convergent encryption", label)
 		}
-	}()
-
-	if err := json.Unmarshal(jsonIn, &s); err != nil {
-		return jsonStatusError(err)
 	}
+	return nil
+}
 
-	if records.NumRecords() == 0 {
-		err = errors.New("vault has not been created")
-		return jsonStatusError(err)
+// encryptWith encrypts data, convergently if asked to and allowed by
+// the policies of its labels.
+func encryptWith(data []byte, labels []string, access cryptor.AccessStructure, convergent bool) ([]byte, error) {
+	if !convergent {
+		return crypt.Encrypt(data, labels, access)
 	}
-
-	if err := validateUser(s.Name, s.Password, false); err != nil {
-		return jsonStatusError(err)
+	if err := checkConvergent(labels); err != nil {
+		return nil, err
 	}
-
-	return jsonSummary()
+	return crypt.EncryptConvergent(data, labels, access)
 }
 
-// Purge processes a delegation purge request.
-func Purge(jsonIn []byte) ([]byte, error) {
-	var s PurgeRequest
+// Init reads the records from disk from a given path
+func Init(path string) error {
 	var err error
 
 	defer func() {
 		if err != nil {
-			log.Printf("core.purge failed: user=%s %v", s.Name, err)
+			log.Printf("core.init failed: %v", err)
 		} else {
-			log.Printf("core.purge success: user=%s", s.Name)
+			log.Printf("core.init success: path=%s", path)
 		}
 	}()
 
-	if err = json.Unmarshal(jsonIn, &s); err != nil {
-		return jsonStatusError(err)
+	if records, err = passvault.InitFrom(path); err != nil {
+		err = fmt.Errorf("failed to load password vault %s: %s", path, err)
 	}
 
-	if records.NumRecords() == 0 {
-		err = errors.New("vault has not been created")
-		return jsonStatusError(err)
+	logPath := path
+	if path != "memory" {
+		logPath = path + ".adminlog"
 	}
-
-	// Validate the Name and Password as valid and admin
-	if err = validateUser(s.Name, s.Password, true); err != nil {
-		return jsonStatusError(err)
+	var logErr error
+	if adminLog, logErr = adminlog.Open(logPath); logErr != nil && err == nil {
+		err = fmt.Errorf("failed to load admin log %s: %s", logPath, logErr)
 	}
+	auditPath := path
+	if path != "memory" {
+		auditPath = path + ".auditlog"
+	}
+	if auditLog, logErr = auditlog.Open(auditPath, auditSinks...); logErr != nil && err == nil {
+		err = fmt.Errorf("failed to load audit log %s: %s", auditPath, logErr)
+	}
+	pending = nil
 
-	cache.FlushCache()
-	return jsonStatusOk()
+	cache = keycache.Cache{UserKeys: make(map[keycache.DelegateIndex]keycache.ActiveUser)}
+	cache.SetGroups(memberOf)
+	crypt = cryptor.New(&records, &cache)
+	decryptLog = nil
+	history = nil
+	ceremony.founders, ceremony.records = nil, nil
+	shares = nil
+	orders = nil
+	restores = nil
+	claimNonces = nil
+	sealedNonces = nil
+	resetSessions()
+	SetStandby(0)
+	SetEscrowExport(nil, 0)
+	changed()
+
+	return err
+}
+
+// SetCertificates sets the TLS certificates (in DER form) served by the
+// server so that they can be endorsed by the server identity key.
+func SetCertificates(certs [][]byte) {
+	certHashes = nil
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert)
+		certHashes = append(certHashes, hash[:])
+	}
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of a PKIX encoded
+// public key. Encrypted data is referred to by its own fingerprint (see
+// cryptor.Cryptor.GetFingerprint), as returned by Encrypt, wherever the
+// data itself is not needed.
+func Fingerprint(pub []byte) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:])
+}
+
+// SetTicketChecker sets the ticket system that checks the reasons given
+// for decrypting data under labels requiring a ticket.
+func SetTicketChecker(c tickets.Checker) {
+	ticketCheck = c
+}
+
+// SetBreachChecker sets the list of breached passwords that new
+// passwords are checked against, in Create, CreateUser, Password and
+// Delegate when it adds a user. Nil disables the check.
+func SetBreachChecker(c breach.Checker) {
+	breachCheck = c
+}
+
+// SetClassifier sets the classifier of the data given to Encrypt. Data
+// of a class must then be encrypted under a label whose policy lists
+// the class. Nil classifies no data.
+func SetClassifier(c classify.Classifier) {
+	classifier = c
+}
+
+// SetRequireLabels refuses to encrypt data without labels, which
+// cannot be governed by label policies later. With policies, each label
+// must also have a label policy, so that labels are taken from those
+// the admins have set up rather than made up.
+func SetRequireLabels(labels, policies bool) {
+	requireLabels = labels
+	requirePolicies = policies
+}
+
+// SetStalePolicy sets the number of days after which admins who have
+// not authenticated are revoked by RevokeStale. Zero disables revocation.
+func SetStalePolicy(days int) {
+	staleAfter = time.Duration(days) * 24 * time.Hour
+}
+
+// SetAdminLimits sets the minimum and maximum number of admins. Admins
+// cannot be revoked or deleted below the minimum, and the summary flags
+// more admins than the maximum. Zero disables either limit.
+func SetAdminLimits(min, max int) {
+	minAdmins = min
+	maxAdmins = max
+}
+
+// adminCount returns the number of admins against the limits.
+func adminCount() AdminCount {
+	count := AdminCount{Min: minAdmins, Max: maxAdmins}
+	for _, name := range records.Names() {
+		if pr, ok := records.GetRecord(name); ok && pr.IsAdmin() {
+			count.Count++
+		}
+	}
+	count.OverMax = maxAdmins > 0 && count.Count > maxAdmins
+	return count
+}
+
+// checkAdminMinimum returns an error if removing the admin status of
+// name would leave fewer admins than the minimum. Admins for a time do
+// not count, as their status lapses on its own.
+func checkAdminMinimum(name string) error {
+	if pr, ok := records.GetRecord(name); !ok || !pr.IsAdmin() || !pr.AdminUntil.IsZero() {
+		return nil
+	}
+	count := 0
+	for _, other := range records.Names() {
+		if pr, ok := records.GetRecord(other); ok && pr.IsAdmin() && pr.AdminUntil.IsZero() {
+			count++
+		}
+	}
+	if minAdmins > 0 && count-1 < minAdmins {
+		return fmt.Errorf("core: at least %d admins are required", minAdmins)
+	}
+	return nil
+}
+
+// SetWriteBehind batches the writes of the vault made within interval
+// of each other, leaving them to Flush. Zero writes every change.
+func SetWriteBehind(interval time.Duration) {
+	records.SetWriteBehind(interval)
+}
+
+// SetUnwrapTTL sets the time for which the AES key of a piece of data
+// unwrapped by a delegation is kept to decrypt it again, never past the
+// expiry of the delegation. Zero keeps none.
+func SetUnwrapTTL(ttl time.Duration) {
+	cache.SetUnwrapTTL(ttl)
+}
+
+// Flush writes the changes to the vault left by write-behind.
+func Flush() error {
+	err := records.Flush()
+	if err != nil {
+		log.Printf("core.flush failed: %v", err)
+	}
+	return err
+}
+
+// RevokeStale revokes the admin status of admins who have not
+// authenticated within the stale period. Records are kept, and admins
+// are never revoked below the minimum (see SetAdminLimits), or the last
+// remaining one. Records that have never been seen
+// authenticating (such as those from an older vault) start their period
+// now.
+func RevokeStale(now time.Time) (revoked []string, err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("core.revoke-stale failed: %v", err)
+		} else if len(revoked) > 0 {
+			log.Printf("core.revoke-stale success: revoked=%v", revoked)
+		}
+	}()
+
+	if staleAfter == 0 {
+		return
+	}
+
+	keep := minAdmins
+	if keep < 1 {
+		keep = 1
+	}
+
+	var names []string
+	admins := 0
+	for _, name := range records.Names() {
+		if pr, _ := records.GetRecord(name); !pr.IsAdmin() {
+			continue
+		}
+		admins++
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		pr, _ := records.GetRecord(name)
+		if pr.LastAuth.IsZero() {
+			if err = records.SetLastAuth(name, now); err != nil {
+				return
+			}
+			continue
+		}
+		if now.Sub(pr.LastAuth) <= staleAfter || admins <= keep {
+			continue
+		}
+
+		if err = records.RevokeRecord(name); err != nil {
+			return
+		}
+		if err = logAdmin("", "revoke-stale", name); err != nil {
+			return
+		}
+		publish(events.Event{Type: "revoke-stale", Name: name})
+		admins--
+		revoked = append(revoked, name)
+	}
+
+	return
+}
+
+// ExpireAdmins takes away the admin status of those made admin for a
+// time (see the elevate command of Modify) whose time has run out. Their
+// admin status already lapsed then; this records the demotion in the
+// vault and the admin log.
+func ExpireAdmins(now time.Time) (expired []string, err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("core.expire-admins failed: %v", err)
+		} else if len(expired) > 0 {
+			log.Printf("core.expire-admins success: expired=%v", expired)
+		}
+	}()
+
+	if expired, err = records.ExpireAdmins(now); err != nil {
+		return
+	}
+	for _, name := range expired {
+		if err = logAdmin("", "expire-admin", name); err != nil {
+			return
+		}
+		publish(events.Event{Type: "expire-admin", Name: name})
+	}
+	return
+}
+
+// ID returns the server identity public key and its fingerprint, along
+// with the hashes of the TLS certificates of the server signed by the
+// identity key. Clients that have pinned the fingerprint can use this to
+// check they are talking to the real server.
+func ID(jsonIn []byte) ([]byte, error) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.id failed: %v", err)
+		} else {
+			log.Printf("core.id success")
+		}
+	}()
+
+	pub, err := records.GetIdentityPub()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	sig, err := records.Sign(bytes.Join(certHashes, nil))
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return json.Marshal(IDData{
+		Status:       "ok",
+		PublicKey:    pubBytes,
+		Fingerprint:  Fingerprint(pubBytes),
+		Certificates: certHashes,
+		Signature:    sig,
+	})
+}
+
+// Create processes a create request.
+func Create(jsonIn []byte) ([]byte, error) {
+	var s CreateRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.create failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.create success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if records.NumRecords() != 0 {
+		err = errors.New("Vault is already created")
+		return jsonStatusError(err)
+	}
+
+	// Validate the Name and Password as valid
+	if err = validateName(s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkBreached(s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if ceremony.size > 1 {
+		var resp CreateData
+		if resp, err = createFounder(s); err != nil {
+			return jsonStatusError(err)
+		}
+		return json.Marshal(resp)
+	}
+
+	if _, err = records.AddNewRecord(s.Name, s.Password, true, passvault.DefaultRecordType); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = logAdmin(s.Name, "create", s.Name); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// checkReplay returns an error if a sealed request was sealed more than
+// sealedWindow away from now, or was already received, and otherwise
+// remembers its nonce until the request is too old to be accepted.
+func checkReplay(body SealedBody, now time.Time) error {
+	for nonce, t := range sealedNonces {
+		if now.Sub(t) > sealedWindow {
+			delete(sealedNonces, nonce)
+		}
+	}
+
+	if body.Nonce == "" || len(body.Nonce) > maxNonce {
+		return errors.New("Sealed request needs a nonce")
+	}
+	if d := now.Sub(body.Time); d > sealedWindow || d < -sealedWindow {
+		return errors.New("Sealed request is too old or from the future")
+	}
+	if _, ok := sealedNonces[body.Nonce]; ok {
+		return errors.New("Sealed request was already received")
+	}
+
+	if sealedNonces == nil {
+		sealedNonces = make(map[string]time.Time)
+	}
+	sealedNonces[body.Nonce] = body.Time
+	return nil
+}
+
+// Unseal decrypts a sealed request with the server identity key. A
+// request is only unsealed once.
+func Unseal(jsonIn []byte) (body SealedBody, err error) {
+	var s SealedRequest
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return
+	}
+
+	in, err := records.DecryptWithIdentity(s.Request)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(in, &body); err != nil {
+		return
+	}
+	if err = checkReplay(body, time.Now()); err != nil {
+		return
+	}
+	unsealAudit(body)
+	return
+}
+
+// Seal encrypts the response to a sealed request to the reply key of
+// the request. The encrypted response is returned in the Response field
+// of the ResponseData.
+func Seal(resp []byte, body SealedBody) ([]byte, error) {
+	if pending != nil {
+		var inner struct{ Status string }
+		json.Unmarshal(resp, &inner)
+		pending.Status = inner.Status
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(body.ReplyKey)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return jsonStatusError(errors.New("Reply key is not an ECDSA key"))
+	}
+
+	sealed, err := ecdh.Encrypt(ecPub, resp)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	return jsonResponse(sealed)
+}
+
+// Subscribe returns a channel receiving the events of the server as
+// they happen, and a function to cancel the subscription. Unlike the
+// rest of core, it is safe to call from any goroutine.
+func Subscribe() (<-chan events.Event, func()) {
+	return bus.Subscribe()
+}
+
+// Events processes a request to open the event stream. It only checks
+// that the user may see the stream; the events themselves are read
+// with Subscribe.
+func Events(jsonIn []byte) ([]byte, error) {
+	var s EventsRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.events failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.events success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("events", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// Summary processes a summary request.
+func Summary(jsonIn []byte) ([]byte, error) {
+	var s SummaryRequest
+	var err error
+	cache.Refresh()
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.summary failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.summary success: user=%s", s.Name)
+		}
+	}()
+
+	if err := json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if records.NumRecords() == 0 {
+		err = errors.New("vault has not been created")
+		return jsonStatusError(err)
+	}
+
+	if err := authorize("summary", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	// A signed summary is wrapped so the signature covers the exact
+	// bytes of the summary.
+	out, err := cachedSummary(s.Signed)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	return out, nil
+}
+
+// Users processes a request to list the user records.
+func Users(jsonIn []byte) ([]byte, error) {
+	var s SummaryRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.users failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.users success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("users", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	list := []UserInfo{}
+	for _, name := range records.Names() {
+		pr, _ := records.GetRecord(name)
+		list = append(list, UserInfo{ID: pr.ID, Name: name, Admin: pr.IsAdmin(), Role: pr.GetRole(), Type: pr.Type})
+	}
+
+	out, err := json.Marshal(list)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Signed {
+		return jsonSignedResponse(out)
+	}
+	return jsonResponse(out)
+}
+
+// Delegations processes a request to list the live delegations.
+func Delegations(jsonIn []byte) ([]byte, error) {
+	var s SummaryRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.delegations failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.delegations success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("delegations", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	cache.Refresh()
+
+	var ids []keycache.DelegateIndex
+	for d := range cache.UserKeys {
+		ids = append(ids, d)
+	}
+	sort.Sort(delegateIndexes(ids))
+
+	list := []DelegationInfo{}
+	for _, d := range ids {
+		active := cache.UserKeys[d]
+		list = append(list, DelegationInfo{
+			ID:     active.ID,
+			Name:   d.Name,
+			Slot:   d.Slot,
+			Uses:   active.Uses,
+			Expiry: active.Expiry,
+			Users:  active.Users,
+			Labels: active.Labels,
+		})
+	}
+
+	out, err := json.Marshal(list)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Signed {
+		return jsonSignedResponse(out)
+	}
+	return jsonResponse(out)
+}
+
+// LabelPolicies processes a request to list the label policies.
+func LabelPolicies(jsonIn []byte) ([]byte, error) {
+	var s SummaryRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.label-policies failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.label-policies success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("label-policies", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	var labels []string
+	for label := range records.Policies {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	list := []LabelPolicyInfo{}
+	for _, label := range labels {
+		policy, _ := records.GetLabelPolicy(label)
+		list = append(list, LabelPolicyInfo{ID: policy.ID, Label: label, OwnersInclude: policy.OwnersInclude, RequireReason: policy.RequireReason, RequireTicket: policy.RequireTicket, Watermark: policy.Watermark})
+	}
+
+	out, err := json.Marshal(list)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Signed {
+		return jsonSignedResponse(out)
+	}
+	return jsonResponse(out)
+}
+
+// delegateIndexes sorts delegations by name and then slot.
+type delegateIndexes []keycache.DelegateIndex
+
+func (s delegateIndexes) Len() int      { return len(s) }
+func (s delegateIndexes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s delegateIndexes) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Slot < s[j].Slot
+}
+
+// Purge processes a delegation purge request.
+func Purge(jsonIn []byte) ([]byte, error) {
+	var s PurgeRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.purge failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.purge success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if records.NumRecords() == 0 {
+		err = errors.New("vault has not been created")
+		return jsonStatusError(err)
+	}
+
+	// Validate the Name and Password as valid and admin
+	if err = authorize("purge", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	cache.FlushCache()
+
+	if err = logAdmin(s.Name, "purge", ""); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// Delegate processes a delegation request.
+func Delegate(jsonIn []byte) ([]byte, error) {
+	var s DelegateRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.delegate failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.delegate success: user=%s uses=%d time=%s users=%v labels=%v template=%s reason=%q", s.Name, s.Uses, s.Time, s.Users, s.Labels, s.Template, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if records.NumRecords() == 0 {
+		err = errors.New("Vault is not created yet")
+		return jsonStatusError(err)
+	}
+
+	// Validate the Name and Password as valid
+	if err = validateName(s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	// A template supplies all of the delegation parameters, so they
+	// must not also be given in the request.
+	if s.Template != "" {
+		template, ok := records.GetTemplate(s.Template)
+		if !ok {
+			err = errors.New("Template not present")
+			return jsonStatusError(err)
+		}
+		if s.Uses != 0 || len(s.LabelUses) != 0 || s.Time != "" || len(s.Users) != 0 || len(s.Labels) != 0 {
+			err = errors.New("Delegations from a template cannot set uses, time, users or labels")
+			return jsonStatusError(err)
+		}
+
+		s.Uses, s.Time, s.Users, s.Labels = template.Uses, template.Time, template.Users, template.Labels
+		if s.Slot == "" {
+			s.Slot = s.Template
+		}
+	}
+
+	// Labels with their own budget are implicitly allowed, and the
+	// delegation defaults to the sum of the label budgets.
+	labelUses := 0
+	for label, uses := range s.LabelUses {
+		if uses < 0 {
+			err = errors.New("Label uses cannot be negative")
+			return jsonStatusError(err)
+		}
+		if !containsString(s.Labels, label) {
+			s.Labels = append(s.Labels, label)
+		}
+		labelUses += uses
+	}
+	if s.Uses == 0 {
+		s.Uses = labelUses
+	}
+
+	if err = checkReason(s.Labels, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.BindDevice && s.Device == "" {
+		err = errors.New("Binding a delegation requires a client certificate")
+		return jsonStatusError(err)
+	}
+
+	// Make sure the users we are delegating to exist
+	if err = checkUsers(s.Users); err != nil {
+		return jsonStatusError(err)
+	}
+	// Find password record for user and verify that their password
+	// matches. If not found then add a new entry for this user.
+
+	pr, found := records.GetRecord(s.Name)
+	if found {
+		if err = authorize("delegate", s.Name, s.Password); err != nil {
+			return jsonStatusError(err)
+		}
+		if err = checkAllowedLabels(s.Name, s.Labels); err != nil {
+			return jsonStatusError(err)
+		}
+	} else {
+		if err = checkBreached(s.Password); err != nil {
+			return jsonStatusError(err)
+		}
+		if pr, err = records.AddNewRecord(s.Name, s.Password, false, passvault.DefaultRecordType); err != nil {
+			return jsonStatusError(err)
+		}
+		changed()
+	}
+
+	// add signed-in record to active set, taking it back out if the
+	// delegation cannot be recorded in the vault
+	checkpoint := cache.Checkpoint()
+	if len(s.Unwrapped) > 0 {
+		err = cache.AddKeyFromClient(pr, s.Name, s.Password, s.Users, s.Labels, s.Uses, s.LabelUses, s.Slot, s.Time, s.Unwrapped)
+	} else {
+		err = cache.AddKeyFromRecord(pr, s.Name, s.Password, s.Users, s.Labels, s.Uses, s.LabelUses, s.Slot, s.Time)
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if s.BindDevice {
+		cache.BindDevice(s.Name, s.Slot, s.Device)
+	}
+
+	if err = records.SetLastDelegation(s.Name, time.Now()); err != nil {
+		cache.Restore(checkpoint)
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "delegate", Name: s.Name, Labels: s.Labels, Uses: s.Uses, Reason: s.Reason})
+
+	return jsonStatusOk()
+}
+
+// RevokeDelegation removes delegations of the requesting user before
+// they expire or are used up. Standby servers hold no delegations, so
+// once it returns the keys can no longer be used by any server.
+func RevokeDelegation(jsonIn []byte) ([]byte, error) {
+	var s RevokeDelegationRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.revoke-delegation failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.revoke-delegation success: user=%s slots=%v", s.Name, s.Slots)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("revoke-delegation", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	revoked := false
+	for d := range cache.UserKeys {
+		if d.Name == s.Name && (len(s.Slots) == 0 || containsString(s.Slots, d.Slot)) {
+			revoked = cache.DeleteSlot(d.Name, d.Slot) || revoked
+		}
+	}
+	if !revoked {
+		err = errors.New("No delegation to revoke")
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "revoke-delegation", Name: s.Name})
+
+	return jsonStatusOk()
+}
+
+// Template processes a request to define or delete a delegation template.
+func Template(jsonIn []byte) ([]byte, error) {
+	var s TemplateRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.template failed: user=%s template=%s %v", s.Name, s.Template, err)
+		} else {
+			log.Printf("core.template success: user=%s template=%s delete=%v", s.Name, s.Template, s.Delete)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("template", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Template == "" {
+		err = errors.New("Template name must not be blank")
+		return jsonStatusError(err)
+	}
+
+	if s.Delete && stageChanges {
+		if _, ok := records.GetTemplate(s.Template); !ok {
+			err = errors.New("Template missing")
+			return jsonStatusError(err)
+		}
+		return stage(passvault.Change{Template: s.Template}, s.Name)
+	}
+
+	if s.Delete {
+		if err = records.DeleteTemplate(s.Template); err != nil {
+			return jsonStatusError(err)
+		}
+		if err = logAdmin(s.Name, "delete-template", s.Template); err != nil {
+			return jsonStatusError(err)
+		}
+		return jsonStatusOk()
+	}
+
+	if _, err = time.ParseDuration(s.Time); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkUsers(s.Users); err != nil {
+		return jsonStatusError(err)
+	}
+
+	template := passvault.DelegationTemplate{
+		Uses:   s.Uses,
+		Time:   s.Time,
+		Users:  s.Users,
+		Labels: s.Labels,
+	}
+	if stageChanges {
+		return stage(passvault.Change{Template: s.Template, Delegation: &template}, s.Name)
+	}
+	if err = records.SetTemplate(s.Template, template); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = logAdmin(s.Name, "template", s.Template); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// Absence processes a request to plan or cancel an absence of the user,
+// during which a substitute may stand in for them, or for an admin to
+// approve the planned absence of another user.
+func Absence(jsonIn []byte) ([]byte, error) {
+	var s AbsenceRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.absence failed: user=%s substitute=%s approve=%s %v", s.Name, s.Substitute, s.Approve, err)
+		} else {
+			log.Printf("core.absence success: user=%s substitute=%s approve=%s delete=%v", s.Name, s.Substitute, s.Approve, s.Delete)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Approve != "" {
+		if err = authorize("approve-absence", s.Name, s.Password); err != nil {
+			return jsonStatusError(err)
+		}
+		if s.Approve == s.Name {
+			err = errors.New("Cannot approve own absence")
+			return jsonStatusError(err)
+		}
+		if err = records.ApproveAbsence(s.Approve, s.Name); err != nil {
+			return jsonStatusError(err)
+		}
+		if err = logAdmin(s.Name, "approve-absence", s.Approve); err != nil {
+			return jsonStatusError(err)
+		}
+		return jsonStatusOk()
+	}
+
+	if err = authorize("absence", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Delete {
+		err = records.DeleteAbsence(s.Name)
+	} else {
+		err = records.SetAbsence(s.Name, s.Password, s.Substitute, s.Start, s.End)
+	}
+	changed()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// checkClasses classifies data to be encrypted under labels, and
+// returns an error if a class found is not listed by the policy of any
+// of the labels.
+func checkClasses(data []byte, labels []string) error {
+	if classifier == nil {
+		return nil
+	}
+
+	classes, err := classifier.Classify(data)
+	if err != nil {
+		return err
+	}
+	for _, class := range classes {
+		allowed := false
+		for _, label := range labels {
+			if policy, ok := records.GetLabelPolicy(label); ok && containsString(policy.Classes, class) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Data looks like %s and must be encrypted under a label allowing it", class)
+		}
+	}
+	return nil
+}
+
+// checkLabelsRequired returns an error if data may not be encrypted
+// under labels (see SetRequireLabels).
+func checkLabelsRequired(labels []string) error {
+	if requireLabels && len(labels) == 0 {
+		return errors.New("Data must be encrypted under at least one label")
+	}
+	if !requirePolicies {
+		return nil
+	}
+	for _, label := range labels {
+		if _, ok := records.GetLabelPolicy(label); !ok {
+			return fmt.Errorf("Label %s has no label policy", label)
+		}
+	}
+	return nil
+}
+
+// checkAllowedLabels returns an error if the user name may not
+// delegate for or encrypt under one of the labels. A user restricted to
+// some labels must name at least one, since delegations and data
+// without labels are not restricted to any.
+func checkAllowedLabels(name string, labels []string) error {
+	pr, ok := records.GetRecord(name)
+	if !ok || len(pr.AllowedLabels) == 0 {
+		return nil
+	}
+	if len(labels) == 0 {
+		return errors.New("User may only use some labels and must name them")
+	}
+	for _, label := range labels {
+		if !pr.AllowsLabel(label) {
+			return fmt.Errorf("User may not use label %s", label)
+		}
+	}
+	return nil
+}
+
+// checkReason returns an error if one of the labels has a policy
+// requiring a reason and none was given.
+func checkReason(labels []string, reason string) error {
+	if strings.TrimSpace(reason) != "" {
+		return nil
+	}
+
+	for _, label := range labels {
+		if policy, ok := records.GetLabelPolicy(label); ok && (policy.RequireReason || policy.RequireTicket) {
+			return fmt.Errorf("Label %s requires a reason", label)
+		}
+	}
+	return nil
+}
+
+// checkDataReason is checkReason for the decryption of encrypted data
+// by name. If a label of the data requires a ticket, the reason must
+// also start with a ticket accepted by the ticket system.
+func checkDataReason(in []byte, name, reason string) error {
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return err
+	}
+	if err = checkReason(labels, reason); err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		if policy, ok := records.GetLabelPolicy(label); ok && policy.RequireTicket {
+			if ticketCheck == nil {
+				return fmt.Errorf("Label %s requires a ticket, but no ticket system is configured", label)
+			}
+			return ticketCheck.Check(tickets.TicketID(reason), name)
+		}
+	}
+	return nil
+}
+
+// checkApprovals checks that enough approvers of the data approved its
+// decryption by name (see checkApprovers), and asks the approval system
+// of each label of the data whose policy names one to approve it.
+func checkApprovals(in []byte, name, reason string) error {
+	if err := checkApprovers(in, name); err != nil {
+		return err
+	}
+
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := crypt.GetFingerprint(in)
+	if err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		policy, ok := records.GetLabelPolicy(label)
+		if !ok || policy.ApprovalURL == "" {
+			continue
+		}
+		req := approvals.Request{Name: name, Label: label, Reason: reason, Fingerprint: fingerprint}
+		if err = approvals.Ask(ctx, policy.ApprovalURL, policy.ApprovalKey, req); err != nil {
+			return fmt.Errorf("Label %s: %v", label, err)
+		}
+	}
+	return nil
+}
+
+// checkWindows returns an error if a label of the data has a policy
+// restricting decryptions to time windows and the current time is in
+// none of them. An admin can override the windows with a reason; the
+// labels overridden are returned so that the override can be logged.
+func checkWindows(in []byte, name, reason string, override bool) (overridden []string, err error) {
+	closed, err := closedWindows(in)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, label := range closed {
+		if !override {
+			return nil, fmt.Errorf("Label %s may only be decrypted within its time windows", label)
+		}
+		if pr, ok := records.GetRecord(name); !ok || !pr.IsAdmin() {
+			return nil, errors.New("Only admins can override time windows")
+		}
+		if strings.TrimSpace(reason) == "" {
+			return nil, errors.New("Overriding time windows requires a reason")
+		}
+		overridden = append(overridden, label)
+	}
+	return overridden, nil
+}
+
+// closedWindows returns the labels of the data whose policy restricts
+// decryptions to time windows that the current time is in none of.
+func closedWindows(in []byte) (closed []string, err error) {
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, label := range labels {
+		policy, ok := records.GetLabelPolicy(label)
+		if !ok || len(policy.Windows) == 0 {
+			continue
+		}
+		if within, err := withinWindows(policy, time.Now()); err != nil {
+			return nil, err
+		} else if !within {
+			closed = append(closed, label)
+		}
+	}
+	return closed, nil
+}
+
+// withinWindows returns true if t is within one of the time windows of
+// a label policy.
+func withinWindows(policy passvault.LabelPolicy, t time.Time) (bool, error) {
+	loc, err := time.LoadLocation(policy.TimeZone)
+	if err != nil {
+		return false, err
+	}
+	for _, expr := range policy.Windows {
+		w, err := window.Parse(expr)
+		if err != nil {
+			return false, err
+		}
+		if w.Contains(t.In(loc)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// logOverrides records in the admin log the time windows overridden by
+// an admin for a decryption.
+func logOverrides(name string, labels []string, reason string) error {
+	for _, label := range labels {
+		if err := logAdmin(name, "override-window", label+" "+reason); err != nil {
+			return err
+		}
+	}
+	if len(labels) > 0 {
+		publish(events.Event{Type: "override-window", Name: name, Labels: labels, Reason: reason})
+	}
+	return nil
+}
+
+// dataTransform returns the spec of the transform requested for the
+// decryption of the encrypted data in: the transform of that name of a
+// label of the data, or else the spec requested. It returns an error if
+// a label requires one of its transforms and none was requested.
+func dataTransform(in []byte, requested string) (string, error) {
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return "", err
+	}
+
+	spec, named := requested, false
+	for _, label := range labels {
+		policy, ok := records.GetLabelPolicy(label)
+		if ok && requested != "" && policy.Transforms[requested] != "" && !named {
+			spec, named = policy.Transforms[requested], true
+		}
+	}
+	for _, label := range labels {
+		policy, ok := records.GetLabelPolicy(label)
+		if ok && policy.RequireTransform && (requested == "" || policy.Transforms[requested] == "") {
+			return "", fmt.Errorf("Label %s requires one of its transforms", label)
+		}
+	}
+
+	if spec != "" {
+		if err = transform.Check(spec); err != nil {
+			return "", err
+		}
+	}
+	return spec, nil
+}
+
+// checkRelease checks the policies gating the release of the whole
+// encrypted data in to name, rather than a transform of it or a
+// credential derived from it, as by a re-encryption or a share: its
+// vetoes, reasons, required transforms and derivations, time windows,
+// which an admin can override, and approvals. The labels overridden are
+// returned, to be logged with logOverrides once the data is released.
+func checkRelease(in []byte, name, reason string, override bool) (overridden []string, err error) {
+	if err = checkVetoes(in); err != nil {
+		return nil, err
+	}
+	if err = checkDataReason(in, name, reason); err != nil {
+		return nil, err
+	}
+	if _, err = dataTransform(in, ""); err != nil {
+		return nil, err
+	}
+	if err = checkDerive(in, ""); err != nil {
+		return nil, err
+	}
+	if overridden, err = checkWindows(in, name, reason, override); err != nil {
+		return nil, err
+	}
+	if err = checkApprovals(in, name, reason); err != nil {
+		return nil, err
+	}
+	return overridden, nil
+}
+
+// checkVetoes returns an error if a veto is in place on the encrypted
+// data in.
+func checkVetoes(in []byte) error {
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := crypt.GetFingerprint(in)
+	if err != nil {
+		return err
+	}
+
+	if vetoes := records.GetVetoes(fingerprint, labels); len(vetoes) > 0 {
+		return fmt.Errorf("Decryption vetoed by %s", vetoes[0].By)
+	}
+	return nil
+}
+
+// Veto processes a request to place or lift a veto.
+func Veto(jsonIn []byte) ([]byte, error) {
+	var s VetoRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.veto failed: user=%s label=%s lift=%s %v", s.Name, s.Label, s.Lift, err)
+		} else {
+			log.Printf("core.veto success: user=%s label=%s lift=%s", s.Name, s.Label, s.Lift)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("veto", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Lift != "" {
+		veto, ok := records.GetVeto(s.Lift)
+		var lifted bool
+		if lifted, err = records.LiftVeto(s.Lift, s.Name); err != nil {
+			return jsonStatusError(err)
+		}
+		if ok && veto.By != s.Name {
+			if err = logAdmin(s.Name, "lift-veto", s.Lift); err != nil {
+				return jsonStatusError(err)
+			}
+		}
+		return json.Marshal(VetoData{Status: "ok", ID: s.Lift, Lifted: lifted})
+	}
+
+	fingerprint := s.Fingerprint
+	if len(s.Data) > 0 {
+		if fingerprint, err = crypt.GetFingerprint(s.Data); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	veto, err := records.AddVeto(s.Name, fingerprint, s.Label)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return json.Marshal(VetoData{Status: "ok", ID: veto.ID})
 }
 
-// Delegate processes a delegation request.
-func Delegate(jsonIn []byte) ([]byte, error) {
-	var s DelegateRequest
+// watermarked returns true if the policy of one of the labels requires
+// decrypted data to be watermarked.
+func watermarked(labels []string) bool {
+	for _, label := range labels {
+		if policy, ok := records.GetLabelPolicy(label); ok && policy.Watermark {
+			return true
+		}
+	}
+	return false
+}
+
+// markDecrypted hides a watermark naming user in decrypted data if one
+// of its labels requires it. Only text is marked.
+func markDecrypted(data []byte, labels []string, user string) ([]byte, bool, error) {
+	if !watermarked(labels) {
+		return data, false, nil
+	}
+
+	key, err := records.GetHMACKey()
+	if err != nil {
+		return nil, false, err
+	}
+	marked, ok := watermark.Embed(data, watermark.Mark{Name: user, Time: time.Now()}, key)
+	return marked, ok, nil
+}
+
+// checkWatermarksKept returns an error if a label of the encrypted data
+// in requires watermarks and is not among labels, so that re-encrypting
+// the data cannot rid it of its watermarks.
+func checkWatermarksKept(in []byte, labels []string) error {
+	inLabels, err := crypt.GetLabels(in)
+	if err != nil {
+		return err
+	}
+	for _, label := range inLabels {
+		if watermarked([]string{label}) && !containsString(labels, label) {
+			return fmt.Errorf("Label %s requires watermarks and must be kept", label)
+		}
+	}
+	return nil
+}
+
+// Watermark processes a request to find who decrypted a piece of
+// watermarked text.
+func Watermark(jsonIn []byte) ([]byte, error) {
+	var s WatermarkRequest
 	var err error
 
 	defer func() {
 		if err != nil {
-			log.Printf("core.delegate failed: user=%s %v", s.Name, err)
+			log.Printf("core.watermark failed: user=%s %v", s.Name, err)
 		} else {
-			log.Printf("core.delegate success: user=%s uses=%d time=%s users=%v labels=%v", s.Name, s.Uses, s.Time, s.Users, s.Labels)
+			log.Printf("core.watermark success: user=%s", s.Name)
 		}
 	}()
 
@@ -315,39 +2105,114 @@ func Delegate(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
-	if records.NumRecords() == 0 {
-		err = errors.New("Vault is not created yet")
+	if err = authorize("watermark", s.Name, s.Password); err != nil {
 		return jsonStatusError(err)
 	}
 
-	// Validate the Name and Password as valid
-	if err = validateName(s.Name, s.Password); err != nil {
+	key, err := records.GetHMACKey()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	mark, err := watermark.Extract(s.Data, key)
+	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	// Make sure the user we are delegating to exists
-	for _, user := range s.Users {
-		if _, ok := records.GetRecord(user); !ok {
-			err = errors.New("User not present")
+	return json.Marshal(WatermarkData{Status: "ok", Name: mark.Name, Time: mark.Time})
+}
+
+// LabelPolicy processes a request to set or delete the policy of a label.
+func LabelPolicy(jsonIn []byte) ([]byte, error) {
+	var s LabelPolicyRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.label-policy failed: user=%s label=%s %v", s.Name, s.Label, err)
+		} else {
+			log.Printf("core.label-policy success: user=%s label=%s delete=%v", s.Name, s.Label, s.Delete)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("label-policy", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Label == "" {
+		err = errors.New("Label must not be blank")
+		return jsonStatusError(err)
+	}
+
+	if s.Delete && stageChanges {
+		if _, ok := records.GetLabelPolicy(s.Label); !ok {
+			err = errors.New("Policy missing")
 			return jsonStatusError(err)
 		}
+		return stage(passvault.Change{Label: s.Label}, s.Name)
 	}
-	// Find password record for user and verify that their password
-	// matches. If not found then add a new entry for this user.
 
-	pr, found := records.GetRecord(s.Name)
-	if found {
-		if err = pr.ValidatePassword(s.Password); err != nil {
+	if s.Delete {
+		if err = records.DeleteLabelPolicy(s.Label); err != nil {
 			return jsonStatusError(err)
 		}
-	} else {
-		if pr, err = records.AddNewRecord(s.Name, s.Password, false, passvault.DefaultRecordType); err != nil {
+		if err = logAdmin(s.Name, "delete-label-policy", s.Label); err != nil {
 			return jsonStatusError(err)
 		}
+		return jsonStatusOk()
 	}
 
-	// add signed-in record to active set
-	if err = cache.AddKeyFromRecord(pr, s.Name, s.Password, s.Users, s.Labels, s.Uses, s.Slot, s.Time); err != nil {
+	for _, selector := range s.Policy.OwnersInclude {
+		if _, _, err = parseSelector(selector); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	for name, spec := range s.Policy.Transforms {
+		if err = transform.Check(spec); err != nil {
+			err = fmt.Errorf("Transform %s: %v", name, err)
+			return jsonStatusError(err)
+		}
+	}
+	if s.Policy.RequireTransform && len(s.Policy.Transforms) == 0 {
+		err = errors.New("Requiring a transform needs at least one transform")
+		return jsonStatusError(err)
+	}
+
+	for _, expr := range s.Policy.Windows {
+		if _, err = window.Parse(expr); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+	if _, err = time.LoadLocation(s.Policy.TimeZone); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Policy.ApprovalURL != "" || len(s.Policy.ApprovalKey) > 0 {
+		if err = approvals.CheckURL(s.Policy.ApprovalURL); err != nil {
+			return jsonStatusError(err)
+		}
+		if _, err = approvals.ParseKey(s.Policy.ApprovalKey); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	if s.Policy.AllowConvergent {
+		log.Printf("core.label-policy: label %s allows convergent encryption, giving away which data under it is the same", s.Label)
+	}
+
+	if stageChanges {
+		return stage(passvault.Change{Label: s.Label, Policy: &s.Policy}, s.Name)
+	}
+
+	if err = records.SetLabelPolicy(s.Label, s.Policy); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = logAdmin(s.Name, "label-policy", s.Label); err != nil {
 		return jsonStatusError(err)
 	}
 
@@ -376,149 +2241,372 @@ func CreateUser(jsonIn []byte) ([]byte, error) {
 		s.UserType = passvault.DefaultRecordType
 	}
 
-	if records.NumRecords() == 0 {
-		err = errors.New("Vault is not created yet")
+	if records.NumRecords() == 0 {
+		err = errors.New("Vault is not created yet")
+		return jsonStatusError(err)
+	}
+
+	// Validate the Name and Password as valid
+	if err = validateName(s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	_, found := records.GetRecord(s.Name)
+	if found {
+		err = errors.New("User with that name already exists")
+		return jsonStatusError(err)
+	}
+	if _, found = records.GetImported(s.Name); found {
+		err = errors.New("User with that name must claim their imported key")
+		return jsonStatusError(err)
+	}
+	if err = checkBreached(s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.UserType == passvault.HSMRecord {
+		err = addHSMRecord(s.Name, s.Password, s.PublicKey)
+	} else if len(s.PublicKey) > 0 {
+		err = errors.New("Only HSM records are created with a public key")
+	} else {
+		_, err = records.AddNewRecord(s.Name, s.Password, false, s.UserType)
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logAdmin(s.Name, "create-user", s.Name); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// Password processes a password change request.
+func Password(jsonIn []byte) ([]byte, error) {
+	var err error
+	var s PasswordRequest
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.password failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.password success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if records.NumRecords() == 0 {
+		err = errors.New("Vault is not created yet")
+		return jsonStatusError(err)
+	}
+
+	if err = checkBreached(s.NewPassword); err != nil {
+		return jsonStatusError(err)
+	}
+
+	// add signed-in record to active set
+	err = records.ChangePassword(s.Name, s.Password, s.NewPassword)
+	changed()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logAdmin(s.Name, "password", s.Name); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
+
+// Encrypt processes an encrypt request.
+func Encrypt(jsonIn []byte) ([]byte, error) {
+	var s EncryptRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.encrypt failed: user=%s size=%d %v", s.Name, len(s.Data), err)
+		} else {
+			log.Printf("core.encrypt success: user=%s size=%d", s.Name, len(s.Data))
+		}
+	}()
+
+	err = json.Unmarshal(jsonIn, &s)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("encrypt", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	access := cryptor.AccessStructure{
+		Names:       s.Owners,
+		LeftNames:   s.LeftOwners,
+		RightNames:  s.RightOwners,
+		Predicate:   s.Predicate,
+		Constraints: s.Constraints,
+
+		MaxDelegationAge: s.MaxDelegationAge,
+		Escrow:           s.Escrow,
+		Approvers:        s.Approvers,
+		ApprovalMinimum:  s.ApprovalMinimum,
+	}
+	if err = resolveAccess(&access); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkLabelsRequired(s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkAllowedLabels(s.Name, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkClasses(s.Data, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	resp, err := encryptWith(s.Data, s.Labels, access, s.Convergent)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	owners, _, err := crypt.GetOwners(resp)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkLabelPolicies(s.Labels, owners); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonEncrypted(resp)
+}
+
+// ReEncrypt processes an Re-encrypt request.
+func ReEncrypt(jsonIn []byte) ([]byte, error) {
+	var s ReEncryptRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.re-encrypt failed: user=%s size=%d %v", s.Name, len(s.Data), err)
+		} else {
+			log.Printf("core.re-encrypt success: user=%s size=%d", s.Name, len(s.Data))
+		}
+	}()
+
+	err = json.Unmarshal(jsonIn, &s)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("re-encrypt", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkLabelsRequired(s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkAllowedLabels(s.Name, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkWatermarksKept(s.Data, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	overridden, err := checkRelease(s.Data, s.Name, s.Reason, s.Override)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logOverrides(s.Name, overridden, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	data, _, secure, err := decryptFrom(s.Data, s.Name, s.Device)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if !secure {
+		return jsonStatusError(errors.New("decryption's secure bit is false"))
+	}
+	if err = checkClasses(data, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+
+	access := cryptor.AccessStructure{
+		Names:       s.Owners,
+		LeftNames:   s.LeftOwners,
+		RightNames:  s.RightOwners,
+		Constraints: s.Constraints,
+
+		MaxDelegationAge: s.MaxDelegationAge,
+		Escrow:           s.Escrow,
+		Approvers:        s.Approvers,
+		ApprovalMinimum:  s.ApprovalMinimum,
+	}
+	if err = resolveAccess(&access); err != nil {
 		return jsonStatusError(err)
 	}
 
-	// Validate the Name and Password as valid
-	if err = validateName(s.Name, s.Password); err != nil {
+	resp, err := encryptWith(data, s.Labels, access, s.Convergent)
+	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	_, found := records.GetRecord(s.Name)
-	if found {
-		err = errors.New("User with that name already exists")
+	owners, _, err := crypt.GetOwners(resp)
+	if err != nil {
 		return jsonStatusError(err)
 	}
-
-	if _, err = records.AddNewRecord(s.Name, s.Password, false, s.UserType); err != nil {
+	if err = checkLabelPolicies(s.Labels, owners); err != nil {
 		return jsonStatusError(err)
 	}
 
-	return jsonStatusOk()
+	return jsonEncrypted(resp)
 }
 
-// Password processes a password change request.
-func Password(jsonIn []byte) ([]byte, error) {
+// Decrypt processes a decrypt request.
+func Decrypt(jsonIn []byte) ([]byte, error) {
+	var s DecryptRequest
 	var err error
-	var s PasswordRequest
 
 	defer func() {
 		if err != nil {
-			log.Printf("core.password failed: user=%s %v", s.Name, err)
+			log.Printf("core.decrypt failed: user=%s dryrun=%v %v", s.Name, s.DryRun, err)
 		} else {
-			log.Printf("core.password success: user=%s", s.Name)
+			log.Printf("core.decrypt success: user=%s dryrun=%v reason=%q", s.Name, s.DryRun, s.Reason)
 		}
 	}()
 
-	if err = json.Unmarshal(jsonIn, &s); err != nil {
+	err = json.Unmarshal(jsonIn, &s)
+	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	if records.NumRecords() == 0 {
-		err = errors.New("Vault is not created yet")
+	err = authorize("decrypt", s.Name, s.Password)
+	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	// add signed-in record to active set
-	err = records.ChangePassword(s.Name, s.Password, s.NewPassword)
-	if err != nil {
+	if err = checkVetoes(s.Data); err != nil {
 		return jsonStatusError(err)
 	}
 
-	return jsonStatusOk()
-}
-
-// Encrypt processes an encrypt request.
-func Encrypt(jsonIn []byte) ([]byte, error) {
-	var s EncryptRequest
-	var err error
-
-	defer func() {
-		if err != nil {
-			log.Printf("core.encrypt failed: user=%s size=%d %v", s.Name, len(s.Data), err)
-		} else {
-			log.Printf("core.encrypt success: user=%s size=%d", s.Name, len(s.Data))
-		}
-	}()
+	if err = checkDataReason(s.Data, s.Name, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
 
-	err = json.Unmarshal(jsonIn, &s)
+	spec, err := dataTransform(s.Data, s.Transform)
 	if err != nil {
 		return jsonStatusError(err)
 	}
-
-	if err = validateUser(s.Name, s.Password, false); err != nil {
+	if err = checkDerive(s.Data, s.Derive); err != nil {
 		return jsonStatusError(err)
 	}
-
-	access := cryptor.AccessStructure{
-		Names:      s.Owners,
-		LeftNames:  s.LeftOwners,
-		RightNames: s.RightOwners,
-		Predicate:  s.Predicate,
+	ttl, err := deriveTTL(s.DeriveTTL)
+	if err != nil {
+		return jsonStatusError(err)
 	}
 
-	resp, err := crypt.Encrypt(s.Data, s.Labels, access)
+	overridden, err := checkWindows(s.Data, s.Name, s.Reason, s.Override)
 	if err != nil {
-		return jsonStatusError(err)
+		closed, _ := closedWindows(s.Data)
+		return jsonDenied(err, explainDecrypt(s, closed))
 	}
-	return jsonResponse(resp)
-}
 
-// ReEncrypt processes an Re-encrypt request.
-func ReEncrypt(jsonIn []byte) ([]byte, error) {
-	var s ReEncryptRequest
-	var err error
+	if s.DryRun {
+		return decryptDryRun(s)
+	}
 
-	defer func() {
-		if err != nil {
-			log.Printf("core.re-encrypt failed: user=%s size=%d %v", s.Name, len(s.Data), err)
-		} else {
-			log.Printf("core.re-encrypt success: user=%s size=%d", s.Name, len(s.Data))
-		}
-	}()
+	if err = checkApprovals(s.Data, s.Name, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logOverrides(s.Name, overridden, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
 
-	err = json.Unmarshal(jsonIn, &s)
+	cache.Refresh()
+	checkpoint := cache.Checkpoint()
+	var data []byte
+	var names []string
+	var secure bool
+	if s.File == "" {
+		data, names, secure, err = decryptFrom(s.Data, s.Name, s.Device)
+	} else {
+		data, names, secure, err = extractFrom(s.Data, s.File, s.Name, s.Device, checkpoint)
+	}
 	if err != nil {
-		return jsonStatusError(err)
+		return jsonDenied(err, explainDecrypt(s, nil))
+	}
+	if spec != "" {
+		// delegations are not used up by data the transform fails on
+		if data, err = transform.Apply(spec, data); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
 	}
 
-	if err = validateUser(s.Name, s.Password, false); err != nil {
-		return jsonStatusError(err)
+	var credential *derive.Credential
+	if s.Derive != "" {
+		// the data stays here, so it is not watermarked
+		if credential, err = derive.Mint(s.Derive, data, s.Name, ttl, time.Now()); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		data = nil
 	}
 
-	data, _, secure, err := crypt.Decrypt(s.Data, s.Name)
+	labels, err := crypt.GetLabels(s.Data)
 	if err != nil {
 		return jsonStatusError(err)
 	}
-	if !secure {
-		return jsonStatusError(errors.New("decryption's secure bit is false"))
+	fingerprint, err := crypt.GetFingerprint(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	var marked bool
+	if credential == nil {
+		if data, marked, err = markDecrypted(data, labels, s.Name); err != nil {
+			return jsonStatusError(err)
+		}
 	}
+	recordDecrypt(labels, names)
+	publish(events.Event{Type: "decrypt", Name: s.Name, Labels: labels, Delegates: names, Reason: s.Reason, Fingerprint: fingerprint})
 
-	access := cryptor.AccessStructure{
-		Names:      s.Owners,
-		LeftNames:  s.LeftOwners,
-		RightNames: s.RightOwners,
+	resp := &DecryptWithDelegates{
+		Data:        data,
+		Secure:      secure,
+		Delegates:   names,
+		Watermarked: marked,
+		Delegations: usedDelegations(checkpoint),
+		Credential:  credential,
 	}
 
-	resp, err := crypt.Encrypt(data, s.Labels, access)
+	out, err := json.Marshal(resp)
 	if err != nil {
 		return jsonStatusError(err)
 	}
-	return jsonResponse(resp)
+
+	return jsonResponse(out)
 }
 
-// Decrypt processes a decrypt request.
-func Decrypt(jsonIn []byte) ([]byte, error) {
-	var s DecryptRequest
+// DecryptBatch processes a request to decrypt several pieces of data at
+// once. Either all of them are decrypted or none are, and delegations are
+// only consumed if every decryption succeeds.
+func DecryptBatch(jsonIn []byte) ([]byte, error) {
+	var s DecryptBatchRequest
 	var err error
 
 	defer func() {
 		if err != nil {
-			log.Printf("core.decrypt failed: user=%s %v", s.Name, err)
+			log.Printf("core.decrypt-batch failed: user=%s count=%d %v", s.Name, len(s.Data), err)
 		} else {
-			log.Printf("core.decrypt success: user=%s", s.Name)
+			log.Printf("core.decrypt-batch success: user=%s count=%d reason=%q", s.Name, len(s.Data), s.Reason)
 		}
 	}()
 
@@ -527,20 +2615,140 @@ func Decrypt(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
-	err = validateUser(s.Name, s.Password, false)
+	err = authorize("decrypt-batch", s.Name, s.Password)
 	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	data, names, secure, err := crypt.Decrypt(s.Data, s.Name)
+	cache.Refresh()
+	checkpoint := cache.Checkpoint()
+
+	var resp []DecryptWithDelegates
+	var labels [][]string
+	var fingerprints, overridden []string
+	for _, in := range s.Data {
+		var data []byte
+		var names, inLabels, inOverridden []string
+		var fingerprint string
+		var secure, marked bool
+		if err = ctx.Err(); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		if inOverridden, err = checkRelease(in, s.Name, s.Reason, s.Override); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		overridden = append(overridden, inOverridden...)
+		before := cache.Checkpoint()
+		if data, names, secure, err = decryptFrom(in, s.Name, s.Device); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		if inLabels, err = crypt.GetLabels(in); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		if fingerprint, err = crypt.GetFingerprint(in); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		if data, marked, err = markDecrypted(data, inLabels, s.Name); err != nil {
+			cache.Restore(checkpoint)
+			return jsonStatusError(err)
+		}
+		labels = append(labels, inLabels)
+		fingerprints = append(fingerprints, fingerprint)
+
+		resp = append(resp, DecryptWithDelegates{
+			Data:        data,
+			Secure:      secure,
+			Delegates:   names,
+			Watermarked: marked,
+			Delegations: usedDelegations(before),
+		})
+	}
+
+	if err = logOverrides(s.Name, overridden, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+	for i, r := range resp {
+		recordDecrypt(labels[i], r.Delegates)
+		publish(events.Event{Type: "decrypt", Name: s.Name, Labels: labels[i], Delegates: r.Delegates, Reason: s.Reason, Fingerprint: fingerprints[i]})
+	}
+
+	out, err := json.Marshal(resp)
 	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	resp := &DecryptWithDelegates{
-		Data:      data,
-		Secure:    secure,
-		Delegates: names,
+	return jsonResponse(out)
+}
+
+// delegationUse describes the use of the delegation d, which has
+// usesAfter uses left after it.
+func delegationUse(d keycache.DelegateIndex, active keycache.ActiveUser, usesAfter int) DelegationUse {
+	return DelegationUse{
+		ID:        d.String(),
+		Name:      d.Name,
+		Slot:      d.Slot,
+		Uses:      active.Uses,
+		UsesAfter: usesAfter,
+		Expiry:    active.Expiry,
+		Created:   active.Created,
+		Labels:    active.Labels,
+	}
+}
+
+// usedDelegations returns the delegations consumed since checkpoint was
+// taken with cache.Checkpoint, sorted by ID. A delegation gone since
+// with a single use left was used up.
+func usedDelegations(checkpoint map[keycache.DelegateIndex]keycache.ActiveUser) (used []DelegationUse) {
+	for d, before := range checkpoint {
+		after, ok := cache.UserKeys[d]
+		switch {
+		case ok && after.Uses < before.Uses:
+			used = append(used, delegationUse(d, before, after.Uses))
+		case !ok && before.Uses == 1:
+			used = append(used, delegationUse(d, before, 0))
+		}
+	}
+	sort.Sort(delegationUses(used))
+	return used
+}
+
+// delegationUses sorts by ID.
+type delegationUses []DelegationUse
+
+func (s delegationUses) Len() int           { return len(s) }
+func (s delegationUses) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s delegationUses) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// decryptFrom decrypts in for user with the delegations that may be
+// used by decryptions requested from device.
+func decryptFrom(in []byte, user, device string) ([]byte, []string, bool, error) {
+	view := cache.ForDevice(device)
+	defer cache.Update(view)
+	defer changed()
+	c := cryptor.New(&records, view)
+	return c.DecryptContext(ctx, in, user)
+}
+
+// decryptDryRun reports the delegations that a decrypt request would
+// consume without consuming them or decrypting the data.
+func decryptDryRun(s DecryptRequest) ([]byte, error) {
+	cache.Refresh()
+
+	c := cryptor.New(&records, cache.ForDevice(s.Device))
+	delegates, err := c.Delegates(s.Data, s.Name)
+	if err != nil {
+		return jsonDenied(err, explainDecrypt(s, nil))
+	}
+
+	var resp DecryptDryRun
+	for _, d := range delegates {
+		active := cache.UserKeys[d]
+		resp.Delegations = append(resp.Delegations, delegationUse(d, active, active.Uses-1))
 	}
 
 	out, err := json.Marshal(resp)
@@ -551,6 +2759,25 @@ func Decrypt(jsonIn []byte) ([]byte, error) {
 	return jsonResponse(out)
 }
 
+// explainDecrypt returns why the delegations do not allow a decrypt
+// request, along with the labels closed by their time windows, or nil
+// if neither is why it failed.
+func explainDecrypt(s DecryptRequest, closed []string) *DecryptDenial {
+	cache.Refresh()
+
+	c := cryptor.New(&records, cache.ForDevice(s.Device))
+	denial, err := c.Explain(s.Data, s.Name)
+	if err != nil || (denial == nil && len(closed) == 0) {
+		return nil
+	}
+
+	resp := &DecryptDenial{Windows: closed}
+	if denial != nil {
+		resp.Denial = *denial
+	}
+	return resp
+}
+
 // Modify processes a modify request.
 func Modify(jsonIn []byte) ([]byte, error) {
 	var s ModifyRequest
@@ -569,7 +2796,7 @@ func Modify(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
-	if err = validateUser(s.Name, s.Password, true); err != nil {
+	if err = authorize("modify", s.Name, s.Password); err != nil {
 		return jsonStatusError(err)
 	}
 
@@ -583,18 +2810,65 @@ func Modify(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
+	switch s.Command {
+	case "delete", "revoke":
+		err = checkAdminMinimum(s.ToModify)
+	case "set-role":
+		if s.Value != passvault.AdminRole {
+			err = checkAdminMinimum(s.ToModify)
+		}
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
 	switch s.Command {
 	case "delete":
+		// the delegations go first, so that they cannot outlive a
+		// deletion that fails to be written
+		cache.DeleteUser(s.ToModify)
 		err = records.DeleteRecord(s.ToModify)
 	case "revoke":
 		err = records.RevokeRecord(s.ToModify)
 	case "admin":
 		err = records.MakeAdmin(s.ToModify)
+	case "elevate":
+		var duration time.Duration
+		if duration, err = time.ParseDuration(s.Value); err == nil && duration <= 0 {
+			err = errors.New("core: admin time must be positive")
+		}
+		if err == nil {
+			err = records.MakeAdminUntil(s.ToModify, time.Now().Add(duration))
+		}
+	case "set-role":
+		err = records.SetRole(s.ToModify, s.Value)
+	case "set-notes":
+		err = records.SetNotes(s.ToModify, s.Value)
+	case "set-labels":
+		var patterns []string
+		if s.Value != "" {
+			patterns = strings.Split(s.Value, ",")
+		}
+		err = records.SetAllowedLabels(s.ToModify, patterns)
+	case "grant-veto":
+		err = records.SetVetoer(s.ToModify, true)
+	case "revoke-veto":
+		err = records.SetVetoer(s.ToModify, false)
+	case "set-attr":
+		if s.Attribute == "" {
+			err = errors.New("core: attribute name must not be blank")
+		} else {
+			err = records.SetAttribute(s.ToModify, s.Attribute, s.Value)
+		}
 	default:
 		err = fmt.Errorf("core: unknown command '%s' passed to modify", s.Command)
 		return jsonStatusError(err)
 	}
 
+	if err == nil {
+		err = logAdmin(s.Name, s.Command, s.ToModify)
+	}
+
 	if err != nil {
 		return jsonStatusError(err)
 	} else {
@@ -625,7 +2899,35 @@ func Owners(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
-	return json.Marshal(OwnersData{Status: "ok", Owners: names, Predicate: predicate})
+	labels, err := crypt.GetLabels(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	fingerprint, err := crypt.GetFingerprint(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	vetoes := records.GetVetoes(fingerprint, labels)
+
+	escrow, err := crypt.GetEscrow(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	approvers, minimum, err := crypt.GetApprovers(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	approvals := records.GetApprovals(fingerprint)
+	var approved []string
+	for _, approver := range approvers {
+		if _, ok := approvals[approver]; ok {
+			approved = append(approved, approver)
+		}
+	}
+
+	return json.Marshal(OwnersData{Status: "ok", Owners: names, Predicate: predicate, Vetoes: vetoes, Escrow: escrow,
+		Approvers: approvers, ApprovalMinimum: minimum, Approved: approved})
 }
 
 // Export returns a backed up vault.
@@ -646,15 +2948,146 @@ func Export(jsonIn []byte) ([]byte, error) {
 		return jsonStatusError(err)
 	}
 
-	err = validateUser(s.Name, s.Password, true)
+	err = authorize("export", s.Name, s.Password)
 	if err != nil {
 		return jsonStatusError(err)
 	}
 
-	out, err := json.Marshal(records)
+	out, err := records.Export()
 	if err != nil {
 		return jsonStatusError(err)
 	}
 
+	if err = logAdmin(s.Name, "export", ""); err != nil {
+		return jsonStatusError(err)
+	}
+
 	return jsonResponse(out)
 }
+
+// AdminLog returns the size and root hash of the admin log. If Index
+// names an entry of the log, that entry and its inclusion proof are
+// returned as well.
+func AdminLog(jsonIn []byte) ([]byte, error) {
+	var s AdminLogRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.admin-log failed: user=%s index=%d %v", s.Name, s.Index, err)
+		} else {
+			log.Printf("core.admin-log success: user=%s index=%d", s.Name, s.Index)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("admin-log", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	resp := AdminLogData{Status: "ok", Size: adminLog.Size(), Root: adminLog.Root()}
+	if s.Index >= 0 && s.Index < resp.Size {
+		if resp.Entry, err = adminLog.Entry(s.Index); err != nil {
+			return jsonStatusError(err)
+		}
+		if resp.Proof, err = adminLog.Proof(s.Index); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	return json.Marshal(resp)
+}
+
+// Changelog returns the changes to the vault, as recorded in the admin
+// log, from the sequence number Since on. Changes are returned in order,
+// at most Limit at a time, so that external systems can follow them.
+func Changelog(jsonIn []byte) ([]byte, error) {
+	var s ChangelogRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.changelog failed: user=%s since=%d %v", s.Name, s.Since, err)
+		} else {
+			log.Printf("core.changelog success: user=%s since=%d", s.Name, s.Since)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("changelog", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Since < 0 || s.Limit < 0 {
+		err = errors.New("Since and Limit must not be negative")
+		return jsonStatusError(err)
+	}
+	if s.Limit == 0 {
+		s.Limit = defaultChangelogLimit
+	} else if s.Limit > maxChangelogLimit {
+		s.Limit = maxChangelogLimit
+	}
+
+	resp := ChangelogData{Status: "ok", Changes: []ChangelogEntry{}, Next: s.Since}
+	for ; resp.Next < adminLog.Size() && len(resp.Changes) < s.Limit; resp.Next++ {
+		var line []byte
+		if line, err = adminLog.Entry(resp.Next); err != nil {
+			return jsonStatusError(err)
+		}
+		change := ChangelogEntry{Seq: resp.Next}
+		if err = json.Unmarshal(line, &change.Entry); err != nil {
+			return jsonStatusError(err)
+		}
+		resp.Changes = append(resp.Changes, change)
+	}
+
+	return json.Marshal(resp)
+}
+
+// Merge copies the records of an exported vault into the current one.
+func Merge(jsonIn []byte) ([]byte, error) {
+	var s MergeRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.merge failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.merge success: user=%s dryrun=%v", s.Name, s.DryRun)
+		}
+	}()
+
+	err = json.Unmarshal(jsonIn, &s)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	err = authorize("merge", s.Name, s.Password)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	var other passvault.Records
+	if err = json.Unmarshal(s.Vault, &other); err != nil {
+		return jsonStatusError(err)
+	}
+
+	added, conflicts, err := records.MergeRecords(other, s.DryRun)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if !s.DryRun {
+		if err = logAdmin(s.Name, "merge", strings.Join(added, ",")); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	return json.Marshal(MergeData{Status: "ok", Added: added, Conflicts: conflicts})
+}
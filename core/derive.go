@@ -0,0 +1,64 @@
+// derive.go: short-lived credentials derived from decrypted data
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/redoctober/derive"
+)
+
+// How long a derived credential lasts if the request does not say, and
+// at most.
+const (
+	defaultDeriveTTL = 15 * time.Minute
+	maxDeriveTTL     = 24 * time.Hour
+)
+
+// requiresDerive returns the first of labels whose policy requires
+// decryptions to mint a derived credential, if any.
+func requiresDerive(labels []string) (string, bool) {
+	for _, label := range labels {
+		if policy, ok := records.GetLabelPolicy(label); ok && policy.RequireDerive {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// checkDerive returns an error if the derivation requested for the
+// decryption of the encrypted data in is not one, or if none was and a
+// label of the data requires one.
+func checkDerive(in []byte, requested string) error {
+	if requested != "" {
+		return derive.Check(requested)
+	}
+
+	labels, err := crypt.GetLabels(in)
+	if err != nil {
+		return err
+	}
+	if label, ok := requiresDerive(labels); ok {
+		return fmt.Errorf("Label %s requires a derived credential", label)
+	}
+	return nil
+}
+
+// deriveTTL parses the lifetime of a derived credential.
+func deriveTTL(requested string) (time.Duration, error) {
+	if requested == "" {
+		return defaultDeriveTTL, nil
+	}
+	ttl, err := time.ParseDuration(requested)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 || ttl > maxDeriveTTL {
+		return 0, errors.New("Credential lifetime must be positive and at most 24h")
+	}
+	return ttl, nil
+}
@@ -0,0 +1,191 @@
+// escrow.go: keys exported to an escrow key under a quorum of admins
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/events"
+)
+
+// escrowWindow is the time within which the admins exporting a key to
+// escrow must all approve.
+const escrowWindow = time.Hour
+
+var (
+	// escrowKey is the public key keys are exported to (see
+	// SetEscrowExport).
+	escrowKey *ecdsa.PublicKey
+
+	// escrowQuorum is the number of admins who must approve an
+	// export.
+	escrowQuorum int
+
+	// escrowApprovals holds the time each admin approved the export
+	// of each target.
+	escrowApprovals map[string]map[string]time.Time
+)
+
+type EscrowExportRequest struct {
+	Name     string
+	Password string
+
+	// Exactly one of User, whose private key is exported, or Data,
+	// whose data key is exported, must be set.
+	User   string
+	Data   []byte
+	Reason string
+}
+
+type EscrowExportData struct {
+	Status    string
+	Approvals []string // admins who approved the export so far
+	Exported  bool     // set once the quorum is reached
+
+	// Escrow is set once exported. For a user, it is their private
+	// key in PKCS #8 form encrypted with ecdh to the escrow key. For
+	// data, it is a JSON encoded cryptor.Link whose Key is encrypted
+	// to the escrow key.
+	Escrow []byte `json:",omitempty"`
+}
+
+// SetEscrowExport sets the public key user and data keys are exported
+// to by EscrowExport, and the number of admins who must approve each
+// export. Nil disables exports.
+func SetEscrowExport(pub *ecdsa.PublicKey, quorum int) {
+	escrowKey = pub
+	escrowQuorum = quorum
+	escrowApprovals = make(map[string]map[string]time.Time)
+}
+
+// escrowTarget returns the key of the export of a request in
+// escrowApprovals, which is also the target in the admin log.
+func escrowTarget(s EscrowExportRequest) (string, error) {
+	switch {
+	case (s.User == "") == (len(s.Data) == 0):
+		return "", errors.New("Escrow export needs either a user or data")
+	case s.User != "":
+		if _, ok := records.GetRecord(s.User); !ok {
+			return "", errors.New("User not present")
+		}
+		return "user:" + s.User, nil
+	default:
+		fingerprint, err := crypt.GetFingerprint(s.Data)
+		if err != nil {
+			return "", err
+		}
+		return "data:" + fingerprint, nil
+	}
+}
+
+// exportEscrow exports the key of a request to the escrow key.
+func exportEscrow(s EscrowExportRequest) ([]byte, error) {
+	if s.User != "" {
+		return cache.SealUser(s.User, escrowKey)
+	}
+
+	view := cache.ForDevice("")
+	defer cache.Update(view)
+	defer changed()
+	c := cryptor.New(&records, view)
+	link, names, err := c.Share(s.Data, s.Name, escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	recordDecrypt(link.Labels, names)
+	return json.Marshal(link)
+}
+
+// EscrowExport processes the approval of an admin to export the private
+// key of a user, or the data key of a piece of encrypted data, to the
+// escrow key, for legal or compliance recovery. The key is exported
+// once the quorum of admins approved the same export within an hour of
+// each other. A data key is only exported if the data passes the
+// policies of a decryption, as for Share. Each approval and the export
+// are written to the admin log.
+func EscrowExport(jsonIn []byte) ([]byte, error) {
+	var s EscrowExportRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.escrow-export failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.escrow-export success: user=%s for=%s reason=%q", s.Name, s.User, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("escrow-export", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if escrowKey == nil {
+		err = errors.New("No escrow key is set")
+		return jsonStatusError(err)
+	}
+
+	target, err := escrowTarget(s)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	// the quorum of admins does not override the policies of the data,
+	// which are checked on each approval, the last one included
+	if len(s.Data) != 0 {
+		if _, err = checkRelease(s.Data, s.Name, s.Reason, false); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	if err = logAdmin(s.Name, "approve-escrow", target+" "+s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	now := time.Now()
+	approvals := escrowApprovals[target]
+	if approvals == nil {
+		approvals = make(map[string]time.Time)
+		escrowApprovals[target] = approvals
+	}
+	for name, when := range approvals {
+		if now.Sub(when) > escrowWindow {
+			delete(approvals, name)
+		}
+	}
+	approvals[s.Name] = now
+
+	resp := EscrowExportData{Status: "ok"}
+	for name := range approvals {
+		resp.Approvals = append(resp.Approvals, name)
+	}
+	sort.Strings(resp.Approvals)
+
+	if len(resp.Approvals) < escrowQuorum {
+		return json.Marshal(resp)
+	}
+
+	if resp.Escrow, err = exportEscrow(s); err != nil {
+		return jsonStatusError(err)
+	}
+	delete(escrowApprovals, target)
+	resp.Exported = true
+
+	if err = logAdmin(s.Name, "escrow-export", target); err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "escrow-export", Name: s.Name, Reason: s.Reason})
+
+	return json.Marshal(resp)
+}
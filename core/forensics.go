@@ -0,0 +1,189 @@
+// forensics.go: exports of the state of the server for incident response
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ForensicsRequest struct {
+	Name     string
+	Password string
+
+	Case   string // incident or case the export is collected for
+	Reason string
+}
+
+// ForensicsManifest describes the files of a forensics export and how
+// they were collected. Like a snapshot, it is the first file of the
+// export, followed by its signature by the server identity key.
+type ForensicsManifest struct {
+	Case        string
+	Reason      string `json:",omitempty"`
+	CollectedBy string
+	CollectedAt time.Time
+	Host        string
+
+	VaultId      int
+	AdminLogSize int
+	AdminLogRoot []byte
+	Files        []SnapshotFile
+}
+
+// ForensicsData is a piece of encrypted data seen in the decryptions
+// kept for the audit reports, identified by its fingerprint.
+type ForensicsData struct {
+	Fingerprint string
+	Labels      []string `json:",omitempty"`
+	Decryptions int
+	First       time.Time
+	Last        time.Time
+}
+
+// forensicsData sorts by the time the data was first decrypted.
+type forensicsData []ForensicsData
+
+func (s forensicsData) Len() int           { return len(s) }
+func (s forensicsData) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s forensicsData) Less(i, j int) bool { return s[i].First.Before(s[j].First) }
+
+// dataSeen returns the encrypted data decrypted at or after since in
+// the history, in the order it was first decrypted.
+func dataSeen(since time.Time) []ForensicsData {
+	seen := make(map[string]*ForensicsData)
+	for _, e := range history {
+		if e.Type != "decrypt" || e.Fingerprint == "" || e.Time.Before(since) {
+			continue
+		}
+		d, ok := seen[e.Fingerprint]
+		if !ok {
+			d = &ForensicsData{Fingerprint: e.Fingerprint, Labels: e.Labels, First: e.Time}
+			seen[e.Fingerprint] = d
+		}
+		d.Decryptions++
+		d.Last = e.Time
+	}
+
+	data := []ForensicsData{}
+	for _, d := range seen {
+		data = append(data, *d)
+	}
+	sort.Sort(forensicsData(data))
+	return data
+}
+
+// forensicsFiles returns the files of a forensics export: the admin
+// log, the history of delegations and decryptions, the current
+// delegations, the encrypted data seen, the users, the label policies
+// and the vetoes. No key material is included.
+func forensicsFiles() (names []string, files map[string][]byte, err error) {
+	files = make(map[string][]byte)
+
+	_, snapshot, err := snapshotFiles()
+	if err != nil {
+		return
+	}
+	files["adminlog"] = snapshot["adminlog"]
+	files["label-policies.json"] = snapshot["label-policies.json"]
+
+	var lines bytes.Buffer
+	for _, e := range history {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+	files["history"] = lines.Bytes()
+
+	if files["data.json"], err = json.Marshal(dataSeen(time.Time{})); err != nil {
+		return
+	}
+
+	if files["delegations.json"], err = json.Marshal(cache.GetSummary()); err != nil {
+		return
+	}
+	if files["users.json"], err = json.Marshal(records.GetSummary()); err != nil {
+		return
+	}
+	if files["vetoes.json"], err = json.Marshal(records.Vetoes); err != nil {
+		return
+	}
+	if files["approvals.json"], err = json.Marshal(records.Approvals); err != nil {
+		return
+	}
+
+	return []string{"adminlog", "history", "delegations.json", "data.json", "users.json", "label-policies.json", "vetoes.json", "approvals.json"}, files, nil
+}
+
+// Forensics processes a request by an admin for an export of the state
+// of the server for incident responders, as a tarball with a signed
+// manifest recording who collected it, when, and for which case.
+func Forensics(jsonIn []byte) ([]byte, error) {
+	var s ForensicsRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.forensics failed: user=%s case=%q %v", s.Name, s.Case, err)
+		} else {
+			log.Printf("core.forensics success: user=%s case=%q", s.Name, s.Case)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("forensics", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if strings.TrimSpace(s.Case) == "" {
+		err = errors.New("Forensics export requires a case")
+		return jsonStatusError(err)
+	}
+
+	// the export is logged first, so that the admin log it includes
+	// records its own collection
+	if err = logAdmin(s.Name, "forensics", s.Case); err != nil {
+		return jsonStatusError(err)
+	}
+
+	names, files, err := forensicsFiles()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	manifest := ForensicsManifest{
+		Case:         s.Case,
+		Reason:       s.Reason,
+		CollectedBy:  s.Name,
+		CollectedAt:  time.Now().UTC(),
+		AdminLogSize: adminLog.Size(),
+		AdminLogRoot: adminLog.Root(),
+		Files:        hashFiles(names, files),
+	}
+	if manifest.Host, err = os.Hostname(); err != nil {
+		return jsonStatusError(err)
+	}
+	if manifest.VaultId, err = records.GetVaultID(); err != nil {
+		return jsonStatusError(err)
+	}
+
+	out, err := signedTarball(manifest, manifest.CollectedAt, names, files)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	return jsonResponse(out)
+}
@@ -0,0 +1,77 @@
+// hsm.go: users whose private keys are held in their own hardware
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// WrappedKeyRequest asks for the key of a piece of encrypted data
+// wrapped for the requesting user, for the client of an HSM record to
+// unwrap and delegate (see DelegateRequest.Unwrapped).
+type WrappedKeyRequest struct {
+	Name     string
+	Password string
+
+	Data []byte
+}
+
+type WrappedKeyData struct {
+	Status  string
+	Wrapped []byte `json:",omitempty"` // RSA-OAEP with SHA-1
+}
+
+// addHSMRecord adds the record of an HSM user given the PKIX encoding of
+// their RSA public key.
+func addHSMRecord(name, password string, der []byte) error {
+	if len(der) == 0 {
+		return errors.New("HSM records need a public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("HSM keys must be RSA keys")
+	}
+	_, err = records.AddHSMRecord(name, password, pub)
+	return err
+}
+
+// WrappedKey processes a request for the key of a piece of encrypted
+// data wrapped for the user. The data is only unpacked: nothing is
+// decrypted and no delegation is used.
+func WrappedKey(jsonIn []byte) ([]byte, error) {
+	var s WrappedKeyRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.wrapped-key failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.wrapped-key success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("wrapped-key", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	wrapped, err := crypt.GetWrappedKey(s.Data, s.Name)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return json.Marshal(WrappedKeyData{Status: "ok", Wrapped: wrapped})
+}
@@ -0,0 +1,238 @@
+// import.go: users created from SSH keys they already have
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/redoctober/passvault"
+	"github.com/cloudflare/redoctober/sshkey"
+)
+
+type ImportRequest struct {
+	Name     string
+	Password string
+
+	Keys     string // authorized_keys file, user names taken from the key comments
+	UserType string
+}
+
+type ImportData struct {
+	Status   string
+	Imported []string
+	Skipped  []string `json:",omitempty"` // keys without a name, or whose user exists
+}
+
+// claimTTL is the time a user has to sign their claim challenge.
+const claimTTL = 5 * time.Minute
+
+// claimNonces holds the nonce of the latest claim challenge of each
+// imported user, by name. A nonce is used at most once.
+var claimNonces map[string]claimNonce
+
+type claimNonce struct {
+	Nonce  string
+	Expiry time.Time
+}
+
+type ClaimChallengeRequest struct {
+	Name string
+}
+
+type ClaimChallengeData struct {
+	Status    string
+	Challenge []byte // LoginChallenge, to sign with the imported key
+	Expiry    time.Time
+}
+
+type ClaimRequest struct {
+	Name      string
+	Password  string // of the account, chosen by the user
+	Signature []byte // SSH signature of the challenge, as made by ssh-agent
+}
+
+// LoginChallenge returns the data a user signs with their imported SSH
+// key to claim it. fingerprint is the fingerprint of the server
+// identity, from /id, and nonce is the one given by ClaimChallenge.
+func LoginChallenge(fingerprint, name, nonce string) []byte {
+	return []byte("redoctober-login:" + fingerprint + ":" + name + ":" + nonce)
+}
+
+// identityFingerprint returns the fingerprint of the server identity.
+func identityFingerprint() (string, error) {
+	pub, err := records.GetIdentityPub()
+	if err != nil {
+		return "", err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(pubBytes), nil
+}
+
+// Import processes a request to import the SSH keys of users, for
+// them to claim with Claim.
+func Import(jsonIn []byte) ([]byte, error) {
+	var s ImportRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.import failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.import success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("import", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.UserType == "" {
+		s.UserType = passvault.DefaultRecordType
+	}
+
+	keys, err := sshkey.ParseAuthorizedKeys([]byte(s.Keys))
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	resp := ImportData{Status: "ok"}
+	for _, key := range keys {
+		name := key.Name()
+		if _, ok := records.GetRecord(name); ok || name == "" {
+			resp.Skipped = append(resp.Skipped, key.Comment)
+			continue
+		}
+		if _, ok := records.GetImported(name); ok {
+			resp.Skipped = append(resp.Skipped, key.Comment)
+			continue
+		}
+
+		imported := passvault.ImportedKey{Key: key.Blob, Type: s.UserType, By: s.Name, Imported: time.Now()}
+		if err = records.SetImported(name, imported); err != nil {
+			return jsonStatusError(err)
+		}
+		resp.Imported = append(resp.Imported, name)
+	}
+
+	if err = logAdmin(s.Name, "import", strings.Join(resp.Imported, ",")); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return json.Marshal(resp)
+}
+
+// ClaimChallenge processes a request for the challenge an imported user
+// signs to claim their key. The challenge holds a nonce, replacing any
+// earlier one, which Claim accepts once within claimTTL.
+func ClaimChallenge(jsonIn []byte) ([]byte, error) {
+	var s ClaimChallengeRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.claim-challenge failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.claim-challenge success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if _, ok := records.GetImported(s.Name); !ok {
+		err = errors.New("No key imported for that user")
+		return jsonStatusError(err)
+	}
+
+	fingerprint, err := identityFingerprint()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	nonce, err := passvault.NewID()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if claimNonces == nil {
+		claimNonces = make(map[string]claimNonce)
+	}
+	c := claimNonce{Nonce: nonce, Expiry: time.Now().Add(claimTTL)}
+	claimNonces[s.Name] = c
+
+	return json.Marshal(ClaimChallengeData{Status: "ok", Challenge: LoginChallenge(fingerprint, s.Name, nonce), Expiry: c.Expiry})
+}
+
+// Claim processes a request from a user to create their record from
+// their imported SSH key, with a password of their choice, proving
+// possession of the key with a signature of the challenge given by
+// ClaimChallenge. The challenge can only be used once, so a signature
+// seen by someone else is of no use to them.
+func Claim(jsonIn []byte) ([]byte, error) {
+	var s ClaimRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.claim failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.claim success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	key, ok := records.GetImported(s.Name)
+	if !ok {
+		err = errors.New("No key imported for that user")
+		return jsonStatusError(err)
+	}
+
+	if err = validateName(s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkBreached(s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	// the nonce is used up by any attempt
+	c, ok := claimNonces[s.Name]
+	delete(claimNonces, s.Name)
+	if !ok || !time.Now().Before(c.Expiry) {
+		err = errors.New("No claim challenge, or it expired")
+		return jsonStatusError(err)
+	}
+
+	fingerprint, err := identityFingerprint()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = sshkey.Verify(key.Key, LoginChallenge(fingerprint, s.Name, c.Nonce), s.Signature); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if _, err = records.ClaimImported(s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logAdmin(s.Name, "claim", s.Name); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonStatusOk()
+}
@@ -0,0 +1,94 @@
+// oncall.go: owners resolved from the schedules of a paging system
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/oncall"
+)
+
+// oncallPrefix followed by a schedule may be given instead of a user
+// name in the owners of encrypted data, for the users on call for the
+// schedule when the data is encrypted.
+const oncallPrefix = "oncall:"
+
+// oncallResolver resolves on-call owners (see SetOnCall).
+var oncallResolver oncall.Resolver
+
+// SetOnCall sets the paging system that resolves the owners given as
+// "oncall:<schedule>" to the users on call. Nil refuses such owners.
+func SetOnCall(r oncall.Resolver) {
+	oncallResolver = r
+}
+
+// resolveOwners replaces the on-call owners in owners with the users
+// of the vault on call for their schedule, matched by name or by their
+// "email" attribute.
+func resolveOwners(owners []string) ([]string, error) {
+	resolve := false
+	for _, owner := range owners {
+		resolve = resolve || strings.HasPrefix(owner, oncallPrefix)
+	}
+	if !resolve {
+		return owners, nil
+	}
+	if oncallResolver == nil {
+		return nil, errors.New("On-call owners need an on-call system")
+	}
+
+	var resolved []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			resolved = append(resolved, name)
+		}
+	}
+
+	for _, owner := range owners {
+		if !strings.HasPrefix(owner, oncallPrefix) {
+			add(owner)
+			continue
+		}
+
+		schedule := strings.TrimPrefix(owner, oncallPrefix)
+		people, err := oncallResolver.OnCall(schedule)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, name := range records.Names() {
+			pr, _ := records.GetRecord(name)
+			for _, person := range people {
+				if person != "" && (strings.EqualFold(person, name) || strings.EqualFold(person, pr.Attributes["email"])) {
+					add(name)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No user of the vault is on call for %s", schedule)
+		}
+	}
+	return resolved, nil
+}
+
+// resolveAccess resolves the on-call owners of an access structure.
+func resolveAccess(access *cryptor.AccessStructure) (err error) {
+	if access.Names, err = resolveOwners(access.Names); err != nil {
+		return
+	}
+	if access.LeftNames, err = resolveOwners(access.LeftNames); err != nil {
+		return
+	}
+	access.RightNames, err = resolveOwners(access.RightNames)
+	return
+}
@@ -0,0 +1,347 @@
+// order.go: decryption orders waiting for the owners to delegate
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/notify"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// How long an order stays open if the request does not say, and at
+// most.
+const (
+	defaultOrder = time.Hour
+	maxOrder     = 24 * time.Hour
+)
+
+var (
+	// orders holds the open decryption orders, by ID. Like shares
+	// they are kept in memory, and must be placed again after a
+	// restart.
+	orders map[string]*Order
+
+	notifiers []notify.Notifier
+)
+
+// Order is a decryption of a piece of encrypted data that a user is
+// waiting to make until enough of its owners have delegated.
+type Order struct {
+	ID          string
+	Name        string // the user who placed the order
+	Fingerprint string
+	Owners      []string
+	Labels      []string `json:",omitempty"`
+	Reason      string   `json:",omitempty"`
+	Created     time.Time
+	Expiry      time.Time
+
+	// Delegated lists the owners whose delegations the decryption can
+	// use, and Ready is set once they are enough. Both are as of the
+	// time the order is returned.
+	Delegated []string `json:",omitempty"`
+	Ready     bool
+
+	data []byte
+}
+
+type OrderRequest struct {
+	Name     string
+	Password string
+
+	Data   []byte
+	Reason string
+	Time   string // how long the order stays open, 1h if not set
+}
+
+type OrderData struct {
+	Status string
+	Order  Order
+}
+
+type OrdersRequest struct {
+	Name     string
+	Password string
+}
+
+type OrdersData struct {
+	Status string
+	Orders []Order
+}
+
+// OrderOutRequest fulfills an order by decrypting its data, or cancels
+// it.
+type OrderOutRequest struct {
+	Name     string
+	Password string
+
+	ID     string
+	Cancel bool
+	Device string // set by the server from the client certificate
+}
+
+// SetNotifiers sets the notifiers telling owners about the orders
+// waiting for their delegations. None disables notifications.
+func SetNotifiers(ns ...notify.Notifier) {
+	notifiers = ns
+}
+
+// pruneOrders forgets the orders that have expired.
+func pruneOrders(now time.Time) {
+	for id, o := range orders {
+		if !now.Before(o.Expiry) {
+			delete(orders, id)
+		}
+	}
+}
+
+// orderStatus returns a copy of an order with its delegations as of
+// now.
+func orderStatus(o *Order) Order {
+	status := *o
+	status.Delegated, status.Ready = nil, false
+
+	denial, err := crypt.Explain(o.data, o.Name)
+	if err == nil && denial == nil {
+		status.Ready = true
+		status.Delegated = o.Owners
+	} else if denial != nil {
+		status.Delegated = denial.Delegated
+	}
+	return status
+}
+
+// listOrders returns the open orders for which match returns true,
+// oldest first.
+func listOrders(match func(o *Order) bool) []Order {
+	pruneOrders(time.Now())
+
+	list := []Order{}
+	for _, o := range orders {
+		if match(o) {
+			list = append(list, orderStatus(o))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// summaryOrders returns the open orders for the summary, by ID.
+func summaryOrders() map[string]Order {
+	list := listOrders(func(*Order) bool { return true })
+	if len(list) == 0 {
+		return nil
+	}
+	byID := make(map[string]Order, len(list))
+	for _, o := range list {
+		byID[o.ID] = o
+	}
+	return byID
+}
+
+// PlaceOrder processes a request to order the decryption of a piece of
+// encrypted data, telling the owners of the data through the notifiers
+// that their delegations are needed. The order is fulfilled with
+// OrderOut once enough of them have delegated.
+func PlaceOrder(jsonIn []byte) ([]byte, error) {
+	var s OrderRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.order failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.order success: user=%s reason=%q", s.Name, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("order", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	duration := defaultOrder
+	if s.Time != "" {
+		if duration, err = time.ParseDuration(s.Time); err != nil {
+			return jsonStatusError(err)
+		}
+		if duration <= 0 || duration > maxOrder {
+			err = errors.New("Order time must be positive and at most 24h")
+			return jsonStatusError(err)
+		}
+	}
+
+	owners, _, err := crypt.GetOwners(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	labels, err := crypt.GetLabels(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	fingerprint, err := crypt.GetFingerprint(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkVetoes(s.Data); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkDataReason(s.Data, s.Name, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	id, err := passvault.NewID()
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	now := time.Now()
+	o := &Order{
+		ID:          id,
+		Name:        s.Name,
+		Fingerprint: fingerprint,
+		Owners:      owners,
+		Labels:      labels,
+		Reason:      s.Reason,
+		Created:     now,
+		Expiry:      now.Add(duration),
+		data:        s.Data,
+	}
+	pruneOrders(now)
+	if orders == nil {
+		orders = make(map[string]*Order)
+	}
+	orders[id] = o
+	publish(events.Event{Type: "order", Name: s.Name, Labels: labels, Reason: s.Reason, Fingerprint: o.Fingerprint})
+
+	status := orderStatus(o)
+	if !status.Ready {
+		notifyOwners(status)
+	}
+
+	return json.Marshal(OrderData{Status: "ok", Order: status})
+}
+
+// notifyOwners tells the owners of an order who have not delegated yet
+// that it is waiting for them.
+func notifyOwners(o Order) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	n := notify.Notification{Type: "order", ID: o.ID, Name: o.Name, Labels: o.Labels, Reason: o.Reason, Expiry: o.Expiry}
+	for _, owner := range o.Owners {
+		if owner == o.Name || containsString(o.Delegated, owner) {
+			continue
+		}
+		n.Owners = append(n.Owners, owner)
+		if pr, ok := records.GetRecord(owner); ok && pr.Attributes["contact"] != "" {
+			if n.Contacts == nil {
+				n.Contacts = make(map[string]string)
+			}
+			n.Contacts[owner] = pr.Attributes["contact"]
+		}
+	}
+	if len(n.Owners) > 0 {
+		notify.Send(notifiers, n)
+	}
+}
+
+// Orders lists the open orders placed by the user or waiting for their
+// delegations. Admins see every order.
+func Orders(jsonIn []byte) ([]byte, error) {
+	var s OrdersRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.orders failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.orders success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("orders", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	admin := false
+	if pr, ok := records.GetRecord(s.Name); ok {
+		admin = pr.IsAdmin()
+	}
+	list := listOrders(func(o *Order) bool {
+		return admin || o.Name == s.Name || containsString(o.Owners, s.Name)
+	})
+
+	return json.Marshal(OrdersData{Status: "ok", Orders: list})
+}
+
+// OrderOut processes a request to fulfill an order, decrypting its data
+// for the user who placed it as Decrypt does, or to cancel it, which
+// the user who placed it and admins can do. A fulfilled order is
+// closed.
+func OrderOut(jsonIn []byte) ([]byte, error) {
+	var s OrderOutRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.orderout failed: user=%s id=%s cancel=%v %v", s.Name, s.ID, s.Cancel, err)
+		} else {
+			log.Printf("core.orderout success: user=%s id=%s cancel=%v", s.Name, s.ID, s.Cancel)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("orderout", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	// orders of others are not found, so that their IDs are not given
+	// away; admins can cancel any order
+	pruneOrders(time.Now())
+	o, ok := orders[s.ID]
+	pr, _ := records.GetRecord(s.Name)
+	if !ok || (o.Name != s.Name && !(s.Cancel && pr.IsAdmin())) {
+		err = errors.New("Order not found")
+		return jsonStatusError(err)
+	}
+
+	if s.Cancel {
+		delete(orders, s.ID)
+		publish(events.Event{Type: "cancel-order", Name: s.Name, Labels: o.Labels, Fingerprint: o.Fingerprint})
+		return jsonStatusOk()
+	}
+
+	// Decrypt checks the permission to decrypt
+	in, err := json.Marshal(DecryptRequest{Name: s.Name, Password: s.Password, Data: o.data, Reason: o.Reason, Device: s.Device})
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	out, err := Decrypt(in)
+	if err != nil {
+		return out, err
+	}
+	var resp ResponseData
+	if json.Unmarshal(out, &resp) == nil && resp.Status == "ok" {
+		delete(orders, s.ID)
+	}
+	return out, nil
+}
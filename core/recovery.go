@@ -0,0 +1,126 @@
+// recovery.go: delegations recovered from snapshots sealed to a recovery key
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/redoctober/events"
+)
+
+// recoveryKey is the public key the delegations are sealed to by
+// SealDelegations (see SetRecoveryKey).
+var recoveryKey *ecdsa.PublicKey
+
+type RecoverRequest struct {
+	Name     string
+	Password string
+
+	Snapshot []byte // as written by SealDelegations
+	Key      []byte // recovery private key, in SEC 1 or PKCS #8 form
+}
+
+type RecoverData struct {
+	Status    string
+	Recovered []string
+}
+
+// SetRecoveryKey sets the public key SealDelegations seals the
+// delegations to. Nil disables the snapshots.
+func SetRecoveryKey(pub *ecdsa.PublicKey) {
+	recoveryKey = pub
+}
+
+// SealDelegations returns a snapshot of the live delegations, with
+// their private keys, encrypted to the recovery key. If the server is
+// lost, the holders of the recovery key can restore the delegations on
+// its replacement with Recover, rather than having every owner
+// delegate again. It returns nil if no recovery key is set.
+func SealDelegations() ([]byte, error) {
+	if recoveryKey == nil {
+		return nil, nil
+	}
+
+	sealed, err := cache.Seal(recoveryKey)
+	if err != nil {
+		log.Printf("core.seal-delegations failed: %v", err)
+	}
+	return sealed, err
+}
+
+// parseRecoveryKey parses an ECDSA private key in SEC 1 or PKCS #8 form.
+func parseRecoveryKey(der []byte) (*ecdsa.PrivateKey, error) {
+	if priv, err := x509.ParseECPrivateKey(der); err == nil {
+		return priv, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Recovery key is not an ECDSA key")
+	}
+	return priv, nil
+}
+
+// Recover processes a request by an admin to restore the delegations
+// of a snapshot written by SealDelegations. Delegations that have
+// expired are skipped, as are those of users not in the vault and
+// those already delegated again. Uses consumed since the snapshot was
+// taken are available again.
+func Recover(jsonIn []byte) ([]byte, error) {
+	var s RecoverRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.recover failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.recover success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("recover", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	priv, err := parseRecoveryKey(s.Key)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	added, err := cache.Recover(priv, s.Snapshot)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	resp := RecoverData{Status: "ok", Recovered: []string{}}
+	for _, d := range added {
+		if _, ok := records.GetRecord(d.Name); !ok {
+			cache.DeleteSlot(d.Name, d.Slot)
+			continue
+		}
+		resp.Recovered = append(resp.Recovered, d.String())
+	}
+	sort.Strings(resp.Recovered)
+
+	if err = logAdmin(s.Name, "recover", strings.Join(resp.Recovered, ",")); err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "recover", Name: s.Name})
+
+	return json.Marshal(resp)
+}
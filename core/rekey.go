@@ -0,0 +1,90 @@
+// rekey.go: moving the records of the vault to new KDF parameters
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// RekeyRequest starts, pauses or resumes the move of the records of the
+// vault to new KDF parameters, or asks how far it has got. Command is
+// "start", with the parameters N, R and P, "pause", "resume" or
+// "status", the default.
+type RekeyRequest struct {
+	Name     string
+	Password string
+
+	Command string
+	N, R, P int
+}
+
+type RekeyData struct {
+	Status   string
+	Progress passvault.RekeyProgress
+}
+
+// Rekey processes a request about the re-keying of the vault. Records
+// are re-keyed as their users authenticate, see rekeyRecord.
+func Rekey(jsonIn []byte) ([]byte, error) {
+	var s RekeyRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.rekey failed: user=%s command=%s %v", s.Name, s.Command, err)
+		} else {
+			log.Printf("core.rekey success: user=%s command=%s", s.Name, s.Command)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("rekey", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	switch s.Command {
+	case "", "status":
+	case "start":
+		err = records.StartRekey(passvault.KDFParams{N: s.N, R: s.R, P: s.P}, time.Now())
+	case "pause":
+		err = records.PauseRekey(true)
+	case "resume":
+		err = records.PauseRekey(false)
+	default:
+		err = fmt.Errorf("Unknown re-keying command '%s'", s.Command)
+	}
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Command != "" && s.Command != "status" {
+		if err = logAdmin(s.Name, "rekey-"+s.Command, ""); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	return json.Marshal(RekeyData{Status: "ok", Progress: records.GetRekeyProgress()})
+}
+
+// rekeyRecord re-keys the record of a user who has just authenticated
+// with password, if the vault is being re-keyed. A record that cannot
+// be re-keyed keeps its parameters until the user next authenticates,
+// so the request of the user goes on regardless.
+func rekeyRecord(name, password string) {
+	rekeyed, err := records.RekeyRecord(name, password)
+	if err != nil {
+		log.Printf("core.rekey failed: user=%s %v", name, err)
+	} else if rekeyed {
+		log.Printf("core.rekey success: user=%s", name)
+	}
+}
@@ -0,0 +1,344 @@
+// restore.go: vaults restored from snapshots uploaded in chunks
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// restoreIdle is the time after which a restore that received no chunk
+// is forgotten.
+const restoreIdle = 24 * time.Hour
+
+// maxRestoreChunks is the most chunks a restore can be split in, and
+// maxRestoreSize the most bytes of chunks kept for all the restores in
+// progress.
+const (
+	maxRestoreChunks = 1 << 12
+	maxRestoreSize   = 1 << 28
+)
+
+// restores holds the restores in progress, by ID. Like shares they are
+// kept in memory, and must be started again after a restart.
+var restores map[string]*pendingRestore
+
+// restorePub is the key snapshots taken by another server must be
+// signed by (see SetRestoreKey).
+var restorePub *ecdsa.PublicKey
+
+// pendingRestore is a snapshot being uploaded by an admin, one chunk
+// at a time. Nothing of it is used until all the chunks are received,
+// the snapshot verifies and another admin approves it.
+type pendingRestore struct {
+	By      string
+	Updated time.Time
+
+	hashes [][]byte // SHA-256 hash of each chunk, as announced
+	chunks [][]byte
+	vault  *passvault.Records // once the snapshot verifies
+}
+
+// missing returns the indexes of the chunks not received yet.
+func (r *pendingRestore) missing() []int {
+	list := []int{}
+	for i, chunk := range r.chunks {
+		if chunk == nil {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// RestoreRequest is one step of the restore of a vault from a snapshot
+// (see Snapshot) split in chunks, so that a large vault can be sent
+// over an unreliable link: "begin" announces the hashes of the chunks,
+// "chunk" sends one of them, which can be sent again if the request
+// failed, "finish" verifies the snapshot, "approve", by another admin,
+// replaces the vault with it, and "abort" forgets it.
+type RestoreRequest struct {
+	Name     string
+	Password string
+
+	Command string // "begin", "chunk", "finish", "approve" or "abort"
+	ID      string // of the restore, for all commands but begin
+
+	Chunks []string // begin: hex SHA-256 hash of each chunk, in order
+	Index  int      // chunk: the index of the chunk in Chunks
+	Data   []byte   // chunk: the chunk
+}
+
+type RestoreData struct {
+	Status   string
+	ID       string
+	Missing  []int // indexes of the chunks not received yet
+	Verified bool  // set once the snapshot verifies, to be approved
+	Restored bool  // set once the vault was replaced
+}
+
+// SetRestoreKey sets the public key snapshots taken by another server,
+// such as the identity key of a lost server, must be signed by to be
+// restored. Snapshots signed by the identity key of this server are
+// always accepted; nil accepts no others.
+func SetRestoreKey(pub *ecdsa.PublicKey) {
+	restorePub = pub
+}
+
+// pruneRestores forgets the restores that received no chunk for a day.
+func pruneRestores(now time.Time) {
+	for id, r := range restores {
+		if now.Sub(r.Updated) > restoreIdle {
+			delete(restores, id)
+		}
+	}
+}
+
+// restoreBuffered returns the bytes of chunks kept for the restores in
+// progress.
+func restoreBuffered() int {
+	size := 0
+	for _, r := range restores {
+		for _, chunk := range r.chunks {
+			size += len(chunk)
+		}
+	}
+	return size
+}
+
+// readSnapshot returns the files of a snapshot after checking that the
+// manifest is signed by one of pubs and that the files match it. Files
+// not listed in the manifest are ignored.
+func readSnapshot(tarball []byte, pubs []*ecdsa.PublicKey) (files map[string][]byte, err error) {
+	raw := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(tarball))
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if raw[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return
+		}
+	}
+
+	hash := sha256.Sum256(raw["manifest.json"])
+	signed := false
+	for _, pub := range pubs {
+		signed = signed || ecdsa.VerifyASN1(pub, hash[:], raw["manifest.sig"])
+	}
+	if raw["manifest.json"] == nil || !signed {
+		err = errors.New("Wrong signature of the snapshot manifest")
+		return
+	}
+	var manifest SnapshotManifest
+	if err = json.Unmarshal(raw["manifest.json"], &manifest); err != nil {
+		return
+	}
+
+	files = make(map[string][]byte)
+	for _, f := range manifest.Files {
+		data, ok := raw[f.Name]
+		hash := sha256.Sum256(data)
+		if !ok || len(data) != f.Size || hex.EncodeToString(hash[:]) != f.SHA256 {
+			err = fmt.Errorf("File %s does not match the snapshot manifest", f.Name)
+			return
+		}
+		files[f.Name] = data
+	}
+	if files["vault.json"] == nil {
+		err = errors.New("Snapshot has no vault")
+	}
+	return
+}
+
+// restoreKeys returns the keys the manifest of a snapshot may be signed
+// by: the identity key of the server, and the restore key if set. The
+// keys are never taken from the request, as an admin could then sign a
+// snapshot of their own.
+func restoreKeys() ([]*ecdsa.PublicKey, error) {
+	pub, err := records.GetIdentityPub()
+	if err != nil {
+		return nil, err
+	}
+	pubs := []*ecdsa.PublicKey{pub}
+	if restorePub != nil {
+		pubs = append(pubs, restorePub)
+	}
+	return pubs, nil
+}
+
+// Restore processes a step of the restore of the vault from a snapshot
+// uploaded in chunks by an admin. Each chunk is checked against the
+// hash announced for it when it is received, and the snapshot is only
+// verified once all of them are received: its manifest must be signed
+// by the identity key of the server or the restore key, and the files
+// must match it. The vault is then replaced once an admin other than
+// the one who uploaded it approves. The delegations are flushed, while
+// the admin log of the server is kept and records the restore.
+func Restore(jsonIn []byte) ([]byte, error) {
+	var s RestoreRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.restore failed: user=%s command=%s id=%s %v", s.Name, s.Command, s.ID, err)
+		} else {
+			log.Printf("core.restore success: user=%s command=%s id=%s", s.Name, s.Command, s.ID)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("restore", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if standby {
+		err = errors.New("Server is a standby")
+		return jsonStatusError(err)
+	}
+
+	now := time.Now()
+	pruneRestores(now)
+	if restores == nil {
+		restores = make(map[string]*pendingRestore)
+	}
+
+	if s.Command == "begin" {
+		if len(s.Chunks) == 0 || len(s.Chunks) > maxRestoreChunks {
+			err = fmt.Errorf("A restore needs between 1 and %d chunks", maxRestoreChunks)
+			return jsonStatusError(err)
+		}
+		hashes := make([][]byte, len(s.Chunks))
+		for i, h := range s.Chunks {
+			if hashes[i], err = hex.DecodeString(h); err != nil || len(hashes[i]) != sha256.Size {
+				err = fmt.Errorf("Invalid chunk hash %q", h)
+				return jsonStatusError(err)
+			}
+		}
+
+		if s.ID, err = passvault.NewID(); err != nil {
+			return jsonStatusError(err)
+		}
+		r := &pendingRestore{By: s.Name, Updated: now, hashes: hashes, chunks: make([][]byte, len(s.Chunks))}
+		restores[s.ID] = r
+		return json.Marshal(RestoreData{Status: "ok", ID: s.ID, Missing: r.missing()})
+	}
+
+	r, ok := restores[s.ID]
+	if !ok {
+		err = errors.New("Restore not found")
+		return jsonStatusError(err)
+	}
+	if s.Command != "approve" && s.Command != "abort" && r.By != s.Name {
+		err = errors.New("Restore was started by another admin")
+		return jsonStatusError(err)
+	}
+
+	switch s.Command {
+	case "chunk":
+		if r.vault != nil {
+			err = errors.New("Restore is already verified")
+			return jsonStatusError(err)
+		}
+		if s.Index < 0 || s.Index >= len(r.chunks) {
+			err = fmt.Errorf("No chunk %d", s.Index)
+			return jsonStatusError(err)
+		}
+		hash := sha256.Sum256(s.Data)
+		if !bytes.Equal(hash[:], r.hashes[s.Index]) {
+			err = fmt.Errorf("Chunk %d does not match its hash", s.Index)
+			return jsonStatusError(err)
+		}
+		if restoreBuffered()-len(r.chunks[s.Index])+len(s.Data) > maxRestoreSize {
+			err = fmt.Errorf("Restores in progress are limited to %d bytes", maxRestoreSize)
+			return jsonStatusError(err)
+		}
+		r.chunks[s.Index] = append([]byte{}, s.Data...)
+		r.Updated = now
+		return json.Marshal(RestoreData{Status: "ok", ID: s.ID, Missing: r.missing()})
+
+	case "finish":
+		if missing := r.missing(); len(missing) > 0 {
+			err = fmt.Errorf("%d chunks not received", len(missing))
+			return jsonStatusError(err)
+		}
+
+		var pubs []*ecdsa.PublicKey
+		if pubs, err = restoreKeys(); err != nil {
+			return jsonStatusError(err)
+		}
+		var files map[string][]byte
+		if files, err = readSnapshot(bytes.Join(r.chunks, nil), pubs); err != nil {
+			return jsonStatusError(err)
+		}
+
+		other := new(passvault.Records)
+		if err = json.Unmarshal(files["vault.json"], other); err != nil {
+			return jsonStatusError(err)
+		}
+		r.vault = other
+		r.Updated = now
+		if err = logAdmin(s.Name, "stage-restore", s.ID); err != nil {
+			return jsonStatusError(err)
+		}
+		return json.Marshal(RestoreData{Status: "ok", ID: s.ID, Missing: []int{}, Verified: true})
+
+	case "approve":
+		if r.vault == nil {
+			err = errors.New("Restore is not verified")
+			return jsonStatusError(err)
+		}
+		if r.By == s.Name {
+			err = errors.New("Restores must be approved by another admin")
+			return jsonStatusError(err)
+		}
+		if err = records.Replace(*r.vault); err != nil {
+			return jsonStatusError(err)
+		}
+		delete(restores, s.ID)
+
+		// the delegations and sessions were of the vault replaced
+		cache.FlushCache()
+		resetSessions()
+
+		if err = logAdmin(s.Name, "restore", s.ID); err != nil {
+			return jsonStatusError(err)
+		}
+		publish(events.Event{Type: "restore", Name: s.Name})
+		return json.Marshal(RestoreData{Status: "ok", ID: s.ID, Missing: []int{}, Verified: true, Restored: true})
+
+	case "abort":
+		delete(restores, s.ID)
+		if r.By != s.Name {
+			if err = logAdmin(s.Name, "reject-restore", s.ID); err != nil {
+				return jsonStatusError(err)
+			}
+		}
+		return json.Marshal(RestoreData{Status: "ok", ID: s.ID})
+
+	default:
+		err = fmt.Errorf("Unknown restore command %q", s.Command)
+		return jsonStatusError(err)
+	}
+}
@@ -0,0 +1,171 @@
+// selftest.go: self-tests of the full cryptographic path
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/keycache"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// selfTestCanary is the data encrypted and decrypted by the self-test.
+var selfTestCanary = []byte("Red October self-test canary")
+
+type SelfTestRequest struct {
+	Name     string
+	Password string
+}
+
+// SelfTestStage is the result of one stage of a self-test.
+type SelfTestStage struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+type SelfTestData struct {
+	Status string
+	Time   time.Time
+	Passed bool
+	Stages []SelfTestStage
+}
+
+// selfTest runs the stages of a self-test in order on records and a key
+// cache of its own, stopping at the first that fails. The vault and the
+// delegations of the server are not used.
+func selfTest() SelfTestData {
+	resp := SelfTestData{Status: "ok", Time: time.Now(), Passed: true}
+
+	var (
+		vault       passvault.Records
+		keys        = keycache.NewCache()
+		c           = cryptor.New(&vault, &keys)
+		owners      = []string{"selftest-rsa", "selftest-ecc"}
+		labels      = []string{"selftest"}
+		password    = "selftest"
+		data, clear []byte
+	)
+
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"kdf", func() (err error) {
+			if vault, err = passvault.InitFrom("memory"); err != nil {
+				return
+			}
+			for i, recordType := range []string{passvault.RSARecord, passvault.ECCRecord} {
+				pr, err := vault.AddNewRecord(owners[i], password, false, recordType)
+				if err != nil {
+					return err
+				}
+				if err = pr.ValidatePassword(password); err != nil {
+					return err
+				}
+				if pr.ValidatePassword(password+"!") == nil {
+					return errors.New("Wrong password accepted")
+				}
+			}
+			return nil
+		}},
+		{"delegate", func() error {
+			for _, name := range owners {
+				pr, _ := vault.GetRecord(name)
+				if err := keys.AddKeyFromRecord(pr, name, password, nil, labels, 1, nil, "", "1m"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"encrypt", func() (err error) {
+			data, err = c.Encrypt(selfTestCanary, labels, cryptor.AccessStructure{Names: owners})
+			if err == nil && bytes.Contains(data, selfTestCanary) {
+				err = errors.New("Canary found in the encrypted data")
+			}
+			return
+		}},
+		{"decrypt", func() (err error) {
+			clear, _, _, err = c.Decrypt(data, "selftest")
+			if err == nil && !bytes.Equal(clear, selfTestCanary) {
+				err = errors.New("Canary decrypted to the wrong data")
+			}
+			return
+		}},
+		{"cache", func() error {
+			// each delegation had a single use
+			keys.Refresh()
+			if len(keys.UserKeys) != 0 {
+				return errors.New("Delegations not used up")
+			}
+			if _, _, _, err := c.Decrypt(data, "selftest"); err == nil {
+				return errors.New("Decrypted without delegations")
+			}
+			return nil
+		}},
+	}
+
+	for _, stage := range stages {
+		result := SelfTestStage{Name: stage.name, OK: true}
+		if err := stage.run(); err != nil {
+			result.OK, result.Error = false, err.Error()
+			resp.Passed = false
+		}
+		resp.Stages = append(resp.Stages, result)
+		if !resp.Passed {
+			break
+		}
+	}
+	keys.FlushCache()
+
+	return resp
+}
+
+// RunSelfTest encrypts and decrypts a canary with records and
+// delegations made for the purpose, checking the password hashing, key
+// wrapping, encrypted data format and key cache end to end. A failure
+// is logged and published as a "selftest-failed" event, so that a
+// regression, such as after an upgrade, is noticed.
+func RunSelfTest() SelfTestData {
+	resp := selfTest()
+
+	if !resp.Passed {
+		stage := resp.Stages[len(resp.Stages)-1]
+		log.Printf("core.selftest failed: stage=%s %s", stage.Name, stage.Error)
+		publish(events.Event{Type: "selftest-failed", Reason: stage.Name + ": " + stage.Error})
+	}
+	return resp
+}
+
+// SelfTest processes a request by an admin to run a self-test (see
+// RunSelfTest) and returns its result.
+func SelfTest(jsonIn []byte) ([]byte, error) {
+	var s SelfTestRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.selftest failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.selftest success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("selftest", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return json.Marshal(RunSelfTest())
+}
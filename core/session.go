@@ -0,0 +1,104 @@
+// session.go: password checks remembered for the session of a client
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// sessionTTL is the time a password check is remembered for a session.
+// Zero disables sessions.
+var sessionTTL time.Duration
+
+// sessionKey keys the verifiers of the sessions. It is drawn again by
+// Init, forgetting all sessions.
+var sessionKey []byte
+
+// sessions holds the verifier of the last password checked in each
+// session, by session token.
+var sessions = map[string]session{}
+
+type session struct {
+	name     string
+	verifier []byte
+	expires  time.Time
+}
+
+type sessionTokenKey struct{}
+
+// SetSessionTTL sets the time for which a correct password is
+// remembered for the session it was given in, so that requests of the
+// same session do not hash it again. Zero disables sessions.
+func SetSessionTTL(ttl time.Duration) {
+	sessionTTL = ttl
+	sessions = map[string]session{}
+}
+
+// WithSession returns a context for the requests of the session
+// identified by token. The token must be bound to the channel the
+// requests are received on, such as keying material exported from its
+// TLS connection, so that it cannot be replayed from another one.
+func WithSession(c context.Context, token []byte) context.Context {
+	return context.WithValue(c, sessionTokenKey{}, token)
+}
+
+// resetSessions forgets all sessions and draws a new session key.
+func resetSessions() {
+	sessions = map[string]session{}
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		sessionKey = nil
+	}
+}
+
+// sessionVerifier derives the verifier of the password of a user in
+// a session. It covers the stored hash of the password, so that it no
+// longer matches once the password is changed.
+func sessionVerifier(token []byte, name, password string, pr passvault.PasswordRecord) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	for _, field := range [][]byte{token, []byte(name), []byte(password), pr.PasswordSalt, pr.HashedPassword} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		mac.Write(length[:])
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+// checkPassword returns an error if the password of the user is
+// incorrect. A password already found correct in the session of the
+// request within the session TTL is not hashed again.
+func checkPassword(name, password string, pr passvault.PasswordRecord) error {
+	token, _ := ctx.Value(sessionTokenKey{}).([]byte)
+	if sessionTTL <= 0 || len(token) == 0 || sessionKey == nil {
+		return pr.ValidatePasswordContext(ctx, password)
+	}
+
+	now := time.Now()
+	verifier := sessionVerifier(token, name, password, pr)
+	if s, ok := sessions[string(token)]; ok && s.name == name && now.Before(s.expires) &&
+		hmac.Equal(s.verifier, verifier) {
+		return nil
+	}
+
+	if err := pr.ValidatePasswordContext(ctx, password); err != nil {
+		return err
+	}
+
+	for token, s := range sessions {
+		if !now.Before(s.expires) {
+			delete(sessions, token)
+		}
+	}
+	sessions[string(token)] = session{name: name, verifier: verifier, expires: now.Add(sessionTTL)}
+	return nil
+}
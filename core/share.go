@@ -0,0 +1,346 @@
+// share.go: encrypted data shared with other Red October servers
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// shares holds the shares waiting for the approval of an admin, by ID.
+// Like the decryption history they are kept in memory, and must be
+// requested again after a restart.
+var shares map[string]pendingShare
+
+// pendingShare is an outgoing share of encrypted data with another
+// server, or an incoming link from one.
+type pendingShare struct {
+	By     string
+	Time   time.Time
+	Reason string
+
+	// outgoing: the data and the identity key of the recipient
+	Data []byte
+	To   *ecdsa.PublicKey
+
+	// incoming: the link and how to encrypt it here
+	Link   *cryptor.Link
+	Labels []string
+	Access cryptor.AccessStructure
+}
+
+// SharedLink is a cryptor.Link signed by the identity key of the
+// server that shared it.
+type SharedLink struct {
+	Link      []byte // JSON encoded cryptor.Link
+	From      []byte // PKIX identity key of the sending server
+	Signature []byte // ASN.1 ECDSA signature of the SHA-256 hash of Link
+}
+
+type ShareRequest struct {
+	Name     string
+	Password string
+
+	Data   []byte
+	To     []byte // PKIX identity key of the receiving server, from its /id
+	Reason string
+}
+
+type ReceiveRequest struct {
+	Name     string
+	Password string
+
+	Link   []byte   // JSON encoded SharedLink
+	From   []byte   // PKIX identity key the link must be signed by
+	Labels []string // labels here, by default those of the link
+
+	Owners      []string
+	LeftOwners  []string
+	RightOwners []string
+	Predicate   string
+	Reason      string
+}
+
+type ShareData struct {
+	Status string
+	ID     string // of the share awaiting approval
+}
+
+type ApproveShareRequest struct {
+	Name     string
+	Password string
+
+	ID     string
+	Reject bool
+}
+
+// addShare keeps a share for an admin to approve and returns its ID.
+func addShare(share pendingShare) (string, error) {
+	id, err := passvault.NewID()
+	if err != nil {
+		return "", err
+	}
+	if shares == nil {
+		shares = make(map[string]pendingShare)
+	}
+	share.Time = time.Now()
+	shares[id] = share
+	return id, nil
+}
+
+// Share processes a request to share encrypted data with another Red
+// October server. Nothing is shared until an admin other than the user
+// approves it with ApproveShare.
+func Share(jsonIn []byte) ([]byte, error) {
+	var s ShareRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.share failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.share success: user=%s reason=%q", s.Name, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("share", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(s.To)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	to, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		err = errors.New("Recipient key is not an ECDSA key")
+		return jsonStatusError(err)
+	}
+
+	labels, err := crypt.GetLabels(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	fingerprint, err := crypt.GetFingerprint(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if _, err = checkRelease(s.Data, s.Name, s.Reason, false); err != nil {
+		return jsonStatusError(err)
+	}
+
+	id, err := addShare(pendingShare{By: s.Name, Reason: s.Reason, Data: s.Data, To: to})
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "share", Name: s.Name, Labels: labels, Reason: s.Reason, Fingerprint: fingerprint})
+
+	return json.Marshal(ShareData{Status: "ok", ID: id})
+}
+
+// Receive processes a request to encrypt the data of a link shared by
+// another Red October server for owners here. Nothing is encrypted
+// until an admin other than the user approves it with ApproveShare.
+func Receive(jsonIn []byte) ([]byte, error) {
+	var s ReceiveRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.receive failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.receive success: user=%s from=%s", s.Name, Fingerprint(s.From))
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("receive", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	var shared SharedLink
+	if err = json.Unmarshal(s.Link, &shared); err != nil {
+		return jsonStatusError(err)
+	}
+	if !bytes.Equal(shared.From, s.From) {
+		err = errors.New("Link is not from the expected server")
+		return jsonStatusError(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(shared.From)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	from, ok := pub.(*ecdsa.PublicKey)
+	hash := sha256.Sum256(shared.Link)
+	if !ok || !ecdsa.VerifyASN1(from, hash[:], shared.Signature) {
+		err = errors.New("Wrong signature of the link")
+		return jsonStatusError(err)
+	}
+
+	var link cryptor.Link
+	if err = json.Unmarshal(shared.Link, &link); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if s.Labels == nil {
+		s.Labels = link.Labels
+	}
+	if err = checkLabelsRequired(s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = checkAllowedLabels(s.Name, s.Labels); err != nil {
+		return jsonStatusError(err)
+	}
+	if classifier != nil {
+		var data []byte
+		if data, err = crypt.OpenLink(link); err != nil {
+			return jsonStatusError(err)
+		}
+		if err = checkClasses(data, s.Labels); err != nil {
+			return jsonStatusError(err)
+		}
+	}
+
+	access := cryptor.AccessStructure{
+		Names:      s.Owners,
+		LeftNames:  s.LeftOwners,
+		RightNames: s.RightOwners,
+		Predicate:  s.Predicate,
+	}
+	id, err := addShare(pendingShare{By: s.Name, Reason: s.Reason, Link: &link, Labels: s.Labels, Access: access})
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "receive", Name: s.Name, Labels: s.Labels, Reason: s.Reason})
+
+	return json.Marshal(ShareData{Status: "ok", ID: id})
+}
+
+// approveShare carries out an approved share. For an outgoing share it
+// returns the signed link for the receiving server, and for an
+// incoming one the encrypted data.
+func approveShare(share pendingShare) ([]byte, error) {
+	if share.Link != nil {
+		out, err := crypt.Receive(*share.Link, share.Labels, share.Access)
+		if err != nil {
+			return nil, err
+		}
+		owners, _, err := crypt.GetOwners(out)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkLabelPolicies(share.Labels, owners); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	// policies are checked again, as vetoes may have been placed,
+	// approvals withdrawn or windows closed since the request
+	if _, err := checkRelease(share.Data, share.By, share.Reason, false); err != nil {
+		return nil, err
+	}
+
+	view := cache.ForDevice("")
+	defer cache.Update(view)
+	defer changed()
+	c := cryptor.New(&records, view)
+	link, names, err := c.Share(share.Data, share.By, share.To)
+	if err != nil {
+		return nil, err
+	}
+	recordDecrypt(link.Labels, names)
+
+	shared := SharedLink{}
+	if shared.Link, err = json.Marshal(link); err != nil {
+		return nil, err
+	}
+	pub, err := records.GetIdentityPub()
+	if err != nil {
+		return nil, err
+	}
+	if shared.From, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		return nil, err
+	}
+	if shared.Signature, err = records.Sign(shared.Link); err != nil {
+		return nil, err
+	}
+	return json.Marshal(shared)
+}
+
+// ApproveShare processes a request by an admin to approve or reject a
+// share requested by another user. The response to an approval holds
+// the signed link of an outgoing share, to be passed to Receive on the
+// other server, or the encrypted data of an incoming one.
+func ApproveShare(jsonIn []byte) ([]byte, error) {
+	var s ApproveShareRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.approve-share failed: user=%s id=%s %v", s.Name, s.ID, err)
+		} else {
+			log.Printf("core.approve-share success: user=%s id=%s reject=%v", s.Name, s.ID, s.Reject)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("approve-share", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	share, ok := shares[s.ID]
+	if !ok {
+		err = errors.New("Share missing")
+		return jsonStatusError(err)
+	}
+
+	if s.Reject {
+		delete(shares, s.ID)
+		if err = logAdmin(s.Name, "reject-share", s.ID); err != nil {
+			return jsonStatusError(err)
+		}
+		publish(events.Event{Type: "reject-share", Name: s.Name})
+		return jsonStatusOk()
+	}
+
+	if s.Name == share.By {
+		err = errors.New("Shares must be approved by someone other than the requester")
+		return jsonStatusError(err)
+	}
+
+	out, err := approveShare(share)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	delete(shares, s.ID)
+
+	if err = logAdmin(s.Name, "approve-share", s.ID); err != nil {
+		return jsonStatusError(err)
+	}
+	publish(events.Event{Type: "approve-share", Name: s.Name})
+
+	return jsonResponse(out)
+}
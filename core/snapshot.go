@@ -0,0 +1,171 @@
+// snapshot.go: point-in-time backups of the state of the server
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type SnapshotRequest struct {
+	Name     string
+	Password string
+}
+
+// SnapshotManifest describes the files of a snapshot. It is the first
+// file of the snapshot, followed by its signature by the server identity
+// key and the files it lists.
+type SnapshotManifest struct {
+	Time         time.Time
+	VaultId      int
+	AdminLogSize int
+	AdminLogRoot []byte
+	Files        []SnapshotFile
+}
+
+// SnapshotFile is a file of a snapshot and its hex encoded SHA-256 hash.
+type SnapshotFile struct {
+	Name   string
+	Size   int
+	SHA256 string
+}
+
+// snapshotFiles returns the files of a snapshot of the current state:
+// the vault, its label policies, and the admin log.
+func snapshotFiles() (names []string, files map[string][]byte, err error) {
+	files = make(map[string][]byte)
+
+	if files["vault.json"], err = records.Export(); err != nil {
+		return
+	}
+	if files["label-policies.json"], err = json.Marshal(records.Policies); err != nil {
+		return
+	}
+
+	var entries bytes.Buffer
+	for i := 0; i < adminLog.Size(); i++ {
+		entry, err := adminLog.Entry(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries.Write(entry)
+		entries.WriteByte('\n')
+	}
+	files["adminlog"] = entries.Bytes()
+
+	return []string{"vault.json", "label-policies.json", "adminlog"}, files, nil
+}
+
+// snapshot returns a tarball of the current state with its manifest.
+// Requests are processed one at a time, so nothing changes while it is
+// built, and the vault is taken from memory rather than from disk so
+// that changes left by write-behind are included.
+func snapshot(now time.Time) ([]byte, error) {
+	names, files, err := snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	vaultID, err := records.GetVaultID()
+	if err != nil {
+		return nil, err
+	}
+	manifest := SnapshotManifest{
+		Time:         now.UTC(),
+		VaultId:      vaultID,
+		AdminLogSize: adminLog.Size(),
+		AdminLogRoot: adminLog.Root(),
+		Files:        hashFiles(names, files),
+	}
+	return signedTarball(manifest, manifest.Time, names, files)
+}
+
+// hashFiles lists the named files with their hashes for a manifest.
+func hashFiles(names []string, files map[string][]byte) (list []SnapshotFile) {
+	for _, name := range names {
+		hash := sha256.Sum256(files[name])
+		list = append(list, SnapshotFile{Name: name, Size: len(files[name]), SHA256: hex.EncodeToString(hash[:])})
+	}
+	return
+}
+
+// signedTarball returns a tarball of manifest.json, its signature
+// manifest.sig by the server identity key, and the named files.
+func signedTarball(manifest interface{}, modTime time.Time, names []string, files map[string][]byte) ([]byte, error) {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := records.Sign(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	if err = add("manifest.json", manifestBytes); err != nil {
+		return nil, err
+	}
+	if err = add("manifest.sig", sig); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err = add(name, files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Snapshot processes a request for a consistent snapshot of the vault,
+// its label policies and the admin log, as a tarball.
+func Snapshot(jsonIn []byte) ([]byte, error) {
+	var s SnapshotRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.snapshot failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.snapshot success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("snapshot", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	out, err := snapshot(time.Now())
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = logAdmin(s.Name, "snapshot", ""); err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonResponse(out)
+}
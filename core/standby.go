@@ -0,0 +1,149 @@
+// standby.go: standby servers copying the vault of an active one
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// promoteWindow is the time within which the admins promoting a
+// standby must all approve.
+const promoteWindow = time.Hour
+
+var (
+	// standby is set while the server is a standby of another one.
+	standby bool
+
+	// promoteQuorum is the number of admins who must approve the
+	// promotion of the standby.
+	promoteQuorum int
+
+	// promoteApprovals holds the time each admin approved promotion.
+	promoteApprovals map[string]time.Time
+
+	// primaryUp is cleared while the active server cannot be reached.
+	primaryUp bool
+)
+
+type PromoteRequest struct {
+	Name     string
+	Password string
+}
+
+type PromoteData struct {
+	Status    string
+	Approvals []string // admins who approved the promotion so far
+	Promoted  bool     // set once the quorum is reached
+}
+
+// SetStandby makes the server a standby, whose vault is replaced by
+// SyncVault, until quorum admins promote it. Zero makes it active.
+func SetStandby(quorum int) {
+	standby = quorum > 0
+	promoteQuorum = quorum
+	promoteApprovals = make(map[string]time.Time)
+	primaryUp = true
+}
+
+// SetPrimaryUp records whether the active server could last be reached
+// by a standby. A standby is only promoted while it cannot.
+func SetPrimaryUp(up bool) {
+	primaryUp = up
+}
+
+// IsStandby returns true while the server is a standby.
+func IsStandby() bool {
+	return standby
+}
+
+// SyncVault replaces the vault of a standby with vault, as exported by
+// the active server.
+func SyncVault(vault []byte) (err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("core.sync failed: %v", err)
+		}
+	}()
+
+	if !standby {
+		return errors.New("Server is not a standby")
+	}
+
+	var other passvault.Records
+	if err = json.Unmarshal(vault, &other); err != nil {
+		return err
+	}
+	if err = records.Replace(other); err != nil {
+		return err
+	}
+	changed()
+	return nil
+}
+
+// Promote processes the approval of an admin to promote a standby to
+// be the active server, which is refused while the current one can be
+// reached. The standby is promoted once the quorum of admins approved
+// within an hour of each other.
+func Promote(jsonIn []byte) ([]byte, error) {
+	var s PromoteRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.promote failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.promote success: user=%s", s.Name)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("promote", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if !standby {
+		err = errors.New("Server is not a standby")
+		return jsonStatusError(err)
+	}
+	if primaryUp {
+		err = errors.New("Active server is up")
+		return jsonStatusError(err)
+	}
+
+	now := time.Now()
+	for name, when := range promoteApprovals {
+		if now.Sub(when) > promoteWindow {
+			delete(promoteApprovals, name)
+		}
+	}
+	promoteApprovals[s.Name] = now
+
+	var approvals []string
+	for name := range promoteApprovals {
+		approvals = append(approvals, name)
+	}
+	sort.Strings(approvals)
+
+	promoted := len(approvals) >= promoteQuorum
+	if promoted {
+		if err = logAdmin(s.Name, "promote", ""); err != nil {
+			return jsonStatusError(err)
+		}
+		SetStandby(0)
+		publish(events.Event{Type: "promote", Name: s.Name})
+	}
+
+	return json.Marshal(PromoteData{Status: "ok", Approvals: approvals, Promoted: promoted})
+}
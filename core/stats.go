@@ -0,0 +1,225 @@
+// stats.go: usage statistics reported in the summary, and the public
+// statistics with noise added
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	statsDay       = 24 * time.Hour
+	statsWeek      = 7 * 24 * time.Hour
+	inactiveAfter  = 90 * 24 * time.Hour
+	maxTopDelegate = 10
+
+	// decryptions are kept a day longer than reported in the summary,
+	// so that the public statistics cover 7 complete days
+	statsKeep = statsWeek + statsDay
+
+	// publicEpsilon is the privacy budget of each count of the public
+	// statistics: noise is drawn from a Laplace distribution of scale
+	// 1/publicEpsilon, a user changing a count by at most one.
+	publicEpsilon = 0.5
+)
+
+// UsageStats summarizes how the vault has been used recently.
+type UsageStats struct {
+	DecryptsDay  map[string]int  // Decryptions per label in the last 24 hours
+	DecryptsWeek map[string]int  // Decryptions per label in the last 7 days
+	TopDelegates []DelegateCount // Most used delegators in the last 7 days
+	Inactive     []string        // Users who have not delegated in 90 days
+}
+
+// DelegateCount is the number of decryptions a delegator took part in.
+type DelegateCount struct {
+	Name string
+	Uses int
+}
+
+// delegateCounts sorts by decreasing uses, then by name.
+type delegateCounts []DelegateCount
+
+func (s delegateCounts) Len() int      { return len(s) }
+func (s delegateCounts) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s delegateCounts) Less(i, j int) bool {
+	if s[i].Uses != s[j].Uses {
+		return s[i].Uses > s[j].Uses
+	}
+	return s[i].Name < s[j].Name
+}
+
+// decryptEvent is a successful decryption kept for the statistics.
+type decryptEvent struct {
+	when      time.Time
+	labels    []string
+	delegates []string
+}
+
+var decryptLog []decryptEvent
+
+// recordDecrypt adds a successful decryption to the statistics and
+// drops the decryptions that are too old to be reported. The count of
+// the day is also kept in the vault for the public statistics.
+func recordDecrypt(labels, delegates []string) {
+	now := time.Now()
+
+	i := 0
+	for i < len(decryptLog) && now.Sub(decryptLog[i].when) > statsKeep {
+		i++
+	}
+	decryptLog = append(decryptLog[i:], decryptEvent{now, labels, delegates})
+
+	day, since := now.UTC().Format("2006-01-02"), now.UTC().Add(-statsKeep).Format("2006-01-02")
+	if err := records.CountDecrypt(day, since); err != nil {
+		log.Printf("core.stats: decryption not counted: %v", err)
+	}
+}
+
+// usageStats computes the statistics as of now.
+func usageStats(now time.Time) UsageStats {
+	stats := UsageStats{
+		DecryptsDay:  make(map[string]int),
+		DecryptsWeek: make(map[string]int),
+		TopDelegates: []DelegateCount{},
+		Inactive:     []string{},
+	}
+
+	uses := make(map[string]int)
+	for _, event := range decryptLog {
+		age := now.Sub(event.when)
+		if age > statsWeek {
+			continue
+		}
+		for _, label := range event.labels {
+			stats.DecryptsWeek[label]++
+			if age <= statsDay {
+				stats.DecryptsDay[label]++
+			}
+		}
+		for _, name := range event.delegates {
+			uses[name]++
+		}
+	}
+
+	for name, count := range uses {
+		stats.TopDelegates = append(stats.TopDelegates, DelegateCount{name, count})
+	}
+	sort.Sort(delegateCounts(stats.TopDelegates))
+	if len(stats.TopDelegates) > maxTopDelegate {
+		stats.TopDelegates = stats.TopDelegates[:maxTopDelegate]
+	}
+
+	for _, name := range records.Names() {
+		// users who never delegated count from their creation
+		pr, _ := records.GetRecord(name)
+		since := pr.LastDelegation
+		if pr.Created.After(since) {
+			since = pr.Created
+		}
+		if now.Sub(since) > inactiveAfter {
+			stats.Inactive = append(stats.Inactive, name)
+		}
+	}
+	sort.Strings(stats.Inactive)
+
+	return stats
+}
+
+// StatsData holds the public statistics: coarse counts with noise
+// added, that tell how much the vault is used but not by whom.
+type StatsData struct {
+	Status      string
+	Days        []DayStats // the 7 days before today (UTC), oldest first
+	ActiveUsers int        // users who authenticated in those 7 days
+}
+
+// DayStats is the number of decryptions made on a day.
+type DayStats struct {
+	Day      string // as YYYY-MM-DD
+	Decrypts int
+}
+
+// laplace returns noise drawn from a Laplace distribution of the given
+// scale.
+func laplace(scale float64) float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	// uniform in (-0.5, 0.5)
+	u := (float64(binary.BigEndian.Uint64(b[:])>>11)+0.5)/(1<<53) - 0.5
+	return -scale * math.Copysign(1, u) * math.Log(1-2*math.Abs(u))
+}
+
+// noisy returns count with noise added, the same for the same key: the
+// counts already returned are kept in the vault with released, so that
+// asking again, even after a restart, returns the same ones instead of
+// new noise that could be averaged away. Only complete days are
+// reported, so counts never change once computed.
+func noisy(released map[string]int, key string, count int) int {
+	if v, ok := records.GetReleased(key); ok {
+		released[key] = v
+		return v
+	}
+	v := int(math.Round(float64(count) + laplace(1/publicEpsilon)))
+	if v < 0 {
+		v = 0
+	}
+	released[key] = v
+	return v
+}
+
+// publicStats computes the public statistics as of now, and keeps the
+// counts returned in the vault.
+func publicStats(now time.Time) (StatsData, error) {
+	today := now.UTC().Truncate(statsDay)
+	stats := StatsData{Status: "ok"}
+	released := make(map[string]int)
+
+	for i := 7; i >= 1; i-- {
+		day := today.Add(-time.Duration(i) * statsDay).Format("2006-01-02")
+		count := records.GetDecryptCount(day)
+		stats.Days = append(stats.Days, DayStats{day, noisy(released, "decrypts "+day, count)})
+	}
+
+	active := 0
+	for _, name := range records.Names() {
+		pr, _ := records.GetRecord(name)
+		if !pr.LastAuth.Before(today.Add(-statsWeek)) && pr.LastAuth.Before(today) {
+			active++
+		}
+	}
+	stats.ActiveUsers = noisy(released, "active "+today.Format("2006-01-02"), active)
+
+	for key, v := range released {
+		if old, ok := records.GetReleased(key); !ok || old != v {
+			return stats, records.SetReleased(released)
+		}
+	}
+	return stats, nil
+}
+
+// Stats returns the public statistics. It needs no credentials.
+func Stats(jsonIn []byte) ([]byte, error) {
+	if records.NumRecords() == 0 {
+		log.Printf("core.stats failed: vault is not created yet")
+		return jsonStatusError(errors.New("Vault is not created yet"))
+	}
+	stats, err := publicStats(time.Now())
+	if err != nil {
+		log.Printf("core.stats failed: %v", err)
+		return jsonStatusError(err)
+	}
+	log.Printf("core.stats success")
+	return json.Marshal(stats)
+}
@@ -0,0 +1,179 @@
+// stream.go: decryptions streamed to the client, or of a part of the data
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/cloudflare/redoctober/archive"
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/events"
+	"github.com/cloudflare/redoctober/keycache"
+)
+
+// PlaintextStream receives the plaintext of a request to DecryptStream,
+// to be written by the server once the request has been processed.
+type PlaintextStream struct {
+	stream *cryptor.Stream
+}
+
+type plaintextStreamKey struct{}
+
+// WithPlaintextStream returns a context in which DecryptStream opens
+// the plaintext it decrypts into p.
+func WithPlaintextStream(c context.Context, p *PlaintextStream) context.Context {
+	return context.WithValue(c, plaintextStreamKey{}, p)
+}
+
+// Opened returns true if DecryptStream opened the plaintext.
+func (p *PlaintextStream) Opened() bool {
+	return p.stream != nil
+}
+
+// Size returns the size of the plaintext.
+func (p *PlaintextStream) Size() int {
+	return p.stream.Size()
+}
+
+// WriteTo writes the plaintext to w a chunk at a time (see
+// cryptor.Stream).
+func (p *PlaintextStream) WriteTo(w io.Writer) (int64, error) {
+	return p.stream.WriteTo(w)
+}
+
+// DecryptStream processes a decrypt request whose plaintext is written
+// straight to the client by the server, instead of being returned in
+// the response, so that the whole plaintext is never held in memory at
+// once. The checks are those of Decrypt, but data requiring a
+// transform or a watermark cannot be streamed. The response has the
+// delegates and delegations used, without Data.
+//
+// The delegations are consumed before the plaintext is written, so a
+// client that goes away during the stream has still used them.
+func DecryptStream(jsonIn []byte) ([]byte, error) {
+	var s DecryptRequest
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.decrypt-stream failed: user=%s %v", s.Name, err)
+		} else {
+			log.Printf("core.decrypt-stream success: user=%s reason=%q", s.Name, s.Reason)
+		}
+	}()
+
+	if err = json.Unmarshal(jsonIn, &s); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = authorize("decrypt", s.Name, s.Password); err != nil {
+		return jsonStatusError(err)
+	}
+
+	p, _ := ctx.Value(plaintextStreamKey{}).(*PlaintextStream)
+	if p == nil {
+		err = errors.New("Decryptions cannot be streamed here")
+		return jsonStatusError(err)
+	}
+
+	if err = checkVetoes(s.Data); err != nil {
+		return jsonStatusError(err)
+	}
+
+	if err = checkDataReason(s.Data, s.Name, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	spec, err := dataTransform(s.Data, s.Transform)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	labels, err := crypt.GetLabels(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	fingerprint, err := crypt.GetFingerprint(s.Data)
+	if err != nil {
+		return jsonStatusError(err)
+	}
+	if spec != "" || watermarked(labels) {
+		err = errors.New("Data with a transform or watermark cannot be streamed")
+		return jsonStatusError(err)
+	}
+	if _, required := requiresDerive(labels); required || s.Derive != "" {
+		err = errors.New("Derived credentials cannot be streamed")
+		return jsonStatusError(err)
+	}
+
+	overridden, err := checkWindows(s.Data, s.Name, s.Reason, s.Override)
+	if err != nil {
+		closed, _ := closedWindows(s.Data)
+		return jsonDenied(err, explainDecrypt(s, closed))
+	}
+
+	if err = checkApprovals(s.Data, s.Name, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+	if err = logOverrides(s.Name, overridden, s.Reason); err != nil {
+		return jsonStatusError(err)
+	}
+
+	cache.Refresh()
+	checkpoint := cache.Checkpoint()
+	stream, names, secure, err := openFrom(s.Data, s.Name, s.Device)
+	if err != nil {
+		return jsonDenied(err, explainDecrypt(s, nil))
+	}
+
+	recordDecrypt(labels, names)
+	publish(events.Event{Type: "decrypt", Name: s.Name, Labels: labels, Delegates: names, Reason: s.Reason, Fingerprint: fingerprint})
+
+	out, err := json.Marshal(DecryptWithDelegates{
+		Secure:      secure,
+		Delegates:   names,
+		Delegations: usedDelegations(checkpoint),
+	})
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	p.stream = stream
+	return jsonResponse(out)
+}
+
+// openFrom is decryptFrom, returning a stream of the plaintext.
+func openFrom(in []byte, user, device string) (*cryptor.Stream, []string, bool, error) {
+	view := cache.ForDevice(device)
+	defer cache.Update(view)
+	defer changed()
+	c := cryptor.New(&records, view)
+	return c.Open(ctx, in, user)
+}
+
+// extractFrom is decryptFrom, returning only the file called name of an
+// encrypted directory. Only the blocks of the index of the directory and
+// of the file are decrypted. Delegations are not used up by data that is
+// not a directory holding the file.
+func extractFrom(in []byte, name, user, device string, checkpoint map[keycache.DelegateIndex]keycache.ActiveUser) ([]byte, []string, bool, error) {
+	stream, names, secure, err := openFrom(in, user, device)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	ar, err := archive.NewReader(stream, int64(stream.Size()))
+	var data []byte
+	if err == nil {
+		data, err = ar.ReadFile(name)
+	}
+	if err != nil {
+		cache.Restore(checkpoint)
+		return nil, nil, false, err
+	}
+	return data, names, secure, nil
+}
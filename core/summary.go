@@ -0,0 +1,93 @@
+// summary.go: the summary, kept until the state it reports changes
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// version counts the changes to the state reported in the summary.
+var version uint64
+
+// summaryCache holds the last summary built, and the same summary
+// signed once one is asked for.
+var summaryCache struct {
+	version uint64    // version of the state summarized
+	expires time.Time // time after which the summary changes by itself
+	summary []byte
+	signed  []byte
+}
+
+// changed marks the state reported in the summary as changed, so that
+// the summary is built again.
+func changed() {
+	version++
+}
+
+// summaryExpiry returns the first time after now at which the summary
+// changes without anything being done: when a delegation expires, a
+// decryption leaves the statistics of the last day or week, a user
+// becomes inactive, or an order expires.
+func summaryExpiry(now time.Time) time.Time {
+	var expires time.Time
+	next := func(t time.Time) {
+		if t.After(now) && (expires.IsZero() || t.Before(expires)) {
+			expires = t
+		}
+	}
+
+	for _, active := range cache.UserKeys {
+		next(active.Usage.Expiry)
+	}
+	for _, event := range decryptLog {
+		next(event.when.Add(statsDay))
+		next(event.when.Add(statsWeek))
+	}
+	for _, name := range records.Names() {
+		pr, _ := records.GetRecord(name)
+		next(pr.LastDelegation.Add(inactiveAfter))
+	}
+	for _, o := range orders {
+		next(o.Expiry)
+	}
+
+	if expires.IsZero() {
+		expires = now.Add(statsWeek)
+	}
+	return expires
+}
+
+// cachedSummary returns the summary, signed if asked, building it again
+// only if the state changed or time changed it since it was last built.
+func cachedSummary(signed bool) ([]byte, error) {
+	now := time.Now()
+	if summaryCache.summary == nil || summaryCache.version != version || !now.Before(summaryCache.expires) {
+		out, err := jsonSummary()
+		if err != nil {
+			return nil, err
+		}
+		summaryCache.version = version
+		summaryCache.expires = summaryExpiry(now)
+		summaryCache.summary = out
+		summaryCache.signed = nil
+	}
+
+	if !signed {
+		return summaryCache.summary, nil
+	}
+	if summaryCache.signed == nil {
+		sig, err := records.Sign(summaryCache.summary)
+		if err != nil {
+			return nil, err
+		}
+		out, err := json.Marshal(ResponseData{Status: "ok", Response: summaryCache.summary, Signature: sig})
+		if err != nil {
+			return nil, err
+		}
+		summaryCache.signed = out
+	}
+	return summaryCache.signed, nil
+}
@@ -0,0 +1,90 @@
+// version.go: signed attestation of the server build
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"runtime"
+	"sort"
+
+	"github.com/cloudflare/redoctober/chaos"
+)
+
+// The build of the server, set at link time with
+//
+//	go build -ldflags "-X github.com/cloudflare/redoctober/core.BuildVersion=<version> -X github.com/cloudflare/redoctober/core.BuildCommit=<commit> -X github.com/cloudflare/redoctober/core.BuildTime=<time>"
+var (
+	BuildVersion = "dev"
+	BuildCommit  = "unknown"
+	BuildTime    = "unknown"
+)
+
+// BuildInfo describes the code a server runs and the optional features
+// it has enabled.
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildTime string
+	GoVersion string
+	Features  []string
+}
+
+// features returns the optional features enabled, sorted by name.
+func features() []string {
+	var out []string
+	for name, on := range map[string]bool{
+		"admin-limits":     minAdmins > 0 || maxAdmins > 0,
+		"breach-check":     breachCheck != nil,
+		"ceremony":         ceremony.size > 1,
+		"chaos":            chaos.Enabled,
+		"classify":         classifier != nil,
+		"escrow-export":    escrowKey != nil,
+		"recovery-key":     recoveryKey != nil,
+		"require-labels":   requireLabels,
+		"require-policies": requireLabels && requirePolicies,
+		"sessions":         sessionTTL > 0,
+		"stage-changes":    stageChanges,
+		"stale-revocation": staleAfter > 0,
+		"standby":          standby,
+		"tickets":          ticketCheck != nil,
+	} {
+		if on {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Version returns the build of the server, signed by the server
+// identity key (see ID). The BuildInfo is JSON encoded in Response, so
+// that the signature can be checked over the exact bytes signed, and
+// clients and auditors can check what code protects their data. No
+// credentials are required.
+func Version(jsonIn []byte) ([]byte, error) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			log.Printf("core.version failed: %v", err)
+		} else {
+			log.Printf("core.version success")
+		}
+	}()
+
+	out, err := json.Marshal(BuildInfo{
+		Version:   BuildVersion,
+		Commit:    BuildCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Features:  features(),
+	})
+	if err != nil {
+		return jsonStatusError(err)
+	}
+
+	return jsonSignedResponse(out)
+}
@@ -0,0 +1,91 @@
+// convergent.go: encryption of identical data into identical envelopes
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+)
+
+// EncryptConvergent encrypts data as Encrypt does, but the IV, the data
+// key and the keys wrapping it are derived from the hash of the data,
+// its labels and access structure, and the HMAC key of the vault. The
+// same data encrypted the same way by the same vault gives the same
+// envelope, so that backups of it can be deduplicated.
+//
+// This gives away which envelopes hold the same data, and lets anyone
+// who can ask the server to encrypt data confirm a guess of what an
+// envelope holds. It is only meant for data that cannot be guessed.
+// Predicates and escrow, whose encryption is always random, are
+// refused. Envelopes stay the same for as long as the vault HMAC key
+// and the keys of the owners do.
+func (c *Cryptor) EncryptConvergent(in []byte, labels []string, access AccessStructure) ([]byte, error) {
+	if access.Predicate != "" || access.Escrow != "" {
+		return nil, errors.New("Convergent encryption does not support predicates or escrow")
+	}
+
+	hmacKey, err := c.records.GetHMACKey()
+	if err != nil {
+		return nil, err
+	}
+	accessBytes, err := json.Marshal(access)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]string{}, labels...)
+	sort.Strings(sorted)
+	labelBytes, err := json.Marshal(sorted)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(in)
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte("convergent encryption"))
+	mac.Write(hash[:])
+	mac.Write(labelBytes)
+	mac.Write(accessBytes)
+
+	random, err := newKeyStream(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return c.encrypt(in, labels, access, random)
+}
+
+// keyStream is a reader of the AES-CTR key stream of a seed, whose
+// bytes stand in for random ones in convergent encryption.
+type keyStream struct {
+	stream cipher.Stream
+}
+
+func newKeyStream(seed []byte) (*keyStream, error) {
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &keyStream{cipher.NewCTR(block, make([]byte, aes.BlockSize))}, nil
+}
+
+func (k *keyStream) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	k.stream.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// makeRandom returns length bytes read from random.
+func makeRandom(random io.Reader, length int) ([]byte, error) {
+	out := make([]byte, length)
+	_, err := io.ReadFull(random, out)
+	return out, err
+}
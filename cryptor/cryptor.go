@@ -6,26 +6,42 @@
 package cryptor
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cloudflare/redoctober/chaos"
 	"github.com/cloudflare/redoctober/keycache"
 	"github.com/cloudflare/redoctober/msp"
 	"github.com/cloudflare/redoctober/padding"
 	"github.com/cloudflare/redoctober/passvault"
-	"github.com/cloudflare/redoctober/symcrypt"
 )
 
 const (
 	DEFAULT_VERSION = 1
 )
 
+// decryptChunk is the amount of data decrypted between checks of the
+// context of a decryption.
+const decryptChunk = 1 << 20
+
+// errConstraints is returned when enough owners have delegated but
+// they break the quorum constraints of the data.
+var errConstraints = errors.New("Delegates do not satisfy the quorum constraints")
+
 type Cryptor struct {
 	records *passvault.Records
 	cache   *keycache.Cache
@@ -40,7 +56,8 @@ func New(records *passvault.Records, cache *keycache.Cache) Cryptor {
 // must be delegated to decrypt.  If len(LeftNames) > 0 & len(RightNames) > 0,
 // then at least one from each list must be delegated (if the same user is in
 // both, then he can decrypt it alone).  If a predicate is present, it must be
-// satisfied to decrypt.
+// satisfied to decrypt.  Any constraints further restrict which sets of
+// delegates may be used together.
 type AccessStructure struct {
 	Names []string
 
@@ -48,6 +65,79 @@ type AccessStructure struct {
 	RightNames []string
 
 	Predicate string
+
+	Constraints []Constraint
+
+	// MaxDelegationAge, if set, only allows delegations made within
+	// this duration of the decryption to be used.
+	MaxDelegationAge string
+
+	// Escrow, if set, is an armored OpenPGP key ring whose public keys
+	// the data key is also encrypted to.
+	Escrow string
+
+	// Approvers, if set, are users of whom ApprovalMinimum (1 if not
+	// set) must approve a decryption, on top of the owners delegating.
+	// They need not be owners, and their keys do not wrap the data.
+	Approvers       []string
+	ApprovalMinimum int
+}
+
+// Constraint restricts the composition of the set of delegates used to
+// decrypt.  If Include is set, at least one delegate must match it,
+// where "admin" matches admins and "key=value" matches records with that
+// attribute.  If Distinct is set, the delegates must have at least Count
+// different values of that attribute.
+type Constraint struct {
+	Include  string `json:",omitempty"`
+	Distinct string `json:",omitempty"`
+	Count    int    `json:",omitempty"`
+}
+
+// validate checks that a constraint is well formed.
+func (c Constraint) validate() error {
+	if (c.Include == "") == (c.Distinct == "") {
+		return errors.New("Constraint must set exactly one of Include or Distinct")
+	}
+	if c.Include != "" && c.Include != "admin" {
+		if parts := strings.SplitN(c.Include, "=", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid constraint selector '%s'", c.Include)
+		}
+	}
+	if c.Distinct != "" && c.Count < 1 {
+		return errors.New("Distinct constraint needs a positive count")
+	}
+	return nil
+}
+
+// satisfied returns true if the records of the named delegates, as
+// returned by lookup, meet the constraint.
+func (c Constraint) satisfied(lookup func(name string) (passvault.PasswordRecord, bool), names []string) bool {
+	values := make(map[string]bool)
+	for _, name := range names {
+		rec, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case c.Include == "admin":
+			if rec.IsAdmin() {
+				return true
+			}
+		case c.Include != "":
+			parts := strings.SplitN(c.Include, "=", 2)
+			if rec.HasAttribute(parts[0], parts[1]) {
+				return true
+			}
+		default:
+			if value, ok := rec.Attributes[c.Distinct]; ok {
+				values[value] = true
+			}
+		}
+	}
+
+	return c.Include == "" && len(values) >= c.Count
 }
 
 // Implements msp.UserDatabase
@@ -69,7 +159,7 @@ func (u UserDatabase) ValidUser(name string) bool {
 }
 
 func (u UserDatabase) CanGetShare(name string) bool {
-	_, _, ok1 := u.cache.MatchUser(name, u.user, u.labels)
+	ok1 := delegated(u.records, u.cache, name, u.user, u.labels)
 	_, ok2 := u.shareSet[name]
 	_, ok3 := u.keySet[name]
 
@@ -79,6 +169,17 @@ func (u UserDatabase) CanGetShare(name string) bool {
 func (u UserDatabase) GetShare(name string) ([][]byte, error) {
 	*u.names = append(*u.names, name)
 
+	if pr, absence, ok := substituted(u.records, u.cache, name, u.user, u.labels); ok {
+		return u.cache.DecryptSharesAbsent(
+			u.shareSet[name],
+			pr,
+			absence,
+			u.user,
+			u.labels,
+			u.keySet[name].Key,
+		)
+	}
+
 	return u.cache.DecryptShares(
 		u.shareSet[name],
 		name,
@@ -88,6 +189,53 @@ func (u UserDatabase) GetShare(name string) ([][]byte, error) {
 	)
 }
 
+// substituted returns the record and planned absence of name if their
+// key is not delegated but can be used through the delegation of the
+// substitute of an approved absence.
+func substituted(records *passvault.Records, cache *keycache.Cache, name, user string, labels []string) (passvault.PasswordRecord, *passvault.Absence, bool) {
+	if cache.Valid(name, user, labels) {
+		return passvault.PasswordRecord{}, nil, false
+	}
+
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return pr, nil, false
+	}
+	absence, ok := pr.ActiveAbsence(time.Now())
+	if !ok || !cache.Valid(absence.Substitute, user, labels) {
+		return pr, nil, false
+	}
+	return pr, absence, true
+}
+
+// distinctDelegates returns true if no delegation would stand in for
+// more than one of names, so that a substitute cannot make up a quorum
+// of an absent user and themselves.
+func distinctDelegates(records *passvault.Records, cache *keycache.Cache, names []string, user string, labels []string) bool {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		delegate := name
+		if _, absence, ok := substituted(records, cache, name, user, labels); ok {
+			delegate = absence.Substitute
+		}
+		if seen[delegate] {
+			return false
+		}
+		seen[delegate] = true
+	}
+	return true
+}
+
+// delegated returns true if the key of name can be used by user,
+// either through their own delegation or that of their substitute.
+func delegated(records *passvault.Records, cache *keycache.Cache, name, user string, labels []string) bool {
+	if cache.Valid(name, user, labels) {
+		return true
+	}
+	_, _, ok := substituted(records, cache, name, user, labels)
+	return ok
+}
+
 // MultiWrappedKey is a structure containing a 16-byte key encrypted
 // once for each of the keys corresponding to the names of the users
 // in Name in order.
@@ -106,16 +254,21 @@ type SingleWrappedKey struct {
 // EncryptedData is the format for encrypted data containing all the
 // keys necessary to decrypt it when delegated.
 type EncryptedData struct {
-	Version   int
-	VaultId   int                         `json:",omitempty"`
-	Labels    []string                    `json:",omitempty"`
-	Predicate string                      `json:",omitempty"`
-	KeySet    []MultiWrappedKey           `json:",omitempty"`
-	KeySetRSA map[string]SingleWrappedKey `json:",omitempty"`
-	ShareSet  map[string][][]byte         `json:",omitempty"`
-	IV        []byte                      `json:",omitempty"`
-	Data      []byte
-	Signature []byte
+	Version     int
+	VaultId     int                         `json:",omitempty"`
+	Labels      []string                    `json:",omitempty"`
+	Predicate   string                      `json:",omitempty"`
+	Constraints []Constraint                `json:",omitempty"`
+	MaxAge      string                      `json:",omitempty"`
+	KeySet      []MultiWrappedKey           `json:",omitempty"`
+	KeySetRSA   map[string]SingleWrappedKey `json:",omitempty"`
+	ShareSet    map[string][][]byte         `json:",omitempty"`
+	IV          []byte                      `json:",omitempty"`
+	Escrow      *Escrow                     `json:",omitempty"`
+	Approvers   []string                    `json:",omitempty"`
+	ApprovalMin int                         `json:",omitempty"`
+	Data        []byte
+	Signature   []byte
 }
 
 type pair struct {
@@ -194,9 +347,48 @@ func (encrypted *EncryptedData) computeHmac(key []byte) []byte {
 		mac.Write([]byte(encrypted.Labels[index]))
 	}
 
+	// hash the constraints
+	for _, constraint := range encrypted.Constraints {
+		mac.Write([]byte(constraint.Include))
+		mac.Write([]byte(constraint.Distinct))
+		mac.Write([]byte(strconv.Itoa(constraint.Count)))
+	}
+
+	// hash the delegation age limit
+	if encrypted.MaxAge != "" {
+		mac.Write([]byte(encrypted.MaxAge))
+	}
+
+	// hash the escrow recipients and key
+	if encrypted.Escrow != nil {
+		for _, recipient := range encrypted.Escrow.Recipients {
+			mac.Write([]byte(recipient))
+		}
+		mac.Write(encrypted.Escrow.Key)
+	}
+
+	// hash the approvers
+	if len(encrypted.Approvers) > 0 {
+		for _, name := range encrypted.Approvers {
+			mac.Write([]byte(name))
+		}
+		mac.Write([]byte(strconv.Itoa(encrypted.ApprovalMin)))
+	}
+
 	return mac.Sum(nil)
 }
 
+// constraintsMet returns true if the named delegates satisfy every
+// constraint of the encrypted data.
+func (encrypted *EncryptedData) constraintsMet(lookup func(name string) (passvault.PasswordRecord, bool), names []string) bool {
+	for _, constraint := range encrypted.Constraints {
+		if !constraint.satisfied(lookup, names) {
+			return false
+		}
+	}
+	return true
+}
+
 func (encrypted *EncryptedData) lock(key []byte) (err error) {
 	payload, err := json.Marshal(encrypted)
 	if err != nil {
@@ -233,8 +425,9 @@ func (encrypted *EncryptedData) unlock(key []byte) (err error) {
 	return json.Unmarshal(encrypted.Data, encrypted)
 }
 
-// wrapKey encrypts the clear key according to an access structure.
-func (encrypted *EncryptedData) wrapKey(records *passvault.Records, clearKey []byte, access AccessStructure) (err error) {
+// wrapKey encrypts the clear key according to an access structure, with
+// the keys of the owners drawn from random.
+func (encrypted *EncryptedData) wrapKey(records *passvault.Records, clearKey []byte, access AccessStructure, random io.Reader) (err error) {
 	generateRandomKey := func(name string) (singleWrappedKey SingleWrappedKey, err error) {
 		rec, ok := records.GetRecord(name)
 		if !ok {
@@ -242,11 +435,11 @@ func (encrypted *EncryptedData) wrapKey(records *passvault.Records, clearKey []b
 			return
 		}
 
-		if singleWrappedKey.aesKey, err = symcrypt.MakeRandom(16); err != nil {
+		if singleWrappedKey.aesKey, err = makeRandom(random, 16); err != nil {
 			return
 		}
 
-		if singleWrappedKey.Key, err = rec.EncryptKey(singleWrappedKey.aesKey); err != nil {
+		if singleWrappedKey.Key, err = rec.EncryptKeyFrom(random, singleWrappedKey.aesKey); err != nil {
 			return
 		}
 
@@ -382,84 +575,128 @@ func (encrypted *EncryptedData) wrapKey(records *passvault.Records, clearKey []b
 	return nil
 }
 
-// unwrapKey decrypts first key in keys whose encryption keys are in keycache
-func (encrypted *EncryptedData) unwrapKey(cache *keycache.Cache, user string) (unwrappedKey []byte, names []string, err error) {
-	var (
-		keyFound  error
-		fullMatch bool = false
-		nameSet        = map[string]bool{}
-	)
-
+// selectDelegates picks the delegates whose keys would be used to decrypt
+// the data, without decrypting anything or consuming any delegations. In
+// the combinatorial case it also returns the multi-wrapped key that they
+// open.
+func (encrypted *EncryptedData) selectDelegates(records *passvault.Records, cache *keycache.Cache, user string) (mwKey *MultiWrappedKey, names []string, err error) {
 	if len(encrypted.Predicate) == 0 {
-		for _, mwKey := range encrypted.KeySet {
-			// validate the size of the keys
-			if len(mwKey.Key) != 16 {
-				err = errors.New("Invalid Input")
-			}
+		constrained := false
 
-			if err != nil {
-				return nil, nil, err
+		for i := range encrypted.KeySet {
+			// validate the size of the keys
+			if len(encrypted.KeySet[i].Key) != 16 {
+				return nil, nil, errors.New("Invalid Input")
 			}
 
 			// loop through users to see if they are all delegated
-			fullMatch = true
-			for _, mwName := range mwKey.Name {
-				if valid := cache.Valid(mwName, user, encrypted.Labels); !valid {
+			fullMatch := true
+			for _, mwName := range encrypted.KeySet[i].Name {
+				if valid := delegated(records, cache, mwName, user, encrypted.Labels); !valid {
 					fullMatch = false
 					break
 				}
-				nameSet[mwName] = true
+			}
+			if !fullMatch || !distinctDelegates(records, cache, encrypted.KeySet[i].Name, user, encrypted.Labels) {
+				continue
 			}
 
-			// if the keys are delegated, decrypt the mwKey with them
-			if fullMatch == true {
-				tmpKeyValue := mwKey.Key
-				for _, mwName := range mwKey.Name {
-					pubEncrypted := encrypted.KeySetRSA[mwName]
-					if tmpKeyValue, keyFound = cache.DecryptKey(tmpKeyValue, mwName, user, encrypted.Labels, pubEncrypted.Key); keyFound != nil {
-						break
-					}
-				}
-				unwrappedKey = tmpKeyValue
-				break
+			// skip sets of delegates that break the constraints
+			if !encrypted.constraintsMet(records.GetRecord, encrypted.KeySet[i].Name) {
+				constrained = true
+				continue
 			}
-		}
 
-		if !fullMatch {
-			err = errors.New("Need more delegated keys")
-			names = nil
+			return &encrypted.KeySet[i], encrypted.KeySet[i].Name, nil
 		}
 
-		names = make([]string, 0, len(nameSet))
-		for name := range nameSet {
-			names = append(names, name)
+		if constrained {
+			return nil, nil, errConstraints
 		}
-		return
-	} else {
-		var sss msp.MSP
-		sss, err = msp.StringToMSP(encrypted.Predicate)
-		if err != nil {
-			return nil, nil, err
+		return nil, nil, errors.New("Need more delegated keys")
+	}
+
+	sss, err := msp.StringToMSP(encrypted.Predicate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db := msp.UserDatabase(UserDatabase{
+		records:  records,
+		cache:    cache,
+		user:     user,
+		labels:   encrypted.Labels,
+		keySet:   encrypted.KeySetRSA,
+		shareSet: encrypted.ShareSet,
+	})
+
+	ok, _, _, trace := sss.DerivePath(&db)
+	if !ok || !distinctDelegates(records, cache, trace, user, encrypted.Labels) {
+		return nil, nil, errors.New("Need more delegated keys")
+	}
+	if !encrypted.constraintsMet(records.GetRecord, trace) {
+		return nil, nil, errConstraints
+	}
+
+	return nil, trace, nil
+}
+
+// unwrapKey decrypts first key in keys whose encryption keys are in keycache
+// and whose owners satisfy the constraints of the encrypted data
+func (encrypted *EncryptedData) unwrapKey(records *passvault.Records, cache *keycache.Cache, user string) (unwrappedKey []byte, names []string, err error) {
+	mwKey, names, err := encrypted.selectDelegates(records, cache, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(encrypted.Predicate) == 0 {
+		// decrypt the mwKey with the keys of its delegates
+		unwrappedKey = mwKey.Key
+		for _, mwName := range mwKey.Name {
+			pubEncrypted := encrypted.KeySetRSA[mwName]
+			if pr, absence, ok := substituted(records, cache, mwName, user, encrypted.Labels); ok {
+				unwrappedKey, err = cache.DecryptKeyAbsent(unwrappedKey, pr, absence, user, encrypted.Labels, pubEncrypted.Key)
+			} else {
+				unwrappedKey, err = cache.DecryptKey(unwrappedKey, mwName, user, encrypted.Labels, pubEncrypted.Key)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 
-		db := msp.UserDatabase(UserDatabase{
-			names:    &names,
-			cache:    cache,
-			user:     user,
-			labels:   encrypted.Labels,
-			keySet:   encrypted.KeySetRSA,
-			shareSet: encrypted.ShareSet,
-		})
-		unwrappedKey, err = sss.RecoverSecret(&db)
+		return unwrappedKey, names, nil
+	}
 
-		return
+	sss, err := msp.StringToMSP(encrypted.Predicate)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	names = nil
+	db := msp.UserDatabase(UserDatabase{
+		names:    &names,
+		records:  records,
+		cache:    cache,
+		user:     user,
+		labels:   encrypted.Labels,
+		keySet:   encrypted.KeySetRSA,
+		shareSet: encrypted.ShareSet,
+	})
+	unwrappedKey, err = sss.RecoverSecret(&db)
+
+	return
 }
 
 // Encrypt encrypts data with the keys associated with names. This
 // requires a minimum of min keys to decrypt.  NOTE: as currently
 // implemented, the maximum value for min is 2.
 func (c *Cryptor) Encrypt(in []byte, labels []string, access AccessStructure) (resp []byte, err error) {
+	return c.encrypt(in, labels, access, rand.Reader)
+}
+
+// encrypt is Encrypt, with the IV, the data key and the keys wrapping
+// it drawn from random.
+func (c *Cryptor) encrypt(in []byte, labels []string, access AccessStructure, random io.Reader) (resp []byte, err error) {
 	var encrypted EncryptedData
 	encrypted.Version = DEFAULT_VERSION
 	if encrypted.VaultId, err = c.records.GetVaultID(); err != nil {
@@ -467,18 +704,17 @@ func (c *Cryptor) Encrypt(in []byte, labels []string, access AccessStructure) (r
 	}
 
 	// Generate random IV and encryption key
-	encrypted.IV, err = symcrypt.MakeRandom(16)
+	encrypted.IV, err = makeRandom(random, 16)
 	if err != nil {
 		return
 	}
 
-	clearKey, err := symcrypt.MakeRandom(16)
+	clearKey, err := makeRandom(random, 16)
 	if err != nil {
 		return
 	}
 
-	err = encrypted.wrapKey(c.records, clearKey, access)
-	if err != nil {
+	if err = encrypted.protect(c.records, clearKey, access, random); err != nil {
 		return
 	}
 
@@ -497,9 +733,81 @@ func (c *Cryptor) Encrypt(in []byte, labels []string, access AccessStructure) (r
 	encrypted.Data = encryptedFile
 	encrypted.Labels = labels
 
+	return c.pack(encrypted)
+}
+
+// protect wraps the clear key according to an access structure,
+// applying its constraints, delegation age limit and escrow.
+func (encrypted *EncryptedData) protect(records *passvault.Records, clearKey []byte, access AccessStructure, random io.Reader) (err error) {
+	for _, constraint := range access.Constraints {
+		if err = constraint.validate(); err != nil {
+			return
+		}
+	}
+	encrypted.Constraints = access.Constraints
+
+	if access.MaxDelegationAge != "" {
+		var age time.Duration
+		if age, err = time.ParseDuration(access.MaxDelegationAge); err != nil {
+			return
+		}
+		if age <= 0 {
+			return errors.New("Maximum delegation age must be positive")
+		}
+		encrypted.MaxAge = access.MaxDelegationAge
+	}
+
+	if len(access.Approvers) > 0 {
+		if err = encrypted.setApprovers(records, access); err != nil {
+			return
+		}
+	}
+
+	if err = encrypted.wrapKey(records, clearKey, access, random); err != nil {
+		return
+	}
+
+	if access.Escrow != "" {
+		if encrypted.Escrow, err = escrowKey(access.Escrow, clearKey, encrypted.IV); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// setApprovers records the approvers of an access structure, who must
+// be distinct users of the vault.
+func (encrypted *EncryptedData) setApprovers(records *passvault.Records, access AccessStructure) error {
+	seen := make(map[string]bool)
+	for _, name := range access.Approvers {
+		if _, ok := records.GetRecord(name); !ok {
+			return fmt.Errorf("Unknown approver %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Approver %s given twice", name)
+		}
+		seen[name] = true
+	}
+
+	minimum := access.ApprovalMinimum
+	if minimum == 0 {
+		minimum = 1
+	}
+	if minimum < 0 || minimum > len(access.Approvers) {
+		return errors.New("Approval minimum must be between 1 and the number of approvers")
+	}
+
+	encrypted.Approvers = access.Approvers
+	encrypted.ApprovalMin = minimum
+	return nil
+}
+
+// pack signs encrypted data with the HMAC key of the vault and returns
+// it in its final form.
+func (c *Cryptor) pack(encrypted EncryptedData) ([]byte, error) {
 	hmacKey, err := c.records.GetHMACKey()
 	if err != nil {
-		return
+		return nil, err
 	}
 	encrypted.Signature = encrypted.computeHmac(hmacKey)
 	encrypted.lock(hmacKey)
@@ -507,15 +815,16 @@ func (c *Cryptor) Encrypt(in []byte, labels []string, access AccessStructure) (r
 	return json.Marshal(encrypted)
 }
 
-// Decrypt decrypts a file using the keys in the key cache.
-func (c *Cryptor) Decrypt(in []byte, user string) (resp []byte, names []string, secure bool, err error) {
+// unpack parses encrypted data and checks that it was produced by the
+// active vault and has not been modified.
+func (c *Cryptor) unpack(in []byte) (encrypted EncryptedData, secure bool, err error) {
 	// unwrap encrypted file
-	var encrypted EncryptedData
 	if err = json.Unmarshal(in, &encrypted); err != nil {
 		return
 	}
 	if encrypted.Version != DEFAULT_VERSION && encrypted.Version != -1 {
-		return nil, nil, secure, errors.New("Unknown version")
+		err = errors.New("Unknown version")
+		return
 	}
 
 	secure = encrypted.Version == -1
@@ -535,7 +844,8 @@ func (c *Cryptor) Decrypt(in []byte, user string) (resp []byte, names []string,
 		return
 	}
 	if encrypted.VaultId != vaultId {
-		return nil, nil, secure, errors.New("Wrong vault")
+		err = errors.New("Wrong vault")
+		return
 	}
 
 	// compute HMAC
@@ -545,14 +855,19 @@ func (c *Cryptor) Decrypt(in []byte, user string) (resp []byte, names []string,
 		return
 	}
 
-	// decrypt file key with delegate keys
-	var unwrappedKey = make([]byte, 16)
-	unwrappedKey, names, err = encrypted.unwrapKey(c.cache, user)
-	if err != nil {
-		return
-	}
+	return
+}
 
-	aesCrypt, err := aes.NewCipher(unwrappedKey)
+// Decrypt decrypts a file using the keys in the key cache.
+func (c *Cryptor) Decrypt(in []byte, user string) (resp []byte, names []string, secure bool, err error) {
+	return c.DecryptContext(context.Background(), in, user)
+}
+
+// DecryptContext is Decrypt, giving up once ctx is done. Delegations
+// are only consumed if ctx is not done before they are used; a
+// decryption given up on later has still consumed them.
+func (c *Cryptor) DecryptContext(ctx context.Context, in []byte, user string) (resp []byte, names []string, secure bool, err error) {
+	encrypted, aesCrypt, names, secure, err := c.open(ctx, in, user)
 	if err != nil {
 		return
 	}
@@ -560,48 +875,159 @@ func (c *Cryptor) Decrypt(in []byte, user string) (resp []byte, names []string,
 	aesCBC := cipher.NewCBCDecrypter(aesCrypt, encrypted.IV)
 
 	// decrypt contents of file
-	aesCBC.CryptBlocks(clearData, encrypted.Data)
+	for i := 0; i < len(clearData); i += decryptChunk {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		end := i + decryptChunk
+		if end > len(clearData) {
+			end = len(clearData)
+		}
+		aesCBC.CryptBlocks(clearData[i:end], encrypted.Data[i:end])
+	}
 
 	resp, err = padding.RemovePadding(clearData)
 	return
 }
 
-// GetOwners returns the list of users that can delegate their passwords
-// to decrypt the given encrypted secret.
-func (c *Cryptor) GetOwners(in []byte) (names []string, predicate string, err error) {
-	// unwrap encrypted file
-	var encrypted EncryptedData
-	if err = json.Unmarshal(in, &encrypted); err != nil {
+// open unpacks encrypted data and unwraps its key with the delegations
+// in the key cache, consuming them.
+func (c *Cryptor) open(ctx context.Context, in []byte, user string) (encrypted EncryptedData, aesCrypt cipher.Block, names []string, secure bool, err error) {
+	encrypted, secure, err = c.unpack(in)
+	if err != nil {
 		return
 	}
-	if encrypted.Version != DEFAULT_VERSION && encrypted.Version != -1 {
-		err = errors.New("Unknown version")
+	if err = ctx.Err(); err != nil {
 		return
 	}
 
-	hmacKey, err := c.records.GetHMACKey()
+	cache, err := c.delegations(encrypted)
 	if err != nil {
 		return
 	}
+	if cache != c.cache {
+		defer c.cache.Update(cache)
+	}
 
-	if err = encrypted.unlock(hmacKey); err != nil {
+	// decrypt file key with delegate keys
+	var unwrappedKey = make([]byte, 16)
+	unwrappedKey, names, err = encrypted.unwrapKey(c.records, cache, user)
+	if err != nil {
 		return
 	}
 
-	// make sure file was encrypted with the active vault
-	vaultId, err := c.records.GetVaultID()
+	aesCrypt, err = aes.NewCipher(unwrappedKey)
+	return
+}
+
+// delegations returns the delegations that may be used to decrypt the
+// encrypted data: all of them, or only the recent ones if the data
+// limits the age of delegations.
+func (c *Cryptor) delegations(encrypted EncryptedData) (*keycache.Cache, error) {
+	if encrypted.MaxAge == "" {
+		return c.cache, nil
+	}
+
+	age, err := time.ParseDuration(encrypted.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return c.cache.Since(chaos.Now().Add(-age)), nil
+}
+
+// Delegates returns the delegations that would be consumed if user
+// decrypted the given encrypted secret now. Nothing is decrypted and no
+// delegations are consumed.
+func (c *Cryptor) Delegates(in []byte, user string) (delegates []keycache.DelegateIndex, err error) {
+	encrypted, _, err := c.unpack(in)
 	if err != nil {
 		return
 	}
-	if encrypted.VaultId != vaultId {
-		err = errors.New("Wrong vault")
+
+	cache, err := c.delegations(encrypted)
+	if err != nil {
 		return
 	}
 
-	// compute HMAC
-	expectedMAC := encrypted.computeHmac(hmacKey)
-	if !hmac.Equal(encrypted.Signature, expectedMAC) {
-		err = errors.New("Signature mismatch")
+	_, names, err := encrypted.selectDelegates(c.records, cache, user)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		// a substitute's delegation is used in place of an absent user's
+		delegate := name
+		if _, absence, ok := substituted(c.records, cache, name, user, encrypted.Labels); ok {
+			delegate = absence.Substitute
+		}
+
+		_, slot, ok := cache.MatchUser(delegate, user, encrypted.Labels)
+		if !ok {
+			return nil, errors.New("Key not delegated")
+		}
+		delegates = append(delegates, keycache.DelegateIndex{Name: delegate, Slot: slot})
+	}
+
+	return
+}
+
+// GetLabels returns the labels the given encrypted secret was
+// encrypted under.
+func (c *Cryptor) GetLabels(in []byte) (labels []string, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+
+	return encrypted.Labels, nil
+}
+
+// GetFingerprint returns the hex encoded SHA-256 hash of the signature
+// of the given encrypted secret. Unlike a hash of in, it identifies the
+// secret however its JSON is formatted, as the signature is checked
+// against the parsed secret.
+func (c *Cryptor) GetFingerprint(in []byte) (fingerprint string, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+
+	hash := sha256.Sum256(encrypted.Signature)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// GetWrappedKey returns the key of the given encrypted secret wrapped
+// for name, for the client of an HSM record to unwrap (see
+// keycache.AddKeyFromClient).
+func (c *Cryptor) GetWrappedKey(in []byte, name string) (wrapped []byte, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+
+	key, ok := encrypted.KeySetRSA[name]
+	if !ok {
+		return nil, errors.New("User is not an owner of the data")
+	}
+	return key.Key, nil
+}
+
+// GetApprovers returns the users who approve decryptions of the given
+// encrypted secret, and how many of them must, 0 if none.
+func (c *Cryptor) GetApprovers(in []byte) (names []string, minimum int, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+
+	return encrypted.Approvers, encrypted.ApprovalMin, nil
+}
+
+// GetOwners returns the list of users that can delegate their passwords
+// to decrypt the given encrypted secret.
+func (c *Cryptor) GetOwners(in []byte) (names []string, predicate string, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
 		return
 	}
 
@@ -626,3 +1052,17 @@ func (c *Cryptor) GetOwners(in []byte) (names []string, predicate string, err er
 
 	return
 }
+
+// GetEscrow returns the fingerprints of the OpenPGP keys the data key
+// of the given encrypted secret is escrowed to.
+func (c *Cryptor) GetEscrow(in []byte) (recipients []string, err error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+
+	if encrypted.Escrow != nil {
+		recipients = encrypted.Escrow.Recipients
+	}
+	return
+}
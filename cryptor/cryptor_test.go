@@ -6,14 +6,119 @@ package cryptor
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/redoctober/keycache"
+	"github.com/cloudflare/redoctober/padding"
 	"github.com/cloudflare/redoctober/passvault"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
+//go:generate go run gen_golden.go
+
+// goldenVault opens a copy of the vault of the golden corpus, so that
+// loading it can never rewrite the corpus.
+func goldenVault(t *testing.T) passvault.Records {
+	data, err := ioutil.ReadFile("testdata/golden/vault.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, err := ioutil.TempFile("", "golden")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	records, err := passvault.InitFrom(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return records
+}
+
+// TestGolden decrypts the envelopes of the golden corpus, written by
+// earlier versions of the cryptor, to make sure that they can still be
+// decrypted.
+func TestGolden(t *testing.T) {
+	records := goldenVault(t)
+	cache := keycache.NewCache()
+	c := Cryptor{&records, &cache}
+
+	paths, err := filepath.Glob("testdata/golden/*.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		if name == "vault" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var fixture struct {
+			Delegates  []string
+			Labels     []string
+			Plaintext  string
+			Ciphertext json.RawMessage
+		}
+		if err = json.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, delegate := range fixture.Delegates {
+			rec, ok := records.GetRecord(delegate)
+			if !ok {
+				t.Fatalf("%s: missing user %s", name, delegate)
+			}
+			err = cache.AddKeyFromRecord(rec, delegate, "golden", nil, fixture.Labels, 1, nil, "", "1h")
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		out, _, _, err := c.Decrypt(fixture.Ciphertext, fixture.Delegates[0])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(out) != fixture.Plaintext {
+			t.Fatalf("%s: decrypted %q", name, out)
+		}
+
+		cache.FlushCache()
+	}
+
+	if len(paths) < 2 {
+		t.Fatalf("Golden corpus is missing")
+	}
+}
+
 func TestHash(t *testing.T) {
 	decryptJson := []byte("{\"Version\":1,\"VaultId\":529853895,\"KeySet\":[{\"Name\":[\"Bob\",\"Alice\"],\"Key\":\"2j3tI2PBFBbwFX0BlQdUuA==\"},{\"Name\":[\"Bob\",\"Carol\"],\"Key\":\"yLSSB/U6+5rc1E+gjGXT4w==\"},{\"Name\":[\"Alice\",\"Bob\"],\"Key\":\"DDlWHF7szzISuXWaEz8llQ==\"},{\"Name\":[\"Alice\",\"Carol\"],\"Key\":\"TkA13aPrYFNbveIbl0qdww==\"},{\"Name\":[\"Carol\",\"Bob\"],\"Key\":\"KXm0uObmRJ2ZvSYEWPwk2A==\"},{\"Name\":[\"Carol\",\"Alice\"],\"Key\":\"L9c+PqtxPh9y6apRvtbCQw==\"}],\"KeySetRSA\":{\"Alice\":{\"Key\":\"fj5mqnq7y5KCafCGT1I51xI5JsX746+9TTSsp/8ybf3iZjhFzSlwP3aNmsOx3SUKTmZlfs+b+MeD4eKJ2uKBFzQHAIPO0fwoiCDKHhKH6KsolNq4+jgpkLAMOLsQGs8g6BhJy6bCFRjZVc3IdlQABPM6PkTbuSvKhn9atDFwZQD5TJBISi7d2hw4LradtLITbNqwiFMTQQ9+psXzyavY8H3LNHKGgf5Od7IpthEQPCHi4nw7X/YVRTEMfoIVcMcKOwYjlC45/VJEHK9Zy3DSiLBzjmr57YNIVjw8YZY5DGBWqbgu51RUbIcrqyLphBhXoBRu4R+yrhygBNWbvkkifA==\"},\"Bob\":{\"Key\":\"HTYiZ18sf721cAN1LRNkJ/+L4AKWilMrkMyNiBjWcl9HRTVPNXITqQBXd0fBggGNPiZr6VQTySK4ZFvJKGDGiz17Te/ToDn8Yk/B9cqMsN5fHoQtXvl8IZo2wioA67ccAJ1gHMMNpPyLdF43SQqgI+XaQ2lMSYLMfxxDmBBOQ1SWAto0BDRdnsqpwUwIPKQ9Y3/1osmrjLmJoAC3MPplexYWhexNwJtSd+mFdVZ3Qe4x9RsRHcN/myihOt/67V60qzs13F0RZkMSDzj5Ddg+1KVNJZY9dmolPNkAZj8z20L9uzpatrTYTR6A8q/sRn+inO7ZQVQ00XO6q6lYYQzxnw==\"},\"Carol\":{\"Key\":\"ItrvS02nSfbcA2fl1L1i61xqPEDKRdsrYe3+UCbkT+ipheiQRPSuikbzeV2kshn4yJDeku5bmTNqW8HSGtU7GTgCoIWV8WmEf4w6ovzShPbu+VrIZvRz3wjh2oYHT/gtPVAQnBa/71FeoBNxy5l/hBcUmBky43j83Mlt2+8QZx6PEUDmpaPQemVh99+C20nQtkAUFeMc2Ge4y7RlHSxtfABvwlXx1NzCD40nyJfF1SjV/fZh/E2Al4Tavx6DOJkYGoJ2mp7XBvX0IF2tp8T3U5VpnTek/WuNrLL9z7/jqzWh87lZ5KheWXhGkU1BNH4lfIj43pDkSy50aDvS0zYfHQ==\"}},\"IV\":\"58r9Mz8e06mItBG9nSV/0Q==\",\"Data\":\"QE9ZhcGXNXauUdMk04biUGy1SoP5H2nF/j2JjiiVFKPdIdRp/Gc+AZvUI9n22ZM4q+zDiJz7qvK4bKaPpXhTmGP0XheaFUukeVNS9STMoTbNcY/ZtVOz6hizUPF7gSq388QPUsT+Axml3rEUTWOhnw==\",\"Signature\":\"ItiAS26GFlbM5szJr5HXVB9BR+s=\"}")
 
@@ -108,7 +213,7 @@ func TestDuplicates(t *testing.T) {
 
 	// Delegate one key at a time and check that decryption fails.
 	for name, pr := range recs {
-		err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 2, "", "1h")
+		err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 2, nil, "", "1h")
 		if err != nil {
 			t.Fatalf("%v", err)
 		}
@@ -121,3 +226,702 @@ func TestDuplicates(t *testing.T) {
 		cache.FlushCache()
 	}
 }
+
+func TestConstraints(t *testing.T) {
+	// Alice and Bob are on one team, Carl is on another.
+	teams := map[string]string{"Alice": "sre", "Bob": "sre", "Carl": "security"}
+	recs := make(map[string]passvault.PasswordRecord, 0)
+
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := Cryptor{&records, &cache}
+
+	for name, team := range teams {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, passvault.ECCRecord)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = records.SetAttribute(name, "team", team); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		recs[name] = pr
+	}
+
+	ac := AccessStructure{
+		Names:       []string{"Alice", "Bob", "Carl"},
+		Constraints: []Constraint{{Distinct: "team", Count: 2}},
+	}
+
+	resp, err := c.Encrypt([]byte("Hello World!"), []string{}, ac)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// Two delegates from the same team must not be enough.
+	for _, name := range []string{"Alice", "Bob"} {
+		err = cache.AddKeyFromRecord(recs[name], name, "weakpassword", nil, nil, 2, nil, "", "1h")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if _, _, _, err = c.Decrypt(resp, "Alice"); err == nil {
+		t.Fatalf("That shouldn't have worked!")
+	}
+
+	err = cache.AddKeyFromRecord(recs["Carl"], "Carl", "weakpassword", nil, nil, 2, nil, "", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	out, names, _, err := c.Decrypt(resp, "Alice")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if string(out) != "Hello World!" {
+		t.Fatalf("Decryption returned the wrong data")
+	}
+	for _, name := range names {
+		if name == "Carl" {
+			return
+		}
+	}
+	t.Fatalf("Decryption did not use a delegate from the other team: %v", names)
+}
+
+func TestAbsence(t *testing.T) {
+	recs := make(map[string]passvault.PasswordRecord, 0)
+
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := Cryptor{&records, &cache}
+
+	types := map[string]string{"Alice": passvault.RSARecord, "Bob": passvault.ECCRecord, "Carl": passvault.RSARecord}
+	for name, recType := range types {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, recType)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		recs[name] = pr
+	}
+
+	encrypt := func(ac AccessStructure) []byte {
+		resp, err := c.Encrypt([]byte("Hello World!"), []string{}, ac)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		return resp
+	}
+	twoOfTwo := encrypt(AccessStructure{Names: []string{"Alice", "Bob"}})
+	predicate := encrypt(AccessStructure{Predicate: "Alice & Bob"})
+
+	// Carl stands in for Bob while he is away.
+	now := time.Now()
+	if err = records.SetAbsence("Bob", "weakpassword", "Carl", now.Add(-time.Hour), now.Add(time.Hour)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, name := range []string{"Alice", "Carl"} {
+		err = cache.AddKeyFromRecord(recs[name], name, "weakpassword", nil, nil, 10, nil, "", "1h")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if _, _, _, err = c.Decrypt(twoOfTwo, "Alice"); err == nil {
+		t.Fatalf("Absence should need approval")
+	}
+
+	if err = records.ApproveAbsence("Bob", "Admin"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, in := range [][]byte{twoOfTwo, predicate} {
+		out, names, _, err := c.Decrypt(in, "Alice")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if string(out) != "Hello World!" {
+			t.Fatalf("Decryption returned the wrong data")
+		}
+		sort.Strings(names)
+		if len(names) != 2 || names[0] != "Alice" || names[1] != "Bob" {
+			t.Fatalf("Decryption used the wrong delegates: %v", names)
+		}
+	}
+
+	delegates, err := c.Delegates(twoOfTwo, "Alice")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(delegates) != 2 || delegates[1].Name != "Carl" {
+		t.Fatalf("Substitute should be reported as the delegate: %v", delegates)
+	}
+
+	// A substitute cannot make up a quorum with themselves.
+	if err = records.SetAbsence("Bob", "weakpassword", "Alice", now.Add(-time.Hour), now.Add(time.Hour)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = records.ApproveAbsence("Bob", "Admin"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cache.FlushCache()
+	err = cache.AddKeyFromRecord(recs["Alice"], "Alice", "weakpassword", nil, nil, 10, nil, "", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, in := range [][]byte{twoOfTwo, predicate} {
+		if _, _, _, err = c.Decrypt(in, "Alice"); err == nil {
+			t.Fatalf("That shouldn't have worked!")
+		}
+	}
+}
+
+func TestMaxDelegationAge(t *testing.T) {
+	recs := make(map[string]passvault.PasswordRecord, 0)
+
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := Cryptor{&records, &cache}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, passvault.RSARecord)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		recs[name] = pr
+
+		err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 3, nil, "", "24h")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	names := []string{"Alice", "Bob"}
+	if _, err = c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Names: names, MaxDelegationAge: "-1m"}); err == nil {
+		t.Fatalf("Negative delegation age should be rejected")
+	}
+
+	fresh, err := c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Names: names, MaxDelegationAge: "1h"})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	standing, err := c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Names: names})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if _, _, _, err = c.Decrypt(fresh, "Alice"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	alice := keycache.DelegateIndex{Name: "Alice"}
+	if cache.UserKeys[alice].Usage.Uses != 2 {
+		t.Fatalf("Use was not consumed: %d", cache.UserKeys[alice].Usage.Uses)
+	}
+
+	// Alice's delegation is now too old for the sensitive secret.
+	active := cache.UserKeys[alice]
+	active.Usage.Created = active.Usage.Created.Add(-2 * time.Hour)
+	cache.UserKeys[alice] = active
+
+	if _, _, _, err = c.Decrypt(fresh, "Alice"); err == nil {
+		t.Fatalf("Old delegation should not decrypt")
+	}
+	if _, err = c.Delegates(fresh, "Alice"); err == nil {
+		t.Fatalf("Old delegation should not be reported")
+	}
+	if _, _, _, err = c.Decrypt(standing, "Alice"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if cache.UserKeys[alice].Usage.Uses != 1 {
+		t.Fatalf("Use was not consumed: %d", cache.UserKeys[alice].Usage.Uses)
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cache := keycache.NewCache()
+	c := Cryptor{&records, &cache}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		if _, err = records.AddNewRecord(name, "weakpassword", false, passvault.RSARecord); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Without a config, the key declares no hash preferences, as keys
+	// made by some tools do.
+	escrowHolder, err := openpgp.NewEntity("Escrow", "", "escrow@example.com", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, id := range escrowHolder.Identities {
+		if len(id.SelfSignature.PreferredHash) != 0 {
+			t.Fatalf("Escrow key declares hash preferences")
+		}
+	}
+	var keyRing bytes.Buffer
+	w, err := armor.Encode(&keyRing, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = escrowHolder.Serialize(w); err != nil {
+		t.Fatalf("%v", err)
+	}
+	w.Close()
+
+	names := []string{"Alice", "Bob"}
+	if _, err = c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Names: names, Escrow: "not a key"}); err == nil {
+		t.Fatalf("Invalid escrow keys should be rejected")
+	}
+
+	out, err := c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Names: names, Escrow: keyRing.String()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	recipients, err := c.GetEscrow(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fingerprint := strings.ToUpper(hex.EncodeToString(escrowHolder.PrimaryKey.Fingerprint[:]))
+	if len(recipients) != 1 || recipients[0] != fingerprint {
+		t.Fatalf("Wrong escrow recipients: %v", recipients)
+	}
+
+	// The escrow holder recovers the data without Red October.
+	encrypted, _, err := c.unpack(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	block, err := armor.Decode(bytes.NewReader(encrypted.Escrow.Key))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{escrowHolder}, nil, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	line, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var keyHex, ivHex string
+	if _, err = fmt.Sscanf(string(line), "aes-128-cbc key=%s iv=%s", &keyHex, &ivHex); err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, _ := hex.DecodeString(keyHex)
+	iv, _ := hex.DecodeString(ivHex)
+
+	aesCrypt, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	clear := make([]byte, len(encrypted.Data))
+	cipher.NewCBCDecrypter(aesCrypt, iv).CryptBlocks(clear, encrypted.Data)
+	if clear, err = padding.RemovePadding(clear); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(clear) != "Hello World!" {
+		t.Fatalf("Escrow recovered %q", clear)
+	}
+}
+
+func TestShare(t *testing.T) {
+	// two servers, each with its own vault and owners
+	recordsA, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	recordsB, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cacheA, cacheB := keycache.NewCache(), keycache.NewCache()
+	a, b := Cryptor{&recordsA, &cacheA}, Cryptor{&recordsB, &cacheB}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		pr, err := recordsA.AddNewRecord(name, "weakpassword", false, passvault.DefaultRecordType)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = cacheA.AddKeyFromRecord(pr, name, "weakpassword", nil, []string{"red"}, 1, nil, "", "1h"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	for _, name := range []string{"Carol", "Dave"} {
+		pr, err := recordsB.AddNewRecord(name, "weakpassword", false, passvault.DefaultRecordType)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = cacheB.AddKeyFromRecord(pr, name, "weakpassword", nil, []string{"blue"}, 1, nil, "", "1h"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	in, err := a.Encrypt([]byte("Hello World!"), []string{"red"}, AccessStructure{Names: []string{"Alice", "Bob"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pubB, err := recordsB.GetIdentityPub()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	link, names, err := a.Share(in, "anybody", pubB)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "Alice" || names[1] != "Bob" {
+		t.Fatalf("Wrong delegates used: %v", names)
+	}
+	cacheA.Refresh()
+	if len(cacheA.UserKeys) != 0 {
+		t.Fatalf("Sharing did not consume the delegations")
+	}
+
+	// only B can receive the link
+	if _, err = a.Receive(link, nil, AccessStructure{Names: []string{"Alice", "Bob"}}); err == nil {
+		t.Fatalf("Link received by the wrong server")
+	}
+
+	if _, err = a.OpenLink(link); err == nil {
+		t.Fatalf("Link opened by the wrong server")
+	}
+	if clear, err := b.OpenLink(link); err != nil || string(clear) != "Hello World!" {
+		t.Fatalf("Link opened to %q, %v", clear, err)
+	}
+
+	out, err := b.Receive(link, []string{"blue"}, AccessStructure{Names: []string{"Carol", "Dave"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	labels, err := b.GetLabels(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(labels) != 1 || labels[0] != "blue" {
+		t.Fatalf("Wrong labels: %v", labels)
+	}
+	clear, _, secure, err := b.Decrypt(out, "anybody")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !secure || string(clear) != "Hello World!" {
+		t.Fatalf("Shared data decrypted to %q", clear)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	teams := map[string]string{"Alice": "sre", "Bob": "sre", "Carl": "security"}
+
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := Cryptor{&records, &cache}
+
+	for name, team := range teams {
+		if _, err = records.AddNewRecord(name, "weakpassword", false, passvault.ECCRecord); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = records.SetAttribute(name, "team", team); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ac := AccessStructure{
+		Names:       []string{"Alice", "Bob", "Carl"},
+		Constraints: []Constraint{{Distinct: "team", Count: 2}},
+	}
+	resp, err := c.Encrypt([]byte("Hello World!"), []string{"red"}, ac)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pred, err := c.Encrypt([]byte("Hello World!"), nil, AccessStructure{Predicate: "(Alice | Bob) & Carl"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	policy, err := ReadPolicy(resp)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !policy.Secure || !reflect.DeepEqual(policy.Owners, []string{"Alice", "Bob", "Carl"}) || !reflect.DeepEqual(policy.Labels, []string{"red"}) {
+		t.Fatalf("Wrong policy: %+v", policy)
+	}
+	predPolicy, err := ReadPolicy(pred)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = ReadPolicy([]byte(`{"Version":7}`)); err == nil {
+		t.Fatalf("Policy read from an unknown version")
+	}
+
+	// policies are evaluated without a vault, given the records
+	offline := func(name string) (passvault.PasswordRecord, bool) {
+		team, ok := teams[name]
+		return passvault.PasswordRecord{Attributes: map[string]string{"team": team}}, ok
+	}
+	for _, test := range []struct {
+		policy Policy
+		names  []string
+		ok     bool
+	}{
+		{policy, []string{"Alice"}, false},
+		{policy, []string{"Alice", "Bob"}, false},
+		{policy, []string{"Alice", "Carl"}, true},
+		{policy, []string{"Alice", "Bob", "Carl"}, true},
+		{predPolicy, []string{"Alice", "Bob"}, false},
+		{predPolicy, []string{"Bob", "Carl"}, true},
+		{predPolicy, []string{"Carl", "Dave"}, false},
+	} {
+		ok, err := test.policy.Satisfied(test.names, offline)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if ok != test.ok {
+			t.Fatalf("Policy satisfied by %v: %v, expected %v", test.names, ok, test.ok)
+		}
+	}
+	if ok, _ := policy.Satisfied([]string{"Alice", "Carl"}, records.GetRecord); !ok {
+		t.Fatalf("Policy not satisfied with the records of the vault")
+	}
+}
+
+// chunkWriter records the largest write it was given.
+type chunkWriter struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) > w.largest {
+		w.largest = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestStream(t *testing.T) {
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := Cryptor{&records, &cache}
+
+	owners := []string{"Alice", "Bob"}
+	for _, name := range owners {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, passvault.ECCRecord)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 100, nil, "", "1h"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, streamChunk - 1, streamChunk, streamChunk + 1, 3*streamChunk - 16} {
+		clear := make([]byte, size)
+		rand.Read(clear)
+
+		enc, err := c.Encrypt(clear, nil, AccessStructure{Names: owners})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		stream, names, _, err := c.Open(context.Background(), enc, "Alice")
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if len(names) != 2 || stream.Size() != size {
+			t.Fatalf("%d bytes: wrong stream %v %d", size, names, stream.Size())
+		}
+
+		var w chunkWriter
+		n, err := stream.WriteTo(&w)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if n != int64(size) || !bytes.Equal(w.Bytes(), clear) {
+			t.Fatalf("%d bytes: wrong plaintext", size)
+		}
+		if w.largest > streamChunk {
+			t.Fatalf("%d bytes: wrote %d bytes at once", size, w.largest)
+		}
+
+		for _, r := range [][2]int{{0, size}, {1, 15}, {15, 2}, {16, 16}, {size / 3, size / 2}, {size - 1, 5}} {
+			if r[0] < 0 || r[0] >= size {
+				continue
+			}
+			p := make([]byte, r[1])
+			n, err := stream.ReadAt(p, int64(r[0]))
+			want := clear[r[0]:]
+			if len(want) > r[1] {
+				want = want[:r[1]]
+			}
+			if (err != nil && err != io.EOF) || !bytes.Equal(p[:n], want) {
+				t.Fatalf("%d bytes: wrong plaintext at %d: %v", size, r[0], err)
+			}
+		}
+	}
+}
+
+func TestEncryptConvergent(t *testing.T) {
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := Cryptor{&records, &cache}
+
+	for name, recordType := range map[string]string{"Alice": passvault.ECCRecord, "Bob": passvault.RSARecord} {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, recordType)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, []string{"a", "b"}, 100, nil, "", "1h"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	access := AccessStructure{Names: []string{"Alice", "Bob"}}
+
+	first, err := c.EncryptConvergent([]byte("backup"), []string{"b", "a"}, access)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second, err := c.EncryptConvergent([]byte("backup"), []string{"a", "b"}, access)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("Same data gave different envelopes")
+	}
+
+	for _, other := range []struct {
+		data   string
+		labels []string
+		access AccessStructure
+	}{
+		{"backup2", []string{"a", "b"}, access},
+		{"backup", []string{"a"}, access},
+		{"backup", []string{"a", "b"}, AccessStructure{Names: []string{"Bob", "Alice"}}},
+	} {
+		out, err := c.EncryptConvergent([]byte(other.data), other.labels, other.access)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if bytes.Equal(out, first) {
+			t.Fatalf("Different encryptions gave the same envelope: %v", other)
+		}
+	}
+
+	random, err := c.Encrypt([]byte("backup"), []string{"a", "b"}, access)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if bytes.Equal(random, first) {
+		t.Fatalf("Encrypt is convergent")
+	}
+
+	out, _, _, err := c.Decrypt(first, "Alice")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(out) != "backup" {
+		t.Fatalf("Wrong plaintext: %q", out)
+	}
+
+	if _, err = c.EncryptConvergent([]byte("backup"), nil, AccessStructure{Predicate: "Alice & Bob"}); err == nil {
+		t.Fatalf("Predicate encrypted convergently")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cache := keycache.NewCache()
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c := Cryptor{&records, &cache}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		if _, err = records.AddNewRecord(name, "weakpassword", true, passvault.DefaultRecordType); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ac := AccessStructure{Names: []string{"Alice", "Bob"}}
+	in, err := c.Encrypt([]byte("Hello World!"), []string{"red"}, ac)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fingerprint, err := c.GetFingerprint(in)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The same data, with other whitespace or its keys in another
+	// order, has the same fingerprint.
+	var indented bytes.Buffer
+	if err = json.Indent(&indented, in, "", "  "); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(in, &fields); err != nil {
+		t.Fatalf("%v", err)
+	}
+	reordered, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if bytes.Equal(reordered, in) {
+		t.Fatalf("Keys were not reordered")
+	}
+	for _, other := range [][]byte{append([]byte(" "), in...), indented.Bytes(), reordered} {
+		if f, err := c.GetFingerprint(other); err != nil || f != fingerprint {
+			t.Fatalf("Fingerprint of %s is %s, expected %s (%v)", other, f, fingerprint, err)
+		}
+	}
+
+	// Another encryption of the same message is other data.
+	again, err := c.Encrypt([]byte("Hello World!"), []string{"red"}, ac)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if f, err := c.GetFingerprint(again); err != nil || f == fingerprint {
+		t.Fatalf("Two encryptions have the same fingerprint %s (%v)", f, err)
+	}
+
+	// Modified data has no fingerprint.
+	var encrypted EncryptedData
+	if err = json.Unmarshal(in, &encrypted); err != nil {
+		t.Fatalf("%v", err)
+	}
+	encrypted.Data[0] ^= 1
+	modified, err := json.Marshal(encrypted)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = c.GetFingerprint(modified); err == nil {
+		t.Fatalf("Modified data has a fingerprint")
+	}
+}
@@ -0,0 +1,78 @@
+// denial.go: explanations of why encrypted data cannot be decrypted
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import "sort"
+
+// Denial explains why a user cannot decrypt a piece of encrypted data
+// with the delegations present.
+type Denial struct {
+	Delegated []string `json:",omitempty"` // owners whose delegations the user can use
+
+	// Owners holds why the delegations of each other owner cannot
+	// be used: "missing", "expired", "labels" or "user" (see
+	// keycache.Cache.Reason), or "stale" if they were made before
+	// the maximum delegation age of the data.
+	Owners map[string]string `json:",omitempty"`
+
+	// Constraints is set if enough owners have delegated, but they
+	// break the quorum constraints of the data.
+	Constraints bool   `json:",omitempty"`
+	Predicate   string `json:",omitempty"`
+}
+
+// Explain returns why user cannot decrypt the given encrypted secret
+// now, or nil if they can. Nothing is decrypted and no delegations are
+// consumed.
+func (c *Cryptor) Explain(in []byte, user string) (*Denial, error) {
+	encrypted, _, err := c.unpack(in)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := c.delegations(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = encrypted.selectDelegates(c.records, cache, user)
+	if err == nil {
+		return nil, nil
+	}
+
+	denial := &Denial{
+		Owners:      make(map[string]string),
+		Constraints: err == errConstraints,
+		Predicate:   encrypted.Predicate,
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, mwKey := range encrypted.KeySet {
+		names = append(names, mwKey.Name...)
+	}
+	for name := range encrypted.ShareSet {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if delegated(c.records, cache, name, user, encrypted.Labels) {
+			denial.Delegated = append(denial.Delegated, name)
+			continue
+		}
+		reason := cache.Reason(name, user, encrypted.Labels)
+		if cache != c.cache && c.cache.Valid(name, user, encrypted.Labels) {
+			reason = "stale"
+		}
+		denial.Owners[name] = reason
+	}
+	sort.Strings(denial.Delegated)
+
+	return denial, nil
+}
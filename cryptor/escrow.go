@@ -0,0 +1,76 @@
+// escrow.go: the data key encrypted to OpenPGP escrow recipients
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	// OpenPGP assumes RIPEMD-160 for keys declaring no hash
+	// preferences, and refuses to encrypt to them without it.
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// Escrow holds the data key of encrypted data encrypted to OpenPGP
+// public keys, so that their holders can decrypt it offline with
+// standard tools such as GnuPG, without Red October.
+type Escrow struct {
+	// Recipients are the fingerprints of the primary keys the data
+	// key is encrypted to, in upper case hex.
+	Recipients []string
+
+	// Key is an armored OpenPGP message to the recipients. It holds
+	// a line "aes-128-cbc key=<hex> iv=<hex>" giving the cipher, key
+	// and IV of Data. The last byte of the decrypted Data is the
+	// number of padding bytes to remove.
+	Key []byte
+}
+
+// escrowKey encrypts the clear key and IV to the OpenPGP public keys
+// of an armored key ring.
+func escrowKey(keyRing string, clearKey, iv []byte) (*Escrow, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keyRing))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid escrow keys: %v", err)
+	}
+	if len(entities) == 0 {
+		return nil, errors.New("Invalid escrow keys: no keys")
+	}
+
+	escrow := &Escrow{}
+	for _, entity := range entities {
+		escrow.Recipients = append(escrow.Recipients,
+			strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])))
+	}
+
+	var out bytes.Buffer
+	armored, err := armor.Encode(&out, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(armored, entities, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	line := fmt.Sprintf("aes-128-cbc key=%x iv=%x\n", clearKey, iv)
+	if _, err = plaintext.Write([]byte(line)); err != nil {
+		return nil, err
+	}
+	if err = plaintext.Close(); err != nil {
+		return nil, err
+	}
+	if err = armored.Close(); err != nil {
+		return nil, err
+	}
+
+	escrow.Key = out.Bytes()
+	return escrow, nil
+}
@@ -0,0 +1,108 @@
+// federation.go: encrypted data shared between Red October servers
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+
+	"github.com/cloudflare/redoctober/ecdh"
+	"github.com/cloudflare/redoctober/padding"
+)
+
+// Link is encrypted data shared with another Red October server. Its
+// data key is encrypted to the identity key of that server, which wraps
+// it again for its own owners with Receive, so the data itself is only
+// decrypted if the receiving server looks at it with OpenLink.
+type Link struct {
+	Labels []string `json:",omitempty"`
+	IV     []byte
+	Data   []byte
+	Key    []byte // the data key, encrypted with ecdh to the recipient
+}
+
+// Share unwraps the data key of encrypted data with the delegations
+// user may use, consuming them as Decrypt does, and returns a link to
+// the data for the server whose identity key is to. It also returns
+// the names of the delegates used.
+func (c *Cryptor) Share(in []byte, user string, to *ecdsa.PublicKey) (link Link, names []string, err error) {
+	encrypted, secure, err := c.unpack(in)
+	if err != nil {
+		return
+	}
+	if !secure {
+		err = errors.New("Only data with the secure bit set can be shared")
+		return
+	}
+
+	cache, err := c.delegations(encrypted)
+	if err != nil {
+		return
+	}
+	if cache != c.cache {
+		defer c.cache.Update(cache)
+	}
+
+	clearKey, names, err := encrypted.unwrapKey(c.records, cache, user)
+	if err != nil {
+		return
+	}
+
+	link = Link{Labels: encrypted.Labels, IV: encrypted.IV, Data: encrypted.Data}
+	link.Key, err = ecdh.Encrypt(to, clearKey)
+	return
+}
+
+// linkKey decrypts the data key of a link shared with this server with
+// the server identity key.
+func (c *Cryptor) linkKey(link Link) ([]byte, error) {
+	clearKey, err := c.records.DecryptWithIdentity(link.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(clearKey) != 16 || len(link.IV) != 16 || len(link.Data) == 0 || len(link.Data)%16 != 0 {
+		return nil, errors.New("Invalid link")
+	}
+	return clearKey, nil
+}
+
+// OpenLink decrypts the data of a link shared with this server, so it
+// can be classified before it is received.
+func (c *Cryptor) OpenLink(link Link) ([]byte, error) {
+	clearKey, err := c.linkKey(link)
+	if err != nil {
+		return nil, err
+	}
+	aesCrypt, err := aes.NewCipher(clearKey)
+	if err != nil {
+		return nil, err
+	}
+	clearData := make([]byte, len(link.Data))
+	cipher.NewCBCDecrypter(aesCrypt, link.IV).CryptBlocks(clearData, link.Data)
+	return padding.RemovePadding(clearData)
+}
+
+// Receive decrypts the data key of a link shared with this server with
+// the server identity key, and wraps it for the owners given in access
+// under labels. The result is encrypted data as returned by Encrypt.
+func (c *Cryptor) Receive(link Link, labels []string, access AccessStructure) (resp []byte, err error) {
+	clearKey, err := c.linkKey(link)
+	if err != nil {
+		return
+	}
+
+	encrypted := EncryptedData{Version: DEFAULT_VERSION, IV: link.IV, Data: link.Data, Labels: labels}
+	if encrypted.VaultId, err = c.records.GetVaultID(); err != nil {
+		return
+	}
+	if err = encrypted.protect(c.records, clearKey, access, rand.Reader); err != nil {
+		return
+	}
+
+	return c.pack(encrypted)
+}
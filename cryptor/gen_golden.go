@@ -0,0 +1,190 @@
+//go:build ignore
+// +build ignore
+
+// gen_golden.go: mints the envelopes of the golden corpus in
+// testdata/golden. Run with "go generate" after adding a fixture for a
+// new envelope format to the list below; existing fixtures are kept so
+// that the corpus always holds envelopes written by older versions.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/redoctober/cryptor"
+	"github.com/cloudflare/redoctober/keycache"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// password is the password of every user of the golden vault.
+const password = "golden"
+
+// users are the users of the golden vault, with their record type and
+// team attribute.
+var users = []struct {
+	Name, Type, Team string
+}{
+	{"Alice", passvault.RSARecord, "sre"},
+	{"Bob", passvault.RSARecord, "sre"},
+	{"Carol", passvault.ECCRecord, "security"},
+}
+
+// fixture is a golden envelope, with what it takes to decrypt it.
+type fixture struct {
+	Description string
+	Delegates   []string
+	Labels      []string `json:",omitempty"`
+	Plaintext   string
+	Ciphertext  json.RawMessage
+
+	access cryptor.AccessStructure
+	// unlocked writes the version 1 envelope found inside the locked
+	// one, as encrypted before envelopes were locked.
+	unlocked bool
+}
+
+var fixtures = map[string]fixture{
+	"v1": {
+		Description: "version 1 envelope, two of Alice, Bob and Carol",
+		Delegates:   []string{"Alice", "Bob"},
+		access:      cryptor.AccessStructure{Names: []string{"Alice", "Bob", "Carol"}},
+		unlocked:    true,
+	},
+	"locked": {
+		Description: "locked envelope, two of Alice, Bob and Carol",
+		Delegates:   []string{"Alice", "Carol"},
+		access:      cryptor.AccessStructure{Names: []string{"Alice", "Bob", "Carol"}},
+	},
+	"split": {
+		Description: "locked envelope, Alice and one of Bob or Carol",
+		Delegates:   []string{"Alice", "Carol"},
+		access:      cryptor.AccessStructure{LeftNames: []string{"Alice"}, RightNames: []string{"Bob", "Carol"}},
+	},
+	"labels": {
+		Description: "locked envelope under the label blue",
+		Delegates:   []string{"Bob", "Carol"},
+		Labels:      []string{"blue"},
+		access:      cryptor.AccessStructure{Names: []string{"Alice", "Bob", "Carol"}},
+	},
+	"predicate": {
+		Description: "locked envelope with the predicate Alice & (Bob | Carol)",
+		Delegates:   []string{"Alice", "Bob"},
+		access:      cryptor.AccessStructure{Predicate: "Alice & (Bob | Carol)"},
+	},
+	"constraints": {
+		Description: "locked envelope needing delegates from two teams",
+		Delegates:   []string{"Bob", "Carol"},
+		access: cryptor.AccessStructure{
+			Names:       []string{"Alice", "Bob", "Carol"},
+			Constraints: []cryptor.Constraint{{Distinct: "team", Count: 2}},
+		},
+	},
+	"maxage": {
+		Description: "locked envelope only accepting delegations from the last day",
+		Delegates:   []string{"Alice", "Bob"},
+		access: cryptor.AccessStructure{
+			Names:            []string{"Alice", "Bob", "Carol"},
+			MaxDelegationAge: "24h",
+		},
+	},
+}
+
+// vault opens the golden vault, creating it if it does not exist.
+func vault(path string) (passvault.Records, error) {
+	records, err := passvault.InitFrom(path)
+	if err != nil {
+		return records, err
+	}
+
+	for _, user := range users {
+		if _, ok := records.GetRecord(user.Name); ok {
+			continue
+		}
+		if _, err = records.AddNewRecord(user.Name, password, false, user.Type); err != nil {
+			return records, err
+		}
+		if err = records.SetAttribute(user.Name, "team", user.Team); err != nil {
+			return records, err
+		}
+	}
+	return records, records.WriteRecordsToDisk()
+}
+
+// mint encrypts the plaintext of a fixture and checks that it decrypts.
+func mint(c cryptor.Cryptor, records *passvault.Records, cache *keycache.Cache, f *fixture) error {
+	out, err := c.Encrypt([]byte(f.Plaintext), f.Labels, f.access)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range f.Delegates {
+		rec, _ := records.GetRecord(name)
+		if err = cache.AddKeyFromRecord(rec, name, password, nil, f.Labels, 1, nil, "", "1h"); err != nil {
+			return err
+		}
+	}
+	defer cache.FlushCache()
+
+	clear, _, _, err := c.Decrypt(out, f.Delegates[0])
+	if err != nil {
+		return err
+	}
+	if string(clear) != f.Plaintext {
+		return fmt.Errorf("decrypted %q", clear)
+	}
+
+	if f.unlocked {
+		var locked cryptor.EncryptedData
+		if err = json.Unmarshal(out, &locked); err != nil {
+			return err
+		}
+		out = locked.Data
+	}
+	f.Ciphertext = out
+	return nil
+}
+
+func main() {
+	dir := flag.String("dir", "testdata/golden", "directory of the golden corpus")
+	force := flag.Bool("force", false, "mint fixtures that already exist again")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	records, err := vault(filepath.Join(*dir, "vault.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache := keycache.NewCache()
+	c := cryptor.New(&records, &cache)
+
+	for name, f := range fixtures {
+		path := filepath.Join(*dir, name+".json")
+		if _, err = os.Stat(path); err == nil && !*force {
+			continue
+		}
+
+		f.Plaintext = fmt.Sprintf("Golden %s fixture", name)
+		if err = mint(c, &records, &cache, &f); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		out, err := json.MarshalIndent(f, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, append(out, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %s", path)
+	}
+}
@@ -0,0 +1,136 @@
+// policy.go: access policies of encrypted data, evaluated offline
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/cloudflare/redoctober/msp"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// Policy is the access policy of encrypted data: who must delegate for
+// it to be decrypted. It is read and evaluated without a vault or any
+// delegations, so that stored data can be checked against the policy
+// of an organization offline, for example in CI or by an auditor.
+type Policy struct {
+	Secure bool     // whether the data is in the HMAC-locked form
+	Labels []string `json:",omitempty"`
+	Owners []string // every user who can take part in a decryption
+
+	// KeySet lists the sets of owners who can decrypt the data
+	// together, unless it is protected by Predicate instead.
+	KeySet    [][]string `json:",omitempty"`
+	Predicate string     `json:",omitempty"`
+
+	Constraints []Constraint `json:",omitempty"`
+	MaxAge      string       `json:",omitempty"`
+	Escrow      []string     `json:",omitempty"` // fingerprints of the escrow keys
+}
+
+// ReadPolicy returns the access policy of encrypted data. The signature
+// of the data can only be checked with the vault that encrypted it, so
+// the policy is only as trustworthy as the place the data was read from.
+func ReadPolicy(in []byte) (policy Policy, err error) {
+	var encrypted EncryptedData
+	if err = json.Unmarshal(in, &encrypted); err != nil {
+		return
+	}
+	if encrypted.Version == -1 {
+		policy.Secure = true
+		if err = json.Unmarshal(encrypted.Data, &encrypted); err != nil {
+			return
+		}
+	}
+	if encrypted.Version != DEFAULT_VERSION {
+		err = errors.New("Unknown version")
+		return
+	}
+
+	policy.Labels = encrypted.Labels
+	policy.Predicate = encrypted.Predicate
+	policy.Constraints = encrypted.Constraints
+	policy.MaxAge = encrypted.MaxAge
+	if encrypted.Escrow != nil {
+		policy.Escrow = encrypted.Escrow.Recipients
+	}
+
+	owners := make(map[string]bool)
+	for _, mwKey := range encrypted.KeySet {
+		policy.KeySet = append(policy.KeySet, mwKey.Name)
+		for _, name := range mwKey.Name {
+			owners[name] = true
+		}
+	}
+	for name := range encrypted.ShareSet {
+		owners[name] = true
+	}
+	for name := range owners {
+		policy.Owners = append(policy.Owners, name)
+	}
+	sort.Strings(policy.Owners)
+
+	return
+}
+
+// policyDatabase implements msp.UserDatabase for evaluating a predicate
+// against a set of delegates. It holds no shares.
+type policyDatabase struct {
+	owners    map[string]bool
+	delegated map[string]bool
+}
+
+func (db policyDatabase) ValidUser(name string) bool {
+	return db.owners[name]
+}
+
+func (db policyDatabase) CanGetShare(name string) bool {
+	return db.owners[name] && db.delegated[name]
+}
+
+func (db policyDatabase) GetShare(name string) ([][]byte, error) {
+	return nil, errors.New("Policies hold no shares")
+}
+
+// Satisfied returns true if delegations by the named users, and no one
+// else, would allow the data to be decrypted. The records of the users,
+// for the constraints, are returned by lookup, which can be the
+// GetRecord method of the vault. Delegation labels, expiry and age are
+// not considered.
+func (policy Policy) Satisfied(names []string, lookup func(name string) (passvault.PasswordRecord, bool)) (bool, error) {
+	encrypted := EncryptedData{Constraints: policy.Constraints}
+	delegated := make(map[string]bool)
+	for _, name := range names {
+		delegated[name] = true
+	}
+
+	if policy.Predicate == "" {
+		for _, set := range policy.KeySet {
+			all := true
+			for _, name := range set {
+				all = all && delegated[name]
+			}
+			if all && encrypted.constraintsMet(lookup, set) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	sss, err := msp.StringToMSP(policy.Predicate)
+	if err != nil {
+		return false, err
+	}
+
+	db := policyDatabase{owners: make(map[string]bool), delegated: delegated}
+	for _, name := range policy.Owners {
+		db.owners[name] = true
+	}
+	mspDB := msp.UserDatabase(db)
+	ok, _, _, trace := sss.DerivePath(&mspDB)
+	return ok && encrypted.constraintsMet(lookup, trace), nil
+}
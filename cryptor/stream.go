@@ -0,0 +1,133 @@
+// stream.go: decryption a chunk at a time into a writer
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package cryptor
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+// streamChunk is the amount of data a Stream holds decrypted in memory
+// at a time.
+const streamChunk = 64 << 10
+
+// Stream is the plaintext of encrypted data whose key is unwrapped,
+// decrypted by WriteTo a chunk at a time, so that the whole plaintext
+// is never held in memory at once.
+type Stream struct {
+	block cipher.Block
+	iv    []byte
+	data  []byte
+	size  int // of the plaintext, without its padding
+}
+
+// Open unwraps the key of encrypted data with the delegations in the
+// key cache, consuming them, and returns a stream of its plaintext. The
+// padding is checked here, so that the plaintext written by the stream
+// is never cut short by a bad key.
+func (c *Cryptor) Open(ctx context.Context, in []byte, user string) (stream *Stream, names []string, secure bool, err error) {
+	encrypted, aesCrypt, names, secure, err := c.open(ctx, in, user)
+	if err != nil {
+		return
+	}
+
+	data := encrypted.Data
+	if len(data) == 0 || len(data)%aesCrypt.BlockSize() != 0 {
+		err = errors.New("Encrypted data is not a whole number of blocks")
+		return
+	}
+
+	// the last block holds the padding, and is decrypted on its own
+	// by XORing with the block before it
+	n := len(data) - aesCrypt.BlockSize()
+	prev := encrypted.IV
+	if n > 0 {
+		prev = data[n-aesCrypt.BlockSize() : n]
+	}
+	last := make([]byte, aesCrypt.BlockSize())
+	aesCrypt.Decrypt(last, data[n:])
+	padding := int(last[len(last)-1] ^ prev[len(prev)-1])
+	wipe(last)
+	if padding > 16 {
+		err = errors.New("Padding incorrect")
+		return
+	}
+
+	stream = &Stream{block: aesCrypt, iv: encrypted.IV, data: data, size: len(data) - padding}
+	return
+}
+
+// Size returns the size of the plaintext.
+func (s *Stream) Size() int {
+	return s.size
+}
+
+// WriteTo writes the plaintext to w. Each chunk is zeroed once it has
+// been written.
+func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
+	aesCBC := cipher.NewCBCDecrypter(s.block, s.iv)
+	buf := make([]byte, streamChunk)
+	defer wipe(buf)
+
+	for i := 0; i < s.size; i += streamChunk {
+		end := i + streamChunk
+		if end > len(s.data) {
+			end = len(s.data)
+		}
+		chunk := buf[:end-i]
+		aesCBC.CryptBlocks(chunk, s.data[i:end])
+		if end > s.size {
+			chunk = chunk[:s.size-i]
+		}
+
+		var written int
+		written, err = w.Write(chunk)
+		wipe(buf[:end-i])
+		n += int64(written)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadAt reads the plaintext at off into p. As each block of CBC is
+// decrypted with the block before it alone, only the blocks holding p
+// are decrypted.
+func (s *Stream) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= int64(s.size) {
+		return 0, io.EOF
+	}
+	if end := int64(s.size) - off; int64(len(p)) > end {
+		p = p[:end]
+		err = io.EOF
+	}
+
+	bs := int64(s.block.BlockSize())
+	first := off / bs * bs
+	last := (off + int64(len(p)) + bs - 1) / bs * bs
+	iv := s.iv
+	if first > 0 {
+		iv = s.data[first-bs : first]
+	}
+
+	buf := make([]byte, last-first)
+	defer wipe(buf)
+	cipher.NewCBCDecrypter(s.block, iv).CryptBlocks(buf, s.data[first:last])
+	n = copy(p, buf[off-first:])
+	return
+}
+
+// wipe zeroes plaintext held in memory.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,174 @@
+// Package derive mints short-lived credentials from a decrypted root
+// secret, so that the secret itself need not leave the server: callers
+// get a credential that expires, and that is of no use for anything
+// other than the context it was minted for.
+//
+// A derivation is described by a spec of the form "kind:context":
+//
+//	key:db-backup      a 32 byte sub-key of the root for the context
+//	token:deploy       a token naming the caller, signed with a key
+//	                   derived from the root for the context
+//
+// Both are bound to their expiry: a sub-key is derived from the context
+// and the time it expires, and a token carries its expiry under its
+// signature. Anyone holding the root secret can derive the same sub-key
+// or check a token with VerifyToken.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package derive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeySize is the size of the sub-keys minted.
+const KeySize = 32
+
+// Credential is a credential minted from a root secret.
+type Credential struct {
+	Kind    string // "key" or "token"
+	Context string
+	Expiry  time.Time
+	Key     []byte `json:",omitempty"`
+	Token   string `json:",omitempty"`
+}
+
+// Claims are the contents of a token.
+type Claims struct {
+	Subject string // the user the token was minted for
+	Context string
+	Issued  time.Time
+	Expiry  time.Time
+}
+
+// Check returns an error if spec does not describe a derivation.
+func Check(spec string) error {
+	_, _, err := parse(spec)
+	return err
+}
+
+// Mint returns the credential described by spec, derived from root, for
+// subject and lasting ttl from now.
+func Mint(spec string, root []byte, subject string, ttl time.Duration, now time.Time) (*Credential, error) {
+	kind, context, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, errors.New("Credential lifetime must be positive")
+	}
+	if len(root) == 0 {
+		return nil, errors.New("No root secret to derive from")
+	}
+
+	// expiries are whole seconds, so that they survive encoding
+	expiry := now.Add(ttl).Truncate(time.Second).UTC()
+	cred := &Credential{Kind: kind, Context: context, Expiry: expiry}
+	switch kind {
+	case "key":
+		cred.Key = SubKey(root, context, expiry)
+	default:
+		claims := Claims{Subject: subject, Context: context, Issued: now.Truncate(time.Second).UTC(), Expiry: expiry}
+		if cred.Token, err = sign(root, claims); err != nil {
+			return nil, err
+		}
+	}
+	return cred, nil
+}
+
+// SubKey returns the sub-key of root for context expiring at expiry.
+func SubKey(root []byte, context string, expiry time.Time) []byte {
+	info := "key\x00" + context + "\x00" + strconv.FormatInt(expiry.Unix(), 10)
+	return hkdf(root, []byte(info), KeySize)
+}
+
+// VerifyToken checks that token was signed with a key derived from root
+// for context, and that it has not expired, returning its claims.
+func VerifyToken(token string, root []byte, context string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Malformed token")
+	}
+
+	if !hmac.Equal(sig, tokenMAC(root, context, payload)) {
+		return nil, errors.New("Invalid token signature")
+	}
+	claims := new(Claims)
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	if claims.Context != context {
+		return nil, errors.New("Token is for another context")
+	}
+	if !now.Before(claims.Expiry) {
+		return nil, errors.New("Token has expired")
+	}
+	return claims, nil
+}
+
+// sign returns the token of claims, the base64 encoded claims and their
+// MAC separated by a dot.
+func sign(root []byte, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(tokenMAC(root, claims.Context, payload)), nil
+}
+
+func tokenMAC(root []byte, context string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, hkdf(root, []byte("token\x00"+context), sha256.Size))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// hkdf returns length bytes of the HKDF-SHA256 (RFC 5869) of secret
+// with info and no salt.
+func hkdf(secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// parse splits a spec into its kind and context.
+func parse(spec string) (kind, context string, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid derivation %q", spec)
+	}
+	switch parts[0] {
+	case "key", "token":
+		return parts[0], parts[1], nil
+	default:
+		return "", "", fmt.Errorf("Unknown derivation %q", parts[0])
+	}
+}
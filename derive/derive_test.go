@@ -0,0 +1,109 @@
+// derive_test.go: tests for derive.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package derive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869, test case 3
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	okm, _ := hex.DecodeString("8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8")
+	if out := hkdf(ikm, nil, len(okm)); !bytes.Equal(out, okm) {
+		t.Fatalf("Wrong HKDF output %x", out)
+	}
+}
+
+func TestMintKey(t *testing.T) {
+	root := []byte("root secret")
+	now := time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC)
+
+	cred, err := Mint("key:db-backup", root, "Alice", time.Hour, now)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cred.Kind != "key" || cred.Context != "db-backup" || len(cred.Key) != KeySize || cred.Token != "" {
+		t.Fatalf("Wrong credential %v", cred)
+	}
+	if !cred.Expiry.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Wrong expiry %v", cred.Expiry)
+	}
+	if !bytes.Equal(SubKey(root, "db-backup", cred.Expiry), cred.Key) {
+		t.Fatalf("Sub-key cannot be derived again")
+	}
+
+	// other contexts, expiries and roots give other keys
+	for _, other := range [][]byte{
+		SubKey(root, "db-restore", cred.Expiry),
+		SubKey(root, "db-backup", cred.Expiry.Add(time.Second)),
+		SubKey([]byte("other root"), "db-backup", cred.Expiry),
+	} {
+		if bytes.Equal(other, cred.Key) {
+			t.Fatalf("Sub-key is not bound to its inputs")
+		}
+	}
+}
+
+func TestMintToken(t *testing.T) {
+	root := []byte("root secret")
+	now := time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC)
+
+	cred, err := Mint("token:deploy", root, "Alice", 10*time.Minute, now)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cred.Kind != "token" || cred.Token == "" || cred.Key != nil {
+		t.Fatalf("Wrong credential %v", cred)
+	}
+
+	claims, err := VerifyToken(cred.Token, root, "deploy", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if claims.Subject != "Alice" || !claims.Expiry.Equal(cred.Expiry) || !claims.Issued.Equal(now) {
+		t.Fatalf("Wrong claims %v", claims)
+	}
+
+	if _, err = VerifyToken(cred.Token, root, "deploy", now.Add(10*time.Minute)); err == nil {
+		t.Fatalf("Expired token verified")
+	}
+	if _, err = VerifyToken(cred.Token, root, "other", now); err == nil {
+		t.Fatalf("Token verified for another context")
+	}
+	if _, err = VerifyToken(cred.Token, []byte("other root"), "deploy", now); err == nil {
+		t.Fatalf("Token verified with another root")
+	}
+	parts := strings.Split(cred.Token, ".")
+	forged, _ := Mint("token:deploy", root, "Mallory", time.Hour, now)
+	if _, err = VerifyToken(strings.Split(forged.Token, ".")[0]+"."+parts[1], root, "deploy", now); err == nil {
+		t.Fatalf("Token verified with swapped claims")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, spec := range []string{"key:a", "token:deploy:prod"} {
+		if err := Check(spec); err != nil {
+			t.Fatalf("Valid spec %q refused: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "key:", "key", "field:password"} {
+		if err := Check(spec); err == nil {
+			t.Fatalf("Invalid spec %q accepted", spec)
+		}
+	}
+
+	now := time.Now()
+	if _, err := Mint("key:a", []byte("root"), "Alice", 0, now); err == nil {
+		t.Fatalf("Credential without lifetime minted")
+	}
+	if _, err := Mint("key:a", nil, "Alice", time.Hour, now); err == nil {
+		t.Fatalf("Credential minted from nothing")
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"errors"
+	"io"
+	"math/big"
 
 	"github.com/cloudflare/redoctober/padding"
 	"github.com/cloudflare/redoctober/symcrypt"
@@ -23,7 +25,13 @@ var Curve = elliptic.P256
 // Encrypt secures and authenticates its input using the public key
 // using ECDHE with AES-128-CBC-HMAC-SHA1.
 func Encrypt(pub *ecdsa.PublicKey, in []byte) (out []byte, err error) {
-	ephemeral, err := ecdsa.GenerateKey(Curve(), rand.Reader)
+	return EncryptFrom(rand.Reader, pub, in)
+}
+
+// EncryptFrom is Encrypt, taking the ephemeral key and the IV from
+// random, so that the same random bytes give the same output.
+func EncryptFrom(random io.Reader, pub *ecdsa.PublicKey, in []byte) (out []byte, err error) {
+	ephemeral, err := ephemeralKey(random)
 	if err != nil {
 		return
 	}
@@ -32,8 +40,8 @@ func Encrypt(pub *ecdsa.PublicKey, in []byte) (out []byte, err error) {
 		return nil, errors.New("Failed to generate encryption key")
 	}
 	shared := sha256.Sum256(x.Bytes())
-	iv, err := symcrypt.MakeRandom(16)
-	if err != nil {
+	iv := make([]byte, 16)
+	if _, err = io.ReadFull(random, iv); err != nil {
 		return
 	}
 
@@ -57,10 +65,34 @@ func Encrypt(pub *ecdsa.PublicKey, in []byte) (out []byte, err error) {
 	return
 }
 
+// ephemeralKey returns a key generated from random, as in FIPS 186-4
+// B.4.1. Unlike ecdsa.GenerateKey, it reads random the same way every
+// time.
+func ephemeralKey(random io.Reader) (*ecdsa.PrivateKey, error) {
+	params := Curve().Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return nil, err
+	}
+
+	k := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(params.N, big.NewInt(1))
+	k.Mod(k, n)
+	k.Add(k, big.NewInt(1))
+
+	priv := &ecdsa.PrivateKey{D: k}
+	priv.PublicKey.Curve = Curve()
+	priv.PublicKey.X, priv.PublicKey.Y = priv.PublicKey.Curve.ScalarBaseMult(k.Bytes())
+	return priv, nil
+}
+
 // Decrypt authenticates and recovers the original message from
 // its input using the private key and the ephemeral key included in
 // the message.
 func Decrypt(priv *ecdsa.PrivateKey, in []byte) (out []byte, err error) {
+	if len(in) == 0 || len(in) < 1+int(in[0]) {
+		return nil, errors.New("Invalid ciphertext")
+	}
 	ephLen := int(in[0])
 	ephPub := in[1 : 1+ephLen]
 	ct := in[1+ephLen:]
@@ -69,8 +101,7 @@ func Decrypt(priv *ecdsa.PrivateKey, in []byte) (out []byte, err error) {
 	}
 
 	x, y := elliptic.Unmarshal(Curve(), ephPub)
-	ok := Curve().IsOnCurve(x, y) // Rejects the identity point too.
-	if x == nil || !ok {
+	if x == nil || !Curve().IsOnCurve(x, y) { // Rejects the identity point too.
 		return nil, errors.New("Invalid public key")
 	}
 
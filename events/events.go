@@ -0,0 +1,82 @@
+// Package events passes the events of the Red October server, such as
+// delegations and decryptions, to any number of subscribers as they
+// happen.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event describes something that happened on the server. Name is the
+// user who caused the event, or who it happened to.
+type Event struct {
+	Time      time.Time
+	Type      string
+	Name      string
+	Labels    []string `json:",omitempty"`
+	Delegates []string `json:",omitempty"`
+	Uses      int      `json:",omitempty"`
+	Reason    string   `json:",omitempty"`
+
+	// Fingerprint identifies the data decrypted, see core.Fingerprint.
+	Fingerprint string `json:",omitempty"`
+
+	// Source is the address of the client whose request caused the
+	// event, and Anomaly the kind of an alert raised about unusual
+	// activity (see package anomaly).
+	Source  string `json:",omitempty"`
+	Anomaly string `json:",omitempty"`
+}
+
+// Bus hands every published event to each of its subscribers. It is
+// safe to use from several goroutines.
+type Bus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+// backlog is the number of events kept for a subscriber that is not
+// keeping up. Further events are dropped until it catches up.
+const backlog = 64
+
+// New returns an empty event bus.
+func New() *Bus {
+	return &Bus{subscribers: make(map[chan Event]bool)}
+}
+
+// Subscribe returns a channel receiving all events published from now
+// on, and a function to cancel the subscription which closes it.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, backlog)
+
+	b.lock.Lock()
+	b.subscribers[ch] = true
+	b.lock.Unlock()
+
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends an event to the subscribers. It never blocks: a
+// subscriber whose backlog is full misses the event.
+func (b *Bus) Publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// events_test.go: tests for events.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	b := New()
+
+	first, cancelFirst := b.Subscribe()
+	second, cancelSecond := b.Subscribe()
+	defer cancelSecond()
+
+	b.Publish(Event{Time: time.Now(), Type: "delegate", Name: "Alice"})
+	for _, ch := range []<-chan Event{first, second} {
+		if e := <-ch; e.Type != "delegate" || e.Name != "Alice" {
+			t.Fatalf("Wrong event received: %v", e)
+		}
+	}
+
+	cancelFirst()
+	cancelFirst()
+	if _, ok := <-first; ok {
+		t.Fatalf("Cancelled subscription still open")
+	}
+
+	// A subscriber that does not keep up misses events rather than
+	// blocking the publisher.
+	for i := 0; i < backlog+10; i++ {
+		b.Publish(Event{Type: "decrypt", Uses: i})
+	}
+	if len(second) != backlog {
+		t.Fatalf("Expected %d events, got %d", backlog, len(second))
+	}
+	if e := <-second; e.Uses != 0 {
+		t.Fatalf("Wrong event received: %v", e)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/cloudflare/redoctober/chaos"
 	"github.com/cloudflare/redoctober/ecdh"
 	"github.com/cloudflare/redoctober/passvault"
 )
@@ -29,27 +30,54 @@ type DelegateIndex struct {
 	Slot string
 }
 
+// String returns the identifier of the delegation used in summaries.
+func (d DelegateIndex) String() string {
+	if d.Slot != "" {
+		return fmt.Sprintf("%s-%s", d.Name, d.Slot)
+	}
+	return d.Name
+}
+
 // Usage holds the permissions of a delegated permission
 type Usage struct {
-	Uses   int       // Number of uses delegated
-	Labels []string  // File labels allowed to decrypt
-	Users  []string  // Set of users allows to decrypt
-	Expiry time.Time // Expiration of usage
+	Uses      int            // Number of uses delegated
+	LabelUses map[string]int `json:",omitempty"` // Number of uses delegated per label
+	Labels    []string       // File labels allowed to decrypt
+	Users     []string       // Set of users allows to decrypt
+	Expiry    time.Time      // Expiration of usage
+	Created   time.Time      // Time of delegation
+	Device    string         `json:",omitempty"` // Device decryptions must be requested from, if bound
 }
 
 // ActiveUser holds the information about an actively delegated key.
 type ActiveUser struct {
 	Usage
+	ID    string
 	Admin bool
 	Type  string
 
-	rsaKey rsa.PrivateKey
-	eccKey *ecdsa.PrivateKey
+	rsaKey    rsa.PrivateKey
+	eccKey    *ecdsa.PrivateKey
+	unwrapped unwrapped
 }
 
 // Cache represents the current list of delegated keys in memory
 type Cache struct {
 	UserKeys map[DelegateIndex]ActiveUser
+
+	// included holds the delegations of the parent of a cache
+	// returned by Since or ForDevice.
+	included map[DelegateIndex]bool
+
+	unwrapTTL time.Duration // see SetUnwrapTTL
+
+	// isMember tells whether a user belongs to a group named in the
+	// Users of a delegation (see SetGroups).
+	isMember func(user, group string) bool
+
+	// lapsed holds the users whose delegations were purged by Refresh
+	// since they last delegated, for Reason.
+	lapsed map[string]bool
 }
 
 // matchesLabel returns true if this usage applies the user and label
@@ -60,19 +88,32 @@ func (usage Usage) matchesLabel(labels []string) bool {
 		return true
 	}
 
+	_, ok := usage.matchedLabel(labels)
+	return ok
+}
+
+// matchedLabel returns the first label allowed by this usage which
+// still has uses left in its budget. Labels without a budget are only
+// limited by the overall number of uses.
+func (usage Usage) matchedLabel(labels []string) (string, bool) {
 	for _, validLabel := range usage.Labels {
 		for _, label := range labels {
-			if label == validLabel {
-				return true
+			if label != validLabel {
+				continue
+			}
+			if uses, ok := usage.LabelUses[label]; !ok || uses > 0 {
+				return label, true
 			}
 		}
 	}
-	return false
+	return "", false
 }
 
 // matches returns true if this usage applies the user and label
 // an empty array of Users indicates that all users are valid
-func (usage Usage) matches(user string, labels []string) bool {
+// isMember, if not nil, tells whether the user belongs to a group
+// listed in Users
+func (usage Usage) matches(user string, labels []string, isMember func(user, group string) bool) bool {
 	if !usage.matchesLabel(labels) {
 		return false
 	}
@@ -84,18 +125,30 @@ func (usage Usage) matches(user string, labels []string) bool {
 		if user == validUser {
 			return true
 		}
+		if isMember != nil && isMember(user, validUser) {
+			return true
+		}
 	}
 	return false
 }
 
 // NewCache initalizes a new cache.
 func NewCache() Cache {
-	return Cache{make(map[DelegateIndex]ActiveUser)}
+	return Cache{UserKeys: make(map[DelegateIndex]ActiveUser)}
+}
+
+// SetGroups sets the function telling whether a user belongs to a
+// group, such as the admins, named in the Users of a delegation. Groups
+// are checked when a delegation is used, so that delegations to a group
+// follow changes to its members.
+func (cache *Cache) SetGroups(isMember func(user, group string) bool) {
+	cache.isMember = isMember
 }
 
 // setUser takes an ActiveUser and adds it to the cache.
 func (cache *Cache) setUser(in ActiveUser, name, slot string) {
 	cache.UserKeys[DelegateIndex{Name: name, Slot: slot}] = in
+	delete(cache.lapsed, name)
 }
 
 // Valid returns true if matching active user is present.
@@ -104,7 +157,7 @@ func (cache *Cache) Valid(name, user string, labels []string) (present bool) {
 		if d.Name != name {
 			continue
 		}
-		if key.Usage.matches(user, labels) {
+		if key.Usage.matches(user, labels, cache.isMember) {
 			return true
 		}
 	}
@@ -112,6 +165,32 @@ func (cache *Cache) Valid(name, user string, labels []string) (present bool) {
 	return false
 }
 
+// Reason explains why no delegation of name can be used by user to
+// decrypt data under labels: "missing" if name has not delegated,
+// "expired" if their delegations have expired or been used up, "labels"
+// if none is for the labels, and "user" if none is for user. It returns
+// "" if a delegation can be used.
+func (cache *Cache) Reason(name, user string, labels []string) string {
+	reason := "missing"
+	if cache.lapsed[name] {
+		reason = "expired"
+	}
+	for d, key := range cache.UserKeys {
+		if d.Name != name {
+			continue
+		}
+		if key.Usage.matches(user, labels, cache.isMember) {
+			return ""
+		}
+		if key.Usage.matchesLabel(labels) {
+			reason = "user"
+		} else if reason != "user" {
+			reason = "labels"
+		}
+	}
+	return reason
+}
+
 // MatchUser returns the matching active user if present
 // and a boolean to indicate its presence.
 func (cache *Cache) MatchUser(name, user string, labels []string) (ActiveUser, string, bool) {
@@ -120,7 +199,7 @@ func (cache *Cache) MatchUser(name, user string, labels []string) (ActiveUser, s
 		if d.Name != name {
 			continue
 		}
-		if key.Usage.matches(user, labels) {
+		if key.Usage.matches(user, labels, cache.isMember) {
 			return key, d.Slot, true
 		}
 	}
@@ -133,6 +212,17 @@ func (cache *Cache) MatchUser(name, user string, labels []string) (ActiveUser, s
 func (cache *Cache) useKey(name, user, slot string, labels []string) {
 	if val, slot, present := cache.MatchUser(name, user, labels); present {
 		val.Usage.Uses -= 1
+		if label, ok := val.Usage.matchedLabel(labels); ok && val.Usage.LabelUses != nil {
+			// copy the budgets so that checkpoints are unaffected
+			labelUses := make(map[string]int, len(val.Usage.LabelUses))
+			for l, uses := range val.Usage.LabelUses {
+				labelUses[l] = uses
+			}
+			if _, ok := labelUses[label]; ok {
+				labelUses[label] -= 1
+			}
+			val.Usage.LabelUses = labelUses
+		}
 		cache.setUser(val, name, slot)
 	}
 }
@@ -141,34 +231,178 @@ func (cache *Cache) useKey(name, user, slot string, labels []string) {
 func (cache *Cache) GetSummary() map[string]ActiveUser {
 	summaryData := make(map[string]ActiveUser)
 	for d, activeUser := range cache.UserKeys {
-		summaryInfo := d.Name
-		if d.Slot != "" {
-			summaryInfo = fmt.Sprintf("%s-%s", d.Name, d.Slot)
-		}
-		summaryData[summaryInfo] = activeUser
+		summaryData[d.String()] = activeUser
 	}
 	return summaryData
 }
 
+// Checkpoint returns a copy of the current delegations that can be
+// passed to Restore to undo the uses consumed after this point.
+func (cache *Cache) Checkpoint() map[DelegateIndex]ActiveUser {
+	checkpoint := make(map[DelegateIndex]ActiveUser, len(cache.UserKeys))
+	for d, active := range cache.UserKeys {
+		checkpoint[d] = active
+	}
+	return checkpoint
+}
+
+// Restore puts back the delegations saved by Checkpoint.
+func (cache *Cache) Restore(checkpoint map[DelegateIndex]ActiveUser) {
+	cache.UserKeys = checkpoint
+}
+
 // FlushCache removes all delegated keys.
 func (cache *Cache) FlushCache() {
-	for d := range cache.UserKeys {
+	for d, active := range cache.UserKeys {
+		active.unwrapped.clear()
 		delete(cache.UserKeys, d)
 	}
+	cache.lapsed = nil
+}
+
+// DeleteUser removes every delegated key of the named user.
+func (cache *Cache) DeleteUser(name string) {
+	for d, active := range cache.UserKeys {
+		if d.Name == name {
+			active.unwrapped.clear()
+			delete(cache.UserKeys, d)
+		}
+	}
+	delete(cache.lapsed, name)
+}
+
+// DeleteSlot removes the delegated key of the named user in a slot,
+// returning false if there was none.
+func (cache *Cache) DeleteSlot(name, slot string) bool {
+	d := DelegateIndex{Name: name, Slot: slot}
+	active, ok := cache.UserKeys[d]
+	if !ok {
+		return false
+	}
+	active.unwrapped.clear()
+	delete(cache.UserKeys, d)
+	return true
 }
 
 // Refresh purges all expired or used up keys.
 func (cache *Cache) Refresh() {
 	for d, active := range cache.UserKeys {
-		if active.Usage.Expiry.Before(time.Now()) || active.Usage.Uses <= 0 {
+		if active.Usage.Expiry.Before(chaos.Now()) || active.Usage.Uses <= 0 {
 			log.Println("Record expired", d.Name, d.Slot, active.Usage.Users, active.Usage.Labels, active.Usage.Expiry)
+			active.unwrapped.clear()
+			delete(cache.UserKeys, d)
+			if cache.lapsed == nil {
+				cache.lapsed = make(map[string]bool)
+			}
+			cache.lapsed[d.Name] = true
+			continue
+		}
+		active.unwrapped.expire()
+	}
+}
+
+// subset returns a cache holding only the delegations for which keep
+// returns true.
+func (cache *Cache) subset(keep func(active ActiveUser) bool) *Cache {
+	sub := &Cache{UserKeys: make(map[DelegateIndex]ActiveUser), included: make(map[DelegateIndex]bool), unwrapTTL: cache.unwrapTTL, isMember: cache.isMember, lapsed: make(map[string]bool)}
+	for name := range cache.lapsed {
+		sub.lapsed[name] = true
+	}
+	for d, active := range cache.UserKeys {
+		if keep(active) {
+			sub.UserKeys[d] = active
+			sub.included[d] = true
+		}
+	}
+	return sub
+}
+
+// Since returns a cache holding only the delegations made at or after
+// t. Uses consumed through it are applied to this cache by Update.
+func (cache *Cache) Since(t time.Time) *Cache {
+	return cache.subset(func(active ActiveUser) bool {
+		return !active.Usage.Created.Before(t)
+	})
+}
+
+// ForDevice returns a cache holding only the delegations that may be
+// used by decryptions requested from device: those that are not bound
+// to a device, and those bound to it. Uses consumed through it are
+// applied to this cache by Update.
+func (cache *Cache) ForDevice(device string) *Cache {
+	return cache.subset(func(active ActiveUser) bool {
+		return active.Usage.Device == "" || active.Usage.Device == device
+	})
+}
+
+// BindDevice restricts the delegation of name in slot to decryptions
+// requested from device.
+func (cache *Cache) BindDevice(name, slot, device string) {
+	d := DelegateIndex{Name: name, Slot: slot}
+	if active, ok := cache.UserKeys[d]; ok {
+		active.Usage.Device = device
+		cache.UserKeys[d] = active
+	}
+}
+
+// Update applies the uses consumed through a cache returned by Since
+// or ForDevice.
+func (cache *Cache) Update(sub *Cache) {
+	for name := range sub.lapsed {
+		if cache.lapsed == nil {
+			cache.lapsed = make(map[string]bool)
+		}
+		cache.lapsed[name] = true
+	}
+
+	for d := range sub.included {
+		active, ok := cache.UserKeys[d]
+		if !ok {
+			continue
+		}
+
+		if updated, ok := sub.UserKeys[d]; ok {
+			cache.UserKeys[d] = updated
+		} else {
+			active.unwrapped.clear()
 			delete(cache.UserKeys, d)
 		}
 	}
 }
 
+// ClientKey is the AES key of a piece of data wrapped for an HSM record,
+// as unwrapped by the client of its user.
+type ClientKey struct {
+	Wrapped []byte // as wrapped for the record in the data
+	Key     []byte
+}
+
 // AddKeyFromRecord decrypts a key for a given record and adds it to the cache.
-func (cache *Cache) AddKeyFromRecord(record passvault.PasswordRecord, name, password string, users, labels []string, uses int, slot, durationString string) (err error) {
+// labelUses optionally limits the number of uses for individual labels.
+func (cache *Cache) AddKeyFromRecord(record passvault.PasswordRecord, name, password string, users, labels []string, uses int, labelUses map[string]int, slot, durationString string) (err error) {
+	return cache.addKey(record, name, password, users, labels, uses, labelUses, slot, durationString, nil)
+}
+
+// AddKeyFromClient adds a delegation of an HSM record, whose private key
+// is not in the vault, holding the AES keys unwrapped by the client of
+// its user. It can only decrypt the data whose keys it holds, which are
+// kept until it expires.
+func (cache *Cache) AddKeyFromClient(record passvault.PasswordRecord, name, password string, users, labels []string, uses int, labelUses map[string]int, slot, durationString string, keys []ClientKey) (err error) {
+	if record.Type != passvault.HSMRecord {
+		return errors.New("Only HSM records delegate keys unwrapped by their client")
+	}
+	if len(keys) == 0 {
+		return errors.New("No unwrapped keys delegated")
+	}
+	for _, key := range keys {
+		if len(key.Key) != 16 || len(key.Wrapped) == 0 {
+			return errors.New("Invalid unwrapped key")
+		}
+	}
+	return cache.addKey(record, name, password, users, labels, uses, labelUses, slot, durationString, keys)
+}
+
+func (cache *Cache) addKey(record passvault.PasswordRecord, name, password string, users, labels []string, uses int, labelUses map[string]int, slot, durationString string, keys []ClientKey) (err error) {
 	var current ActiveUser
 
 	cache.Refresh()
@@ -179,7 +413,9 @@ func (cache *Cache) AddKeyFromRecord(record passvault.PasswordRecord, name, pass
 		return
 	}
 	current.Usage.Uses = uses
-	current.Usage.Expiry = time.Now().Add(duration)
+	current.Usage.LabelUses = labelUses
+	current.Usage.Created = chaos.Now()
+	current.Usage.Expiry = current.Usage.Created.Add(duration)
 	current.Usage.Users = users
 	current.Usage.Labels = labels
 
@@ -189,6 +425,12 @@ func (cache *Cache) AddKeyFromRecord(record passvault.PasswordRecord, name, pass
 		current.rsaKey, err = record.GetKeyRSA(password)
 	case passvault.ECCRecord:
 		current.eccKey, err = record.GetKeyECC(password)
+	case passvault.HSMRecord:
+		if keys == nil {
+			err = errors.New("Keys of HSM records must be unwrapped by their client")
+		} else {
+			err = record.ValidatePassword(password)
+		}
 	default:
 		err = errors.New("Unknown record type")
 	}
@@ -197,16 +439,59 @@ func (cache *Cache) AddKeyFromRecord(record passvault.PasswordRecord, name, pass
 		return
 	}
 
+	if current.ID, err = passvault.NewID(); err != nil {
+		return
+	}
+
 	// set types
 	current.Type = record.Type
-	current.Admin = record.Admin
+	current.Admin = record.IsAdmin()
+	current.unwrapped = make(unwrapped)
+	for _, key := range keys {
+		current.unwrapped.put(key.Wrapped, key.Key, current.Usage.Expiry)
+	}
 
 	// add current to map (overwriting previous for this name)
+	if previous, ok := cache.UserKeys[DelegateIndex{Name: name, Slot: slot}]; ok {
+		previous.unwrapped.clear()
+	}
 	cache.setUser(current, name, slot)
 
 	return
 }
 
+// unwrapAESKey extracts the AES key in pubEncryptedKey using the
+// private key of decryptKey.
+func unwrapAESKey(decryptKey ActiveUser, pubEncryptedKey []byte) (aesKey []byte, err error) {
+	// pick the aesKey to use for decryption
+	switch decryptKey.Type {
+	case passvault.RSARecord:
+		// extract the aes key from the pubEncryptedKey
+		return rsa.DecryptOAEP(sha1.New(), rand.Reader, &decryptKey.rsaKey, pubEncryptedKey, nil)
+	case passvault.ECCRecord:
+		// extract the aes key from the pubEncryptedKey
+		return ecdh.Decrypt(decryptKey.eccKey, pubEncryptedKey)
+	default:
+		return nil, errors.New("unknown type")
+	}
+}
+
+// decryptBlocks decrypts each of the 16 byte blocks in with aesKey.
+func decryptBlocks(in [][]byte, aesKey []byte) (out [][]byte, err error) {
+	aesSession, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return
+	}
+
+	for _, block := range in {
+		tmp := make([]byte, 16)
+		aesSession.Decrypt(tmp, block)
+
+		out = append(out, tmp)
+	}
+	return
+}
+
 // DecryptKey decrypts a 16 byte key using the key corresponding to the name parameter
 // For RSA and EC keys, the cached RSA/EC key is used to decrypt
 // the pubEncryptedKey which is then used to decrypt the input
@@ -219,38 +504,20 @@ func (cache *Cache) DecryptKey(in []byte, name, user string, labels []string, pu
 		return nil, errors.New("Key not delegated")
 	}
 
-	var aesKey []byte
-
-	// pick the aesKey to use for decryption
-	switch decryptKey.Type {
-	case passvault.RSARecord:
-		// extract the aes key from the pubEncryptedKey
-		aesKey, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, &decryptKey.rsaKey, pubEncryptedKey, nil)
-		if err != nil {
-			return out, err
-		}
-	case passvault.ECCRecord:
-		// extract the aes key from the pubEncryptedKey
-		aesKey, err = ecdh.Decrypt(decryptKey.eccKey, pubEncryptedKey)
-
-		if err != nil {
-			return out, err
-		}
-	default:
-		return nil, errors.New("unknown type")
+	aesKey, err := cache.unwrap(decryptKey, pubEncryptedKey)
+	if err != nil {
+		return
 	}
 
 	// decrypt
-	aesSession, err := aes.NewCipher(aesKey)
+	blocks, err := decryptBlocks([][]byte{in}, aesKey)
 	if err != nil {
-		return out, err
+		return
 	}
-	out = make([]byte, 16)
-	aesSession.Decrypt(out, in)
 
 	cache.useKey(name, user, slot, labels)
 
-	return
+	return blocks[0], nil
 }
 
 // DecryptShares decrypts an array of 16 byte shares using the key corresponding
@@ -263,41 +530,64 @@ func (cache *Cache) DecryptShares(in [][]byte, name, user string, labels []strin
 		return nil, errors.New("Key not delegated")
 	}
 
-	var aesKey []byte
+	aesKey, err := cache.unwrap(decryptKey, pubEncryptedKey)
+	if err != nil {
+		return
+	}
 
-	// pick the aesKey to use for decryption
-	switch decryptKey.Type {
+	if out, err = decryptBlocks(in, aesKey); err != nil {
+		return
+	}
+
+	cache.useKey(name, user, slot, labels)
+
+	return
+}
+
+// absentKey recovers the key of a user on a planned absence with the
+// delegation of their substitute, consuming one of its uses.
+func (cache *Cache) absentKey(record passvault.PasswordRecord, absence *passvault.Absence, user string, labels []string) (key ActiveUser, err error) {
+	randomKey, err := cache.DecryptKey(absence.WrappedKey, absence.Substitute, user, labels, absence.PubWrapKey)
+	if err != nil {
+		return
+	}
+
+	key.Type = record.Type
+	switch record.Type {
 	case passvault.RSARecord:
-		// extract the aes key from the pubEncryptedKey
-		aesKey, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, &decryptKey.rsaKey, pubEncryptedKey, nil)
-		if err != nil {
-			return
-		}
+		key.rsaKey, err = absence.GetKeyRSA(randomKey)
 	case passvault.ECCRecord:
-		// extract the aes key from the pubEncryptedKey
-		aesKey, err = ecdh.Decrypt(decryptKey.eccKey, pubEncryptedKey)
-
-		if err != nil {
-			return
-		}
+		key.eccKey, err = absence.GetKeyECC(randomKey)
 	default:
-		return nil, errors.New("unknown type")
+		err = errors.New("Unknown record type")
 	}
+	return
+}
 
-	// decrypt
-	aesSession, err := aes.NewCipher(aesKey)
+// DecryptKeyAbsent is like DecryptKey for a user on a planned absence,
+// using the delegation of their substitute instead of their own.
+func (cache *Cache) DecryptKeyAbsent(in []byte, record passvault.PasswordRecord, absence *passvault.Absence, user string, labels []string, pubEncryptedKey []byte) (out []byte, err error) {
+	blocks, err := cache.DecryptSharesAbsent([][]byte{in}, record, absence, user, labels, pubEncryptedKey)
 	if err != nil {
 		return
 	}
+	return blocks[0], nil
+}
 
-	for _, encShare := range in {
-		tmp := make([]byte, 16)
-		aesSession.Decrypt(tmp, encShare)
+// DecryptSharesAbsent is like DecryptShares for a user on a planned
+// absence, using the delegation of their substitute instead of their own.
+func (cache *Cache) DecryptSharesAbsent(in [][]byte, record passvault.PasswordRecord, absence *passvault.Absence, user string, labels []string, pubEncryptedKey []byte) (out [][]byte, err error) {
+	cache.Refresh()
 
-		out = append(out, tmp)
+	decryptKey, err := cache.absentKey(record, absence, user, labels)
+	if err != nil {
+		return
 	}
 
-	cache.useKey(name, user, slot, labels)
+	aesKey, err := unwrapAESKey(decryptKey, pubEncryptedKey)
+	if err != nil {
+		return
+	}
 
-	return
+	return decryptBlocks(in, aesKey)
 }
@@ -5,9 +5,13 @@ package keycache
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
 	"testing"
 	"time"
 
+	"github.com/cloudflare/redoctober/ecdh"
 	"github.com/cloudflare/redoctober/passvault"
 	"github.com/cloudflare/redoctober/symcrypt"
 )
@@ -27,7 +31,7 @@ func TestUsesFlush(t *testing.T) {
 	// Initialize keycache and delegate the user's key to it.
 	cache := NewCache()
 
-	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 2, "", "1h")
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 2, nil, "", "1h")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -91,7 +95,7 @@ func TestTimeFlush(t *testing.T) {
 
 	cache := NewCache()
 
-	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 10, "", "1s")
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 10, nil, "", "1s")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -130,7 +134,7 @@ func TestGoodLabel(t *testing.T) {
 
 	cache := NewCache()
 
-	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, []string{"red"}, 1, "", "1h")
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, []string{"red"}, 1, nil, "", "1h")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -172,7 +176,7 @@ func TestBadLabel(t *testing.T) {
 
 	cache := NewCache()
 
-	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, []string{"red"}, 1, "", "1h")
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, []string{"red"}, 1, nil, "", "1h")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -218,7 +222,7 @@ func TestGoodUser(t *testing.T) {
 		pr, "user", "weakpassword",
 		[]string{"ci", "buildeng", "user"},
 		[]string{"red", "blue"},
-		1, "", "1h",
+		1, nil, "", "1h",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -265,7 +269,7 @@ func TestBadUser(t *testing.T) {
 		pr, "user", "weakpassword",
 		[]string{"ci", "buildeng", "user"},
 		[]string{"red", "blue"},
-		1, "", "1h",
+		1, nil, "", "1h",
 	)
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -292,3 +296,443 @@ func TestBadUser(t *testing.T) {
 		t.Fatalf("Error in number of live keys %v", cache.UserKeys)
 	}
 }
+
+func TestLabelUses(t *testing.T) {
+	// Initialize passvault with one dummy user.
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pr, err := records.AddNewRecord("user", "weakpassword", true, passvault.DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	err = cache.AddKeyFromRecord(
+		pr, "user", "weakpassword", nil,
+		[]string{"red", "blue"}, 3,
+		map[string]int{"red": 1}, "", "1h",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	checkpoint := cache.Checkpoint()
+
+	dummy := make([]byte, 16)
+	key, err := pr.EncryptKey(dummy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err = cache.DecryptKey(dummy, "user", "anybody", []string{"red"}, key); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The budget for red is used up, but blue is still allowed.
+	if _, err = cache.DecryptKey(dummy, "user", "anybody", []string{"red"}, key); err == nil {
+		t.Fatalf("Decryption should have failed once the label budget was used")
+	}
+	if _, err = cache.DecryptKey(dummy, "user", "anybody", []string{"blue"}, key); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if cache.UserKeys[DelegateIndex{Name: "user"}].Uses != 1 {
+		t.Fatalf("Error in number of live keys")
+	}
+
+	// Restoring a checkpoint also restores the label budgets.
+	cache.Restore(checkpoint)
+	if _, err = cache.DecryptKey(dummy, "user", "anybody", []string{"red"}, key); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	for _, name := range []string{"alice", "bob"} {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, passvault.ECCRecord)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, slot := range []string{"", "spare"} {
+			if err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 2, nil, slot, "1h"); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+
+	cache.DeleteUser("alice")
+	if len(cache.UserKeys) != 2 {
+		t.Fatalf("Error in number of live keys")
+	}
+	for d := range cache.UserKeys {
+		if d.Name != "bob" {
+			t.Fatalf("Delegation of %s left in the cache", d.Name)
+		}
+	}
+}
+
+func TestForDevice(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	for _, name := range []string{"alice", "bob"} {
+		pr, err := records.AddNewRecord(name, "weakpassword", false, passvault.ECCRecord)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = cache.AddKeyFromRecord(pr, name, "weakpassword", nil, nil, 2, nil, "", "1h"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	cache.BindDevice("alice", "", "laptop")
+
+	if view := cache.ForDevice("laptop"); len(view.UserKeys) != 2 {
+		t.Fatalf("Error in number of keys for the bound device")
+	}
+
+	view := cache.ForDevice("phone")
+	if _, ok := view.UserKeys[DelegateIndex{Name: "alice"}]; ok || len(view.UserKeys) != 1 {
+		t.Fatalf("Bound delegation used by another device")
+	}
+
+	// uses consumed through the view are applied to the cache, and
+	// delegations left out of it are kept
+	delete(view.UserKeys, DelegateIndex{Name: "bob"})
+	cache.Update(view)
+	if _, ok := cache.UserKeys[DelegateIndex{Name: "bob"}]; ok {
+		t.Fatalf("Consumed delegation left in the cache")
+	}
+	if _, ok := cache.UserKeys[DelegateIndex{Name: "alice"}]; !ok {
+		t.Fatalf("Bound delegation removed from the cache")
+	}
+}
+
+func TestUnwrapTTL(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pr, err := records.AddNewRecord("user", "weakpassword", true, passvault.DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	cache.SetUnwrapTTL(time.Hour)
+	if err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 3, nil, "", "1h"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	key, err := symcrypt.MakeRandom(16)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pubEncryptedKey, err := pr.EncryptKey(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	block := make([]byte, 16)
+
+	first, err := cache.DecryptKey(block, "user", "anybody", nil, pubEncryptedKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	active := cache.UserKeys[DelegateIndex{Name: "user"}]
+	if len(active.unwrapped) != 1 {
+		t.Fatalf("Unwrapped key not kept")
+	}
+
+	// the kept key gives the same result, and still consumes a use
+	second, err := cache.DecryptKey(block, "user", "anybody", nil, pubEncryptedKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("Kept key decrypted differently")
+	}
+	if uses := cache.UserKeys[DelegateIndex{Name: "user"}].Usage.Uses; uses != 1 {
+		t.Fatalf("Wrong number of uses left: %d", uses)
+	}
+
+	// keys are wiped once expired
+	var kept []byte
+	for _, k := range active.unwrapped {
+		kept = k.key
+	}
+	for h, k := range active.unwrapped {
+		k.expires = time.Now()
+		active.unwrapped[h] = k
+	}
+	cache.Refresh()
+	if len(active.unwrapped) != 0 || !bytes.Equal(kept, make([]byte, len(kept))) {
+		t.Fatalf("Expired key not wiped")
+	}
+
+	// and with their delegation
+	if _, err = cache.DecryptKey(block, "user", "anybody", nil, pubEncryptedKey); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(active.unwrapped) != 1 {
+		t.Fatalf("Unwrapped key not kept")
+	}
+	cache.Refresh()
+	if len(cache.UserKeys) != 0 || len(active.unwrapped) != 0 {
+		t.Fatalf("Key kept past its delegation")
+	}
+}
+
+func TestGroupUser(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pr, err := records.AddNewRecord("user", "weakpassword", true, passvault.DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", []string{"team:sre"}, nil, 2, nil, "", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if cache.Valid("user", "alice", nil) {
+		t.Fatalf("Delegation to a group valid without groups")
+	}
+
+	members := map[string]bool{"alice": true}
+	cache.SetGroups(func(user, group string) bool {
+		return group == "team:sre" && members[user]
+	})
+	if !cache.Valid("user", "alice", nil) || cache.Valid("user", "bob", nil) {
+		t.Fatalf("Error in delegation to a group")
+	}
+	if !cache.Since(time.Time{}).Valid("user", "alice", nil) {
+		t.Fatalf("Groups not kept by a subset of the cache")
+	}
+
+	// membership is checked when the delegation is used
+	members["alice"], members["bob"] = false, true
+	if cache.Valid("user", "alice", nil) || !cache.Valid("user", "bob", nil) {
+		t.Fatalf("Error in delegation to a group after a change of members")
+	}
+}
+
+func TestSealRecover(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rsaRec, err := records.AddNewRecord("alice", "weakpassword", true, passvault.RSARecord)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eccRec, err := records.AddNewRecord("bob", "weakpassword", false, passvault.ECCRecord)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	if err = cache.AddKeyFromRecord(rsaRec, "alice", "weakpassword", nil, []string{"red"}, 2, nil, "", "1h"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = cache.AddKeyFromRecord(eccRec, "bob", "weakpassword", []string{"carol"}, nil, 1, nil, "night", "1h"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	recovery, err := ecdsa.GenerateKey(ecdh.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sealed, err := cache.Seal(&recovery.PublicKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the snapshot is useless without the recovery key
+	other, err := ecdsa.GenerateKey(ecdh.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	restored := NewCache()
+	if _, err = restored.Recover(other, sealed); err == nil {
+		t.Fatalf("Snapshot recovered with the wrong key")
+	}
+
+	added, err := restored.Recover(recovery, sealed)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(added) != 2 || len(restored.UserKeys) != 2 {
+		t.Fatalf("Wrong delegations recovered: %v", added)
+	}
+	bobKey := restored.UserKeys[DelegateIndex{Name: "bob", Slot: "night"}]
+	if bobKey.Type != passvault.ECCRecord || bobKey.Usage.Uses != 1 || len(bobKey.Usage.Users) != 1 {
+		t.Fatalf("Delegation not recovered: %+v", bobKey)
+	}
+
+	// the recovered keys decrypt as the originals did
+	key, err := symcrypt.MakeRandom(16)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	block := make([]byte, 16)
+	for _, c := range []struct {
+		pr    passvault.PasswordRecord
+		name  string
+		user  string
+		label []string
+	}{
+		{rsaRec, "alice", "anybody", []string{"red"}},
+		{eccRec, "bob", "carol", nil},
+	} {
+		pubEncryptedKey, err := c.pr.EncryptKey(key)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		want, err := cache.DecryptKey(block, c.name, c.user, c.label, pubEncryptedKey)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		got, err := restored.DecryptKey(block, c.name, c.user, c.label, pubEncryptedKey)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: recovered key decrypted differently", c.name)
+		}
+	}
+
+	// live delegations are not replaced, but one used up since the
+	// snapshot is recovered with the uses it had then
+	added, err = restored.Recover(recovery, sealed)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(added) != 1 || added[0].Name != "bob" || len(restored.UserKeys) != 2 {
+		t.Fatalf("Wrong delegations recovered: %v", added)
+	}
+	if uses := restored.UserKeys[DelegateIndex{Name: "alice"}].Usage.Uses; uses != 1 {
+		t.Fatalf("Live delegation replaced: %d uses", uses)
+	}
+}
+
+func TestSealUser(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pr, err := records.AddNewRecord("user", "weakpassword", false, passvault.ECCRecord)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	escrow, err := ecdsa.GenerateKey(ecdh.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	if _, err = cache.SealUser("user", &escrow.PublicKey); err == nil {
+		t.Fatalf("Key of a user without delegations sealed")
+	}
+	if err = cache.AddKeyFromRecord(pr, "user", "weakpassword", nil, nil, 1, nil, "", "1h"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sealed, err := cache.SealUser("user", &escrow.PublicKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	der, err := ecdh.Decrypt(escrow, sealed)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok || priv.X.Cmp(pr.ECKey.ECPublic.X) != 0 || priv.Y.Cmp(pr.ECKey.ECPublic.Y) != 0 {
+		t.Fatalf("Wrong key sealed")
+	}
+}
+
+func TestReason(t *testing.T) {
+	records, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pr, err := records.AddNewRecord("user", "weakpassword", true, passvault.DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cache := NewCache()
+	if reason := cache.Reason("user", "anybody", nil); reason != "missing" {
+		t.Fatalf("Expected missing, got %q", reason)
+	}
+
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", []string{"ci"}, []string{"red"}, 1, nil, "", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, c := range []struct {
+		user   string
+		labels []string
+		reason string
+	}{
+		{"ci", []string{"red"}, ""},
+		{"ci", []string{"blue"}, "labels"},
+		{"anybody", []string{"red"}, "user"},
+	} {
+		if reason := cache.Reason("user", c.user, c.labels); reason != c.reason {
+			t.Fatalf("Expected %q for %s %v, got %q", c.reason, c.user, c.labels, reason)
+		}
+	}
+
+	dummy := make([]byte, 16)
+	pubEncryptedKey, err := pr.EncryptKey(dummy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = cache.DecryptKey(dummy, "user", "ci", []string{"red"}, pubEncryptedKey); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// used up delegations are reported until the user delegates again
+	cache.Refresh()
+	if reason := cache.Reason("user", "ci", []string{"red"}); reason != "expired" {
+		t.Fatalf("Expected expired, got %q", reason)
+	}
+	view := cache.ForDevice("")
+	if reason := view.Reason("user", "ci", []string{"red"}); reason != "expired" {
+		t.Fatalf("Expected expired through a view, got %q", reason)
+	}
+
+	err = cache.AddKeyFromRecord(pr, "user", "weakpassword", []string{"ci"}, []string{"blue"}, 1, nil, "", "1h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if reason := cache.Reason("user", "ci", []string{"red"}); reason != "labels" {
+		t.Fatalf("Expected labels, got %q", reason)
+	}
+	cache.DeleteUser("user")
+	if reason := cache.Reason("user", "ci", []string{"red"}); reason != "missing" {
+		t.Fatalf("Expected missing, got %q", reason)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+// mlock_other.go: memory is not locked on systems without mlock
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package keycache
+
+func lock(key []byte)   {}
+func unlock(key []byte) {}
@@ -0,0 +1,23 @@
+//go:build unix
+
+// mlock_unix.go: keeping unwrapped keys out of swap
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package keycache
+
+import "syscall"
+
+// lock keeps the memory of key from being swapped out, if allowed.
+func lock(key []byte) {
+	if len(key) > 0 {
+		syscall.Mlock(key)
+	}
+}
+
+// unlock releases the lock taken by lock.
+func unlock(key []byte) {
+	if len(key) > 0 {
+		syscall.Munlock(key)
+	}
+}
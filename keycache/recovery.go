@@ -0,0 +1,138 @@
+// recovery.go: snapshots of the delegations encrypted to a recovery key
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package keycache
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+
+	"github.com/cloudflare/redoctober/chaos"
+	"github.com/cloudflare/redoctober/ecdh"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// sealedKey is a delegation in a sealed snapshot, with its private key
+// in PKCS #8 form.
+type sealedKey struct {
+	DelegateIndex
+	ActiveUser
+	Key []byte
+}
+
+// privateKey returns the private key of a delegation in PKCS #8 form.
+func (active ActiveUser) privateKey() ([]byte, error) {
+	if active.eccKey != nil {
+		return x509.MarshalPKCS8PrivateKey(active.eccKey)
+	}
+	return x509.MarshalPKCS8PrivateKey(&active.rsaKey)
+}
+
+// Seal returns the live delegations, with their private keys, encrypted
+// to the recovery key pub. The AES keys they have unwrapped are not
+// included.
+func (cache *Cache) Seal(pub *ecdsa.PublicKey) ([]byte, error) {
+	cache.Refresh()
+
+	keys := []sealedKey{}
+	defer func() {
+		for _, k := range keys {
+			wipe(k.Key)
+		}
+	}()
+	for d, active := range cache.UserKeys {
+		// there is no private key to recover for an HSM record
+		if active.Type == passvault.HSMRecord {
+			continue
+		}
+		der, err := active.privateKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sealedKey{DelegateIndex: d, ActiveUser: active, Key: der})
+	}
+
+	in, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(in)
+
+	return ecdh.Encrypt(pub, in)
+}
+
+// SealUser returns the private key of the user name in PKCS #8 form,
+// taken from one of their live delegations, encrypted to pub.
+func (cache *Cache) SealUser(name string, pub *ecdsa.PublicKey) ([]byte, error) {
+	cache.Refresh()
+
+	for d, active := range cache.UserKeys {
+		if d.Name != name {
+			continue
+		}
+		der, err := active.privateKey()
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(der)
+		return ecdh.Encrypt(pub, der)
+	}
+	return nil, errors.New("User has no live delegation")
+}
+
+// Recover adds the delegations of a snapshot returned by Seal, which
+// is decrypted with the recovery key priv. Delegations that have since
+// expired or that are already present are skipped. It returns the
+// delegations added.
+func (cache *Cache) Recover(priv *ecdsa.PrivateKey, sealed []byte) (added []DelegateIndex, err error) {
+	in, err := ecdh.Decrypt(priv, sealed)
+	if err != nil {
+		return
+	}
+	defer wipe(in)
+
+	var keys []sealedKey
+	if err = json.Unmarshal(in, &keys); err != nil {
+		return
+	}
+	defer func() {
+		for _, k := range keys {
+			wipe(k.Key)
+		}
+	}()
+
+	cache.Refresh()
+
+	for _, k := range keys {
+		active := k.ActiveUser
+		if active.Usage.Expiry.Before(chaos.Now()) || active.Usage.Uses <= 0 {
+			continue
+		}
+		if _, ok := cache.UserKeys[k.DelegateIndex]; ok {
+			continue
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(k.Key)
+		if err != nil {
+			return added, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			active.rsaKey = *key
+		case *ecdsa.PrivateKey:
+			active.eccKey = key
+		default:
+			return added, errors.New("Unknown key type in snapshot")
+		}
+		active.unwrapped = make(unwrapped)
+
+		cache.setUser(active, k.Name, k.Slot)
+		added = append(added, k.DelegateIndex)
+	}
+
+	return added, nil
+}
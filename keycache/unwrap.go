@@ -0,0 +1,121 @@
+// unwrap.go: AES keys unwrapped by a delegation, kept for reuse
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package keycache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/cloudflare/redoctober/chaos"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+// unwrapped holds the AES keys a delegation has unwrapped, by hash of
+// the wrapped key. It is shared by the copies of the ActiveUser of the
+// delegation, so that a key is kept however the delegation is used.
+type unwrapped map[[sha256.Size]byte]unwrappedKey
+
+type unwrappedKey struct {
+	key     []byte // in locked memory where possible
+	expires time.Time
+}
+
+// get returns the AES key wrapped in pubEncryptedKey if it was
+// unwrapped before and has not expired.
+func (u unwrapped) get(pubEncryptedKey []byte) ([]byte, bool) {
+	k, ok := u[sha256.Sum256(pubEncryptedKey)]
+	if !ok || !chaos.Now().Before(k.expires) {
+		return nil, false
+	}
+	return k.key, true
+}
+
+// put keeps a copy of the AES key wrapped in pubEncryptedKey until
+// expires.
+func (u unwrapped) put(pubEncryptedKey, aesKey []byte, expires time.Time) {
+	h := sha256.Sum256(pubEncryptedKey)
+	if old, ok := u[h]; ok {
+		wipe(old.key)
+	}
+	key := make([]byte, len(aesKey))
+	copy(key, aesKey)
+	lock(key)
+	u[h] = unwrappedKey{key: key, expires: expires}
+}
+
+// expire forgets the keys that have expired.
+func (u unwrapped) expire() {
+	now := chaos.Now()
+	for h, k := range u {
+		if !now.Before(k.expires) {
+			wipe(k.key)
+			delete(u, h)
+		}
+	}
+}
+
+// clear forgets every key.
+func (u unwrapped) clear() {
+	for h, k := range u {
+		wipe(k.key)
+		delete(u, h)
+	}
+}
+
+// wipe overwrites a key and releases its memory lock.
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+	unlock(key)
+}
+
+// SetUnwrapTTL sets the time for which the AES key of a piece of data
+// unwrapped by a delegation is kept, so that decrypting data encrypted
+// with the same key again does not take a private key operation. Keys
+// are never kept past the expiry of their delegation, and are forgotten
+// with it. Zero keeps none, except those unwrapped by the clients of HSM
+// records, which their delegations cannot unwrap again.
+func (cache *Cache) SetUnwrapTTL(ttl time.Duration) {
+	cache.unwrapTTL = ttl
+	if ttl > 0 {
+		return
+	}
+	for _, active := range cache.UserKeys {
+		if active.Type != passvault.HSMRecord {
+			active.unwrapped.clear()
+		}
+	}
+}
+
+// unwrap extracts the AES key in pubEncryptedKey with the delegation
+// decryptKey, reusing the key it unwrapped before if there is one.
+func (cache *Cache) unwrap(decryptKey ActiveUser, pubEncryptedKey []byte) ([]byte, error) {
+	if decryptKey.Type == passvault.HSMRecord {
+		if aesKey, ok := decryptKey.unwrapped.get(pubEncryptedKey); ok {
+			return aesKey, nil
+		}
+		return nil, errors.New("Key not unwrapped by the client of the HSM record")
+	}
+	if cache.unwrapTTL <= 0 || decryptKey.unwrapped == nil {
+		return unwrapAESKey(decryptKey, pubEncryptedKey)
+	}
+	if aesKey, ok := decryptKey.unwrapped.get(pubEncryptedKey); ok {
+		return aesKey, nil
+	}
+
+	aesKey, err := unwrapAESKey(decryptKey, pubEncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := chaos.Now().Add(cache.unwrapTTL)
+	if decryptKey.Usage.Expiry.Before(expires) {
+		expires = decryptKey.Usage.Expiry
+	}
+	decryptKey.unwrapped.put(pubEncryptedKey, aesKey, expires)
+	return aesKey, nil
+}
@@ -0,0 +1,139 @@
+// Package notify tells users of the server about things waiting for
+// them, such as owners of encrypted data whose delegations a decryption
+// order needs, through webhooks or Slack.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// timeout is how long a notification may take to be delivered.
+const timeout = 10 * time.Second
+
+var client = &http.Client{Timeout: timeout}
+
+// Notification asks Owners to delegate their keys for a decryption
+// order.
+type Notification struct {
+	Type   string   // "order"
+	ID     string   // of the order
+	Name   string   // the user who placed the order
+	Owners []string // the users asked to delegate
+	Labels []string `json:",omitempty"`
+	Reason string   `json:",omitempty"`
+	Expiry time.Time
+
+	// Contacts holds the handles of the owners known to the chat or
+	// paging system, such as Slack user IDs, taken from the "contact"
+	// attribute of their records.
+	Contacts map[string]string `json:",omitempty"`
+}
+
+// Notifier delivers notifications. Teams can plug in their own, such as
+// for a paging system, by implementing it.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// CheckURL returns an error if rawURL cannot be the URL of a webhook.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook URL %s", rawURL)
+	}
+	return nil
+}
+
+// Webhook POSTs notifications as JSON to URL.
+type Webhook struct {
+	URL string
+}
+
+func (w Webhook) Notify(ctx context.Context, n Notification) error {
+	return post(ctx, w.URL, n)
+}
+
+// Slack posts notifications as messages to the Slack incoming webhook
+// at URL, mentioning the owners by their contacts, which must then be
+// Slack user IDs.
+type Slack struct {
+	URL string
+}
+
+func (s Slack) Notify(ctx context.Context, n Notification) error {
+	return post(ctx, s.URL, struct {
+		Text string `json:"text"`
+	}{Message(n)})
+}
+
+// Message returns the text of a notification for people.
+func Message(n Notification) string {
+	var owners []string
+	for _, owner := range n.Owners {
+		if contact := n.Contacts[owner]; contact != "" {
+			owners = append(owners, "<@"+contact+">")
+		} else {
+			owners = append(owners, owner)
+		}
+	}
+
+	text := fmt.Sprintf("%s is asking %s to delegate", n.Name, strings.Join(owners, ", "))
+	if len(n.Labels) > 0 {
+		text += " for " + strings.Join(n.Labels, ", ")
+	}
+	if n.Reason != "" {
+		text += ": " + n.Reason
+	}
+	return text + fmt.Sprintf(" (order %s, until %s)", n.ID, n.Expiry.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+// post POSTs v as JSON to rawURL.
+func post(ctx context.Context, rawURL string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Send delivers n with each of notifiers in the background, so that the
+// server does not wait for them, logging failures.
+func Send(notifiers []Notifier, n Notification) {
+	for _, notifier := range notifiers {
+		go func(notifier Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, n); err != nil {
+				log.Printf("notify failed: type=%s id=%s %v", n.Type, n.ID, err)
+			}
+		}(notifier)
+	}
+}
@@ -0,0 +1,79 @@
+// notify_test.go: tests for notify.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	n := Notification{
+		Type:     "order",
+		ID:       "42",
+		Name:     "Alice",
+		Owners:   []string{"Bob", "Carol"},
+		Labels:   []string{"blue"},
+		Reason:   "INC-1",
+		Expiry:   time.Date(2013, 11, 29, 10, 0, 0, 0, time.UTC),
+		Contacts: map[string]string{"Carol": "U024BE7LH"},
+	}
+	expected := "Alice is asking Bob, <@U024BE7LH> to delegate for blue: INC-1 (order 42, until 2013-11-29 10:00 UTC)"
+	if m := Message(n); m != expected {
+		t.Fatalf("Wrong message %q", m)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies <- body
+	}))
+	defer ts.Close()
+
+	n := Notification{Type: "order", ID: "42", Name: "Alice", Owners: []string{"Bob"}, Expiry: time.Now()}
+	Send([]Notifier{Webhook{URL: ts.URL}, Slack{URL: ts.URL}}, n)
+
+	var webhook, slack bool
+	for i := 0; i < 2; i++ {
+		select {
+		case body := <-bodies:
+			if body["ID"] == "42" && body["Name"] == "Alice" {
+				webhook = true
+			}
+			if text, ok := body["text"].(string); ok && text == Message(n) {
+				slack = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for notifications")
+		}
+	}
+	if !webhook || !slack {
+		t.Fatalf("Notifications not delivered: webhook=%v slack=%v", webhook, slack)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := (Webhook{URL: failing.URL}).Notify(context.Background(), n); err == nil {
+		t.Fatalf("Failed delivery not reported")
+	}
+
+	for _, u := range []string{"ftp://example.com", "https://", "example.com"} {
+		if CheckURL(u) == nil {
+			t.Fatalf("Invalid URL %s accepted", u)
+		}
+	}
+}
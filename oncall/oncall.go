@@ -0,0 +1,153 @@
+// Package oncall resolves the schedules of a paging system to the
+// people on call, so that data can be encrypted for whoever is on call
+// rather than for named users.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package oncall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resolver returns the people on call for a schedule, by name or email
+// address.
+type Resolver interface {
+	OnCall(schedule string) ([]string, error)
+}
+
+// New returns the Resolver for the named system ("pagerduty" or
+// "opsgenie") at the given base URL, which defaults to the public API
+// of the system. The API token is sent with every request.
+func New(system, baseURL, token string) (Resolver, error) {
+	s := server{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	switch system {
+	case "pagerduty":
+		if s.baseURL == "" {
+			s.baseURL = "https://api.pagerduty.com"
+		}
+		s.auth = "Token token=" + token
+		s.accept = "application/vnd.pagerduty+json;version=2"
+		return &PagerDuty{s}, nil
+	case "opsgenie":
+		if s.baseURL == "" {
+			s.baseURL = "https://api.opsgenie.com"
+		}
+		s.auth = "GenieKey " + token
+		s.accept = "application/json"
+		return &Opsgenie{s}, nil
+	default:
+		return nil, fmt.Errorf("Unknown on-call system %s", system)
+	}
+}
+
+// server holds the address and credentials of a paging system.
+type server struct {
+	baseURL string
+	auth    string
+	accept  string
+	client  *http.Client
+}
+
+// get fetches the JSON document at path into v. A missing document is
+// reported as a missing schedule.
+func (s *server) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", s.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", s.accept)
+	req.Header.Set("Authorization", s.auth)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errors.New("Schedule not found")
+	default:
+		return fmt.Errorf("On-call system returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// PagerDuty resolves schedules in PagerDuty, given by ID, to the name
+// and email address of each user on call.
+type PagerDuty struct {
+	server
+}
+
+type pagerDutyOnCalls struct {
+	OnCalls []struct {
+		User struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"user"`
+	} `json:"oncalls"`
+}
+
+// OnCall implements Resolver.
+func (p *PagerDuty) OnCall(schedule string) ([]string, error) {
+	if schedule == "" {
+		return nil, errors.New("No schedule given")
+	}
+
+	query := url.Values{
+		"schedule_ids[]": {schedule},
+		"include[]":      {"users"},
+		"earliest":       {"true"},
+	}
+	var oncalls pagerDutyOnCalls
+	if err := p.get("/oncalls?"+query.Encode(), &oncalls); err != nil {
+		return nil, err
+	}
+
+	var people []string
+	for _, oncall := range oncalls.OnCalls {
+		people = append(people, oncall.User.Name, oncall.User.Email)
+	}
+	return people, nil
+}
+
+// Opsgenie resolves schedules in Opsgenie, given by name, to the email
+// address of each user on call.
+type Opsgenie struct {
+	server
+}
+
+type opsgenieOnCalls struct {
+	Data struct {
+		OnCallRecipients []string `json:"onCallRecipients"`
+	} `json:"data"`
+}
+
+// OnCall implements Resolver.
+func (o *Opsgenie) OnCall(schedule string) ([]string, error) {
+	if schedule == "" {
+		return nil, errors.New("No schedule given")
+	}
+
+	query := url.Values{
+		"scheduleIdentifierType": {"name"},
+		"flat":                   {"true"},
+	}
+	var oncalls opsgenieOnCalls
+	if err := o.get("/v2/schedules/"+url.PathEscape(schedule)+"/on-calls?"+query.Encode(), &oncalls); err != nil {
+		return nil, err
+	}
+	return oncalls.Data.OnCallRecipients, nil
+}
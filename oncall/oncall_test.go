@@ -0,0 +1,94 @@
+// oncall_test.go: tests for oncall.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package oncall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPagerDuty(t *testing.T) {
+	schedules := map[string]string{
+		"P1": `{"oncalls":[{"user":{"name":"Alice","email":"alice@example.com"}},{"user":{"name":"Bob","email":"bob@example.com"}}]}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token token=secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/oncalls" || r.URL.Query().Get("include[]") != "users" {
+			http.NotFound(w, r)
+			return
+		}
+		schedule, ok := schedules[r.URL.Query().Get("schedule_ids[]")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(schedule))
+	}))
+	defer ts.Close()
+
+	r, err := New("pagerduty", ts.URL+"/", "secret")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	people, err := r.OnCall("P1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []string{"Alice", "alice@example.com", "Bob", "bob@example.com"}; !reflect.DeepEqual(people, want) {
+		t.Fatalf("Wrong people on call: %v", people)
+	}
+	if _, err = r.OnCall("P2"); err == nil {
+		t.Fatalf("Missing schedule resolved")
+	}
+	if _, err = r.OnCall(""); err == nil {
+		t.Fatalf("Empty schedule resolved")
+	}
+
+	r, _ = New("pagerduty", ts.URL, "wrong")
+	if _, err = r.OnCall("P1"); err == nil {
+		t.Fatalf("Failed authentication accepted")
+	}
+}
+
+func TestOpsgenie(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "GenieKey secret" || r.URL.Query().Get("scheduleIdentifierType") != "name" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/schedules/payments primary/on-calls" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data":{"onCallRecipients":["carol@example.com"]}}`))
+	}))
+	defer ts.Close()
+
+	r, err := New("opsgenie", ts.URL, "secret")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	people, err := r.OnCall("payments primary")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(people, []string{"carol@example.com"}) {
+		t.Fatalf("Wrong people on call: %v", people)
+	}
+	if _, err = r.OnCall("payments secondary"); err == nil {
+		t.Fatalf("Missing schedule resolved")
+	}
+
+	if _, err = New("victorops", ts.URL, ""); err == nil {
+		t.Fatalf("Unknown system accepted")
+	}
+}
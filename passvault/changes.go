@@ -0,0 +1,109 @@
+// changes.go: configuration changes staged until a second admin approves
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package passvault
+
+import (
+	"errors"
+	"time"
+)
+
+// Change is a change to the label policies or delegation templates of
+// the vault staged by an admin. It only takes effect once another admin
+// approves it, so that no admin can weaken a policy on their own.
+type Change struct {
+	ID   string
+	By   string
+	Time time.Time
+
+	// Label is set for a change to the policy of a label, which is
+	// replaced by Policy, or deleted if Policy is nil.
+	Label  string       `json:",omitempty"`
+	Policy *LabelPolicy `json:",omitempty"`
+
+	// Template is set for a change to a delegation template, which
+	// is replaced by Delegation, or deleted if Delegation is nil.
+	Template   string              `json:",omitempty"`
+	Delegation *DelegationTemplate `json:",omitempty"`
+}
+
+// StageChange records a change staged by name and returns it with its
+// ID set.
+func (records *Records) StageChange(change Change, name string) (Change, error) {
+	if (change.Label == "") == (change.Template == "") {
+		return change, errors.New("Change needs either a label or a template")
+	}
+
+	var err error
+	if change.ID, err = NewID(); err != nil {
+		return change, err
+	}
+	change.By, change.Time = name, time.Now()
+
+	if records.Changes == nil {
+		records.Changes = make(map[string]Change)
+	}
+	records.Changes[change.ID] = change
+	return change, records.WriteRecordsToDisk()
+}
+
+// ApproveChange applies the staged change id on the approval of name,
+// an admin other than the one who staged it. The change and its removal
+// from the staged changes are written to disk at once.
+func (records *Records) ApproveChange(id, name string) (Change, error) {
+	change, ok := records.Changes[id]
+	if !ok {
+		return change, errors.New("Change missing")
+	}
+	if pr, ok := records.GetRecord(name); !ok || !pr.IsAdmin() {
+		return change, errors.New("Only admins can approve changes")
+	}
+	if name == change.By {
+		return change, errors.New("Changes must be approved by another admin")
+	}
+
+	switch {
+	case change.Label != "" && change.Policy != nil:
+		if records.Policies == nil {
+			records.Policies = make(map[string]LabelPolicy)
+		}
+		policy := *change.Policy
+		if old, ok := records.Policies[change.Label]; ok {
+			policy.ID = old.ID
+		} else {
+			var err error
+			if policy.ID, err = NewID(); err != nil {
+				return change, err
+			}
+		}
+		records.Policies[change.Label] = policy
+	case change.Label != "":
+		delete(records.Policies, change.Label)
+	case change.Delegation != nil:
+		if records.Templates == nil {
+			records.Templates = make(map[string]DelegationTemplate)
+		}
+		records.Templates[change.Template] = *change.Delegation
+	default:
+		delete(records.Templates, change.Template)
+	}
+
+	delete(records.Changes, id)
+	return change, records.WriteRecordsToDisk()
+}
+
+// RejectChange discards the staged change id. Any admin, including the
+// one who staged it, can reject it.
+func (records *Records) RejectChange(id, name string) (Change, error) {
+	change, ok := records.Changes[id]
+	if !ok {
+		return change, errors.New("Change missing")
+	}
+	if pr, ok := records.GetRecord(name); !ok || !pr.IsAdmin() {
+		return change, errors.New("Only admins can reject changes")
+	}
+
+	delete(records.Changes, id)
+	return change, records.WriteRecordsToDisk()
+}
@@ -0,0 +1,112 @@
+// kdf.go: the limit on key derivations running at once
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package passvault
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+
+	"github.com/cloudflare/redoctober/chaos"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrKDFBusy is returned instead of deriving a key from a password when
+// as many derivations as allowed are already running.
+var ErrKDFBusy = errors.New("Too many password checks in progress, retry later")
+
+// KDFStats describes the key derivations from passwords.
+type KDFStats struct {
+	Limit   int    // derivations allowed at once, 0 for no limit
+	Running int    // derivations in progress
+	Refused uint64 // derivations refused with ErrKDFBusy
+}
+
+var (
+	kdfMu    sync.Mutex
+	kdfStats KDFStats
+)
+
+func init() {
+	expvar.Publish("kdf", expvar.Func(func() interface{} { return GetKDFStats() }))
+}
+
+// SetKDFLimit sets the number of key derivations from passwords that
+// may run at once. Each one takes 16MB of memory for scrypt, and one
+// given up on by a request that timed out still runs to completion.
+// Zero means no limit.
+func SetKDFLimit(n int) {
+	kdfMu.Lock()
+	kdfStats.Limit = n
+	kdfMu.Unlock()
+}
+
+// GetKDFStats returns the current state of key derivations.
+func GetKDFStats() KDFStats {
+	kdfMu.Lock()
+	defer kdfMu.Unlock()
+	return kdfStats
+}
+
+// startKDF reserves a key derivation, returning ErrKDFBusy if none may
+// start. It must be followed by doneKDF.
+func startKDF() error {
+	kdfMu.Lock()
+	defer kdfMu.Unlock()
+	if kdfStats.Limit > 0 && kdfStats.Running >= kdfStats.Limit {
+		kdfStats.Refused++
+		return ErrKDFBusy
+	}
+	kdfStats.Running++
+	return nil
+}
+
+func doneKDF() {
+	kdfMu.Lock()
+	kdfStats.Running--
+	kdfMu.Unlock()
+}
+
+// KDFParams are the scrypt parameters passwords are hashed, and the
+// keys encrypting private keys derived from them, with.
+type KDFParams struct {
+	N, R, P int
+}
+
+// DefaultKDF are the parameters of the records and vaults that do not
+// give their own.
+var DefaultKDF = KDFParams{N: N, R: R, P: P}
+
+// maxKDFCost bounds N, so that a mistaken parameter cannot make every
+// password check take gigabytes of memory.
+const maxKDFCost = 1 << 20
+
+// Validate returns an error unless scrypt accepts the parameters.
+func (params KDFParams) Validate() error {
+	if params.N <= 1 || params.N&(params.N-1) != 0 {
+		return errors.New("KDF cost N must be a power of 2 above 1")
+	}
+	if params.N > maxKDFCost {
+		return errors.New("KDF cost N is too large")
+	}
+	if params.R <= 0 || params.P <= 0 || params.R*params.P >= 1<<30 {
+		return errors.New("KDF parameters R and P must be positive and small")
+	}
+	return nil
+}
+
+// kdf derives a key from a password with scrypt, within the limit of
+// key derivations set by SetKDFLimit.
+func kdf(params KDFParams, password string, salt []byte) ([]byte, error) {
+	if err := startKDF(); err != nil {
+		return nil, err
+	}
+	defer doneKDF()
+
+	if err := chaos.KDF(); err != nil {
+		return nil, err
+	}
+	return scrypt.Key([]byte(password), salt, params.N, params.R, params.P, KEYLENGTH)
+}
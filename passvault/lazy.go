@@ -0,0 +1,123 @@
+// lazy.go: records decoded from the vault file on first use
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package passvault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// plainRecords is Records without its JSON methods.
+type plainRecords Records
+
+// diskFormat is the JSON form of Records, with the records of users
+// left encoded.
+type diskFormat struct {
+	*plainRecords
+	Passwords map[string]json.RawMessage
+}
+
+// UnmarshalJSON reads a vault without decoding the records of its
+// users, which are decoded when first used. In large vaults most
+// records are never used by a running server.
+func (records *Records) UnmarshalJSON(in []byte) error {
+	disk := diskFormat{plainRecords: (*plainRecords)(records)}
+	if err := json.Unmarshal(in, &disk); err != nil {
+		return err
+	}
+
+	records.Passwords = make(map[string]PasswordRecord)
+	records.encoded = make(map[string]json.RawMessage)
+	for name, raw := range disk.Passwords {
+		records.encoded[name] = raw
+	}
+	return nil
+}
+
+// MarshalJSON writes a vault, copying the records that were never
+// decoded as they were read instead of encoding them again.
+func (records Records) MarshalJSON() ([]byte, error) {
+	passwords, encoded := records.Passwords, records.encoded
+	records.Passwords = nil
+	out, err := json.Marshal(plainRecords(records))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(out[:len(out)-1])
+	buf.WriteString(`,"Passwords":{`)
+	records.Passwords, records.encoded = passwords, encoded
+	for i, name := range records.Names() {
+		raw, ok := encoded[name]
+		if !ok {
+			if raw, err = json.Marshal(passwords[name]); err != nil {
+				return nil, err
+			}
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(raw)
+	}
+	buf.WriteString("}}")
+	return buf.Bytes(), nil
+}
+
+// hasID returns true if an encoded record has an identifier. Records
+// are written with their identifier first, and without one if it is
+// empty.
+func hasID(raw json.RawMessage) bool {
+	return bytes.HasPrefix(raw, []byte(`{"ID":"`)) && !bytes.HasPrefix(raw, []byte(`{"ID":""`))
+}
+
+// decode returns the record of name, decoding it first if it was never
+// used. A record that does not decode to a valid record is an error.
+func (records *Records) decode(name string) (PasswordRecord, bool, error) {
+	if rec, ok := records.Passwords[name]; ok {
+		return rec, true, nil
+	}
+
+	raw, ok := records.encoded[name]
+	if !ok {
+		return PasswordRecord{}, false, nil
+	}
+
+	var rec PasswordRecord
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return PasswordRecord{}, false, err
+	}
+	if !validRecord(rec) {
+		return PasswordRecord{}, false, errors.New("Format error")
+	}
+
+	delete(records.encoded, name)
+	if records.Passwords == nil {
+		records.Passwords = make(map[string]PasswordRecord)
+	}
+	records.Passwords[name] = rec
+	return rec, true, nil
+}
+
+// Names returns the names of all the users of the vault, sorted.
+func (records *Records) Names() []string {
+	names := make([]string, 0, records.NumRecords())
+	for name := range records.Passwords {
+		names = append(names, name)
+	}
+	for name := range records.encoded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -8,35 +8,54 @@ package passvault
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	mrand "math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
 
+	"github.com/cloudflare/redoctober/chaos"
 	"github.com/cloudflare/redoctober/ecdh"
 	"github.com/cloudflare/redoctober/padding"
 	"github.com/cloudflare/redoctober/symcrypt"
-	"golang.org/x/crypto/scrypt"
 )
 
 // Constants for record type
 const (
 	RSARecord = "RSA"
 	ECCRecord = "ECC"
+	HSMRecord = "HSM" // RSA key held by the user in hardware, see AddHSMRecord
 )
 
 var DefaultRecordType = RSARecord
 
+// Constants for roles. Records without a role are operators, unless
+// they are admins.
+const (
+	AdminRole    = "admin"    // may do anything
+	OperatorRole = "operator" // may delegate, encrypt and decrypt, but not change users
+	AuditorRole  = "auditor"  // may read summaries, listings and logs, but never decrypt
+	ServiceRole  = "service"  // may encrypt and decrypt only
+)
+
 // Constants for scrypt
 const (
 	KEYLENGTH = 16    // 16-byte output from scrypt
@@ -67,6 +86,7 @@ func (pk *ECPublicKey) toECDSA() *ecdsa.PublicKey {
 // material for a single user name. It is written and read from
 // storage in JSON format.
 type PasswordRecord struct {
+	ID             string `json:",omitempty"`
 	Type           string
 	PasswordSalt   []byte
 	HashedPassword []byte
@@ -85,24 +105,181 @@ type PasswordRecord struct {
 		ECPrivIV []byte
 		ECPublic ECPublicKey
 	}
-	Admin bool
+	Admin          bool
+	AdminUntil     time.Time         `json:",omitempty"` // end of a time-limited admin status, see MakeAdminUntil
+	Attributes     map[string]string `json:",omitempty"`
+	LastDelegation time.Time
+	LastAuth       time.Time
+	Absence        *Absence `json:",omitempty"`
+	Vetoer         bool     `json:",omitempty"` // may veto decryptions
+	Role           string   `json:",omitempty"` // role of a user that is not an admin
+	SSHKey         []byte   `json:",omitempty"` // key the record was claimed with, see ImportedKey
+	Created        time.Time
+	Notes          string     `json:",omitempty"` // set by admins
+	KDF            *KDFParams `json:",omitempty"` // of the password, DefaultKDF if not set
+
+	// AllowedLabels restricts the labels the user may delegate for
+	// and encrypt under to those matching one of these patterns (see
+	// AllowsLabel). Unset allows every label.
+	AllowedLabels []string `json:",omitempty"`
+}
+
+// Absence is a planned absence of a user during which their substitute
+// may stand in for them. The private key of the user is kept encrypted
+// under a random key, which can only be recovered with the private key
+// of the substitute. An absence has no effect until an admin approves it.
+type Absence struct {
+	Substitute string
+	Start      time.Time
+	End        time.Time
+	ApprovedBy string `json:",omitempty"`
+
+	Key        PasswordRecord // key material of the user, encrypted under the random key
+	WrappedKey []byte         // random key, encrypted with AES under the wrap key
+	PubWrapKey []byte         // wrap key, encrypted to the substitute
 }
 
 // diskRecords is the structure used to read and write a JSON file
 // containing the contents of a password vault
 type Records struct {
-	Version   int
-	VaultId   int
-	HmacKey   []byte
-	Passwords map[string]PasswordRecord
+	Version     int
+	VaultId     int
+	HmacKey     []byte
+	IdentityKey []byte                        `json:",omitempty"`
+	Passwords   map[string]PasswordRecord     `json:",omitempty"` // written by MarshalJSON
+	Templates   map[string]DelegationTemplate `json:",omitempty"`
+	Policies    map[string]LabelPolicy        `json:",omitempty"`
+	Vetoes      map[string]Veto               `json:",omitempty"`
+	Approvals   map[string]Approval           `json:",omitempty"`
+	Imported    map[string]ImportedKey        `json:",omitempty"`
+	Changes     map[string]Change             `json:",omitempty"`
+	KDF         *KDFParams                    `json:",omitempty"` // of new passwords, DefaultKDF if not set
+	Rekey       *RekeyJob                     `json:",omitempty"`
+	Stats       *PublicStats                  `json:",omitempty"`
+
+	localPath string                     // Path of current vault
+	encoded   map[string]json.RawMessage // records not decoded yet
+
+	// Write-behind state, see SetWriteBehind
+	writeBehind time.Duration
+	lastWrite   time.Time
+	dirty       bool
+}
+
+// DelegationTemplate is a named set of delegation parameters defined
+// by an admin that users can delegate with instead of spelling them
+// out on every request.
+type DelegationTemplate struct {
+	Uses   int
+	Time   string
+	Users  []string
+	Labels []string
+}
 
-	localPath string // Path of current vault
+// LabelPolicy holds the restrictions placed on data encrypted under
+// a label. Each entry of OwnersInclude is an attribute selector of the
+// form "key=value" that at least one owner of the data must match. If
+// RequireReason is set, delegations and decryptions for the label must
+// give a reason. If RequireTicket is set, the reason for a decryption
+// must also start with an open ticket naming the user. If ApprovalURL
+// is set, each decryption must be approved by the approval system at
+// that URL, with a decision signed by ApprovalKey. Transforms names
+// transforms (see package transform) that decryptions may ask for, and
+// with RequireTransform, must ask for. With RequireDerive, decryptions
+// must mint a credential derived from the data (see package derive)
+// rather than return it. If Windows is set, decryptions
+// are only allowed within one of its time windows (see package window)
+// in TimeZone, unless an admin overrides them. Classes lists the
+// classes of data (see package classify) that may be encrypted under
+// the label.
+type LabelPolicy struct {
+	ID            string   `json:",omitempty"`
+	OwnersInclude []string `json:",omitempty"`
+	RequireReason bool     `json:",omitempty"`
+	RequireTicket bool     `json:",omitempty"`
+	Watermark     bool     `json:",omitempty"`
+	ApprovalURL   string   `json:",omitempty"`
+	ApprovalKey   []byte   `json:",omitempty"` // PKIX encoded
+
+	Transforms       map[string]string `json:",omitempty"`
+	RequireTransform bool              `json:",omitempty"`
+	RequireDerive    bool              `json:",omitempty"`
+
+	Windows  []string `json:",omitempty"`
+	TimeZone string   `json:",omitempty"` // IANA name, UTC if empty
+
+	Classes []string `json:",omitempty"`
+
+	// AllowConvergent allows data under the label to be encrypted
+	// convergently, giving away which envelopes hold the same data.
+	AllowConvergent bool `json:",omitempty"`
 }
 
+// Veto blocks the decryption of a piece of encrypted data, identified
+// by its fingerprint, or of all data under a label, regardless of how
+// many delegations are available. It can be lifted by the user who
+// placed it, or by two admins.
+type Veto struct {
+	ID          string
+	Fingerprint string `json:",omitempty"`
+	Label       string `json:",omitempty"`
+	By          string
+	Time        time.Time
+	LiftedBy    []string `json:",omitempty"` // admins who approved lifting the veto
+}
+
+// ImportedKey is the SSH public key of a user imported by an admin. The
+// record of the user is created when they prove possession of the key,
+// with a password derived from their signature of a challenge.
+type ImportedKey struct {
+	Key      []byte // in SSH wire format
+	Type     string // type of the record to create
+	By       string // admin who imported the key
+	Imported time.Time
+}
+
+// Approval approves the decryptions of a piece of encrypted data,
+// identified by its fingerprint, until it expires. It counts towards
+// the approvals required by the data if its user is one of the
+// approvers of the data.
+type Approval struct {
+	ID          string
+	Fingerprint string
+	By          string
+	Time        time.Time
+	Expiry      time.Time
+}
+
+type vetoSlice []Veto
+
+func (s vetoSlice) Len() int           { return len(s) }
+func (s vetoSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s vetoSlice) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
 // Summary is a minmial account summary.
 type Summary struct {
-	Admin bool
-	Type  string
+	ID         string
+	Admin      bool
+	Type       string
+	Attributes map[string]string `json:",omitempty"`
+	Absence    *AbsenceSummary   `json:",omitempty"`
+	Vetoer     bool              `json:",omitempty"`
+	Role       string
+
+	KeyFingerprint string // of the public key, see PasswordRecord.KeyFingerprint
+	Created        time.Time
+	LastAuth       time.Time
+	Notes          string     `json:",omitempty"`
+	AllowedLabels  []string   `json:",omitempty"`
+	AdminUntil     *time.Time `json:",omitempty"` // end of a time-limited admin status
+}
+
+// AbsenceSummary describes a planned absence without its key material.
+type AbsenceSummary struct {
+	Substitute string
+	Start      time.Time
+	End        time.Time
+	ApprovedBy string `json:",omitempty"`
 }
 
 func init() {
@@ -115,8 +292,8 @@ func init() {
 
 // hashPassword takes a password and derives a scrypt salted and hashed
 // version
-func hashPassword(password string, salt []byte) ([]byte, error) {
-	return scrypt.Key([]byte(password), salt, N, R, P, KEYLENGTH)
+func hashPassword(params KDFParams, password string, salt []byte) ([]byte, error) {
+	return kdf(params, password, salt)
 }
 
 // encryptRSARecord takes an RSA private key and encrypts it with
@@ -166,23 +343,47 @@ func encryptECCRecord(newRec *PasswordRecord, ecPriv *ecdsa.PrivateKey, passKey
 	return
 }
 
-// createPasswordRec creates a new record from a username and password
-func createPasswordRec(password string, admin bool, userType string) (newRec PasswordRecord, err error) {
+// NewID returns a random identifier in the form of a version 4 UUID.
+func NewID() (string, error) {
+	b, err := symcrypt.MakeRandom(16)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// newPasswordRec creates a new record with the given password, hashed
+// with params, but no keys.
+func newPasswordRec(password string, userType string, params KDFParams) (newRec PasswordRecord, err error) {
 	newRec.Type = userType
+	newRec.Created = time.Now()
+	newRec.setKDF(params)
+
+	if newRec.ID, err = NewID(); err != nil {
+		return
+	}
 
 	if newRec.PasswordSalt, err = symcrypt.MakeRandom(16); err != nil {
 		return
 	}
 
-	if newRec.HashedPassword, err = hashPassword(password, newRec.PasswordSalt); err != nil {
+	if newRec.HashedPassword, err = hashPassword(params, password, newRec.PasswordSalt); err != nil {
 		return
 	}
 
-	if newRec.KeySalt, err = symcrypt.MakeRandom(16); err != nil {
+	newRec.KeySalt, err = symcrypt.MakeRandom(16)
+	return
+}
+
+// createPasswordRec creates a new record from a username and password
+func createPasswordRec(password string, admin bool, userType string, params KDFParams) (newRec PasswordRecord, err error) {
+	if newRec, err = newPasswordRec(password, userType, params); err != nil {
 		return
 	}
 
-	passKey, err := derivePasswordKey(password, newRec.KeySalt)
+	passKey, err := derivePasswordKey(params, password, newRec.KeySalt)
 	if err != nil {
 		return
 	}
@@ -213,6 +414,8 @@ func createPasswordRec(password string, admin bool, userType string) (newRec Pas
 		newRec.ECKey.ECPublic.Curve = ecPriv.PublicKey.Curve.Params()
 		newRec.ECKey.ECPublic.X = ecPriv.PublicKey.X
 		newRec.ECKey.ECPublic.Y = ecPriv.PublicKey.Y
+	case HSMRecord:
+		err = errors.New("HSM records are created with the public key of the user")
 	default:
 		err = errors.New("Unknown record type")
 	}
@@ -224,8 +427,8 @@ func createPasswordRec(password string, admin bool, userType string) (newRec Pas
 
 // derivePasswordKey generates a key from a password (and salt) using
 // scrypt
-func derivePasswordKey(password string, keySalt []byte) ([]byte, error) {
-	return scrypt.Key([]byte(password), keySalt, N, R, P, KEYLENGTH)
+func derivePasswordKey(params KDFParams, password string, keySalt []byte) ([]byte, error) {
+	return kdf(params, password, keySalt)
 }
 
 // decryptECB decrypts bytes using a key in AES ECB mode.
@@ -254,6 +457,49 @@ func encryptECB(data, key []byte) (encryptedData []byte, err error) {
 	return
 }
 
+// validRecord checks that the salts, hashes and encrypted keys of a
+// record read from storage have the expected sizes.
+func validRecord(rec PasswordRecord) bool {
+	if len(rec.PasswordSalt) != 16 {
+		return false
+	}
+	if len(rec.HashedPassword) != 16 {
+		return false
+	}
+	if len(rec.KeySalt) != 16 {
+		return false
+	}
+	if rec.Type == RSARecord {
+		if len(rec.RSAKey.RSAExp) == 0 || len(rec.RSAKey.RSAExp)%16 != 0 {
+			return false
+		}
+		if len(rec.RSAKey.RSAPrimeP) == 0 || len(rec.RSAKey.RSAPrimeP)%16 != 0 {
+			return false
+		}
+		if len(rec.RSAKey.RSAPrimeQ) == 0 || len(rec.RSAKey.RSAPrimeQ)%16 != 0 {
+			return false
+		}
+		if len(rec.RSAKey.RSAExpIV) != 16 {
+			return false
+		}
+		if len(rec.RSAKey.RSAPrimePIV) != 16 {
+			return false
+		}
+		if len(rec.RSAKey.RSAPrimeQIV) != 16 {
+			return false
+		}
+	}
+	if rec.Type == ECCRecord {
+		if len(rec.ECKey.ECPriv) == 0 || len(rec.ECKey.ECPriv)%16 != 0 {
+			return false
+		}
+		if len(rec.ECKey.ECPrivIV) != 16 {
+			return false
+		}
+	}
+	return true
+}
+
 // InitFromDisk reads the record from disk and initialize global context.
 func InitFrom(path string) (records Records, err error) {
 	var jsonDiskRecord []byte
@@ -280,45 +526,15 @@ func InitFrom(path string) (records Records, err error) {
 		}
 	}
 
-	err = errors.New("Format error")
-	for _, rec := range records.Passwords {
-		if len(rec.PasswordSalt) != 16 {
-			return
+	// Records without an identifier are decoded now so that they are
+	// given one below; the others are decoded and checked when used.
+	for name, raw := range records.encoded {
+		if hasID(raw) {
+			continue
 		}
-		if len(rec.HashedPassword) != 16 {
+		if _, _, err = records.decode(name); err != nil {
 			return
 		}
-		if len(rec.KeySalt) != 16 {
-			return
-		}
-		if rec.Type == RSARecord {
-			if len(rec.RSAKey.RSAExp) == 0 || len(rec.RSAKey.RSAExp)%16 != 0 {
-				return
-			}
-			if len(rec.RSAKey.RSAPrimeP) == 0 || len(rec.RSAKey.RSAPrimeP)%16 != 0 {
-				return
-			}
-			if len(rec.RSAKey.RSAPrimeQ) == 0 || len(rec.RSAKey.RSAPrimeQ)%16 != 0 {
-				return
-			}
-			if len(rec.RSAKey.RSAExpIV) != 16 {
-				return
-			}
-			if len(rec.RSAKey.RSAPrimePIV) != 16 {
-				return
-			}
-			if len(rec.RSAKey.RSAPrimeQIV) != 16 {
-				return
-			}
-		}
-		if rec.Type == ECCRecord {
-			if len(rec.ECKey.ECPriv) == 0 || len(rec.ECKey.ECPriv)%16 != 0 {
-				return
-			}
-			if len(rec.ECKey.ECPrivIV) != 16 {
-				return
-			}
-		}
 	}
 
 	// If the Version field is 0 then it indicates that nothing was
@@ -336,26 +552,141 @@ func InitFrom(path string) (records Records, err error) {
 
 	records.localPath = path
 
+	// Older vaults are given an identity key, and their records and
+	// policies identifiers, on load.
+	assigned := false
+	if len(records.IdentityKey) == 0 {
+		var key *ecdsa.PrivateKey
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return
+		}
+		if records.IdentityKey, err = x509.MarshalECPrivateKey(key); err != nil {
+			return
+		}
+		assigned = len(jsonDiskRecord) != 0
+	}
+	for name, rec := range records.Passwords {
+		if rec.ID != "" {
+			continue
+		}
+		if rec.ID, err = NewID(); err != nil {
+			return
+		}
+		records.Passwords[name] = rec
+		assigned = true
+	}
+	for label, policy := range records.Policies {
+		if policy.ID != "" {
+			continue
+		}
+		if policy.ID, err = NewID(); err != nil {
+			return
+		}
+		records.Policies[label] = policy
+		assigned = true
+	}
+	if assigned {
+		if err = records.WriteRecordsToDisk(); err != nil {
+			return
+		}
+	}
+
 	err = nil
 	return
 }
 
 // WriteRecordsToDisk saves the current state of the records to disk.
+// With write-behind, a write following another by less than the
+// write-behind interval is left to Flush.
 func (records *Records) WriteRecordsToDisk() error {
+	if err := chaos.VaultWrite(); err != nil {
+		return err
+	}
 	if records.localPath == "memory" {
 		return nil
 	}
 
-	jsonDiskRecord, err := json.Marshal(records)
+	if records.writeBehind > 0 && time.Since(records.lastWrite) < records.writeBehind {
+		records.dirty = true
+		return nil
+	}
+	return records.write()
+}
+
+// SetWriteBehind batches the writes of the vault made within interval
+// of each other: the first is written at once, and the following ones
+// when Flush is called, which should be at least once per interval.
+// Changes made since the last write are lost if the process dies. An
+// interval of 0 writes every change.
+func (records *Records) SetWriteBehind(interval time.Duration) {
+	records.writeBehind = interval
+}
+
+// Flush writes the changes left by WriteRecordsToDisk, if any.
+func (records *Records) Flush() error {
+	if !records.dirty {
+		return nil
+	}
+	return records.write()
+}
+
+// Export returns the vault as written to disk, but without the server
+// identity key, which never leaves the server.
+func (records *Records) Export() ([]byte, error) {
+	export := *records
+	export.IdentityKey = nil
+	return export.MarshalJSON()
+}
+
+// write replaces the vault on disk. The vault is written to a
+// temporary file which is synced and renamed over the vault, so that
+// the vault on disk is always complete.
+func (records *Records) write() error {
+	// called directly, as json.Marshal would check its output again
+	jsonDiskRecord, err := records.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(records.localPath), filepath.Base(records.localPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	// only the server may read the identity key
+	if err = f.Chmod(0600); err == nil {
+		if _, err = f.Write(jsonDiskRecord); err == nil {
+			err = f.Sync()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(records.localPath, jsonDiskRecord, 0644)
+	if err = os.Rename(f.Name(), records.localPath); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(records.localPath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	records.dirty = false
+	records.lastWrite = time.Now()
+	return nil
 }
 
 // AddNewRecord adds a new record for a given username and password.
 func (records *Records) AddNewRecord(name, password string, admin bool, userType string) (PasswordRecord, error) {
-	pr, err := createPasswordRec(password, admin, userType)
+	// a record that cannot be decoded is not replaced
+	if _, _, err := records.decode(name); err != nil {
+		return PasswordRecord{}, err
+	}
+
+	pr, err := createPasswordRec(password, admin, userType, records.GetKDF())
 	if err != nil {
 		return pr, err
 	}
@@ -363,6 +694,54 @@ func (records *Records) AddNewRecord(name, password string, admin bool, userType
 	return pr, records.WriteRecordsToDisk()
 }
 
+// AddHSMRecord adds the record of a user whose RSA private key is held
+// in their own hardware, such as a smart card. The vault has only the
+// public key: the password authenticates the user, and their client
+// unwraps the keys of the data they delegate for.
+func (records *Records) AddHSMRecord(name, password string, pub *rsa.PublicKey) (PasswordRecord, error) {
+	if _, _, err := records.decode(name); err != nil {
+		return PasswordRecord{}, err
+	}
+	if pub.N.BitLen() < 2048 {
+		return PasswordRecord{}, errors.New("HSM keys must be at least 2048 bits")
+	}
+
+	pr, err := newPasswordRec(password, HSMRecord, records.GetKDF())
+	if err != nil {
+		return pr, err
+	}
+	pr.RSAKey.RSAPublic = *pub
+	records.SetRecord(pr, name)
+	return pr, records.WriteRecordsToDisk()
+}
+
+// NewRecord creates the record of a user with the given password
+// without adding it to the vault (see AddRecords).
+func NewRecord(password string, admin bool, userType string) (PasswordRecord, error) {
+	return createPasswordRec(password, admin, userType, DefaultKDF)
+}
+
+// AddRecords adds the records of new users to the vault, which is
+// written once: if the write fails, none of them are added.
+func (records *Records) AddRecords(prs map[string]PasswordRecord) error {
+	for name := range prs {
+		if _, found := records.GetRecord(name); found {
+			return fmt.Errorf("Record %s already present", name)
+		}
+	}
+
+	for name, pr := range prs {
+		records.SetRecord(pr, name)
+	}
+	if err := records.WriteRecordsToDisk(); err != nil {
+		for name := range prs {
+			delete(records.Passwords, name)
+		}
+		return err
+	}
+	return nil
+}
+
 // ChangePassword changes the password for a given user.
 func (records *Records) ChangePassword(name, password, newPassword string) (err error) {
 	pr, ok := records.GetRecord(name)
@@ -371,11 +750,15 @@ func (records *Records) ChangePassword(name, password, newPassword string) (err
 		return
 	}
 
+	// the new password is hashed with the parameters of the vault,
+	// which re-keys the record if they changed
+	params := records.GetKDF()
+
 	var keySalt []byte
 	if keySalt, err = symcrypt.MakeRandom(16); err != nil {
 		return
 	}
-	newPassKey, err := derivePasswordKey(newPassword, keySalt)
+	newPassKey, err := derivePasswordKey(params, newPassword, keySalt)
 	if err != nil {
 		return
 	}
@@ -405,6 +788,11 @@ func (records *Records) ChangePassword(name, password, newPassword string) (err
 		if err != nil {
 			return
 		}
+	} else if pr.Type == HSMRecord {
+		// the key is not in the vault, but the password must be right
+		if err = pr.ValidatePassword(password); err != nil {
+			return
+		}
 	} else {
 		err = errors.New("Unkown record type")
 		return
@@ -414,9 +802,10 @@ func (records *Records) ChangePassword(name, password, newPassword string) (err
 	if pr.PasswordSalt, err = symcrypt.MakeRandom(16); err != nil {
 		return
 	}
-	if pr.HashedPassword, err = hashPassword(newPassword, pr.PasswordSalt); err != nil {
+	if pr.HashedPassword, err = hashPassword(params, newPassword, pr.PasswordSalt); err != nil {
 		return
 	}
+	pr.setKDF(params)
 
 	pr.KeySalt = keySalt
 
@@ -431,13 +820,141 @@ func (records *Records) DeleteRecord(name string) error {
 		delete(records.Passwords, name)
 		return records.WriteRecordsToDisk()
 	}
+	if _, ok := records.encoded[name]; ok {
+		delete(records.encoded, name)
+		return records.WriteRecordsToDisk()
+	}
 	return errors.New("Record missing")
 }
 
+// SetLastDelegation records the time at which a user last delegated.
+func (records *Records) SetLastDelegation(name string, when time.Time) error {
+	if rec, ok := records.GetRecord(name); ok {
+		rec.LastDelegation = when
+		records.SetRecord(rec, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Record missing")
+}
+
+// SetLastAuth records the time at which a user last authenticated. To
+// avoid writing the vault on every request, the time is only updated
+// once it is more than an hour old.
+func (records *Records) SetLastAuth(name string, when time.Time) error {
+	rec, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+	if when.Sub(rec.LastAuth) < time.Hour {
+		return nil
+	}
+
+	rec.LastAuth = when
+	records.SetRecord(rec, name)
+	return records.WriteRecordsToDisk()
+}
+
+// SetAbsence records a planned absence of name, during which substitute
+// may stand in for them once an admin approves it. The password of name
+// is needed to hand their key over to the substitute.
+func (records *Records) SetAbsence(name, password, substitute string, start, end time.Time) (err error) {
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+	sub, ok := records.GetRecord(substitute)
+	if !ok {
+		return errors.New("Substitute missing")
+	}
+	if name == substitute {
+		return errors.New("Cannot substitute for oneself")
+	}
+	if !end.After(start) {
+		return errors.New("Absence must end after it starts")
+	}
+
+	absence := &Absence{Substitute: substitute, Start: start, End: end}
+	absence.Key.Type = pr.Type
+
+	key, err := symcrypt.MakeRandom(16)
+	if err != nil {
+		return
+	}
+
+	// re-encrypt the key of the user under the random key
+	switch pr.Type {
+	case RSARecord:
+		var rsaKey rsa.PrivateKey
+		if rsaKey, err = pr.GetKeyRSA(password); err != nil {
+			return
+		}
+		if err = encryptRSARecord(&absence.Key, &rsaKey, key); err != nil {
+			return
+		}
+		absence.Key.RSAKey.RSAPublic = rsaKey.PublicKey
+	case ECCRecord:
+		var ecKey *ecdsa.PrivateKey
+		if ecKey, err = pr.GetKeyECC(password); err != nil {
+			return
+		}
+		if err = encryptECCRecord(&absence.Key, ecKey, key); err != nil {
+			return
+		}
+	case HSMRecord:
+		return errors.New("The key of an HSM record cannot be handed over")
+	default:
+		return errors.New("Unknown record type")
+	}
+
+	// wrap the random key for the substitute
+	wrapKey, err := symcrypt.MakeRandom(16)
+	if err != nil {
+		return
+	}
+	if absence.WrappedKey, err = encryptECB(key, wrapKey); err != nil {
+		return
+	}
+	if absence.PubWrapKey, err = sub.EncryptKey(wrapKey); err != nil {
+		return
+	}
+
+	pr.Absence = absence
+	records.SetRecord(pr, name)
+	return records.WriteRecordsToDisk()
+}
+
+// ApproveAbsence approves the planned absence of name.
+func (records *Records) ApproveAbsence(name, admin string) error {
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+	if pr.Absence == nil {
+		return errors.New("No absence planned")
+	}
+
+	pr.Absence.ApprovedBy = admin
+	records.SetRecord(pr, name)
+	return records.WriteRecordsToDisk()
+}
+
+// DeleteAbsence removes the planned absence of name.
+func (records *Records) DeleteAbsence(name string) error {
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+
+	pr.Absence = nil
+	records.SetRecord(pr, name)
+	return records.WriteRecordsToDisk()
+}
+
 // RevokeRecord removes admin status from a record.
 func (records *Records) RevokeRecord(name string) error {
 	if rec, ok := records.GetRecord(name); ok {
 		rec.Admin = false
+		rec.AdminUntil = time.Time{}
 		records.SetRecord(rec, name)
 		return records.WriteRecordsToDisk()
 	}
@@ -448,21 +965,451 @@ func (records *Records) RevokeRecord(name string) error {
 func (records *Records) MakeAdmin(name string) error {
 	if rec, ok := records.GetRecord(name); ok {
 		rec.Admin = true
+		rec.AdminUntil = time.Time{}
+		rec.Role = ""
 		records.SetRecord(rec, name)
 		return records.WriteRecordsToDisk()
 	}
 	return errors.New("Record missing")
 }
 
+// MakeAdminUntil gives a record admin status until the given time, after
+// which it has its former role again. Records that are admins for good
+// are left as they are.
+func (records *Records) MakeAdminUntil(name string, until time.Time) error {
+	rec, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+	if rec.Admin && rec.AdminUntil.IsZero() {
+		return errors.New("User is already an admin")
+	}
+	rec.Admin = true
+	rec.AdminUntil = until
+	records.SetRecord(rec, name)
+	return records.WriteRecordsToDisk()
+}
+
+// ExpireAdmins takes away the admin status of the records whose
+// time-limited admin status ended by now, and returns their names.
+func (records *Records) ExpireAdmins(now time.Time) (expired []string, err error) {
+	for _, name := range records.Names() {
+		rec, ok := records.GetRecord(name)
+		if !ok || !rec.Admin || rec.AdminUntil.IsZero() || now.Before(rec.AdminUntil) {
+			continue
+		}
+		rec.Admin = false
+		rec.AdminUntil = time.Time{}
+		records.SetRecord(rec, name)
+		expired = append(expired, name)
+	}
+	if len(expired) > 0 {
+		err = records.WriteRecordsToDisk()
+	}
+	return
+}
+
+// MergeRecords copies the records of another vault into this one. Records
+// whose name is already taken are left out and returned as conflicts.
+// If dryRun is set the vault is not changed, but the same report is
+// produced. Data encrypted under the other vault is not readable with
+// the merged records, since the vault ID and HMAC key are not copied.
+func (records *Records) MergeRecords(other Records, dryRun bool) (added, conflicts []string, err error) {
+	for _, name := range other.Names() {
+		if _, _, err = other.decode(name); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := records.GetRecord(name); ok {
+			conflicts = append(conflicts, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(conflicts)
+
+	if dryRun || len(added) == 0 {
+		return
+	}
+
+	for _, name := range added {
+		rec := other.Passwords[name]
+		if rec.ID == "" {
+			if rec.ID, err = NewID(); err != nil {
+				return
+			}
+		}
+		records.SetRecord(rec, name)
+	}
+	err = records.WriteRecordsToDisk()
+	return
+}
+
+// Replace makes the vault a copy of other, such as a vault exported by
+// another server, and writes it to disk. The server identity key is
+// kept unless other has one.
+func (records *Records) Replace(other Records) error {
+	if other.Version == 0 || other.NumRecords() == 0 {
+		return errors.New("Vault to copy is empty")
+	}
+
+	records.Version = other.Version
+	records.VaultId = other.VaultId
+	records.HmacKey = other.HmacKey
+	if len(other.IdentityKey) > 0 {
+		records.IdentityKey = other.IdentityKey
+	}
+	records.Passwords = other.Passwords
+	records.Templates = other.Templates
+	records.Policies = other.Policies
+	records.Vetoes = other.Vetoes
+	records.Approvals = other.Approvals
+	records.Imported = other.Imported
+	records.Changes = other.Changes
+	records.KDF = other.KDF
+	records.Rekey = other.Rekey
+	records.Stats = other.Stats
+	records.encoded = other.encoded
+	if records.Passwords == nil {
+		records.Passwords = make(map[string]PasswordRecord)
+	}
+	return records.WriteRecordsToDisk()
+}
+
 // SetRecord puts a record into the global status.
 func (records *Records) SetRecord(pr PasswordRecord, name string) {
+	delete(records.encoded, name)
 	records.Passwords[name] = pr
 }
 
-// GetRecord returns a record given a name.
+// GetRecord returns a record given a name. A record that cannot be
+// decoded is not returned.
 func (records *Records) GetRecord(name string) (PasswordRecord, bool) {
-	dpr, found := records.Passwords[name]
-	return dpr, found
+	dpr, found, err := records.decode(name)
+	return dpr, found && err == nil
+}
+
+// SetAttribute sets an attribute on a given record. An empty value
+// removes the attribute.
+func (records *Records) SetAttribute(name, key, value string) error {
+	rec, ok := records.GetRecord(name)
+	if !ok {
+		return errors.New("Record missing")
+	}
+
+	attributes := make(map[string]string)
+	for k, v := range rec.Attributes {
+		attributes[k] = v
+	}
+	if value == "" {
+		delete(attributes, key)
+	} else {
+		attributes[key] = value
+	}
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+
+	rec.Attributes = attributes
+	records.SetRecord(rec, name)
+	return records.WriteRecordsToDisk()
+}
+
+// SetTemplate adds or replaces the delegation template with the given name.
+func (records *Records) SetTemplate(name string, template DelegationTemplate) error {
+	if records.Templates == nil {
+		records.Templates = make(map[string]DelegationTemplate)
+	}
+	records.Templates[name] = template
+	return records.WriteRecordsToDisk()
+}
+
+// DeleteTemplate removes the delegation template with the given name.
+func (records *Records) DeleteTemplate(name string) error {
+	if _, ok := records.GetTemplate(name); ok {
+		delete(records.Templates, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Template missing")
+}
+
+// GetTemplate returns a delegation template given a name.
+func (records *Records) GetTemplate(name string) (DelegationTemplate, bool) {
+	template, found := records.Templates[name]
+	return template, found
+}
+
+// SetLabelPolicy adds or replaces the policy for a given label.
+func (records *Records) SetLabelPolicy(label string, policy LabelPolicy) error {
+	if records.Policies == nil {
+		records.Policies = make(map[string]LabelPolicy)
+	}
+
+	// Replacing a policy keeps its identifier.
+	if old, ok := records.Policies[label]; ok {
+		policy.ID = old.ID
+	} else {
+		var err error
+		if policy.ID, err = NewID(); err != nil {
+			return err
+		}
+	}
+	records.Policies[label] = policy
+	return records.WriteRecordsToDisk()
+}
+
+// DeleteLabelPolicy removes the policy for a given label.
+func (records *Records) DeleteLabelPolicy(label string) error {
+	if _, ok := records.GetLabelPolicy(label); ok {
+		delete(records.Policies, label)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Policy missing")
+}
+
+// SetRole sets the role of a record. Making a user an admin is the same
+// as MakeAdmin.
+func (records *Records) SetRole(name, role string) error {
+	switch role {
+	case AdminRole, OperatorRole, AuditorRole, ServiceRole:
+	default:
+		return fmt.Errorf("Unknown role %s", role)
+	}
+
+	if rec, ok := records.GetRecord(name); ok {
+		rec.Admin = role == AdminRole
+		rec.AdminUntil = time.Time{}
+		rec.Role = role
+		if rec.Admin || role == OperatorRole {
+			rec.Role = ""
+		}
+		records.SetRecord(rec, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Record missing")
+}
+
+// SetVetoer sets whether the user name may veto decryptions.
+func (records *Records) SetVetoer(name string, vetoer bool) error {
+	if rec, ok := records.GetRecord(name); ok {
+		rec.Vetoer = vetoer
+		records.SetRecord(rec, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Record missing")
+}
+
+// SetNotes sets the notes kept by admins on the user name.
+func (records *Records) SetNotes(name, notes string) error {
+	if rec, ok := records.GetRecord(name); ok {
+		rec.Notes = notes
+		records.SetRecord(rec, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Record missing")
+}
+
+// SetAllowedLabels restricts the labels the user name may delegate for
+// and encrypt under to those matching one of patterns, in the syntax
+// of path.Match (such as "staging/*"). No patterns lifts the
+// restriction.
+func (records *Records) SetAllowedLabels(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad label pattern %q", pattern)
+		}
+	}
+
+	if rec, ok := records.GetRecord(name); ok {
+		rec.AllowedLabels = patterns
+		records.SetRecord(rec, name)
+		return records.WriteRecordsToDisk()
+	}
+	return errors.New("Record missing")
+}
+
+// AddVeto places a veto by name on the data with the given fingerprint,
+// or on the given label. Exactly one of them must be set.
+func (records *Records) AddVeto(name, fingerprint, label string) (veto Veto, err error) {
+	pr, ok := records.GetRecord(name)
+	if !ok {
+		return veto, errors.New("Record missing")
+	}
+	if !pr.Vetoer {
+		return veto, errors.New("User may not veto")
+	}
+	if (fingerprint == "") == (label == "") {
+		return veto, errors.New("Veto needs either a fingerprint or a label")
+	}
+
+	veto = Veto{Fingerprint: fingerprint, Label: label, By: name, Time: time.Now()}
+	if veto.ID, err = NewID(); err != nil {
+		return
+	}
+
+	if records.Vetoes == nil {
+		records.Vetoes = make(map[string]Veto)
+	}
+	records.Vetoes[veto.ID] = veto
+	err = records.WriteRecordsToDisk()
+	return
+}
+
+// LiftVeto lifts the veto id on behalf of name. The user who placed the
+// veto lifts it at once; otherwise two different admins must ask for it
+// to be lifted. lifted is false if the veto is still in place.
+func (records *Records) LiftVeto(id, name string) (lifted bool, err error) {
+	veto, ok := records.Vetoes[id]
+	if !ok {
+		return false, errors.New("Veto missing")
+	}
+
+	if name != veto.By {
+		pr, ok := records.GetRecord(name)
+		if !ok || !pr.IsAdmin() {
+			return false, errors.New("Only the vetoing user or admins can lift a veto")
+		}
+		for _, admin := range veto.LiftedBy {
+			if admin == name {
+				return false, errors.New("Lifting already approved by this admin")
+			}
+		}
+		veto.LiftedBy = append(veto.LiftedBy, name)
+	}
+
+	if name == veto.By || len(veto.LiftedBy) >= 2 {
+		delete(records.Vetoes, id)
+		lifted = true
+	} else {
+		records.Vetoes[id] = veto
+	}
+	err = records.WriteRecordsToDisk()
+	return
+}
+
+// GetVeto returns the veto with the given ID.
+func (records *Records) GetVeto(id string) (Veto, bool) {
+	veto, found := records.Vetoes[id]
+	return veto, found
+}
+
+// GetVetoes returns the vetoes in place on data with the given
+// fingerprint and labels, oldest first.
+func (records *Records) GetVetoes(fingerprint string, labels []string) []Veto {
+	var vetoes vetoSlice
+	for _, veto := range records.Vetoes {
+		match := veto.Fingerprint != "" && veto.Fingerprint == fingerprint
+		for _, label := range labels {
+			if veto.Label != "" && veto.Label == label {
+				match = true
+			}
+		}
+		if match {
+			vetoes = append(vetoes, veto)
+		}
+	}
+	sort.Sort(vetoes)
+	return vetoes
+}
+
+// AddApproval approves decryptions of the data with the given
+// fingerprint by name until expiry, replacing an earlier approval of
+// the data by name. Expired approvals are dropped.
+func (records *Records) AddApproval(name, fingerprint string, expiry time.Time) (approval Approval, err error) {
+	if _, ok := records.GetRecord(name); !ok {
+		return approval, errors.New("Record missing")
+	}
+	if fingerprint == "" {
+		return approval, errors.New("Approval needs a fingerprint")
+	}
+
+	approval = Approval{Fingerprint: fingerprint, By: name, Time: time.Now(), Expiry: expiry}
+	if approval.ID, err = NewID(); err != nil {
+		return
+	}
+
+	if records.Approvals == nil {
+		records.Approvals = make(map[string]Approval)
+	}
+	for id, old := range records.Approvals {
+		if (old.By == name && old.Fingerprint == fingerprint) || !old.Expiry.After(approval.Time) {
+			delete(records.Approvals, id)
+		}
+	}
+	records.Approvals[approval.ID] = approval
+	err = records.WriteRecordsToDisk()
+	return
+}
+
+// WithdrawApproval withdraws the approval by name of decryptions of the
+// data with the given fingerprint.
+func (records *Records) WithdrawApproval(name, fingerprint string) error {
+	for id, approval := range records.Approvals {
+		if approval.By == name && approval.Fingerprint == fingerprint {
+			delete(records.Approvals, id)
+			return records.WriteRecordsToDisk()
+		}
+	}
+	return errors.New("Approval missing")
+}
+
+// GetApprovals returns the approvals of decryptions of the data with
+// the given fingerprint that have not expired, by user name.
+func (records *Records) GetApprovals(fingerprint string) map[string]Approval {
+	now := time.Now()
+	out := make(map[string]Approval)
+	for _, approval := range records.Approvals {
+		if approval.Fingerprint == fingerprint && approval.Expiry.After(now) {
+			out[approval.By] = approval
+		}
+	}
+	return out
+}
+
+// SetImported keeps the imported key of a user without a record.
+func (records *Records) SetImported(name string, key ImportedKey) error {
+	if _, ok := records.GetRecord(name); ok {
+		return errors.New("User with that name already exists")
+	}
+	if records.Imported == nil {
+		records.Imported = make(map[string]ImportedKey)
+	}
+	records.Imported[name] = key
+	return records.WriteRecordsToDisk()
+}
+
+// GetImported returns the imported key of a user who has not claimed
+// it yet.
+func (records *Records) GetImported(name string) (ImportedKey, bool) {
+	key, ok := records.Imported[name]
+	return key, ok
+}
+
+// ClaimImported creates the record of a user from their imported key,
+// with the given password.
+func (records *Records) ClaimImported(name, password string) (PasswordRecord, error) {
+	key, ok := records.Imported[name]
+	if !ok {
+		return PasswordRecord{}, errors.New("No key imported for that user")
+	}
+	if _, ok := records.GetRecord(name); ok {
+		return PasswordRecord{}, errors.New("User with that name already exists")
+	}
+
+	pr, err := createPasswordRec(password, false, key.Type, records.GetKDF())
+	if err != nil {
+		return pr, err
+	}
+	pr.SSHKey = key.Key
+	records.SetRecord(pr, name)
+	delete(records.Imported, name)
+	return pr, records.WriteRecordsToDisk()
+}
+
+// GetLabelPolicy returns the policy for a given label.
+func (records *Records) GetLabelPolicy(label string) (LabelPolicy, bool) {
+	policy, found := records.Policies[label]
+	return policy, found
 }
 
 // GetVaultId returns the id of the current vault.
@@ -475,23 +1422,104 @@ func (records *Records) GetHMACKey() (key []byte, err error) {
 	return records.HmacKey, nil
 }
 
+// identity returns the server identity key of the vault.
+func (records *Records) identity() (*ecdsa.PrivateKey, error) {
+	return x509.ParseECPrivateKey(records.IdentityKey)
+}
+
+// GetIdentityPub returns the public half of the server identity key.
+func (records *Records) GetIdentityPub() (*ecdsa.PublicKey, error) {
+	key, err := records.identity()
+	if err != nil {
+		return nil, err
+	}
+	return &key.PublicKey, nil
+}
+
+// Sign signs data with the server identity key. The signature is an
+// ASN.1 encoded ECDSA signature of the SHA-256 hash of data.
+func (records *Records) Sign(data []byte) ([]byte, error) {
+	key, err := records.identity()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, key, hash[:])
+}
+
+// DecryptWithIdentity decrypts data encrypted with ecdh.Encrypt to the
+// server identity key.
+func (records *Records) DecryptWithIdentity(in []byte) ([]byte, error) {
+	key, err := records.identity()
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.Decrypt(key, in)
+}
+
 // NumRecords returns the number of records in the vault.
 func (records *Records) NumRecords() int {
-	return len(records.Passwords)
+	return len(records.Passwords) + len(records.encoded)
 }
 
 // GetSummary returns a summary of the records on disk.
 func (records *Records) GetSummary() (summary map[string]Summary) {
 	summary = make(map[string]Summary)
-	for name, pass := range records.Passwords {
-		summary[name] = Summary{pass.Admin, pass.Type}
+	for _, name := range records.Names() {
+		pass, ok := records.GetRecord(name)
+		if !ok {
+			continue
+		}
+		var absence *AbsenceSummary
+		if a := pass.Absence; a != nil {
+			absence = &AbsenceSummary{a.Substitute, a.Start, a.End, a.ApprovedBy}
+		}
+		var adminUntil *time.Time
+		if pass.IsAdmin() && !pass.AdminUntil.IsZero() {
+			adminUntil = &pass.AdminUntil
+		}
+		summary[name] = Summary{pass.ID, pass.IsAdmin(), pass.Type, pass.Attributes, absence, pass.Vetoer, pass.GetRole(),
+			pass.KeyFingerprint(), pass.Created, pass.LastAuth, pass.Notes, pass.AllowedLabels, adminUntil}
 	}
 	return
 }
 
-// IsAdmin returns the admin status of the PasswordRecord.
+// IsAdmin returns the admin status of the PasswordRecord, which lapses
+// at AdminUntil if it was given for a time.
 func (pr *PasswordRecord) IsAdmin() bool {
-	return pr.Admin
+	return pr.Admin && (pr.AdminUntil.IsZero() || time.Now().Before(pr.AdminUntil))
+}
+
+// GetRole returns the role of the user.
+func (pr *PasswordRecord) GetRole() string {
+	switch {
+	case pr.IsAdmin():
+		return AdminRole
+	case pr.Role == "":
+		return OperatorRole
+	}
+	return pr.Role
+}
+
+// AllowsLabel returns true if the user may delegate for and encrypt
+// under label.
+func (pr *PasswordRecord) AllowsLabel(label string) bool {
+	if len(pr.AllowedLabels) == 0 {
+		return true
+	}
+	for _, pattern := range pr.AllowedLabels {
+		if ok, _ := path.Match(pattern, label); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAttribute returns true if the PasswordRecord has the attribute
+// key set to value.
+func (pr *PasswordRecord) HasAttribute(key, value string) bool {
+	v, ok := pr.Attributes[key]
+	return ok && v == value
 }
 
 // GetType returns the type status of the PasswordRecord.
@@ -501,10 +1529,16 @@ func (pr *PasswordRecord) GetType() string {
 
 // EncryptKey encrypts a 16-byte key with the RSA or EC key of the record.
 func (pr *PasswordRecord) EncryptKey(in []byte) (out []byte, err error) {
-	if pr.Type == RSARecord {
-		return rsa.EncryptOAEP(sha1.New(), rand.Reader, &pr.RSAKey.RSAPublic, in, nil)
+	return pr.EncryptKeyFrom(rand.Reader, in)
+}
+
+// EncryptKeyFrom is EncryptKey, taking the randomness of the encryption
+// from random, so that the same random bytes give the same output.
+func (pr *PasswordRecord) EncryptKeyFrom(random io.Reader, in []byte) (out []byte, err error) {
+	if pr.Type == RSARecord || pr.Type == HSMRecord {
+		return rsa.EncryptOAEP(sha1.New(), random, &pr.RSAKey.RSAPublic, in, nil)
 	} else if pr.Type == ECCRecord {
-		return ecdh.Encrypt(pr.ECKey.ECPublic.toECDSA(), in)
+		return ecdh.EncryptFrom(random, pr.ECKey.ECPublic.toECDSA(), in)
 	} else {
 		return nil, errors.New("Invalid function for record type")
 	}
@@ -512,7 +1546,7 @@ func (pr *PasswordRecord) EncryptKey(in []byte) (out []byte, err error) {
 
 // GetKeyRSAPub returns the RSA public key of the record.
 func (pr *PasswordRecord) GetKeyRSAPub() (out *rsa.PublicKey, err error) {
-	if pr.Type != RSARecord {
+	if pr.Type != RSARecord && pr.Type != HSMRecord {
 		return out, errors.New("Invalid function for record type")
 	}
 	return &pr.RSAKey.RSAPublic, err
@@ -526,6 +1560,28 @@ func (pr *PasswordRecord) GetKeyECCPub() (out *ecdsa.PublicKey, err error) {
 	return pr.ECKey.ECPublic.toECDSA(), err
 }
 
+// KeyFingerprint returns the hex encoded SHA-256 hash of the PKIX
+// encoded public key of the record, so that users can check the key
+// data is encrypted to. It is empty if the record has no valid key.
+func (pr *PasswordRecord) KeyFingerprint() string {
+	var pub interface{}
+	switch pr.Type {
+	case RSARecord, HSMRecord:
+		pub = &pr.RSAKey.RSAPublic
+	case ECCRecord:
+		pub = pr.ECKey.ECPublic.toECDSA()
+	default:
+		return ""
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
 // GetKeyECC returns the ECDSA private key of the record given the correct password.
 func (pr *PasswordRecord) GetKeyECC(password string) (key *ecdsa.PrivateKey, err error) {
 	if pr.Type != ECCRecord {
@@ -536,11 +1592,16 @@ func (pr *PasswordRecord) GetKeyECC(password string) (key *ecdsa.PrivateKey, err
 		return
 	}
 
-	passKey, err := derivePasswordKey(password, pr.KeySalt)
+	passKey, err := derivePasswordKey(pr.GetKDF(), password, pr.KeySalt)
 	if err != nil {
 		return
 	}
 
+	return pr.decryptKeyECC(passKey)
+}
+
+// decryptKeyECC decrypts the ECC key of a record with the given key.
+func (pr *PasswordRecord) decryptKeyECC(passKey []byte) (key *ecdsa.PrivateKey, err error) {
 	x509Padded, err := symcrypt.DecryptCBC(pr.ECKey.ECPriv, pr.ECKey.ECPrivIV, passKey)
 	if err != nil {
 		return
@@ -564,11 +1625,16 @@ func (pr *PasswordRecord) GetKeyRSA(password string) (key rsa.PrivateKey, err er
 		return
 	}
 
-	passKey, err := derivePasswordKey(password, pr.KeySalt)
+	passKey, err := derivePasswordKey(pr.GetKDF(), password, pr.KeySalt)
 	if err != nil {
 		return
 	}
 
+	return pr.decryptKeyRSA(passKey)
+}
+
+// decryptKeyRSA decrypts the RSA key of a record with the given key.
+func (pr *PasswordRecord) decryptKeyRSA(passKey []byte) (key rsa.PrivateKey, err error) {
 	rsaExponentPadded, err := symcrypt.DecryptCBC(pr.RSAKey.RSAExp, pr.RSAKey.RSAExpIV, passKey)
 	if err != nil {
 		return
@@ -610,13 +1676,62 @@ func (pr *PasswordRecord) GetKeyRSA(password string) (key rsa.PrivateKey, err er
 	return
 }
 
+// ActiveAbsence returns the planned absence of the user if it has been
+// approved and is in effect at the given time.
+func (pr *PasswordRecord) ActiveAbsence(now time.Time) (*Absence, bool) {
+	a := pr.Absence
+	if a == nil || a.ApprovedBy == "" || now.Before(a.Start) || !now.Before(a.End) {
+		return nil, false
+	}
+	return a, true
+}
+
+// GetKeyRSA returns the RSA key of the absent user given the random
+// key recovered by the substitute.
+func (a *Absence) GetKeyRSA(key []byte) (rsa.PrivateKey, error) {
+	return a.Key.decryptKeyRSA(key)
+}
+
+// GetKeyECC returns the ECC key of the absent user given the random
+// key recovered by the substitute.
+func (a *Absence) GetKeyECC(key []byte) (*ecdsa.PrivateKey, error) {
+	return a.Key.decryptKeyECC(key)
+}
+
 // ValidatePassword returns an error if the password is incorrect.
 func (pr *PasswordRecord) ValidatePassword(password string) error {
-	h, err := hashPassword(password, pr.PasswordSalt)
-	if err != nil {
+	return pr.ValidatePasswordContext(context.Background(), password)
+}
+
+// ValidatePasswordContext is ValidatePassword, giving up once ctx is
+// done instead of waiting for the password to be hashed.
+func (pr *PasswordRecord) ValidatePasswordContext(ctx context.Context, password string) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	type hashed struct {
+		h   []byte
+		err error
+	}
+	done := make(chan hashed, 1)
+	salt, params := pr.PasswordSalt, pr.GetKDF()
+	go func() {
+		h, err := hashPassword(params, password, salt)
+		done <- hashed{h, err}
+	}()
+
+	var h []byte
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		h = r.h
+	}
+
 	if bytes.Compare(h, pr.HashedPassword) != 0 {
 		return errors.New("Wrong Password")
 	}
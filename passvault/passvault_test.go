@@ -5,8 +5,14 @@
 package passvault
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestStaticVault(t *testing.T) {
@@ -233,3 +239,434 @@ func TestMakeRevokeAdmin(t *testing.T) {
 	}
 
 }
+
+func TestSetRole(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	myRec, err := records.AddNewRecord("user", "weakpassword", false, ECCRecord)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if myRec.GetRole() != OperatorRole {
+		t.Fatalf("Incorrect default role %s", myRec.GetRole())
+	}
+
+	for _, role := range []string{AuditorRole, AdminRole, ServiceRole, OperatorRole} {
+		if err = records.SetRole("user", role); err != nil {
+			t.Fatalf("%v", err)
+		}
+		myRec, _ = records.GetRecord("user")
+		if myRec.GetRole() != role || myRec.IsAdmin() != (role == AdminRole) {
+			t.Fatalf("Incorrect role %s, admin=%v", myRec.GetRole(), myRec.IsAdmin())
+		}
+	}
+
+	if err = records.SetRole("user", "root"); err == nil {
+		t.Fatalf("Unknown role accepted")
+	}
+	if err = records.SetRole("nobody", AuditorRole); err == nil {
+		t.Fatalf("Role set on missing record")
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	other, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err = records.AddNewRecord("alice", "weakpassword", true, ECCRecord); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = other.AddNewRecord("alice", "otherpassword", true, ECCRecord); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = other.AddNewRecord("bob", "weakpassword", false, ECCRecord); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	added, conflicts, err := records.MergeRecords(other, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(added) != 1 || added[0] != "bob" || len(conflicts) != 1 || conflicts[0] != "alice" {
+		t.Fatalf("Incorrect merge report, added %v, conflicts %v", added, conflicts)
+	}
+	if records.NumRecords() != 1 {
+		t.Fatalf("Dry run merge changed the vault")
+	}
+
+	if _, _, err = records.MergeRecords(other, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if records.NumRecords() != 2 {
+		t.Fatalf("Incorrect number of records after merge")
+	}
+
+	alice, _ := records.GetRecord("alice")
+	if err = alice.ValidatePassword("weakpassword"); err != nil {
+		t.Fatalf("Conflicting record was overwritten")
+	}
+	bob, _ := records.GetRecord("bob")
+	if _, err = bob.GetKeyECC("weakpassword"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestValidatePasswordContext(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pr, err := records.AddNewRecord("alice", "weakpassword", true, DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = pr.ValidatePasswordContext(context.Background(), "weakpassword"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = pr.ValidatePasswordContext(context.Background(), "wrongpassword"); err == nil {
+		t.Fatalf("Wrong password accepted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = pr.ValidatePasswordContext(ctx, "weakpassword"); err != context.Canceled {
+		t.Fatalf("Password checked after the context was done: %v", err)
+	}
+}
+
+func TestKDFLimit(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pr, err := records.AddNewRecord("alice", "weakpassword", true, DefaultRecordType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	SetKDFLimit(1)
+	defer SetKDFLimit(0)
+
+	// a hash still running holds its place
+	if err = startKDF(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = pr.ValidatePassword("weakpassword"); err != ErrKDFBusy {
+		t.Fatalf("Password hashed past the limit: %v", err)
+	}
+	if stats := GetKDFStats(); stats.Running != 1 || stats.Refused != 1 {
+		t.Fatalf("Wrong KDF stats: %+v", stats)
+	}
+
+	doneKDF()
+	if err = pr.ValidatePassword("weakpassword"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stats := GetKDFStats(); stats.Running != 0 {
+		t.Fatalf("Hash not released: %+v", stats)
+	}
+}
+
+func TestLazyRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	records, err := InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err = records.AddNewRecord(name, "weakpassword", false, DefaultRecordType); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	records, err = InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(records.Passwords) != 0 || records.NumRecords() != 2 {
+		t.Fatalf("Records decoded on load: %d of %d", len(records.Passwords), records.NumRecords())
+	}
+
+	pr, ok := records.GetRecord("alice")
+	if !ok {
+		t.Fatalf("Record not decoded")
+	}
+	if err = pr.ValidatePassword("weakpassword"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(records.Passwords) != 1 {
+		t.Fatalf("Wrong number of decoded records: %d", len(records.Passwords))
+	}
+
+	// records that were never used are written back as they were
+	if err = records.SetAttribute("alice", "team", "sre"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	records, err = InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if names := records.Names(); len(names) != 2 || names[0] != "alice" || names[1] != "bob" {
+		t.Fatalf("Wrong names: %v", names)
+	}
+	if pr, _ = records.GetRecord("alice"); pr.Attributes["team"] != "sre" {
+		t.Fatalf("Change to a decoded record lost")
+	}
+	if pr, _ = records.GetRecord("bob"); pr.ValidatePassword("weakpassword") != nil {
+		t.Fatalf("Record never decoded was not kept")
+	}
+
+	// a malformed record is reported when used, and not replaced
+	records.encoded["carol"] = json.RawMessage(`{"ID":"carol","Type":"ECC"}`)
+	if _, ok = records.GetRecord("carol"); ok {
+		t.Fatalf("Malformed record returned")
+	}
+	if _, err = records.AddNewRecord("carol", "weakpassword", false, DefaultRecordType); err == nil {
+		t.Fatalf("Malformed record replaced")
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	records, err := InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	records.SetWriteBehind(time.Hour)
+
+	// the first change is written, the next ones wait for Flush
+	if _, err = records.AddNewRecord("alice", "weakpassword", false, DefaultRecordType); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = records.AddNewRecord("bob", "weakpassword", false, DefaultRecordType); err != nil {
+		t.Fatalf("%v", err)
+	}
+	onDisk, err := InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if onDisk.NumRecords() != 1 {
+		t.Fatalf("Write not deferred: %d records on disk", onDisk.NumRecords())
+	}
+
+	if err = records.Flush(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if onDisk, err = InitFrom(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if onDisk.NumRecords() != 2 {
+		t.Fatalf("Flush lost a change: %d records on disk", onDisk.NumRecords())
+	}
+
+	// no temporary file is left behind
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Wrong number of files: %d", len(files))
+	}
+}
+
+// largeVault writes a vault of n users sharing the same key material,
+// since generating a key for each would take longer than the benchmark.
+func largeVault(b *testing.B, n int) string {
+	records, err := InitFrom("memory")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	pr, err := records.AddNewRecord("user", "weakpassword", false, DefaultRecordType)
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	for i := 0; i < n; i++ {
+		if pr.ID, err = NewID(); err != nil {
+			b.Fatalf("%v", err)
+		}
+		records.SetRecord(pr, fmt.Sprintf("user%d", i))
+	}
+
+	path := filepath.Join(b.TempDir(), "vault.json")
+	out, err := json.Marshal(records)
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	if err = ioutil.WriteFile(path, out, 0644); err != nil {
+		b.Fatalf("%v", err)
+	}
+	return path
+}
+
+func benchmarkInitFrom(b *testing.B, n int) {
+	path := largeVault(b, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := InitFrom(path); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}
+}
+
+func BenchmarkInitFrom10k(b *testing.B)  { benchmarkInitFrom(b, 10000) }
+func BenchmarkInitFrom100k(b *testing.B) { benchmarkInitFrom(b, 100000) }
+
+func benchmarkWrite(b *testing.B, n int) {
+	records, err := InitFrom(largeVault(b, n))
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = records.SetAttribute(fmt.Sprintf("user%d", i%n), "team", "sre"); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}
+}
+
+func BenchmarkWrite10k(b *testing.B)  { benchmarkWrite(b, 10000) }
+func BenchmarkWrite100k(b *testing.B) { benchmarkWrite(b, 100000) }
+
+func BenchmarkGetRecord100k(b *testing.B) {
+	records, err := InitFrom(largeVault(b, 100000))
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := records.GetRecord(fmt.Sprintf("user%d", i%100000)); !ok {
+			b.Fatalf("Record missing")
+		}
+	}
+}
+
+func TestAllowedLabels(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = records.AddNewRecord("alice", "weakpassword", false, DefaultRecordType); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = records.SetAllowedLabels("alice", []string{"staging/[a-"}); err == nil {
+		t.Fatalf("Bad label pattern accepted")
+	}
+	if err = records.SetAllowedLabels("bob", nil); err == nil {
+		t.Fatalf("Labels set on a missing record")
+	}
+
+	pr, _ := records.GetRecord("alice")
+	if !pr.AllowsLabel("prod") {
+		t.Fatalf("Unrestricted user refused a label")
+	}
+
+	if err = records.SetAllowedLabels("alice", []string{"staging/*", "dev"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pr, _ = records.GetRecord("alice")
+	for label, allowed := range map[string]bool{"staging/web": true, "dev": true, "prod": false, "staging/web/db": false, "devel": false} {
+		if pr.AllowsLabel(label) != allowed {
+			t.Fatalf("AllowsLabel(%q) should be %v", label, allowed)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	records, err := InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, recordType := range map[string]string{"alice": RSARecord, "bob": ECCRecord} {
+		if _, err = records.AddNewRecord(name, "weakpassword", false, recordType); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	params := KDFParams{N: 1024, R: 8, P: 1}
+	if err = records.StartRekey(KDFParams{N: 1024, R: 0, P: 1}, time.Now()); err == nil {
+		t.Fatalf("Invalid parameters accepted")
+	}
+	if err = records.StartRekey(params, time.Now()); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the job and the parameters of each record survive a restart,
+	// and progress is known without decoding the records
+	if rekeyed, err := records.RekeyRecord("alice", "weakpassword"); err != nil || !rekeyed {
+		t.Fatalf("Record not re-keyed: %v", err)
+	}
+	records, err = InitFrom(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	progress := records.GetRekeyProgress()
+	if progress.Job == nil || progress.Job.To != params || progress.Total != 2 || progress.Done != 1 || len(records.Passwords) != 0 {
+		t.Fatalf("Wrong progress: %+v", progress)
+	}
+
+	if _, err = records.RekeyRecord("bob", "wrongpassword"); err == nil {
+		t.Fatalf("Record re-keyed with the wrong password")
+	}
+	if rekeyed, err := records.RekeyRecord("bob", "weakpassword"); err != nil || !rekeyed {
+		t.Fatalf("Record not re-keyed: %v", err)
+	}
+	if rekeyed, _ := records.RekeyRecord("bob", "weakpassword"); rekeyed {
+		t.Fatalf("Record re-keyed twice")
+	}
+	if progress = records.GetRekeyProgress(); progress.Done != 2 {
+		t.Fatalf("Wrong progress: %+v", progress)
+	}
+
+	alice, _ := records.GetRecord("alice")
+	if _, err = alice.GetKeyRSA("weakpassword"); err != nil || alice.GetKDF() != params {
+		t.Fatalf("Re-keyed record unusable: %v", err)
+	}
+	bob, _ := records.GetRecord("bob")
+	if _, err = bob.GetKeyECC("weakpassword"); err != nil || bob.GetKDF() != params {
+		t.Fatalf("Re-keyed record unusable: %v", err)
+	}
+}
+
+func TestPublicStats(t *testing.T) {
+	records, err := InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, day := range []string{"2013-11-20", "2013-11-28", "2013-11-28"} {
+		if err = records.CountDecrypt(day, "2013-11-20"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err = records.CountDecrypt("2013-11-29", "2013-11-21"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := records.GetDecryptCount("2013-11-20"); n != 0 {
+		t.Fatalf("Old day kept with %d decryptions", n)
+	}
+	if n := records.GetDecryptCount("2013-11-28"); n != 2 {
+		t.Fatalf("Expected 2 decryptions, got %d", n)
+	}
+
+	if _, ok := records.GetReleased("active 2013-11-29"); ok {
+		t.Fatalf("Count released before it was set")
+	}
+	if err = records.SetReleased(map[string]int{"active 2013-11-29": 7}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if v, ok := records.GetReleased("active 2013-11-29"); !ok || v != 7 {
+		t.Fatalf("Wrong released count %d", v)
+	}
+}
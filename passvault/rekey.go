@@ -0,0 +1,141 @@
+// rekey.go: moving the records of a vault to new KDF parameters
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package passvault
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// RekeyJob is the move of the records of a vault to new KDF parameters.
+// As the vault never holds passwords, a record is re-keyed when its user
+// next authenticates (see RekeyRecord). Each record keeps the parameters
+// it was re-keyed with and is written on its own, so a vault is usable
+// at every step and the job goes on from where it was after a restart.
+type RekeyJob struct {
+	From    KDFParams
+	To      KDFParams
+	Started time.Time
+	Paused  bool `json:",omitempty"`
+}
+
+// RekeyProgress is how far the records of the vault have been moved to
+// its KDF parameters.
+type RekeyProgress struct {
+	Job       *RekeyJob `json:",omitempty"`
+	Total     int
+	Done      int
+	Remaining []string `json:",omitempty"` // users who have yet to authenticate
+}
+
+// GetKDF returns the KDF parameters of the record.
+func (pr *PasswordRecord) GetKDF() KDFParams {
+	if pr.KDF == nil {
+		return DefaultKDF
+	}
+	return *pr.KDF
+}
+
+func (pr *PasswordRecord) setKDF(params KDFParams) {
+	pr.KDF = nil
+	if params != DefaultKDF {
+		pr.KDF = &params
+	}
+}
+
+// GetKDF returns the KDF parameters new passwords are hashed with.
+func (records *Records) GetKDF() KDFParams {
+	if records.KDF == nil {
+		return DefaultKDF
+	}
+	return *records.KDF
+}
+
+// StartRekey sets the KDF parameters of the vault to params, used at
+// once for new passwords, and starts moving the existing records to
+// them. A job already running is replaced.
+func (records *Records) StartRekey(params KDFParams, now time.Time) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	if params == records.GetKDF() {
+		return errors.New("The vault already uses these KDF parameters")
+	}
+
+	records.Rekey = &RekeyJob{From: records.GetKDF(), To: params, Started: now}
+	records.KDF = nil
+	if params != DefaultKDF {
+		records.KDF = &params
+	}
+	return records.WriteRecordsToDisk()
+}
+
+// PauseRekey pauses or resumes the re-keying of records. Records keep
+// their parameters while it is paused.
+func (records *Records) PauseRekey(paused bool) error {
+	if records.Rekey == nil {
+		return errors.New("No re-keying in progress")
+	}
+	records.Rekey.Paused = paused
+	return records.WriteRecordsToDisk()
+}
+
+// recordKDF returns the KDF parameters of the record of name, without
+// decoding a record that was never used.
+func (records *Records) recordKDF(name string) (KDFParams, bool) {
+	if pr, ok := records.Passwords[name]; ok {
+		return pr.GetKDF(), true
+	}
+	raw, ok := records.encoded[name]
+	if !ok {
+		return KDFParams{}, false
+	}
+	var pr struct {
+		KDF *KDFParams
+	}
+	if err := json.Unmarshal(raw, &pr); err != nil {
+		return KDFParams{}, false
+	}
+	if pr.KDF == nil {
+		return DefaultKDF, true
+	}
+	return *pr.KDF, true
+}
+
+// GetRekeyProgress returns how many records have the KDF parameters of
+// the vault, and the users of those that do not.
+func (records *Records) GetRekeyProgress() RekeyProgress {
+	progress := RekeyProgress{Job: records.Rekey}
+	params := records.GetKDF()
+	for _, name := range records.Names() {
+		progress.Total++
+		if kdf, ok := records.recordKDF(name); ok && kdf == params {
+			progress.Done++
+		} else {
+			progress.Remaining = append(progress.Remaining, name)
+		}
+	}
+	return progress
+}
+
+// RekeyRecord re-keys the record of name with the KDF parameters of the
+// vault, given the password its user has just authenticated with, if a
+// re-keying job is running and the record has yet to be. It returns
+// whether the record was re-keyed. The record is replaced in a single
+// write, with its old parameters kept until then.
+func (records *Records) RekeyRecord(name, password string) (bool, error) {
+	if records.Rekey == nil || records.Rekey.Paused {
+		return false, nil
+	}
+	pr, ok := records.GetRecord(name)
+	if !ok || pr.GetKDF() == records.GetKDF() {
+		return false, nil
+	}
+	if err := records.ChangePassword(name, password, password); err != nil {
+		return false, err
+	}
+	return true, nil
+}
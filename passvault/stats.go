@@ -0,0 +1,58 @@
+// stats.go: public statistics kept in the vault across restarts
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package passvault
+
+// PublicStats holds the daily decryption counts the public statistics
+// are computed from, and the noisy counts already returned, so that a
+// restart neither loses the counts nor draws new noise for them.
+type PublicStats struct {
+	Decrypts map[string]int `json:",omitempty"` // by UTC day, as YYYY-MM-DD
+	Released map[string]int `json:",omitempty"` // noisy counts returned, by key
+}
+
+// CountDecrypt adds a decryption on day to the public statistics, and
+// drops the counts of the days before since. Days are given as
+// YYYY-MM-DD, which sorts them by date.
+func (records *Records) CountDecrypt(day, since string) error {
+	if records.Stats == nil {
+		records.Stats = new(PublicStats)
+	}
+	if records.Stats.Decrypts == nil {
+		records.Stats.Decrypts = make(map[string]int)
+	}
+	for d := range records.Stats.Decrypts {
+		if d < since {
+			delete(records.Stats.Decrypts, d)
+		}
+	}
+	records.Stats.Decrypts[day]++
+	return records.WriteRecordsToDisk()
+}
+
+// GetDecryptCount returns the number of decryptions counted on day.
+func (records *Records) GetDecryptCount(day string) int {
+	if records.Stats == nil {
+		return 0
+	}
+	return records.Stats.Decrypts[day]
+}
+
+// GetReleased returns the noisy count returned for key, if any.
+func (records *Records) GetReleased(key string) (int, bool) {
+	if records.Stats == nil {
+		return 0, false
+	}
+	v, ok := records.Stats.Released[key]
+	return v, ok
+}
+
+// SetReleased replaces the noisy counts returned.
+func (records *Records) SetReleased(released map[string]int) error {
+	if records.Stats == nil {
+		records.Stats = new(PublicStats)
+	}
+	records.Stats.Released = released
+	return records.WriteRecordsToDisk()
+}
@@ -5,198 +5,32 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/anomaly"
+	"github.com/cloudflare/redoctober/breach"
+	"github.com/cloudflare/redoctober/chaos"
+	"github.com/cloudflare/redoctober/classify"
+	"github.com/cloudflare/redoctober/notify"
+	"github.com/cloudflare/redoctober/oncall"
+	"github.com/cloudflare/redoctober/server"
+	"github.com/cloudflare/redoctober/tickets"
 	"github.com/coreos/go-systemd/activation"
 )
 
-// List of URLs to register and their related functions
-
-var functions = map[string]func([]byte) ([]byte, error){
-	"/create":      core.Create,
-	"/summary":     core.Summary,
-	"/purge":       core.Purge,
-	"/delegate":    core.Delegate,
-	"/create-user": core.CreateUser,
-	"/password":    core.Password,
-	"/encrypt":     core.Encrypt,
-	"/re-encrypt":  core.ReEncrypt,
-	"/decrypt":     core.Decrypt,
-	"/owners":      core.Owners,
-	"/modify":      core.Modify,
-	"/export":      core.Export,
-}
-
-type userRequest struct {
-	rt string // The request type (which will be one of the
-	// keys of the functions map above
-	in []byte // Arbitrary input data (depends on the core.*
-	// function called)
-	resp chan<- []byte // Channel down which a response is sent (the
-	// data sent will depend on the core.* function
-	// called to handle this request)
-}
-
-// queueRequest handles a single request receive on the JSON API for
-// one of the functions named in the functions map above. It reads the
-// request and sends it to the goroutine started in main() below for
-// processing and then waits for the response.
-func queueRequest(process chan<- userRequest, requestType string, w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	response := make(chan []byte)
-	process <- userRequest{rt: requestType, in: body, resp: response}
-
-	if resp, ok := <-response; ok {
-		header := w.Header()
-		header.Set("Content-Type", "application/json")
-		header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
-
-		w.Write(resp)
-	} else {
-		http.Error(w, "Unknown request", http.StatusInternalServerError)
-	}
-}
-
-// NewServer starts an HTTPS server the handles the redoctober JSON
-// API. Each of the URIs in the functions map above is setup with a
-// separate HandleFunc. Each HandleFunc is an instance of queueRequest
-// above.
-//
-// Returns a valid http.Server handling redoctober JSON requests (and
-// its associated listener) or an error
-func NewServer(process chan<- userRequest, staticPath, addr, caPath string, certPaths, keyPaths []string, useSystemdSocket bool) (*http.Server, *net.Listener, error) {
-	config := &tls.Config{
-		PreferServerCipherSuites: true,
-		SessionTicketsDisabled:   true,
-	}
-	for i, certPath := range certPaths {
-		cert, err := tls.LoadX509KeyPair(certPath, keyPaths[i])
-		if err != nil {
-			return nil, nil, fmt.Errorf("Error loading certificate (%s, %s): %s", certPath, keyPaths[i], err)
-		}
-		config.Certificates = append(config.Certificates, cert)
-	}
-	config.BuildNameToCertificate()
-
-	// If a caPath has been specified then a local CA is being used
-	// and not the system configuration.
-
-	if caPath != "" {
-		pemCert, err := ioutil.ReadFile(caPath)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Error reading %s: %s\n", caPath, err)
-		}
-
-		derCert, _ := pem.Decode(pemCert)
-		if derCert == nil {
-			return nil, nil, fmt.Errorf("No PEM data was found in the CA certificate file\n")
-		}
-
-		cert, err := x509.ParseCertificate(derCert.Bytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Error parsing CA certificate: %s\n", err)
-		}
-
-		rootPool := x509.NewCertPool()
-		rootPool.AddCert(cert)
-
-		config.ClientAuth = tls.RequireAndVerifyClientCert
-		config.ClientCAs = rootPool
-	}
-
-	var lstnr net.Listener
-	if useSystemdSocket {
-		listenFDs, err := activation.Listeners(true)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(listenFDs) != 1 {
-			log.Fatalf("Unexpected number of socket activation FDs! (%d)", len(listenFDs))
-		}
-		lstnr = tls.NewListener(listenFDs[0], config)
-	} else {
-		conn, err := net.Listen("tcp", addr)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Error starting TCP listener on %s: %s\n", addr, err)
-		}
-
-		lstnr = tls.NewListener(conn, config)
-
-	}
-	mux := http.NewServeMux()
-
-	// queue up post URIs
-	for current := range functions {
-		// copy this so reference does not get overwritten
-		requestType := current
-		mux.HandleFunc(requestType, func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("http.server: endpoint=%s remote=%s", requestType, r.RemoteAddr)
-			queueRequest(process, requestType, w, r)
-		})
-	}
-
-	// queue up web frontend
-	idxHandler := &indexHandler{staticPath}
-	mux.HandleFunc("/index", idxHandler.handle)
-	mux.HandleFunc("/", idxHandler.handle)
-
-	srv := http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
-
-	return &srv, &lstnr, nil
-}
-
-type indexHandler struct {
-	staticPath string
-}
-
-func (this *indexHandler) handle(w http.ResponseWriter, r *http.Request) {
-	var body io.ReadSeeker
-	if this.staticPath != "" {
-		f, err := os.Open(this.staticPath)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-		body = f
-	} else {
-		body = bytes.NewReader(indexHtml)
-	}
-
-	header := w.Header()
-	header.Set("Content-Type", "text/html")
-	header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
-	// If the server isn't HTTPS worthy, the HSTS header won't be honored.
-
-	http.ServeContent(w, r, "index.html", time.Now(), body)
-}
-
 const usage = `Usage:
 
-	redoctober -static <path> -vaultpath <path> -addr <addr> -certs <path1>[,<path2>,...] -keys <path1>[,<path2>,...] [-ca <path>]
+	redoctober -static <path> -vaultpath <path> -addr <addr> -certs <path1>[,<path2>,...] -keys <path1>[,<path2>,...] [-ca <path>] [-adminaddr <addr>] [-memory] [-http2=false] [-readtimeout <d>] [-writetimeout <d>] [-idletimeout <d>] [-maxconns <n>] [-maxrequests <n>] [-requesttimeout <d>] [-writebehind <d>] [-sessionttl <d>] [-kdflimit <n>] [-queuelimit <n>] [-batchqueuelimit <n>] [-unwrapttl <d>] [-primary <addr> [-primaryca <path>] [-syncinterval <d>] [-promotequorum <n>]] [-staledays <days>] [-minadmins <n>] [-maxadmins <n>] [-stagechanges] [-ceremony <n>] [-classify] [-requirelabels [-requirepolicies]] [-recoverykey <path> -recoverypath <path> [-recoveryinterval <d>]] [-escrowkey <path> [-escrowquorum <n>]] [-selftestinterval <d>] [-ticketsystem <jira|servicenow> -ticketurl <url>] [-oncallsystem <pagerduty|opsgenie> [-oncallurl <url>]] [-breachlist <path> | -breachapi <url>] [-anomalies] [-notifywebhook <url>] [-notifyslack <url>]
 
 single-cert example:
 redoctober -vaultpath diskrecord.json -addr localhost:8080 -certs cert.pem -keys cert.key
@@ -214,11 +48,54 @@ func main() {
 
 	var staticPath = flag.String("static", "", "Path to override built-in index.html")
 	var vaultPath = flag.String("vaultpath", "diskrecord.json", "Path to the the disk vault")
+	var memory = flag.Bool("memory", false, "Keep the vault in memory only, for tests and demos; nothing is persisted")
 	var addr = flag.String("addr", "localhost:8080", "Server and port separated by :")
+	var adminAddr = flag.String("adminaddr", "", "Server and port, or path of a Unix socket, serving the admin endpoints only (optional)")
+	var http2 = flag.Bool("http2", true, "Negotiate HTTP/2 with clients that support it")
+	var readTimeout = flag.Duration("readtimeout", 30*time.Second, "Time allowed to read a request (0 for none)")
+	var writeTimeout = flag.Duration("writetimeout", 2*time.Minute, "Time allowed to write a response, except for /events (0 for none)")
+	var idleTimeout = flag.Duration("idletimeout", 2*time.Minute, "Time an idle connection is kept open (0 for none)")
+	var maxConns = flag.Int("maxconns", 0, "Connections served at once on each listener, further ones wait (0 for no limit)")
+	var maxRequests = flag.Int("maxrequests", 0, "Requests in progress at once on an HTTP/2 connection (0 for the default of 250)")
+	var requestTimeout = flag.Duration("requesttimeout", time.Minute, "Time allowed to process a request, including waiting for the requests before it (0 for none)")
+	var writeBehind = flag.Duration("writebehind", 0, "Batch the writes of the vault made within this interval of each other (0 writes every change)")
+	var sessionTTL = flag.Duration("sessionttl", time.Minute, "Time a correct password is remembered for the TLS connection it was given on (0 checks it on every request)")
+	var kdfLimit = flag.Int("kdflimit", 4, "Password hashes computed at once, 16MB each; requests needing more are refused with 503 (0 for no limit)")
+	var queueLimit = flag.Int("queuelimit", 0, "Interactive requests waiting to be processed; more are refused with 503 (0 for no limit)")
+	var batchQueueLimit = flag.Int("batchqueuelimit", 0, "Batch requests, such as /decrypt-batch, waiting to be processed; more are refused with 503 (0 for no limit)")
+	var unwrapTTL = flag.Duration("unwrapttl", 0, "Keep the keys of data unwrapped by a delegation this long to decrypt it again, never past the delegation (0 keeps none)")
+	var primary = flag.String("primary", "", "Run as a standby of the active server at this address, with the credentials of an admin in RO_SYNC_USER and RO_SYNC_PASSWORD (optional)")
+	var primaryCA = flag.String("primaryca", "", "Path of the CA of the active server, if not trusted by the system (optional)")
+	var syncInterval = flag.Duration("syncinterval", time.Minute, "Time between copies of the vault of the active server by a standby")
+	var promoteQuorum = flag.Int("promotequorum", 2, "Admins who must approve the promotion of a standby")
 	var useSystemdSocket = flag.Bool("systemdfds", false, "Use systemd socket activation to listen on a file. Useful for binding privileged sockets.")
 	var certsPathString = flag.String("certs", "", "Path(s) of TLS certificate in PEM format, comma-separated")
 	var keysPathString = flag.String("keys", "", "Path(s) of TLS private key in PEM format, comma-separated, must me in the same order as the certs")
 	var caPath = flag.String("ca", "", "Path of TLS CA for client authentication (optional)")
+	var staleDays = flag.Int("staledays", 0, "Revoke admins who have not authenticated in this many days (0 disables)")
+	var minAdmins = flag.Int("minadmins", 0, "Refuse to revoke or delete admins below this many (0 disables)")
+	var maxAdmins = flag.Int("maxadmins", 0, "Flag in the summary more admins than this (0 disables)")
+	var stageChanges = flag.Bool("stagechanges", false, "Stage changes to label policies and templates until a second admin approves them")
+	var ceremony = flag.Int("ceremony", 0, "Founding admins who must each call /create before a new vault is created (0 creates it with the first)")
+	var classifyData = flag.Bool("classify", false, "Require data that looks like private keys or card numbers to be encrypted under labels allowing it")
+	var recoveryKey = flag.String("recoverykey", "", "Path of an ECDSA public key in PEM format the live delegations are periodically sealed to (optional)")
+	var recoveryPath = flag.String("recoverypath", "", "Path the delegations sealed to the recovery key are written to")
+	var recoveryInterval = flag.Duration("recoveryinterval", time.Minute, "Time between snapshots of the delegations sealed to the recovery key")
+	var escrowKey = flag.String("escrowkey", "", "Path of an ECDSA public key in PEM format user and data keys can be exported to by a quorum of admins (optional)")
+	var escrowQuorum = flag.Int("escrowquorum", 2, "Admins who must approve the export of a key to the escrow key")
+	var restoreKey = flag.String("restorekey", "", "Path of an ECDSA public key in PEM format, such as the identity key of another server, whose snapshots can be restored (optional)")
+	var selfTestInterval = flag.Duration("selftestinterval", time.Hour, "Time between self-tests of encryption and decryption with test records, also run at startup (0 disables)")
+	var requireLabels = flag.Bool("requirelabels", false, "Refuse to encrypt data without labels")
+	var requirePolicies = flag.Bool("requirepolicies", false, "With -requirelabels, also refuse labels without a label policy")
+	var ticketSystem = flag.String("ticketsystem", "", "Ticket system checking decryption reasons: jira or servicenow (optional)")
+	var ticketURL = flag.String("ticketurl", "", "Base URL of the ticket system, with credentials in RO_TICKET_USER and RO_TICKET_PASSWORD")
+	var oncallSystem = flag.String("oncallsystem", "", "Paging system resolving \"oncall:<schedule>\" owners: pagerduty or opsgenie, with an API token in RO_ONCALL_TOKEN (optional)")
+	var oncallURL = flag.String("oncallurl", "", "Base URL of the paging system API, if not its public one")
+	var breachList = flag.String("breachlist", "", "Path of a list of SHA-1 hashes of breached passwords, one per line, that new passwords are checked against (optional)")
+	var breachAPI = flag.String("breachapi", "", "Base URL of a k-anonymity range API, such as https://api.pwnedpasswords.com, that new passwords are checked against (optional)")
+	var anomalies = flag.Bool("anomalies", false, "Raise anomaly events on decryption bursts, delegations outside 7:00-20:00 and users at new addresses")
+	var notifyWebhook = flag.String("notifywebhook", "", "URL decryption orders are POSTed to as JSON, to tell the owners to delegate (optional)")
+	var notifySlack = flag.String("notifyslack", "", "URL of a Slack incoming webhook decryption orders are posted to (optional)")
 	flag.Parse()
 
 	if *vaultPath == "" || *certsPathString == "" || *keysPathString == "" || (*addr == "" && *useSystemdSocket == false) {
@@ -227,585 +104,176 @@ func main() {
 		os.Exit(2)
 	}
 
-	certPaths := strings.Split(*certsPathString, ",")
-	keyPaths := strings.Split(*keysPathString, ",")
+	if chaos.Enabled {
+		log.Print("This server is built for failure injection (RO_CHAOS) and must not be used in production")
+	}
 
-	if err := core.Init(*vaultPath); err != nil {
-		log.Fatalf(err.Error())
+	if *memory {
+		*vaultPath = "memory"
+	}
+	if *vaultPath == "memory" {
+		log.Print("*****************************************************************")
+		log.Print("* The vault is kept in memory only. Nothing is written to disk, *")
+		log.Print("* and all users and delegations are lost when the server stops. *")
+		log.Print("*****************************************************************")
 	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	certPaths := strings.Split(*certsPathString, ",")
+	keyPaths := strings.Split(*keysPathString, ",")
 
-	// The core package is not safe to be shared across goroutines so
-	// this supervisor goroutine reads requests from the process
-	// channel and dispatches them to core for processes.
+	config := server.Config{
+		VaultPath:  *vaultPath,
+		StaticPath: *staticPath,
+		CertPaths:  certPaths,
+		KeyPaths:   keyPaths,
+		CAPath:     *caPath,
+		StaleDays:  *staleDays,
+		MinAdmins:  *minAdmins,
+		MaxAdmins:  *maxAdmins,
+
+		StageChanges:         *stageChanges,
+		Ceremony:             *ceremony,
+		RequireLabels:        *requireLabels,
+		RequireLabelPolicies: *requireLabels && *requirePolicies,
+		SeparateAdmin:        *adminAddr != "",
+
+		DisableHTTP2:       !*http2,
+		ReadTimeout:        *readTimeout,
+		WriteTimeout:       *writeTimeout,
+		IdleTimeout:        *idleTimeout,
+		MaxConns:           *maxConns,
+		MaxRequestsPerConn: *maxRequests,
+		RequestTimeout:     *requestTimeout,
+		WriteBehind:        *writeBehind,
+		SessionTTL:         *sessionTTL,
+		KDFLimit:           *kdfLimit,
+		QueueLimit:         *queueLimit,
+		BatchQueueLimit:    *batchQueueLimit,
+		UnwrapTTL:          *unwrapTTL,
+
+		Primary:       *primary,
+		PrimaryCA:     *primaryCA,
+		SyncInterval:  *syncInterval,
+		SyncUser:      os.Getenv("RO_SYNC_USER"),
+		SyncPassword:  os.Getenv("RO_SYNC_PASSWORD"),
+		PromoteQuorum: *promoteQuorum,
+
+		RecoveryKey:      *recoveryKey,
+		RecoveryPath:     *recoveryPath,
+		RecoveryInterval: *recoveryInterval,
+
+		EscrowKey:    *escrowKey,
+		EscrowQuorum: *escrowQuorum,
+
+		RestoreKey: *restoreKey,
+
+		SelfTestInterval: *selfTestInterval,
+	}
 
-	process := make(chan userRequest)
-	go func() {
-		for {
-			req := <-process
-			if f, ok := functions[req.rt]; ok {
-				r, err := f(req.in)
-				if err == nil {
-					req.resp <- r
-				} else {
-					log.Printf("http.main failed: %s: %s", req.rt, err)
-				}
-			} else {
-				log.Printf("http.main: request=%s function is not supported", req.rt)
-			}
+	if *classifyData {
+		config.Classifier = classify.Default
+	}
 
-			// Note that if an error occurs no message is sent down
-			// the channel and then channel is closed. The
-			// queueRequest function will see this as indication of an
-			// error.
+	if *anomalies {
+		config.Detectors = append(config.Detectors, anomaly.NewHeuristic())
+	}
 
-			close(req.resp)
+	if *notifyWebhook != "" {
+		if err := notify.CheckURL(*notifyWebhook); err != nil {
+			log.Fatal(err)
 		}
-	}()
+		config.Notifiers = append(config.Notifiers, notify.Webhook{URL: *notifyWebhook})
+	}
+	if *notifySlack != "" {
+		if err := notify.CheckURL(*notifySlack); err != nil {
+			log.Fatal(err)
+		}
+		config.Notifiers = append(config.Notifiers, notify.Slack{URL: *notifySlack})
+	}
 
-	s, l, err := NewServer(process, *staticPath, *addr, *caPath, certPaths, keyPaths, *useSystemdSocket)
-	if err != nil {
-		log.Fatalf("Error starting redoctober server: %s\n", err)
+	if *ticketSystem != "" {
+		checker, err := tickets.New(*ticketSystem, *ticketURL, os.Getenv("RO_TICKET_USER"), os.Getenv("RO_TICKET_PASSWORD"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Tickets = checker
 	}
-	s.Serve(*l)
-}
 
-var indexHtml = []byte(`<!DOCTYPE html>
-<html lang="en">
-<head>
-	<title>Red October - Two Man Rule File Encryption &amp; Decryption</title>
-	<meta name="viewport" content="width=device-width, initial-scale=1.0, user-scalable=no">
-
-	<link rel="stylesheet" href="//netdna.bootstrapcdn.com/bootstrap/3.0.2/css/bootstrap.min.css" />
-	<link rel="stylesheet" href="//netdna.bootstrapcdn.com/bootstrap/3.0.2/css/bootstrap-theme.min.css" />
-	<script src="//cdnjs.cloudflare.com/ajax/libs/jquery/2.0.3/jquery.min.js"></script>
-	<script src="//netdna.bootstrapcdn.com/bootstrap/3.0.2/js/bootstrap.min.js"></script>
-	<style type="text/css">
-		.footer{ border-top: 1px solid #ccc; margin-top: 50px; padding: 20px 0;}
-	</style>
-</head>
-<body>
-	<nav class="navbar navbar-default" role="banner">
-		<div class="container">
-			<div class="navbar-header">
-				<a href="/" class="navbar-brand">Red October</a>
-			</div>
-
-			<div class="collapse navbar-collapse">
-				<ul class="nav navbar-nav">
-					<li><a href="#delegate">Delegate</a></li>
-					<li><a href="#summary">Summary</a></li>
-					<li><a href="#admin">Admin</a></li>
-					<li><a href="#encrypt">Encrypt</a></li>
-					<li><a href="#decrypt">Decrypt</a></li>
-					<li><a href="#owners">Owners</a></li>
-				</ul>
-			</div>
-		</div>
-	</nav>
-
-	<div class="container">
-		<h1 class="page-header">Red October Management</h1>
-		<section class="row">
-			<div id="delegate" class="col-md-6">
-				<h3>Delegate</h3>
-
-				<form id="user-delegate" class="ro-user-delegate" role="form" action="/delegate" method="post">
-					<div class="feedback delegate-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="delegate-user">User name</label>
-							<input type="text" name="Name" class="form-control" id="delegate-user" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="delegate-user-pass">Password</label>
-							<input type="password" name="Password" class="form-control" id="delegate-user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="delegate-user-time">Delegation Time <small>(e.g., 2h34m)</small></label>
-							<input type="text" name="Time" class="form-control" id="delegate-user-time" placeholder="1h" required />
-						</div>
-						<div class="col-md-6">
-							<label for="delegate-uses">Uses</label>
-							<input type="number" name="Uses" class="form-control" id="delegate-uses" placeholder="5" required />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="delegate-users">Users to allow <small>(comma separated)</small></label>
-							<input type="text" name="Users" class="form-control" id="delegate-users" placeholder="e.g. Alice, Bob" />
-						</div>
-						<div class="col-md-6">
-							<label for="delegate-labels">Labels to allow <small>(comma separated)</small></label>
-							<input type="text" name="Labels" class="form-control" id="delegate-labels" placeholder="e.g. Blue, Red" />
-						</div>
-						<div class="col-md-6">
-							<label for="delegate-labels">Slot Name</label>
-							<input type="text" name="Slot" class="form-control" id="delegate-slot" placeholder="Afternoon" />
-						</div>
-					</div>
-					<button type="submit" class="btn btn-primary">Delegate</button>
-				</form>
-			</div>
-		</section>
-
-		<hr />
-
-		<section class="row">
-			<div id="summary" class="col-md-6">
-				<h3>User summary / delegation list</h3>
-
-				<form id="vault-summary" class="form-inline ro-summary" role="form" action="/summary" method="post">
-					<div class="feedback summary-feedback"></div>
-
-					<div class="form-group">
-						<label class="sr-only" for="admin-user-auth">User name</label>
-						<input type="text" name="Name" class="form-control" id="admin-user-auth" placeholder="User name" required />
-					</div>
-					<div class="form-group">
-						<label class="sr-only" for="admin-pass-auth">Password</label>
-						<input type="password" name="Password" class="form-control" id="admin-pass-auth" placeholder="Password" required />
-					</div>
-					<button type="submit" class="btn btn-primary">Get Summary</button>
-				</form>
-
-				<div class="hide summary-results">
-					<h4>Current Delegations</h4>
-					<ul class="list-group summary-user-delegations"></ul>
-
-					<h4>All Users</h4>
-					<ul class="list-group summary-all-users"></ul>
-				</div>
-			</div>
-		</section>
-
-		<hr />
-
-		<section class="row">
-			<div class="col-md-6" id="admin">
-				<h3>Create vault</h3>
-				<form id="vault-create" class="form-inline ro-admin-create" role="form" action="/create" method="post">
-					<div class="feedback admin-feedback"></div>
-
-					<div class="form-group">
-						<label class="sr-only" for="admin-create-user">User name</label>
-						<input type="text" name="Name" class="form-control" id="admin-create-user" placeholder="User name" required />
-					</div>
-					<div class="form-group">
-						<label class="sr-only" for="admin-create-pass">Password</label>
-						<input type="password" name="Password" class="form-control" id="admin-create-pass" placeholder="Password" required />
-					</div>
-					<button type="submit" class="btn btn-primary">Create Admin</button>
-				</form>
-
-				<hr />
-
-				<h3>Create User</h3>
-
-				<form id="user-create" class="ro-user-create" role="form" action="/create-user" method="post">
-					<div class="feedback create-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="create-user">User name</label>
-							<input type="text" name="Name" class="form-control" id="create-user" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="create-user-pass">Password</label>
-							<input type="password" name="Password" class="form-control" id="create-user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-12">
-							<label for="create-user-type">User Type</label>
-							<select name="UserType" class="form-control" id="create-user-type">
-								<option value="RSA">RSA</option>
-								<option value="ECC">ECC</option>
-							</select>
-						</div>
-					</div>
-					<button type="submit" class="btn btn-primary">Create</button>
-				</form>
-			</div>
-		</section>
-
-		<hr />
-
-		<section class="row">
-			<div id="change-password" class="col-md-6">
-				<h3>Change password</h3>
-
-				<form id="user-change-password" class="ro-user-change-password" role="form" action="/password" method="post">
-					<div class="feedback change-password-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="user-name">User name</label>
-							<input type="text" name="Name" class="form-control" id="user-name" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="user-pass">Password</label>
-							<input type="password" name="Password" class="form-control" id="user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group">
-						<label for="user-pass">New password</label>
-						<input type="password" name="NewPassword" class="form-control" id="user-pass-new" placeholder="New password" required />
-					</div>
-					<button type="submit" class="btn btn-primary">Change password</button>
-				</form>
-
-				<h3>Modify user</h3>
-
-				<form id="user-modify" class="ro-user-modify" role="form" action="/modify" method="post">
-					<div class="feedback modify-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="modify-user-admin">Admin User</label>
-							<input type="text" name="Name" class="form-control" id="modify-user-admin" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="modify-user-pass">Admin Password</label>
-							<input type="password" name="Password" class="form-control" id="modify-user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="modify-user-user">User to modify <small>(e.g., Carol)</small></label>
-							<input type="text" name="ToModify" class="form-control" id="modify-user-user" required />
-						</div>
-						<div class="col-md-6">
-							<label for="modify-user-command">Command</label>
-							<select id="modify-user-command" name="Command" class="form-control" required>
-								<option value="revoke">Revoke Admin Status</option>
-								<option value="admin">Make Admin</option>
-								<option value="delete">Delete User</option>
-							</select>
-						</div>
-					</div>
-					<button type="submit" class="btn btn-primary">Modify user</button>
-				</form>
-			</div>
-		</section>
-		<hr />
-		<section class="row">
-			<div id="encrypt" class="col-md-6">
-				<h3>Encrypt data</h3>
-
-				<form id="encrypt" class="ro-user-encrypt" role="form" action="/encrypt" method="post">
-					<div class="feedback encrypt-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="encrypt-user-admin">User name</label>
-							<input type="text" name="Name" class="form-control" id="encrypt-user-admin" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="encrypt-user-pass">Password</label>
-							<input type="password" name="Password" class="form-control" id="encrypt-user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="encrypt-minimum">Minimum number of users for access</label>
-							<input type="number" name="Minimum" class="form-control" id="encrypt-minimum" placeholder="2" />
-						</div>
-						<div class="col-md-6">
-							<label for="encrypt-owners">Owners <small>(comma separated users)</small></label>
-							<input type="text" name="Owners" class="form-control" id="encrypt-owners" placeholder="e.g., Carol, Bob" />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-12">
-							<label for="encrypt-predicate">(OR) Predicate for decryption</label>
-							<input type="text" name="Predicate" class="form-control" id="encrypt-predicate" placeholder="(Alice | Bob) & Carol" />
-						</div>
-					</div>
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="encrypt-labels">Labels to use <small>(comma separated)</small></label>
-							<input type="text" name="Labels" class="form-control" id="encrypt-labels" placeholder="e.g. Blue, Red" />
-						</div>
-					</div>
-					<div class="form-group">
-						<label for="encrypt-data">Data <small>(not base64 encoded)</small></label>
-						<textarea name="Data" class="form-control" id="encrypt-data" rows="5" required></textarea>
-					</div>
-					<button type="submit" class="btn btn-primary">Encrypt!</button>
-				</form>
-			</div>
-		</section>
-		<hr />
-		<section class="row">
-			<div id="decrypt" class="col-md-6">
-				<h3>Decrypt data</h3>
-
-				<form id="decrypt" class="ro-user-decrypt" role="form" action="/decrypt" method="post">
-					<div class="feedback decrypt-feedback"></div>
-
-					<div class="form-group row">
-						<div class="col-md-6">
-							<label for="decrypt-user-admin">User name</label>
-							<input type="text" name="Name" class="form-control" id="decrypt-user-admin" placeholder="User name" required />
-						</div>
-						<div class="col-md-6">
-							<label for="decrypt-user-pass">Password</label>
-							<input type="password" name="Password" class="form-control" id="decrypt-user-pass" placeholder="Password" required />
-						</div>
-					</div>
-					<div class="form-group">
-						<label for="decrypt-data">Data</label>
-						<textarea name="Data" class="form-control" id="decrypt-data" rows="5" required></textarea>
-					</div>
-					<button type="submit" class="btn btn-primary">Decrypt!</button>
-				</form>
-			</div>
-		</section>
-		<hr />
-		<section class="row">
-			<div id="owners" class="col-md-6">
-				<h3>Get owners</h3>
-
-				<form id="owners" class="ro-user-owners" role="form" action="/owners" method="post">
-					<div class="feedback owners-feedback"></div>
-
-					<div class="form-group">
-						<label for="owners-data">Data</label>
-						<textarea name="Data" class="form-control" id="owners-data" rows="5" required></textarea>
-					</div>
-					<button type="submit" class="btn btn-primary">Get Owners</button>
-				</form>
-			</div>
-		</section>
-	</div>
-
-	<footer id="footer" class="footer">
-		<p class="container">Red October. CloudFlare</p>
-	</footer>
-
-	<script>
-		$(function(){
-			function serialize( $form ){
-				var serialized = $form.serializeArray(), data = {};
-				$.each(serialized, function(idx, item){ data[item.name] = item.value; });
-				return data;
-			}
+	if *oncallSystem != "" {
+		resolver, err := oncall.New(*oncallSystem, *oncallURL, os.Getenv("RO_ONCALL_TOKEN"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.OnCall = resolver
+	}
 
-			function makeAlert(config){ return '<div class="alert alert-dismissable alert-'+config.type+'"><button type="button" class="close" data-dismiss="alert" aria-hidden="true">&times;</button>'+config.message+'</div>'; }
+	switch {
+	case *breachList != "" && *breachAPI != "":
+		log.Fatal("Only one of -breachlist and -breachapi can be given")
+	case *breachList != "":
+		filter, err := breach.LoadFile(*breachList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.BreachCheck = filter
+	case *breachAPI != "":
+		config.BreachCheck = breach.NewRange(*breachAPI)
+	}
 
-			function submit( $form, options ){
-				options || (options = {});
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
-				$.ajax({
-					url: $form.attr('action'),
-					data: JSON.stringify( options.data ),
-					success: function(data){
-						if( data.Status !== 'ok' ){
-							$form.find('.feedback').empty().append( makeAlert({type: 'danger', message: data.Status}) );
-							return;
-						}
+	s, err := server.New(config)
+	if err != nil {
+		log.Fatalf("Error starting redoctober server: %s\n", err)
+	}
 
-						if( options.success ){
-							options.success.apply(this, arguments);
-						}
+	var lstnr net.Listener
+	if *useSystemdSocket {
+		listenFDs, err := activation.Listeners(true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(listenFDs) != 1 {
+			log.Fatalf("Unexpected number of socket activation FDs! (%d)", len(listenFDs))
+		}
+		lstnr = listenFDs[0]
+	} else {
+		lstnr, err = net.Listen("tcp", *addr)
+		if err != nil {
+			log.Fatalf("Error starting TCP listener on %s: %s\n", *addr, err)
+		}
+	}
 
-						$form.get(0).reset();
-					},
-					error: options.error || function(xhr, status, error){ $form.find('.feedback').append( makeAlert({type:'danger', message: error})); }
-				});
+	if *adminAddr != "" {
+		network := "tcp"
+		if strings.HasPrefix(*adminAddr, "/") {
+			network = "unix"
+		}
+		adminLstnr, err := net.Listen(network, *adminAddr)
+		if err != nil {
+			log.Fatalf("Error starting admin listener on %s: %s\n", *adminAddr, err)
+		}
+		go func() {
+			if err := s.ServeAdmin(adminLstnr); err != http.ErrServerClosed {
+				log.Fatal(err)
 			}
+		}()
+	}
 
-			// Ajax defaults for JSON
-			$.ajaxSetup({
-				method: 'POST',
-				dataType : 'json',
-				processData : false
-			});
-
-
-			// Create vault/admin
-			$('body').on('submit', '#vault-create', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').empty().append( makeAlert({ type: 'success', message: 'Created user: '+data.Name }) );
-					}
-				});
-			});
-
-			// Vault summary
-			$('body').on('submit', '#vault-summary', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				$('#summary .feedback').empty();
-
-				submit($form, {
-					data : data,
-					success : function(data){
-						// Empty out the lists
-						$('.summary-user-delegations, .summary-all-users').empty();
-						function buildItem(key, user, loc){
-							var li = $('<li />', {'class': 'list-group-item'}).appendTo(loc);
-							if( user.Uses ){ li.append( $('<span />', {'class': 'badge'}).text(user.Uses+' uses remaining') ); }
-							li.append( $('<h5 />', {'class': 'list-group-item-heading'}).text(key || 'Unknown') );
-							li.append( $('<p />', {'class': 'list-group-item-text'}).html('Type: '+user.Type+ (user.Expiry ? '<br />Expiry: '+user.Expiry : '')+ (user.Users ? '<br />Users: '+user.Users.join(', ') : '')+ (user.Labels ? '<br />Labels: '+user.Labels.join(', ') : '')) );
-
-							if( user.Admin ){
-								li.find('h5').append(' (admin)');
-							}
-						}
-						function buildLiveItem(k,u){ buildItem(k,u,'.summary-user-delegations'); }
-						function buildAllItem(k,u){ buildItem(k,u,'.summary-all-users'); }
-
-						$.each(data.Live, buildLiveItem);
-						$.each(data.All, buildAllItem);
-
-						$('.summary-results').removeClass('hide');
-					}
-				})
-			});
-
-			// Delegate
-			$('body').on('submit', '#user-delegate', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				// Force uses to an integer
-				data.Uses = parseInt(data.Uses, 10);
-				data.Users = data.Users.split(',');
-				for(var i=0, l=data.Users.length; i<l; i++){
-					data.Users[i] = data.Users[i].trim();
-					if (data.Users[i] == "") { data.Users.splice(i, 1); }
-				}
-				data.Labels = data.Labels.split(',');
-				for(var i=0, l=data.Labels.length; i<l; i++){
-					data.Labels[i] = data.Labels[i].trim();
-					if (data.Labels[i] == "") { data.Labels.splice(i, 1); }
-				}
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').append( makeAlert({ type: 'success', message: 'Delegating '+data.Name }) );
-					}
-				});
-			});
-
-			// Create
-			$('body').on('submit', '#user-create', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				// Force uses to an integer
-				data.Uses = parseInt(data.Uses, 10);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').append( makeAlert({ type: 'success', message: 'Creating '+data.Name }) );
-					}
-				});
-			});
-
-			// Change password
-			$('body').on('submit', '#user-change-password', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').empty().append( makeAlert({ type: 'success', message: 'Change password for '+data.Name }) );
-					}
-				});
-			});
-
-			// Modify user
-			$('body').on('submit', '#user-modify', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').empty().append( makeAlert({ type: 'success', message: 'Successfully modified '+data.ToModify }) );
-					}
-				});
-			});
-
-			// Encrypt data
-			$('body').on('submit', '#encrypt', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				data.Minimum = parseInt(data.Minimum, 10);
-				data.Owners = data.Owners.split(',');
-				for(var i=0, l=data.Owners.length; i<l; i++){
-					data.Owners[i] = data.Owners[i].trim();
-					if (data.Owners[i] == "") { data.Owners.splice(i, 1); }
-				}
-				data.Labels = data.Labels.split(',');
-				for(var i=0, l=data.Labels.length; i<l; i++){
-					data.Labels[i] = data.Labels[i].trim();
-					if (data.Labels[i] == "") { data.Labels.splice(i, 1); }
-				}
-
-				// Convert data to base64.
-				data.Data = window.btoa(data.Data);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-						$form.find('.feedback').empty().append( makeAlert({ type: 'success', message: '<p>Successfully encrypted data:</p><pre>'+d.Response+'</pre>' }) );
-					}
-				});
-			});
-
-			// Decrypt data
-			$('body').on('submit', 'form#decrypt', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-					d = JSON.parse(window.atob(d.Response));
-					$form.find('.feedback').empty().append( makeAlert({ type: (d.Secure ? 'success' : 'warning'), message: '<p>Successfully decrypted data:</p><pre>'+ window.atob(d.Data)+'</pre><p>Delegates: '+d.Delegates.sort().join(', ')+'</p>' }) );
-					}
-				});
-			});
-
-			// Get owners
-			$('body').on('submit', 'form#owners', function(evt){
-				evt.preventDefault();
-				var $form = $(evt.currentTarget),
-					data = serialize($form);
-
-				submit( $form, {
-					data : data,
-					success : function(d){
-					$form.find('.feedback').empty().append( makeAlert({ type: 'success', message: '<p>Owners: '+d.Owners.sort().join(', ')+(d.Predicate == '' ? '' : '<br />Predicate: '+d.Predicate)+'</p>' }) );
-					}
-				});
-			});
-		});
-	</script>
-</body>
-</html>`)
+	// stopping the server writes the changes left by write-behind
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if err := s.Close(); err != nil {
+			log.Printf("Error stopping redoctober server: %s\n", err)
+		}
+		close(stopped)
+	}()
+
+	if err := s.Serve(lstnr); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
@@ -7,8 +7,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,10 +20,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/events"
 )
 
 const baseURL = "https://localhost:8080/"
@@ -682,3 +688,95 @@ func TestPurge(t *testing.T) {
 
 	teardown(t, cmd)
 }
+
+// Test that the /id API endpoint returns an identity endorsing the server certificate.
+func TestID(t *testing.T) {
+	cmd := setup(t)
+	defer teardown(t, cmd)
+
+	respBytes, response, err := post("id", struct{}{})
+	if err != nil {
+		t.Fatalf("Error fetching identity, %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected StatusCode 200, got %d instead", response.StatusCode)
+	}
+
+	var id core.IDData
+	if err = json.Unmarshal(respBytes, &id); err != nil {
+		t.Fatalf("Error fetching identity, %v", err)
+	}
+	if id.Status != "ok" || id.Fingerprint != core.Fingerprint(id.PublicKey) {
+		t.Fatalf("Unexpected identity %v", id)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(id.PublicKey)
+	if err != nil {
+		t.Fatalf("Error parsing identity key, %v", err)
+	}
+	hash := sha256.Sum256(bytes.Join(id.Certificates, nil))
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), hash[:], id.Signature) {
+		t.Fatalf("Identity signature does not verify")
+	}
+
+	cert, err := tls.LoadX509KeyPair("testdata/server.crt", "testdata/server.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate, %v", err)
+	}
+	certHash := sha256.Sum256(cert.Certificate[0])
+	if len(id.Certificates) != 1 || !bytes.Equal(id.Certificates[0], certHash[:]) {
+		t.Fatalf("Identity does not endorse the server certificate")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	cmd := setup(t)
+	defer teardown(t, cmd)
+
+	if _, _, err := post("create", createVaultInput); err != nil {
+		t.Fatalf("Error creating vault, %v", err)
+	}
+
+	err := postAndTest("events", &core.EventsRequest{Name: "Alice", Password: "Wrong"}, 200, "Wrong Password")
+	if err != nil {
+		t.Fatalf("Error sending POST request, %v", err)
+	}
+
+	eventsJson, _ := json.Marshal(&core.EventsRequest{Name: createVaultInput.Name, Password: createVaultInput.Password})
+	response, err := http.Post(baseURL+"events", "text/json", bytes.NewBuffer(eventsJson))
+	if err != nil {
+		t.Fatalf("Error opening event stream, %v", err)
+	}
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	if err = postAndTest("delegate", delegateInput1, 200, "ok"); err != nil {
+		t.Fatalf("Error sending POST request, %v", err)
+	}
+
+	found := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				found <- strings.TrimPrefix(scanner.Text(), "data: ")
+				return
+			}
+		}
+	}()
+
+	select {
+	case data := <-found:
+		var e events.Event
+		if err = json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("Error reading event, %v", err)
+		}
+		if e.Type != "delegate" || e.Name != delegateInput1.Name {
+			t.Fatalf("Unexpected event %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event received")
+	}
+}
@@ -0,0 +1,75 @@
+// Compression of request and response bodies with gzip.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the size from which responses are compressed for
+// clients accepting gzip. Smaller ones gain too little to be worth it.
+const gzipMinSize = 1024
+
+// decodeBody replaces the body of a request sent with gzip content
+// encoding by its decompressed content.
+func decodeBody(r *http.Request) error {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip":
+	default:
+		return errors.New("Unsupported content encoding")
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = zr
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+	return nil
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of a request
+// allows a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.ToLower(strings.TrimSpace(params[0])) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeBody writes a response, compressed with gzip if the client
+// accepts it and it is large enough.
+func writeBody(w http.ResponseWriter, r *http.Request, resp []byte) {
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if len(resp) < gzipMinSize || !acceptsGzip(r) {
+		w.Write(resp)
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	zw := gzip.NewWriter(w)
+	zw.Write(resp)
+	zw.Close()
+}
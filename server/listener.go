@@ -0,0 +1,61 @@
+// Listeners limiting the number of connections served at once.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener accepts at most cap(slots) connections at once. Further
+// connections wait in the backlog of the listener until one is closed.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// limit returns l limited to n connections at once, or l itself if n
+// is not positive.
+func limit(l net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, slots: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+// Close stops the connections waiting for a slot from being accepted.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
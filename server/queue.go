@@ -0,0 +1,189 @@
+// queue.go: scheduling of requests by priority and between users
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The priorities of requests. Requests are processed in order of
+// priority, and in turn between the users with requests waiting at the
+// same priority, so that the bulk jobs of one user cannot starve the
+// decryptions of others, such as break-glass ones.
+const (
+	interactive = iota
+	batch
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"interactive", "batch"}
+
+// batchEndpoints are the endpoints of expensive operations on many
+// pieces of data, queued behind interactive requests.
+var batchEndpoints = map[string]bool{
+	"/decrypt-batch": true,
+	"/re-encrypt":    true,
+	"/audit":         true,
+	"/export":        true,
+	"/snapshot":      true,
+	"/forensics":     true,
+}
+
+// errBusy refuses a request when as many as allowed are waiting at its
+// priority.
+var errBusy = errors.New("Server busy, retry later")
+
+// QueueStats describes the requests of one priority.
+type QueueStats struct {
+	Limit     int           // requests allowed to wait, 0 for no limit
+	Waiting   int           // requests waiting
+	Processed uint64        // requests taken from the queue
+	Refused   uint64        // requests refused with errBusy
+	Abandoned uint64        // requests whose client went away while waiting
+	Wait      time.Duration // total time the processed requests waited
+}
+
+// queued is a request waiting in a queue.
+type queued struct {
+	req   userRequest
+	since time.Time
+}
+
+// queue holds the requests waiting to be processed by the goroutine
+// started by New.
+type queue struct {
+	mu      sync.Mutex
+	waiting [numPriorities]map[string][]queued // by user
+	turns   [numPriorities][]string            // users with requests waiting, in turn
+	stats   [numPriorities]QueueStats
+
+	// ready holds a value while requests are waiting.
+	ready chan struct{}
+}
+
+// currentQueue is the queue of the Server of the process, whose stats
+// are published with expvar.
+var currentQueue atomic.Pointer[queue]
+
+func init() {
+	expvar.Publish("queue", expvar.Func(func() interface{} {
+		if q := currentQueue.Load(); q != nil {
+			return q.Stats()
+		}
+		return nil
+	}))
+}
+
+// newQueue returns a queue allowing limit interactive and batchLimit
+// batch requests to wait (0 for no limit).
+func newQueue(limit, batchLimit int) *queue {
+	q := &queue{ready: make(chan struct{}, 1)}
+	for p := range q.waiting {
+		q.waiting[p] = make(map[string][]queued)
+	}
+	q.stats[interactive].Limit = limit
+	q.stats[batch].Limit = batchLimit
+	return q
+}
+
+// Stats returns the state of the queue by priority.
+func (q *queue) Stats() map[string]QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := make(map[string]QueueStats)
+	for p, name := range priorityNames {
+		stats[name] = q.stats[p]
+	}
+	return stats
+}
+
+// push queues a request, or returns errBusy if as many as allowed are
+// waiting at its priority. Requests are attributed to the user named
+// in them.
+func (q *queue) push(req userRequest) error {
+	p := interactive
+	if batchEndpoints[req.rt] {
+		p = batch
+	}
+	var who struct{ Name string }
+	json.Unmarshal(req.in, &who)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := &q.stats[p]
+	if stats.Limit > 0 && stats.Waiting >= stats.Limit {
+		stats.Refused++
+		return errBusy
+	}
+	stats.Waiting++
+
+	if len(q.waiting[p][who.Name]) == 0 {
+		q.turns[p] = append(q.turns[p], who.Name)
+	}
+	q.waiting[p][who.Name] = append(q.waiting[p][who.Name], queued{req: req, since: time.Now()})
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop returns the next request to process, and false if none is
+// waiting. Requests whose client went away are skipped.
+func (q *queue) pop() (userRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p := range q.turns {
+		for len(q.turns[p]) > 0 {
+			user := q.turns[p][0]
+			next := q.waiting[p][user][0]
+
+			// the user goes to the back of the line
+			q.turns[p] = q.turns[p][1:]
+			if rest := q.waiting[p][user][1:]; len(rest) > 0 {
+				q.waiting[p][user] = rest
+				q.turns[p] = append(q.turns[p], user)
+			} else {
+				delete(q.waiting[p], user)
+			}
+
+			stats := &q.stats[p]
+			stats.Waiting--
+			if next.req.ctx.Err() != nil {
+				stats.Abandoned++
+				close(next.req.resp)
+				continue
+			}
+			stats.Processed++
+			stats.Wait += time.Since(next.since)
+
+			q.signal()
+			return next.req, true
+		}
+	}
+	return userRequest{}, false
+}
+
+// signal sets ready if requests are still waiting.
+func (q *queue) signal() {
+	for p := range q.turns {
+		if len(q.turns[p]) > 0 {
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
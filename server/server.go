@@ -0,0 +1,1259 @@
+// Package server runs the Red October JSON API and web interface over
+// HTTPS, so that Red October can be embedded in other Go programs. As
+// the core package keeps the vault in package state, a process can only
+// run one Server at a time.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/redoctober/anomaly"
+	"github.com/cloudflare/redoctober/auditlog"
+	"github.com/cloudflare/redoctober/breach"
+	"github.com/cloudflare/redoctober/classify"
+	"github.com/cloudflare/redoctober/client"
+	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/notify"
+	"github.com/cloudflare/redoctober/oncall"
+	"github.com/cloudflare/redoctober/passvault"
+	"github.com/cloudflare/redoctober/tickets"
+)
+
+// List of URLs to register and their related functions
+
+var functions = map[string]func([]byte) ([]byte, error){
+	"/create":            core.Create,
+	"/summary":           core.Summary,
+	"/purge":             core.Purge,
+	"/delegate":          core.Delegate,
+	"/revoke-delegation": core.RevokeDelegation,
+	"/create-user":       core.CreateUser,
+	"/password":          core.Password,
+	"/encrypt":           core.Encrypt,
+	"/re-encrypt":        core.ReEncrypt,
+	"/decrypt":           core.Decrypt,
+	"/decrypt-stream":    core.DecryptStream,
+	"/decrypt-batch":     core.DecryptBatch,
+	"/owners":            core.Owners,
+	"/modify":            core.Modify,
+	"/export":            core.Export,
+	"/template":          core.Template,
+	"/merge":             core.Merge,
+	"/label-policy":      core.LabelPolicy,
+	"/label-policies":    core.LabelPolicies,
+	"/approve-change":    core.ApproveChange,
+	"/users":             core.Users,
+	"/delegations":       core.Delegations,
+	"/admin-log":         core.AdminLog,
+	"/changelog":         core.Changelog,
+	"/auditlog":          core.AuditLog,
+	"/id":                core.ID,
+	"/version":           core.Version,
+	"/absence":           core.Absence,
+	"/veto":              core.Veto,
+	"/approve-decrypt":   core.ApproveDecrypt,
+	"/wrapped-key":       core.WrappedKey,
+	"/watermark":         core.Watermark,
+	"/audit":             core.Audit,
+	"/promote":           core.Promote,
+	"/snapshot":          core.Snapshot,
+	"/forensics":         core.Forensics,
+	"/recover":           core.Recover,
+	"/restore":           core.Restore,
+	"/escrow-export":     core.EscrowExport,
+	"/selftest":          core.SelfTest,
+	"/share":             core.Share,
+	"/receive":           core.Receive,
+	"/approve-share":     core.ApproveShare,
+	"/import":            core.Import,
+	"/claim-challenge":   core.ClaimChallenge,
+	"/claim":             core.Claim,
+	"/events":            core.Events,
+	"/stats":             core.Stats,
+	"/rekey":             core.Rekey,
+	"/order":             core.PlaceOrder,
+	"/orders":            core.Orders,
+	"/orderout":          core.OrderOut,
+}
+
+// adminEndpoints are the endpoints that only admins can use. With
+// Config.SeparateAdmin they are only served by ServeAdmin.
+var adminEndpoints = map[string]bool{
+	"/modify":         true,
+	"/export":         true,
+	"/merge":          true,
+	"/purge":          true,
+	"/template":       true,
+	"/label-policy":   true,
+	"/approve-change": true,
+	"/approve-share":  true,
+	"/admin-log":      true,
+	"/changelog":      true,
+	"/auditlog":       true,
+	"/snapshot":       true,
+	"/forensics":      true,
+	"/recover":        true,
+	"/restore":        true,
+	"/escrow-export":  true,
+	"/selftest":       true,
+	"/import":         true,
+	"/rekey":          true,
+}
+
+// separateAdmin is set when admin endpoints are kept off the main
+// listener. Like the vault, it is shared by the Server of the process.
+var separateAdmin bool
+
+func init() {
+	functions["/sealed"] = sealed
+}
+
+// sealed processes a request sent end-to-end encrypted to the server
+// identity key by calling the endpoint named inside it, and encrypts the
+// response to the key chosen by the client.
+func sealed(jsonIn []byte) ([]byte, error) {
+	body, err := core.Unseal(jsonIn)
+	if err != nil {
+		log.Printf("http.sealed failed: %s", err)
+		return json.Marshal(core.ResponseData{Status: err.Error()})
+	}
+
+	f, ok := functions[body.Endpoint]
+	if !ok || body.Endpoint == "/sealed" || body.Endpoint == "/events" || (separateAdmin && adminEndpoints[body.Endpoint]) {
+		log.Printf("http.sealed: request=%s function is not supported", body.Endpoint)
+		return json.Marshal(core.ResponseData{Status: "Unknown request"})
+	}
+
+	// the device of the outer request was set by queueRequest
+	var outer struct{ Device string }
+	json.Unmarshal(jsonIn, &outer)
+
+	resp, err := f(withDevice(body.Body, outer.Device))
+	if err != nil {
+		return nil, err
+	}
+	return core.Seal(resp, body)
+}
+
+// withDevice sets the Device field of a JSON request to the fingerprint
+// of the client certificate it was sent with, replacing any device the
+// client put in the request itself. Requests that are not JSON objects
+// are returned unchanged.
+func withDevice(body []byte, device string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return body
+	}
+
+	// encoding/json matches field names without regard to case
+	for key := range fields {
+		if strings.EqualFold(key, "Device") {
+			delete(fields, key)
+		}
+	}
+	if device != "" {
+		fields["Device"], _ = json.Marshal(device)
+	}
+
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+type userRequest struct {
+	rt string // The request type (which will be one of the
+	// keys of the functions map above
+	in []byte // Arbitrary input data (depends on the core.*
+	// function called)
+	resp chan<- []byte // Channel down which a response is sent (the
+	// data sent will depend on the core.* function
+	// called to handle this request)
+	ctx context.Context // Done when the client is gone or the
+	// request timed out
+}
+
+// queueRequest handles a single request receive on the JSON API for
+// one of the functions named in the functions map above. It reads the
+// request and queues it for the goroutine started by New below to
+// process, and then waits for the response.
+func queueRequest(q *queue, requestType string, w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	var err error
+	if requestType == "/encrypt" && isMultipart(r) {
+		body, err = encryptForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if body, err = ioutil.ReadAll(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var device string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		device = core.Fingerprint(r.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	}
+	body = withDevice(body, device)
+
+	// the response is buffered so that processing does not wait for
+	// a client that is gone
+	ctx := r.Context()
+	if token := sessionToken(r); token != nil {
+		ctx = core.WithSession(ctx, token)
+	}
+	ctx = core.WithSource(ctx, r.RemoteAddr)
+	ctx = core.WithEndpoint(ctx, requestType)
+	response := make(chan []byte, 1)
+	if err = q.push(userRequest{rt: requestType, in: body, resp: response, ctx: ctx}); err != nil {
+		writeBusy(w, err)
+		return
+	}
+
+	var resp []byte
+	var ok bool
+	select {
+	case resp, ok = <-response:
+	case <-ctx.Done():
+		http.Error(w, ctx.Err().Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if ok {
+		header := w.Header()
+		header.Set("Content-Type", "application/json")
+		header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
+
+		// too many passwords are being hashed to check this one
+		if bytes.HasPrefix(resp, kdfBusy) {
+			header.Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(resp)
+			return
+		}
+
+		// decrypted data can be sent bare, e.g. to be saved as a file
+		if requestType == "/decrypt" {
+			if format := decryptFormat(r); format != "" && writeDecrypted(w, r, format, resp) {
+				return
+			}
+		}
+
+		// dashboards poll the summary, so let them revalidate it
+		if requestType == "/summary" && bytes.HasPrefix(resp, []byte(`{"Status":"ok"`)) {
+			tag := etag(resp)
+			header.Set("ETag", tag)
+			header.Set("Cache-Control", "private, no-cache")
+			if matchesETag(r.Header.Get("If-None-Match"), tag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		writeBody(w, r, resp)
+	} else {
+		http.Error(w, "Unknown request", http.StatusInternalServerError)
+	}
+}
+
+// maxFormMemory is the size of a multipart form kept in memory, beyond
+// which uploaded files are stored in temporary files.
+const maxFormMemory = 32 << 20
+
+// isMultipart returns true if the request body is a multipart form.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// formList returns the values of a form field, splitting each at commas
+// as typed in the web interface.
+func formList(form *multipart.Form, field string) (list []string) {
+	for _, value := range form.Value[field] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return
+}
+
+// encryptForm turns an encrypt request sent as a multipart form, as
+// browsers upload files, into its JSON form. The data is taken from the
+// file or value of the Data field and the other fields are those of
+// core.EncryptRequest.
+func encryptForm(r *http.Request) ([]byte, error) {
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+		return nil, err
+	}
+	form := r.MultipartForm
+	defer form.RemoveAll()
+
+	value := func(field string) string {
+		if values := form.Value[field]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	req := core.EncryptRequest{
+		Name:             value("Name"),
+		Password:         value("Password"),
+		Owners:           formList(form, "Owners"),
+		LeftOwners:       formList(form, "LeftOwners"),
+		RightOwners:      formList(form, "RightOwners"),
+		Predicate:        value("Predicate"),
+		MaxDelegationAge: value("MaxDelegationAge"),
+		Escrow:           value("Escrow"),
+		Labels:           formList(form, "Labels"),
+		Convergent:       value("Convergent") == "true",
+		Reason:           value("Reason"),
+	}
+
+	if files := form.File["Data"]; len(files) > 0 {
+		f, err := files[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if req.Data, err = ioutil.ReadAll(f); err != nil {
+			return nil, err
+		}
+	} else {
+		req.Data = []byte(value("Data"))
+	}
+
+	return json.Marshal(req)
+}
+
+// writeBusy refuses a request because the server is busy, asking the
+// client to retry.
+func writeBusy(w http.ResponseWriter, err error) {
+	resp, _ := json.Marshal(core.ResponseData{Status: err.Error()})
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(resp)
+}
+
+// kdfBusy starts the response to a request refused because too many
+// passwords are being hashed.
+var kdfBusy = []byte(`{"Status":"` + passvault.ErrKDFBusy.Error() + `"`)
+
+// sessionToken returns keying material exported from the TLS connection
+// of a request, identifying the session of the client, or nil if there
+// is none. It is only known to the two ends of the connection.
+func sessionToken(r *http.Request) []byte {
+	if r.TLS == nil {
+		return nil
+	}
+	token, err := r.TLS.ExportKeyingMaterial("EXPORTER-redoctober-session", nil, 32)
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// decryptFormat returns the format in which the client asked for
+// decrypted data to be sent instead of JSON: "raw", "base64" or "hex",
+// from the format query parameter or else the Accept header. It returns
+// "" for JSON.
+func decryptFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format == "raw" || format == "base64" || format == "hex" {
+			return format
+		}
+		return ""
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if i := strings.Index(accept, ";"); i >= 0 {
+			accept = accept[:i]
+		}
+		if strings.TrimSpace(accept) == "application/octet-stream" {
+			return "raw"
+		}
+	}
+	return ""
+}
+
+// writeDecrypted writes the data of a successful decrypt response in
+// the given format, returning false if the response is not one or
+// holds a derived credential rather than data. Raw data is sent as an
+// attachment named by the filename query parameter.
+func writeDecrypted(w http.ResponseWriter, r *http.Request, format string, resp []byte) bool {
+	var rd core.ResponseData
+	if err := json.Unmarshal(resp, &rd); err != nil || rd.Status != "ok" {
+		return false
+	}
+	var decrypted core.DecryptWithDelegates
+	if err := json.Unmarshal(rd.Response, &decrypted); err != nil || decrypted.Credential != nil {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Delegates", strings.Join(decrypted.Delegates, ","))
+	switch format {
+	case "raw":
+		filename := path.Base(r.URL.Query().Get("filename"))
+		if filename == "." || filename == "/" {
+			filename = "decrypted"
+		}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		w.Write(decrypted.Data)
+	case "base64":
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(base64.StdEncoding.EncodeToString(decrypted.Data) + "\n"))
+	case "hex":
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(hex.EncodeToString(decrypted.Data) + "\n"))
+	}
+	return true
+}
+
+// flushWriter flushes each write to the client, so that the chunks of a
+// streamed decryption are not kept in a buffer once written.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
+
+// streamDecrypt handles a request to /decrypt-stream. The request is
+// processed like any other by the goroutine started by New, which
+// unwraps the key of the data, after which the plaintext is decrypted
+// and written to the client a chunk at a time by this goroutine, so
+// that other requests are not held up by the client. Failed requests
+// get the JSON response of the endpoint.
+func streamDecrypt(q *queue, requestType string, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var device string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		device = core.Fingerprint(r.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	}
+	body = withDevice(body, device)
+
+	ctx := r.Context()
+	if token := sessionToken(r); token != nil {
+		ctx = core.WithSession(ctx, token)
+	}
+	ctx = core.WithSource(ctx, r.RemoteAddr)
+	ctx = core.WithEndpoint(ctx, requestType)
+	plaintext := new(core.PlaintextStream)
+	ctx = core.WithPlaintextStream(ctx, plaintext)
+
+	response := make(chan []byte, 1)
+	if err = q.push(userRequest{rt: requestType, in: body, resp: response, ctx: ctx}); err != nil {
+		writeBusy(w, err)
+		return
+	}
+
+	// the response is received even if the client is gone, as the
+	// plaintext is only opened once it is
+	resp, ok := <-response
+	if !ok {
+		http.Error(w, "Unknown request", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
+	if !plaintext.Opened() {
+		header.Set("Content-Type", "application/json")
+		w.Write(resp)
+		return
+	}
+
+	var rd core.ResponseData
+	var decrypted core.DecryptWithDelegates
+	json.Unmarshal(resp, &rd)
+	json.Unmarshal(rd.Response, &decrypted)
+
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(plaintext.Size()))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Delegates", strings.Join(decrypted.Delegates, ","))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err = plaintext.WriteTo(flushWriter{w, flusher}); err != nil {
+		log.Printf("http.decrypt-stream failed: %s", err)
+	}
+}
+
+// etag returns the entity tag of a response.
+func etag(resp []byte) string {
+	hash := sha256.Sum256(resp)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// matchesETag returns true if the If-None-Match header given matches
+// the entity tag.
+func matchesETag(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == tag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEvents handles a request for the /events stream. The request is
+// authenticated like any other by the goroutine started by New, after
+// which the events of the server are sent to the client as Server-Sent
+// Events until it disconnects.
+func streamEvents(q *queue, requestType string, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before authenticating so that no events are missed
+	stream, cancel := core.Subscribe()
+	defer cancel()
+
+	ctx := core.WithSource(r.Context(), r.RemoteAddr)
+	ctx = core.WithEndpoint(ctx, requestType)
+	response := make(chan []byte, 1)
+	if err = q.push(userRequest{rt: requestType, in: body, resp: response, ctx: ctx}); err != nil {
+		writeBusy(w, err)
+		return
+	}
+
+	resp, ok := <-response
+	if !ok {
+		http.Error(w, "Unknown request", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
+
+	var status core.ResponseData
+	if err = json.Unmarshal(resp, &status); err != nil || status.Status != "ok" {
+		header.Set("Content-Type", "application/json")
+		w.Write(resp)
+		return
+	}
+
+	// the stream lasts longer than any write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-stream:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("http.events failed: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Config holds the settings of a Server.
+type Config struct {
+	VaultPath  string // path of the disk vault, or "memory"
+	StaticPath string // path overriding the built-in index.html (optional)
+
+	// TLS certificates and keys in PEM format, in the same order
+	CertPaths []string
+	KeyPaths  []string
+
+	// CAPath is the path of a CA certificate in PEM format. If set,
+	// clients must present a certificate signed by it.
+	CAPath string
+
+	// StaleDays is the number of days after which admins who have
+	// not authenticated are revoked (0 disables revocation).
+	StaleDays int
+
+	// MinAdmins and MaxAdmins limit the number of admins (0 for no
+	// limit). Admins are not revoked or deleted below MinAdmins, and
+	// the summary flags more than MaxAdmins.
+	MinAdmins int
+	MaxAdmins int
+
+	// Tickets checks the reasons given for decryption under labels
+	// requiring a ticket (optional).
+	Tickets tickets.Checker
+
+	// OnCall resolves the owners given as "oncall:<schedule>" to the
+	// users on call when data is encrypted (optional).
+	OnCall oncall.Resolver
+
+	// BreachCheck rejects new passwords known from a data breach
+	// (optional).
+	BreachCheck breach.Checker
+
+	// Classifier classifies the data given to /encrypt, which must
+	// then be encrypted under a label whose policy allows each class
+	// found (optional).
+	Classifier classify.Classifier
+
+	// Detectors are fed the events of the server and raise anomaly
+	// events on unusual activity (optional).
+	Detectors []anomaly.Detector
+
+	// AuditSinks receive a copy of each entry of the audit log, such
+	// as to forward them to a log collector (optional).
+	AuditSinks []auditlog.Sink
+
+	// Notifiers tell the owners of encrypted data that a decryption
+	// order is waiting for their delegations (optional).
+	Notifiers []notify.Notifier
+
+	// RequireLabels refuses to encrypt data without labels. With
+	// RequireLabelPolicies, each label must also have a label policy.
+	RequireLabels        bool
+	RequireLabelPolicies bool
+
+	// StageChanges stages changes to label policies and delegation
+	// templates until an admin other than the one making them approves
+	// them through /approve-change.
+	StageChanges bool
+
+	// Ceremony is the number of founding admins who must each create
+	// their record through /create before a new vault is created (0
+	// or 1 creates it with the first).
+	Ceremony int
+
+	// SeparateAdmin keeps the admin endpoints off the listeners given
+	// to Serve, so that they are only reachable through ServeAdmin.
+	SeparateAdmin bool
+
+	// DisableHTTP2 serves HTTP/1.1 only. Otherwise HTTP/2 is
+	// negotiated with the clients that support it.
+	DisableHTTP2 bool
+
+	// Timeouts for reading a request, writing its response, and
+	// keeping an idle connection open (0 for none). The write timeout
+	// does not apply to /events streams.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxConns is the number of connections served at once on each
+	// listener (0 for no limit); further connections wait.
+	MaxConns int
+
+	// WriteBehind batches the writes of the vault made within this
+	// interval of each other into one (0 writes every change). Changes
+	// not written yet are lost if the process dies, but the vault on
+	// disk is always complete.
+	WriteBehind time.Duration
+
+	// SessionTTL is the time for which a correct password is
+	// remembered for the TLS connection it was given on, so that
+	// clients polling over one connection do not have it hashed on
+	// every request (0 hashes it every time).
+	SessionTTL time.Duration
+
+	// KDFLimit is the number of password hashes computed at once (0
+	// for no limit). Requests needing one more are refused with 503
+	// Service Unavailable and asked to retry.
+	KDFLimit int
+
+	// UnwrapTTL is the time for which the AES key of a piece of data
+	// unwrapped by a delegation is kept in locked memory, so that
+	// decrypting the same data again does not take a private key
+	// operation (0 keeps none). Keys never outlive their delegation.
+	UnwrapTTL time.Duration
+
+	// RequestTimeout is the time allowed to process a request, from
+	// when it is received (0 for none). Requests are given up on when
+	// it runs out or the client disconnects, including while they
+	// wait for the requests before them.
+	RequestTimeout time.Duration
+
+	// MaxRequestsPerConn is the number of requests a client can have
+	// in progress at once on an HTTP/2 connection (0 for the default
+	// of 250). HTTP/1.1 connections serve one request at a time.
+	MaxRequestsPerConn int
+
+	// Primary is the address of the active server, given as host:port,
+	// if this server is a standby. A standby forwards delegations,
+	// decryptions and changes to the vault to the active server,
+	// copies its vault every SyncInterval using the credentials of the
+	// admin SyncUser, and serves the rest from the copy until
+	// PromoteQuorum admins (2 by default) promote it to be the active
+	// server. PrimaryCA is the path of the CA certificate of the active
+	// server in PEM format, if it is not trusted by the system.
+	Primary       string
+	PrimaryCA     string
+	SyncInterval  time.Duration
+	SyncUser      string
+	SyncPassword  string
+	PromoteQuorum int
+
+	// RecoveryKey is the path of an ECDSA public key in PEM format
+	// (optional). Every RecoveryInterval, the live delegations are
+	// sealed to it and written to RecoveryPath, so that the holders of
+	// the private key can restore them through /recover if the server
+	// is lost.
+	RecoveryKey      string
+	RecoveryPath     string
+	RecoveryInterval time.Duration
+
+	// EscrowKey is the path of an ECDSA public key in PEM format
+	// (optional). With it, EscrowQuorum admins (2 by default) can
+	// export the private key of a user or the key of encrypted data
+	// to it through /escrow-export.
+	EscrowKey    string
+	EscrowQuorum int
+
+	// RestoreKey is the path of an ECDSA public key in PEM format
+	// (optional), such as the identity key of another server, whose
+	// snapshots can be restored through /restore besides those of
+	// this server.
+	RestoreKey string
+
+	// SelfTestInterval, if set, is the time between self-tests of the
+	// cryptographic path (see core.RunSelfTest), which are also run
+	// when the server starts.
+	SelfTestInterval time.Duration
+
+	// QueueLimit and BatchQueueLimit are the numbers of interactive
+	// and batch requests, such as /decrypt-batch and /re-encrypt,
+	// allowed to wait to be processed, beyond which requests are
+	// refused with 503 Service Unavailable (0 for no limit).
+	QueueLimit      int
+	BatchQueueLimit int
+}
+
+// Server serves the Red October API. All requests are passed to a
+// single goroutine, since the core package is not safe to be shared
+// across goroutines, through a queue ordering them by priority.
+type Server struct {
+	queue      *queue
+	done       chan struct{}
+	stopped    chan struct{} // closed once run has returned
+	flush      time.Duration
+	tlsConfig  *tls.Config
+	staticPath string
+	maxConns   int
+	timeout    time.Duration
+	http       *http.Server
+	adminHTTP  *http.Server
+
+	// standby state, see Config.Primary
+	standby      atomic.Bool
+	primary      *client.RemoteServer
+	synced       chan syncResult
+	syncEvery    time.Duration
+	syncUser     string
+	syncPassword string
+
+	// see Config.RecoveryKey
+	recoveryPath  string
+	recoveryEvery time.Duration
+
+	selfTestEvery time.Duration
+}
+
+// New loads the vault and the TLS certificates given in config and
+// returns a Server ready to serve them.
+func New(config Config) (*Server, error) {
+	if len(config.CertPaths) != len(config.KeyPaths) {
+		return nil, fmt.Errorf("Got %d certificates but %d keys", len(config.CertPaths), len(config.KeyPaths))
+	}
+
+	tlsConfig := &tls.Config{
+		PreferServerCipherSuites: true,
+		SessionTicketsDisabled:   true,
+		NextProtos:               []string{"h2", "http/1.1"},
+	}
+	if config.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	for i, certPath := range config.CertPaths {
+		cert, err := tls.LoadX509KeyPair(certPath, config.KeyPaths[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error loading certificate (%s, %s): %s", certPath, config.KeyPaths[i], err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	tlsConfig.BuildNameToCertificate()
+
+	// If a CAPath has been specified then a local CA is being used
+	// and not the system configuration.
+
+	if config.CAPath != "" {
+		pemCert, err := ioutil.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s\n", config.CAPath, err)
+		}
+
+		derCert, _ := pem.Decode(pemCert)
+		if derCert == nil {
+			return nil, fmt.Errorf("No PEM data was found in the CA certificate file\n")
+		}
+
+		cert, err := x509.ParseCertificate(derCert.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CA certificate: %s\n", err)
+		}
+
+		rootPool := x509.NewCertPool()
+		rootPool.AddCert(cert)
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = rootPool
+	} else {
+		// Ask for a certificate without verifying it, so that
+		// delegations can be bound to the device of the client.
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	if err := core.Init(config.VaultPath); err != nil {
+		return nil, err
+	}
+	core.SetStalePolicy(config.StaleDays)
+	core.SetAdminLimits(config.MinAdmins, config.MaxAdmins)
+	core.SetWriteBehind(config.WriteBehind)
+	core.SetSessionTTL(config.SessionTTL)
+	passvault.SetKDFLimit(config.KDFLimit)
+	core.SetUnwrapTTL(config.UnwrapTTL)
+	core.SetTicketChecker(config.Tickets)
+	core.SetOnCall(config.OnCall)
+	core.SetBreachChecker(config.BreachCheck)
+	core.SetStageChanges(config.StageChanges)
+	core.SetClassifier(config.Classifier)
+	core.SetDetectors(config.Detectors...)
+	core.SetAuditSinks(config.AuditSinks...)
+	core.SetNotifiers(config.Notifiers...)
+	core.SetRequireLabels(config.RequireLabels, config.RequireLabelPolicies)
+	core.SetCeremony(config.Ceremony)
+
+	if config.RecoveryKey != "" {
+		pub, err := loadPublicKey(config.RecoveryKey, "recovery")
+		if err != nil {
+			return nil, err
+		}
+		if config.RecoveryPath == "" || config.RecoveryInterval <= 0 {
+			return nil, fmt.Errorf("A recovery key needs a path and an interval")
+		}
+		core.SetRecoveryKey(pub)
+	} else {
+		core.SetRecoveryKey(nil)
+	}
+
+	if config.EscrowKey != "" {
+		pub, err := loadPublicKey(config.EscrowKey, "escrow")
+		if err != nil {
+			return nil, err
+		}
+		quorum := config.EscrowQuorum
+		if quorum <= 0 {
+			quorum = 2
+		}
+		core.SetEscrowExport(pub, quorum)
+	}
+
+	if config.RestoreKey != "" {
+		pub, err := loadPublicKey(config.RestoreKey, "restore")
+		if err != nil {
+			return nil, err
+		}
+		core.SetRestoreKey(pub)
+	} else {
+		core.SetRestoreKey(nil)
+	}
+
+	var certs [][]byte
+	for _, cert := range tlsConfig.Certificates {
+		certs = append(certs, cert.Certificate[0])
+	}
+	core.SetCertificates(certs)
+
+	s := &Server{
+		queue:      newQueue(config.QueueLimit, config.BatchQueueLimit),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		flush:      config.WriteBehind,
+		tlsConfig:  tlsConfig,
+		staticPath: config.StaticPath,
+		maxConns:   config.MaxConns,
+		timeout:    config.RequestTimeout,
+
+		recoveryPath:  config.RecoveryPath,
+		recoveryEvery: config.RecoveryInterval,
+		selfTestEvery: config.SelfTestInterval,
+	}
+	separateAdmin = config.SeparateAdmin
+	currentQueue.Store(s.queue)
+	s.http = newHTTPServer(config, s.Handler())
+	s.adminHTTP = newHTTPServer(config, s.AdminHandler())
+
+	if config.Primary != "" {
+		if config.SyncInterval <= 0 {
+			return nil, fmt.Errorf("A standby needs a sync interval")
+		}
+		quorum := config.PromoteQuorum
+		if quorum <= 0 {
+			quorum = 2
+		}
+		primary, err := client.NewRemoteServer(config.Primary, config.PrimaryCA)
+		if err != nil {
+			return nil, err
+		}
+		s.primary = primary
+		s.synced = make(chan syncResult)
+		s.syncEvery = config.SyncInterval
+		s.syncUser = config.SyncUser
+		s.syncPassword = config.SyncPassword
+		s.standby.Store(true)
+		core.SetStandby(quorum)
+		go s.syncVault()
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// loadPublicKey reads the ECDSA public key in PEM format at path, named
+// by what in errors.
+func loadPublicKey(path, what string) (*ecdsa.PublicKey, error) {
+	pemKey, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", path, err)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data was found in the %s key file", what)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s key: %s", what, err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("The %s key is not an ECDSA key", what)
+	}
+	return ecPub, nil
+}
+
+// writeRecovery writes the live delegations sealed to the recovery key
+// to the recovery path, replacing the previous snapshot at once.
+func (s *Server) writeRecovery() {
+	sealed, err := core.SealDelegations()
+	if err != nil || sealed == nil {
+		return
+	}
+	tmp := s.recoveryPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, sealed, 0600); err == nil {
+		err = os.Rename(tmp, s.recoveryPath)
+	}
+	if err != nil {
+		log.Printf("http.recovery failed: %s", err)
+	}
+}
+
+// newHTTPServer returns an http.Server for handler with the protocols,
+// timeouts and limits given in config.
+func newHTTPServer(config Config, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+		Protocols:    new(http.Protocols),
+		HTTP2:        &http.HTTP2Config{MaxConcurrentStreams: config.MaxRequestsPerConn},
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(!config.DisableHTTP2)
+	return srv
+}
+
+// run takes requests from the queue and dispatches them to core until
+// the server is closed.
+func (s *Server) run() {
+	stale := time.NewTicker(time.Hour)
+	defer stale.Stop()
+	elevations := time.NewTicker(time.Minute)
+	defer elevations.Stop()
+
+	// without write-behind there is never anything to flush
+	var flush <-chan time.Time
+	if s.flush > 0 {
+		ticker := time.NewTicker(s.flush)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
+	var recovery <-chan time.Time
+	if s.recoveryEvery > 0 && s.recoveryPath != "" {
+		ticker := time.NewTicker(s.recoveryEvery)
+		defer ticker.Stop()
+		recovery = ticker.C
+	}
+
+	var selfTest <-chan time.Time
+	if s.selfTestEvery > 0 {
+		core.RunSelfTest()
+		ticker := time.NewTicker(s.selfTestEvery)
+		defer ticker.Stop()
+		selfTest = ticker.C
+	}
+
+	defer close(s.stopped)
+	for {
+		var req userRequest
+		select {
+		case <-s.done:
+			core.Flush()
+			return
+		case <-stale.C:
+			// a standby has the revocations of the active server
+			if !core.IsStandby() {
+				core.RevokeStale(time.Now())
+			}
+			continue
+		case <-elevations.C:
+			if !core.IsStandby() {
+				core.ExpireAdmins(time.Now())
+			}
+			continue
+		case <-flush:
+			core.Flush()
+			continue
+		case <-recovery:
+			// a standby holds no delegations of its own
+			if !core.IsStandby() {
+				s.writeRecovery()
+			}
+			continue
+		case <-selfTest:
+			core.RunSelfTest()
+			continue
+		case r := <-s.synced:
+			core.SetPrimaryUp(r.err == nil)
+			if r.err != nil {
+				log.Printf("http.sync failed: %s", r.err)
+			} else if core.IsStandby() {
+				core.SyncVault(r.vault)
+			}
+			continue
+		case <-s.queue.ready:
+			var ok bool
+			if req, ok = s.queue.pop(); !ok {
+				continue
+			}
+		}
+
+		if f, ok := functions[req.rt]; ok {
+			r, err := core.WithContext(req.ctx, f, req.in)
+			if err == nil {
+				req.resp <- r
+			} else {
+				log.Printf("http.main failed: %s: %s", req.rt, err)
+			}
+		} else {
+			log.Printf("http.main: request=%s function is not supported", req.rt)
+		}
+
+		// a promoted standby serves every request itself
+		if s.standby.Load() && !core.IsStandby() {
+			log.Printf("http.main: promoted to active server")
+			s.standby.Store(false)
+		}
+
+		// Note that if an error occurs no message is sent down
+		// the channel and then channel is closed. The
+		// queueRequest function will see this as indication of an
+		// error.
+
+		close(req.resp)
+	}
+}
+
+// Handler returns a handler for the JSON API and the web interface,
+// without TLS. Each of the URIs in the functions map above is setup
+// with a separate HandleFunc. Each HandleFunc is an instance of
+// queueRequest above. The admin endpoints are not found if they are
+// served separately.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// queue up post URIs
+	for current := range functions {
+		if separateAdmin && adminEndpoints[current] {
+			mux.HandleFunc(current, http.NotFound)
+			continue
+		}
+		s.handle(mux, current)
+	}
+
+	// metrics, such as the password hashes in progress, are kept
+	// with the admin endpoints
+	if !separateAdmin {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+
+	// queue up web frontend
+	idxHandler := &indexHandler{s.staticPath}
+	mux.HandleFunc("/index", idxHandler.handle)
+	mux.HandleFunc("/", idxHandler.handle)
+
+	return mux
+}
+
+// AdminHandler returns a handler for the admin endpoints and the
+// metrics at /debug/vars only, without TLS.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	for current := range adminEndpoints {
+		s.handle(mux, current)
+	}
+	return mux
+}
+
+// handle sets up the HandleFunc of an endpoint of the JSON API.
+func (s *Server) handle(mux *http.ServeMux, requestType string) {
+	handler := queueRequest
+	switch requestType {
+	case "/events":
+		handler = streamEvents
+	case "/decrypt-stream":
+		handler = streamDecrypt
+	}
+	mux.HandleFunc(requestType, func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("http.server: endpoint=%s remote=%s", requestType, r.RemoteAddr)
+		if s.timeout > 0 && requestType != "/events" {
+			ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if err := decodeBody(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if s.standby.Load() && !standbyLocal[requestType] {
+			s.forward(w, r, requestType)
+			return
+		}
+		handler(s.queue, requestType, w, r)
+	})
+}
+
+// Serve accepts connections on l and serves HTTPS on them until the
+// server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.http.Serve(tls.NewListener(limit(l, s.maxConns), s.tlsConfig))
+}
+
+// ServeAdmin accepts connections on l and serves HTTPS on them for the
+// admin endpoints only, until the server is closed.
+func (s *Server) ServeAdmin(l net.Listener) error {
+	return s.adminHTTP.Serve(tls.NewListener(limit(l, s.maxConns), s.tlsConfig))
+}
+
+// Close stops the server, closing its listeners and connections, and
+// writes the changes to the vault left by write-behind.
+func (s *Server) Close() error {
+	err := s.http.Close()
+	if adminErr := s.adminHTTP.Close(); err == nil {
+		err = adminErr
+	}
+	close(s.done)
+	<-s.stopped
+	return err
+}
+
+type indexHandler struct {
+	staticPath string
+}
+
+func (this *indexHandler) handle(w http.ResponseWriter, r *http.Request) {
+	var body io.ReadSeeker
+	if this.staticPath != "" {
+		f, err := os.Open(this.staticPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		body = f
+	} else {
+		body = bytes.NewReader(indexHtml)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/html")
+	header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
+	// If the server isn't HTTPS worthy, the HSTS header won't be honored.
+
+	http.ServeContent(w, r, "index.html", time.Now(), body)
+}
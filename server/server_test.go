@@ -0,0 +1,768 @@
+// server_test.go: tests for server.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/redoctober/core"
+	"github.com/cloudflare/redoctober/ecdh"
+	"github.com/cloudflare/redoctober/passvault"
+)
+
+func TestServer(t *testing.T) {
+	s, err := New(Config{
+		VaultPath: "memory",
+		CertPaths: []string{"../testdata/server.crt"},
+		KeyPaths:  []string{"../testdata/server.pem"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	post := func(api string, v interface{}) core.ResponseData {
+		in, _ := json.Marshal(v)
+		resp, err := client.Post("https://"+l.Addr().String()+api, "application/json", bytes.NewBuffer(in))
+		if err != nil {
+			t.Fatalf("Error posting to %s, %v", api, err)
+		}
+		defer resp.Body.Close()
+
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var d core.ResponseData
+		if err = json.Unmarshal(out, &d); err != nil {
+			t.Fatalf("Error in response from %s, %v", api, err)
+		}
+		return d
+	}
+
+	if d := post("/create", core.CreateRequest{Name: "Alice", Password: "Lewis"}); d.Status != "ok" {
+		t.Fatalf("Error creating vault, %s", d.Status)
+	}
+	if d := post("/summary", core.SummaryRequest{Name: "Alice", Password: "Lewis"}); d.Status != "ok" {
+		t.Fatalf("Error in summary, %s", d.Status)
+	}
+	if d := post("/summary", core.SummaryRequest{Name: "Alice", Password: "Hatter"}); d.Status == "ok" {
+		t.Fatalf("Summary with the wrong password succeeded")
+	}
+	// unchanged summaries are not sent again
+	in, _ := json.Marshal(core.SummaryRequest{Name: "Alice", Password: "Lewis"})
+	resp, err := client.Post("https://"+l.Addr().String()+"/summary", "application/json", bytes.NewBuffer(in))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		t.Fatalf("No ETag on the summary")
+	}
+
+	req, _ := http.NewRequest("POST", "https://"+l.Addr().String()+"/summary", bytes.NewBuffer(in))
+	req.Header.Set("If-None-Match", tag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("Unchanged summary sent again, %s", resp.Status)
+	}
+
+	req, _ = http.NewRequest("POST", "https://"+l.Addr().String()+"/summary", bytes.NewBufferString(`{"Name":"Alice","Password":"Hatter"}`))
+	req.Header.Set("If-None-Match", tag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		t.Fatalf("Summary revalidated with the wrong password")
+	}
+}
+
+func TestSeparateAdmin(t *testing.T) {
+	s, err := New(Config{
+		VaultPath:     "memory",
+		CertPaths:     []string{"../testdata/server.crt"},
+		KeyPaths:      []string{"../testdata/server.pem"},
+		SeparateAdmin: true,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	adminL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Serve(l)
+	go s.ServeAdmin(adminL)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	post := func(l net.Listener, api string, v interface{}) int {
+		in, _ := json.Marshal(v)
+		resp, err := client.Post("https://"+l.Addr().String()+api, "application/json", bytes.NewBuffer(in))
+		if err != nil {
+			t.Fatalf("Error posting to %s, %v", api, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(l, "/create", core.CreateRequest{Name: "Alice", Password: "Lewis"}); code != http.StatusOK {
+		t.Fatalf("Error creating vault, %d", code)
+	}
+	if code := post(adminL, "/create", core.CreateRequest{Name: "Alice", Password: "Lewis"}); code != http.StatusNotFound {
+		t.Fatalf("Admin listener served /create, %d", code)
+	}
+
+	export := core.ExportRequest{Name: "Alice", Password: "Lewis"}
+	if code := post(l, "/export", export); code != http.StatusNotFound {
+		t.Fatalf("Main listener served /export, %d", code)
+	}
+	if code := post(adminL, "/export", export); code != http.StatusOK {
+		t.Fatalf("Error exporting on the admin listener, %d", code)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		s, err := New(Config{
+			VaultPath:    "memory",
+			CertPaths:    []string{"../testdata/server.crt"},
+			KeyPaths:     []string{"../testdata/server.pem"},
+			DisableHTTP2: disable,
+			ReadTimeout:  time.Minute,
+			MaxConns:     1,
+		})
+		if err != nil {
+			t.Fatalf("Error creating server, %v", err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		go s.Serve(l)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Post("https://"+l.Addr().String()+"/summary", "application/json", bytes.NewBufferString("{}"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp.Body.Close()
+		if (resp.ProtoMajor == 2) == disable {
+			t.Fatalf("Wrong protocol %s with DisableHTTP2=%v", resp.Proto, disable)
+		}
+		s.Close()
+	}
+}
+
+func TestLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	l = limit(l, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatalf("Second connection accepted over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("Second connection not accepted after the first closed")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	_, err := New(Config{
+		VaultPath: "memory",
+		CertPaths: []string{"../testdata/server.crt"},
+	})
+	if err == nil {
+		t.Fatalf("Certificate without a key accepted")
+	}
+}
+
+func TestRecoverySnapshot(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(ecdh.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "recovery.pub")
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	snapshotPath := filepath.Join(dir, "recovery")
+
+	config := Config{
+		VaultPath:   "memory",
+		CertPaths:   []string{"../testdata/server.crt"},
+		KeyPaths:    []string{"../testdata/server.pem"},
+		RecoveryKey: keyPath,
+	}
+	if _, err = New(config); err == nil {
+		t.Fatalf("Recovery key without a path accepted")
+	}
+	config.RecoveryPath = snapshotPath
+	config.RecoveryInterval = 10 * time.Millisecond
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+	defer s.Close()
+	defer core.SetRecoveryKey(nil)
+
+	var sealed []byte
+	for i := 0; i < 100 && sealed == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sealed, _ = ioutil.ReadFile(snapshotPath)
+	}
+	if sealed == nil {
+		t.Fatalf("No recovery snapshot written")
+	}
+	if _, err = ecdh.Decrypt(priv, sealed); err != nil {
+		t.Fatalf("Recovery snapshot not sealed to the recovery key, %v", err)
+	}
+}
+
+func TestWithDevice(t *testing.T) {
+	var s core.DecryptRequest
+	in := withDevice([]byte(`{"Name":"Alice","device":"spoofed","DEVICE":"spoofed"}`), "")
+	if err := json.Unmarshal(in, &s); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Name != "Alice" || s.Device != "" {
+		t.Fatalf("Device from the client kept: %s", in)
+	}
+
+	s = core.DecryptRequest{}
+	in = withDevice([]byte(`{"Name":"Alice","Device":"spoofed"}`), "laptop")
+	if err := json.Unmarshal(in, &s); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Device != "laptop" {
+		t.Fatalf("Wrong device set: %s", in)
+	}
+
+	if out := withDevice([]byte(`not json`), "laptop"); string(out) != "not json" {
+		t.Fatalf("Invalid request changed: %s", out)
+	}
+}
+
+func TestDecryptFormat(t *testing.T) {
+	for _, c := range []struct {
+		url, accept, format string
+	}{
+		{"/decrypt", "", ""},
+		{"/decrypt", "application/json", ""},
+		{"/decrypt", "text/html, application/octet-stream;q=0.9", "raw"},
+		{"/decrypt?format=hex", "application/octet-stream", "hex"},
+		{"/decrypt?format=base64", "", "base64"},
+		{"/decrypt?format=pdf", "application/octet-stream", ""},
+	} {
+		r := httptest.NewRequest("POST", c.url, nil)
+		r.Header.Set("Accept", c.accept)
+		if format := decryptFormat(r); format != c.format {
+			t.Fatalf("Format of %s with %q: got %q, want %q", c.url, c.accept, format, c.format)
+		}
+	}
+
+	decrypted, _ := json.Marshal(core.DecryptWithDelegates{Data: []byte("\x00secret"), Delegates: []string{"Alice", "Bob"}})
+	resp, _ := json.Marshal(core.ResponseData{Status: "ok", Response: decrypted})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/decrypt?format=raw&filename=../notes.bin", nil)
+	if !writeDecrypted(w, r, "raw", resp) {
+		t.Fatalf("Decrypted data not written")
+	}
+	if w.Body.String() != "\x00secret" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Wrong raw response: %q %v", w.Body.String(), w.Header())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=notes.bin" {
+		t.Fatalf("Wrong disposition: %s", disposition)
+	}
+	if delegates := w.Header().Get("X-Delegates"); delegates != "Alice,Bob" {
+		t.Fatalf("Wrong delegates: %s", delegates)
+	}
+
+	w = httptest.NewRecorder()
+	if !writeDecrypted(w, r, "hex", resp) || w.Body.String() != "00736563726574\n" {
+		t.Fatalf("Wrong hex response: %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	if writeDecrypted(w, r, "raw", []byte(`{"Status":"Wrong Password"}`)) {
+		t.Fatalf("Error response written as decrypted data")
+	}
+}
+
+func TestEncryptForm(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("Name", "Alice")
+	mw.WriteField("Password", "Lewis")
+	mw.WriteField("Owners", "Bill, Cat,")
+	mw.WriteField("Owners", "Dodo")
+	mw.WriteField("Labels", "blue")
+	fw, err := mw.CreateFormFile("Data", "raven.bin")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fw.Write([]byte("\x00\x01binary"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/encrypt", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if !isMultipart(r) {
+		t.Fatalf("Multipart form not recognized")
+	}
+	in, err := encryptForm(r)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var s core.EncryptRequest
+	if err = json.Unmarshal(in, &s); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Name != "Alice" || s.Password != "Lewis" || string(s.Data) != "\x00\x01binary" {
+		t.Fatalf("Wrong request from form: %s", in)
+	}
+	if len(s.Owners) != 3 || s.Owners[2] != "Dodo" || len(s.Labels) != 1 || s.Labels[0] != "blue" {
+		t.Fatalf("Wrong lists from form: %s", in)
+	}
+
+	r = httptest.NewRequest("POST", "/encrypt", nil)
+	r.Header.Set("Content-Type", "application/json")
+	if isMultipart(r) {
+		t.Fatalf("JSON request taken for a form")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, c := range []struct {
+		accept string
+		gzip   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"br, gzip;q=0", false},
+		{"x-gzip", false},
+	} {
+		r := httptest.NewRequest("POST", "/summary", nil)
+		r.Header.Set("Accept-Encoding", c.accept)
+		if acceptsGzip(r) != c.gzip {
+			t.Fatalf("Accept-Encoding %q: gzip accepted %v", c.accept, !c.gzip)
+		}
+	}
+
+	s, err := New(Config{
+		VaultPath: "memory",
+		CertPaths: []string{"../testdata/server.crt"},
+		KeyPaths:  []string{"../testdata/server.pem"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		DisableCompression: true,
+	}}
+
+	post := func(api, contentEncoding, acceptEncoding string, body []byte) *http.Response {
+		req, _ := http.NewRequest("POST", "https://"+l.Addr().String()+api, bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", contentEncoding)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error posting to %s, %v", api, err)
+		}
+		return resp
+	}
+	status := func(resp *http.Response, body io.Reader) string {
+		defer resp.Body.Close()
+		var d core.ResponseData
+		if err := json.NewDecoder(body).Decode(&d); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return d.Status
+	}
+
+	// a compressed request with an uncompressed response
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"Name":"Alice","Password":"Lewis"}`))
+	zw.Close()
+	resp := post("/create", "gzip", "", buf.Bytes())
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Response compressed without being accepted")
+	}
+	if st := status(resp, resp.Body); st != "ok" {
+		t.Fatalf("Error creating vault from a compressed request, %s", st)
+	}
+
+	for _, name := range []string{"Bill", "Cat"} {
+		resp = post("/create-user", "", "", []byte(`{"Name":"`+name+`","Password":"Lewis"}`))
+		if st := status(resp, resp.Body); st != "ok" {
+			t.Fatalf("Error creating %s, %s", name, st)
+		}
+	}
+
+	// a large compressed request with a compressed response
+	in, _ := json.Marshal(core.EncryptRequest{
+		Name:     "Alice",
+		Password: "Lewis",
+		Owners:   []string{"Bill", "Cat"},
+		Data:     bytes.Repeat([]byte("Why is a raven like a writing desk? "), 100),
+	})
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	zw.Write(in)
+	zw.Close()
+	resp = post("/encrypt", "gzip", "gzip", buf.Bytes())
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Large response not compressed")
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if st := status(resp, zr); st != "ok" {
+		t.Fatalf("Error in compressed encryption, %s", st)
+	}
+
+	// small responses are sent as they are
+	resp = post("/summary", "", "gzip", []byte(`{"Name":"Alice","Password":"Hatter"}`))
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Small response compressed")
+	}
+	status(resp, resp.Body)
+
+	resp = post("/summary", "br", "", []byte(`{"Name":"Alice","Password":"Lewis"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Unsupported content encoding accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	vault, err := passvault.InitFrom("memory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = vault.AddNewRecord("Alice", "Lewis", true, passvault.DefaultRecordType); err != nil {
+		t.Fatalf("%v", err)
+	}
+	exported, _ := json.Marshal(vault)
+
+	// the active server exports its vault and answers delegations
+	primary := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			out, _ := json.Marshal(core.ResponseData{Status: "ok", Response: exported})
+			w.Write(out)
+		case "/delegate":
+			w.Write([]byte(`{"Status":"forwarded"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer primary.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: primary.Certificate().Raw})
+	if err = ioutil.WriteFile(caPath, ca, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	s, err := New(Config{
+		VaultPath:     "memory",
+		CertPaths:     []string{"../testdata/server.crt"},
+		KeyPaths:      []string{"../testdata/server.pem"},
+		Primary:       primary.Listener.Addr().String(),
+		PrimaryCA:     caPath,
+		SyncInterval:  50 * time.Millisecond,
+		SyncUser:      "Alice",
+		SyncPassword:  "Lewis",
+		PromoteQuorum: 1,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	post := func(api string, v interface{}) string {
+		in, _ := json.Marshal(v)
+		resp, err := client.Post("https://"+l.Addr().String()+api, "application/json", bytes.NewBuffer(in))
+		if err != nil {
+			t.Fatalf("Error posting to %s, %v", api, err)
+		}
+		defer resp.Body.Close()
+
+		var d core.ResponseData
+		out, _ := ioutil.ReadAll(resp.Body)
+		if err = json.Unmarshal(out, &d); err != nil {
+			return string(out)
+		}
+		return d.Status
+	}
+	login := core.SummaryRequest{Name: "Alice", Password: "Lewis"}
+	delegate := core.DelegateRequest{Name: "Alice", Password: "Lewis", Uses: 1, Time: "1h"}
+
+	if status := post("/delegate", delegate); status != "forwarded" {
+		t.Fatalf("Delegation not forwarded, %s", status)
+	}
+
+	// the vault is copied from the active server
+	deadline := time.Now().Add(5 * time.Second)
+	for post("/users", login) != "ok" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Vault not copied from the active server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	promote := core.PromoteRequest{Name: "Alice", Password: "Lewis"}
+	if status := post("/promote", promote); status != "Active server is up" {
+		t.Fatalf("Standby promoted while the active server is up, %s", status)
+	}
+
+	primary.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for post("/promote", promote) != "ok" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Standby not promoted once the active server is down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a promoted standby delegates itself
+	if status := post("/delegate", delegate); status != "ok" {
+		t.Fatalf("Error delegating on the promoted standby, %s", status)
+	}
+}
+
+func TestDecryptStream(t *testing.T) {
+	s, err := New(Config{
+		VaultPath: "memory",
+		CertPaths: []string{"../testdata/server.crt"},
+		KeyPaths:  []string{"../testdata/server.pem"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	post := func(api string, v interface{}) (*http.Response, []byte) {
+		in, _ := json.Marshal(v)
+		resp, err := client.Post("https://"+l.Addr().String()+api, "application/json", bytes.NewBuffer(in))
+		if err != nil {
+			t.Fatalf("Error posting to %s, %v", api, err)
+		}
+		defer resp.Body.Close()
+
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return resp, out
+	}
+	status := func(api string, v interface{}) core.ResponseData {
+		_, out := post(api, v)
+		var d core.ResponseData
+		if err := json.Unmarshal(out, &d); err != nil {
+			t.Fatalf("Error in response from %s, %v", api, err)
+		}
+		if d.Status != "ok" {
+			t.Fatalf("Error in %s, %s", api, d.Status)
+		}
+		return d
+	}
+
+	status("/create", core.CreateRequest{Name: "Alice", Password: "Lewis"})
+	status("/create-user", core.CreateUserRequest{Name: "Bob", Password: "Hatter"})
+
+	clear := bytes.Repeat([]byte("Red October "), 20000)
+	d := status("/encrypt", core.EncryptRequest{Name: "Alice", Password: "Lewis", Owners: []string{"Alice", "Bob"}, Data: clear})
+	decrypt := core.DecryptRequest{Name: "Alice", Password: "Lewis", Data: d.Response}
+
+	// not enough delegations: a JSON error
+	resp, out := post("/decrypt-stream", decrypt)
+	if resp.Header.Get("Content-Type") != "application/json" || !bytes.Contains(out, []byte("Need more delegated keys")) {
+		t.Fatalf("Wrong response without delegations: %s", out)
+	}
+
+	status("/delegate", core.DelegateRequest{Name: "Alice", Password: "Lewis", Time: "1h", Uses: 1})
+	status("/delegate", core.DelegateRequest{Name: "Bob", Password: "Hatter", Time: "1h", Uses: 1})
+
+	resp, out = post("/decrypt-stream", decrypt)
+	if resp.Header.Get("Content-Type") != "application/octet-stream" || !bytes.Equal(out, clear) {
+		t.Fatalf("Wrong plaintext streamed: %d bytes of %s", len(out), resp.Header.Get("Content-Type"))
+	}
+	if resp.ContentLength != int64(len(clear)) || resp.Header.Get("X-Delegates") != "Alice,Bob" {
+		t.Fatalf("Wrong headers: %v", resp.Header)
+	}
+
+	// the delegations were used up
+	resp, out = post("/decrypt-stream", decrypt)
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Decrypted with used up delegations: %d bytes", len(out))
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := newQueue(0, 3)
+
+	push := func(rt, name string, ctx context.Context) error {
+		in, _ := json.Marshal(core.DecryptRequest{Name: name})
+		return q.push(userRequest{rt: rt, in: in, resp: make(chan []byte, 1), ctx: ctx})
+	}
+	pop := func() string {
+		req, ok := q.pop()
+		if !ok {
+			return ""
+		}
+		var who struct{ Name string }
+		json.Unmarshal(req.in, &who)
+		return req.rt + " " + who.Name
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := push("/decrypt-batch", "Bulk", context.Background()); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := push("/re-encrypt", "Bob", context.Background()); err != errBusy {
+		t.Fatalf("Batch request over the limit queued: %v", err)
+	}
+	gone, cancel := context.WithCancel(context.Background())
+	push("/decrypt", "Carol", gone)
+	cancel()
+	push("/decrypt", "Alice", context.Background())
+
+	// interactive requests first, skipping abandoned ones
+	if next := pop(); next != "/decrypt Alice" {
+		t.Fatalf("Wrong request first: %s", next)
+	}
+	if next := pop(); next != "/decrypt-batch Bulk" {
+		t.Fatalf("Wrong request second: %s", next)
+	}
+
+	// Bob takes his turn before the rest of the bulk job
+	push("/re-encrypt", "Bob", context.Background())
+	for _, expected := range []string{"/decrypt-batch Bulk", "/re-encrypt Bob", "/decrypt-batch Bulk", ""} {
+		if next := pop(); next != expected {
+			t.Fatalf("Expected %q, got %q", expected, next)
+		}
+	}
+
+	stats := q.Stats()
+	if stats["interactive"].Processed != 1 || stats["interactive"].Abandoned != 1 || stats["batch"].Processed != 4 || stats["batch"].Refused != 1 || stats["batch"].Waiting != 0 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+}
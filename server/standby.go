@@ -0,0 +1,111 @@
+// standby.go: forwarding to the active server and copying its vault
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/redoctober/core"
+)
+
+// standbyLocal are the endpoints a standby serves itself from its copy
+// of the vault. The others, which use delegations or change the vault,
+// are forwarded to the active server.
+var standbyLocal = map[string]bool{
+	"/id":             true,
+	"/version":        true,
+	"/encrypt":        true,
+	"/owners":         true,
+	"/users":          true,
+	"/label-policies": true,
+	"/watermark":      true,
+	"/export":         true,
+	"/admin-log":      true,
+	"/snapshot":       true,
+	"/events":         true,
+	"/promote":        true,
+}
+
+// syncResult is the outcome of copying the vault of the active server.
+type syncResult struct {
+	vault []byte
+	err   error
+}
+
+// forward sends a request received by a standby to the active server
+// and writes back its response.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, requestType string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := s.primary.DoContext(r.Context(), strings.TrimPrefix(requestType, "/"), body)
+	if err != nil {
+		log.Printf("http.forward failed: %s: %s", requestType, err)
+		http.Error(w, "Active server unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Strict-Transport-Security", "max-age=86400; includeSubDomains; preload")
+	writeBody(w, r, resp)
+}
+
+// fetchVault exports the vault of the active server.
+func (s *Server) fetchVault() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.syncEvery)
+	defer cancel()
+
+	req, err := json.Marshal(core.ExportRequest{Name: s.syncUser, Password: s.syncPassword})
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.primary.DoContext(ctx, "export", req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp core.ResponseData
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "ok" {
+		return nil, errors.New(resp.Status)
+	}
+	return resp.Response, nil
+}
+
+// syncVault copies the vault of the active server every sync interval,
+// passing it to run, until the standby is promoted or the server is
+// closed.
+func (s *Server) syncVault() {
+	ticker := time.NewTicker(s.syncEvery)
+	defer ticker.Stop()
+
+	for s.standby.Load() {
+		vault, err := s.fetchVault()
+		select {
+		case s.synced <- syncResult{vault, err}:
+		case <-s.done:
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
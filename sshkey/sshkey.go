@@ -0,0 +1,173 @@
+// Package sshkey reads SSH public keys in the authorized_keys format and
+// checks signatures made with them, so that users can prove possession
+// of a key they already have, for example through ssh-agent. GPG users
+// can do the same with the key printed by gpg --export-ssh-key.
+//
+// Only Ed25519 keys, and RSA keys signing with rsa-sha2-256 rather than
+// SHA-1, are accepted.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package sshkey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Key types
+const (
+	Ed25519 = "ssh-ed25519"
+	RSA     = "ssh-rsa"
+
+	rsaSHA256 = "rsa-sha2-256" // the only signature format of RSA keys accepted
+)
+
+// Key is a public key from an authorized_keys file.
+type Key struct {
+	Type    string
+	Blob    []byte // the key in SSH wire format
+	Comment string
+}
+
+// Name returns the user name in the comment of the key, the part
+// before any "@".
+func (k Key) Name() string {
+	name := k.Comment
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// ParseAuthorizedKeys reads the keys of an authorized_keys file. Blank
+// lines and comments are skipped, as are the options before a key.
+func ParseAuthorizedKeys(in []byte) (keys []Key, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// options come before the key type
+		for len(fields) > 0 && fields[0] != Ed25519 && fields[0] != RSA {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Unsupported key on line %d", line)
+		}
+
+		blob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Bad key on line %d", line)
+		}
+		if _, err = parseKey(fields[0], blob); err != nil {
+			return nil, fmt.Errorf("%s on line %d", err, line)
+		}
+
+		key := Key{Type: fields[0], Blob: blob}
+		if len(fields) > 2 {
+			key.Comment = strings.Join(fields[2:], " ")
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// Verify checks that sig, a signature in SSH wire format as returned by
+// ssh-agent, is a signature of data by the key in SSH wire format.
+func Verify(blob, data, sig []byte) error {
+	keyType, _, ok := readString(blob)
+	if !ok {
+		return errors.New("Bad key")
+	}
+	pub, err := parseKey(string(keyType), blob)
+	if err != nil {
+		return err
+	}
+
+	format, rest, ok := readString(sig)
+	if !ok {
+		return errors.New("Bad signature")
+	}
+	raw, rest, ok := readString(rest)
+	if !ok || len(rest) != 0 {
+		return errors.New("Bad signature")
+	}
+
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if string(format) != Ed25519 || !ed25519.Verify(pub, data, raw) {
+			return errors.New("Wrong signature")
+		}
+	case *rsa.PublicKey:
+		if string(format) != rsaSHA256 {
+			return errors.New("RSA keys must sign with " + rsaSHA256)
+		}
+		hash := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], raw) != nil {
+			return errors.New("Wrong signature")
+		}
+	}
+	return nil
+}
+
+// parseKey returns the public key in blob, which must be of keyType.
+func parseKey(keyType string, blob []byte) (interface{}, error) {
+	name, rest, ok := readString(blob)
+	if !ok || string(name) != keyType {
+		return nil, errors.New("Bad key")
+	}
+
+	switch keyType {
+	case Ed25519:
+		pub, rest, ok := readString(rest)
+		if !ok || len(rest) != 0 || len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("Bad key")
+		}
+		return ed25519.PublicKey(pub), nil
+	case RSA:
+		e, rest, ok := readString(rest)
+		if !ok {
+			return nil, errors.New("Bad key")
+		}
+		n, rest, ok := readString(rest)
+		if !ok || len(rest) != 0 {
+			return nil, errors.New("Bad key")
+		}
+		E := new(big.Int).SetBytes(e)
+		if !E.IsInt64() || E.Int64() < 3 || E.Int64() > 1<<31-1 {
+			return nil, errors.New("Bad key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(E.Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		return pub, nil
+	default:
+		return nil, errors.New("Unsupported key type " + keyType)
+	}
+}
+
+// readString reads a length-prefixed string of the SSH wire format.
+func readString(in []byte) (s, rest []byte, ok bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(in)
+	if uint64(len(in)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return in[4 : 4+n], in[4+n:], true
+}
@@ -0,0 +1,90 @@
+// sshkey_test.go: tests for sshkey.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package sshkey
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func wireString(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(p)))
+		out = append(out, n[:]...)
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	blob := wireString([]byte(Ed25519), pub)
+	line := "# team keys\n\nno-pty,from=\"10.0.0.1\" ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob) + " alice@laptop\n"
+
+	keys, err := ParseAuthorizedKeys([]byte(line))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(keys) != 1 || keys[0].Type != Ed25519 || keys[0].Name() != "alice" {
+		t.Fatalf("Wrong keys read: %+v", keys)
+	}
+
+	data := []byte("challenge")
+	sig := wireString([]byte(Ed25519), ed25519.Sign(priv, data))
+	if err = Verify(keys[0].Blob, data, sig); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = Verify(keys[0].Blob, []byte("other"), sig); err == nil {
+		t.Fatalf("Signature of other data accepted")
+	}
+}
+
+func TestRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	blob := wireString([]byte(RSA), big.NewInt(int64(priv.E)).Bytes(), append([]byte{0}, priv.N.Bytes()...))
+	keys, err := ParseAuthorizedKeys([]byte("ssh-rsa " + base64.StdEncoding.EncodeToString(blob) + " bob"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	data := []byte("challenge")
+	hash := sha256.Sum256(data)
+	raw, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = Verify(keys[0].Blob, data, wireString([]byte("rsa-sha2-256"), raw)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// SHA-1 signatures are refused
+	if err = Verify(keys[0].Blob, data, wireString([]byte("ssh-rsa"), raw)); err == nil {
+		t.Fatalf("ssh-rsa signature accepted")
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := ParseAuthorizedKeys([]byte("ecdsa-sha2-nistp256 AAAA carol")); err == nil {
+		t.Fatalf("Unsupported key accepted")
+	}
+	if _, err := ParseAuthorizedKeys([]byte("ssh-ed25519 !!! carol")); err == nil {
+		t.Fatalf("Bad key accepted")
+	}
+}
@@ -0,0 +1,197 @@
+// Package tickets checks the tickets given as the reasons for
+// decryptions against a ticketing system: the ticket must exist, be
+// open, and name the user asking for the decryption.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package tickets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Checker checks that ticket is an open ticket naming requester.
+type Checker interface {
+	Check(ticket, requester string) error
+}
+
+// New returns the Checker for the named system ("jira" or
+// "servicenow") at the given base URL. User and password are used for
+// HTTP basic authentication if set.
+func New(system, baseURL, user, password string) (Checker, error) {
+	s := server{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	switch system {
+	case "jira":
+		return &Jira{s}, nil
+	case "servicenow":
+		return &ServiceNow{s}, nil
+	default:
+		return nil, fmt.Errorf("Unknown ticket system %s", system)
+	}
+}
+
+// TicketID returns the ticket referenced by a reason: its first word,
+// e.g. "OPS-123" for "OPS-123: rotate the database password".
+func TicketID(reason string) string {
+	fields := strings.Fields(reason)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimRight(fields[0], ":,;.")
+}
+
+// server holds the address and credentials of a ticketing system.
+type server struct {
+	baseURL        string
+	user, password string
+	client         *http.Client
+}
+
+// get fetches the JSON document at path into v. A missing document is
+// reported as a missing ticket.
+func (s *server) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", s.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errors.New("Ticket not found")
+	default:
+		return fmt.Errorf("Ticket system returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// names returns true if requester is one of the people on a ticket.
+func names(requester string, people ...string) bool {
+	for _, person := range people {
+		if person != "" && strings.EqualFold(person, requester) {
+			return true
+		}
+	}
+	return false
+}
+
+// Jira checks issues in Jira. An issue is open unless its status is in
+// the "done" category, and names the requester if they are its reporter
+// or assignee.
+type Jira struct {
+	server
+}
+
+type jiraUser struct {
+	Name         string `json:"name"`
+	EmailAddress string `json:"emailAddress"`
+}
+
+type jiraIssue struct {
+	Fields struct {
+		Status struct {
+			Name           string `json:"name"`
+			StatusCategory struct {
+				Key string `json:"key"`
+			} `json:"statusCategory"`
+		} `json:"status"`
+		Reporter *jiraUser `json:"reporter"`
+		Assignee *jiraUser `json:"assignee"`
+	} `json:"fields"`
+}
+
+// Check implements Checker.
+func (j *Jira) Check(ticket, requester string) error {
+	if ticket == "" {
+		return errors.New("No ticket given")
+	}
+
+	var issue jiraIssue
+	if err := j.get("/rest/api/2/issue/"+url.PathEscape(ticket)+"?fields=status,reporter,assignee", &issue); err != nil {
+		return err
+	}
+
+	if issue.Fields.Status.StatusCategory.Key == "done" {
+		return fmt.Errorf("Ticket %s is %s", ticket, issue.Fields.Status.Name)
+	}
+
+	var people []string
+	for _, u := range []*jiraUser{issue.Fields.Reporter, issue.Fields.Assignee} {
+		if u != nil {
+			people = append(people, u.Name, u.EmailAddress)
+		}
+	}
+	if !names(requester, people...) {
+		return fmt.Errorf("Ticket %s does not name %s", ticket, requester)
+	}
+	return nil
+}
+
+// ServiceNow checks incidents in ServiceNow. An incident is open unless
+// it is resolved, closed or canceled, and names the requester if they
+// are its caller, opener or assignee.
+type ServiceNow struct {
+	server
+}
+
+type serviceNowIncidents struct {
+	Result []struct {
+		State      string `json:"state"`
+		CallerID   string `json:"caller_id"`
+		OpenedBy   string `json:"opened_by"`
+		AssignedTo string `json:"assigned_to"`
+	} `json:"result"`
+}
+
+// Check implements Checker.
+func (s *ServiceNow) Check(ticket, requester string) error {
+	if ticket == "" {
+		return errors.New("No ticket given")
+	}
+
+	query := url.Values{
+		"sysparm_query":         {"number=" + ticket},
+		"sysparm_fields":        {"state,caller_id,opened_by,assigned_to"},
+		"sysparm_display_value": {"true"},
+	}
+	var incidents serviceNowIncidents
+	if err := s.get("/api/now/table/incident?"+query.Encode(), &incidents); err != nil {
+		return err
+	}
+	if len(incidents.Result) == 0 {
+		return errors.New("Ticket not found")
+	}
+
+	incident := incidents.Result[0]
+	switch incident.State {
+	case "Resolved", "Closed", "Canceled":
+		return fmt.Errorf("Ticket %s is %s", ticket, incident.State)
+	}
+
+	if !names(requester, incident.CallerID, incident.OpenedBy, incident.AssignedTo) {
+		return fmt.Errorf("Ticket %s does not name %s", ticket, requester)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// tickets_test.go: tests for tickets.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package tickets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTicketID(t *testing.T) {
+	for reason, id := range map[string]string{
+		"OPS-123: rotate the password": "OPS-123",
+		"  INC0010001 ":                "INC0010001",
+		"":                             "",
+	} {
+		if got := TicketID(reason); got != id {
+			t.Fatalf("Wrong ticket for %q: %q", reason, got)
+		}
+	}
+}
+
+func TestJira(t *testing.T) {
+	issues := map[string]string{
+		"OPS-1": `{"fields":{"status":{"name":"In Progress","statusCategory":{"key":"indeterminate"}},"reporter":{"name":"alice"},"assignee":{"name":"bob"}}}`,
+		"OPS-2": `{"fields":{"status":{"name":"Closed","statusCategory":{"key":"done"}},"reporter":{"name":"alice"}}}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ro" || pass != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		issue, ok := issues[r.URL.Path[len("/rest/api/2/issue/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(issue))
+	}))
+	defer ts.Close()
+
+	c, err := New("jira", ts.URL+"/", "ro", "secret")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = c.Check("OPS-1", "Alice"); err != nil {
+		t.Fatalf("Reporter rejected: %v", err)
+	}
+	if err = c.Check("OPS-1", "bob"); err != nil {
+		t.Fatalf("Assignee rejected: %v", err)
+	}
+	if err = c.Check("OPS-1", "carol"); err == nil {
+		t.Fatalf("Unnamed requester accepted")
+	}
+	if err = c.Check("OPS-2", "alice"); err == nil {
+		t.Fatalf("Closed ticket accepted")
+	}
+	if err = c.Check("OPS-3", "alice"); err == nil {
+		t.Fatalf("Missing ticket accepted")
+	}
+
+	c, _ = New("jira", ts.URL, "ro", "wrong")
+	if err = c.Check("OPS-1", "alice"); err == nil {
+		t.Fatalf("Failed authentication accepted")
+	}
+}
+
+func TestServiceNow(t *testing.T) {
+	incidents := map[string]string{
+		"number=INC001": `{"result":[{"state":"In Progress","caller_id":"Alice","opened_by":"Service Desk","assigned_to":""}]}`,
+		"number=INC002": `{"result":[{"state":"Resolved","caller_id":"Alice"}]}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/now/table/incident" || r.URL.Query().Get("sysparm_display_value") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		incident, ok := incidents[r.URL.Query().Get("sysparm_query")]
+		if !ok {
+			incident = `{"result":[]}`
+		}
+		w.Write([]byte(incident))
+	}))
+	defer ts.Close()
+
+	c, err := New("servicenow", ts.URL, "", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = c.Check("INC001", "alice"); err != nil {
+		t.Fatalf("Caller rejected: %v", err)
+	}
+	if err = c.Check("INC001", "bob"); err == nil {
+		t.Fatalf("Unnamed requester accepted")
+	}
+	if err = c.Check("INC002", "alice"); err == nil {
+		t.Fatalf("Resolved ticket accepted")
+	}
+	if err = c.Check("INC003", "alice"); err == nil {
+		t.Fatalf("Missing ticket accepted")
+	}
+
+	if _, err = New("bugzilla", ts.URL, "", ""); err == nil {
+		t.Fatalf("Unknown system accepted")
+	}
+}
@@ -0,0 +1,160 @@
+// Package transform turns decrypted data into the part of it that is
+// needed, so that callers are not handed more plaintext than they use:
+// a field of a JSON document, a value of a credentials bundle, or a
+// rendering of a template.
+//
+// A transform is described by a spec of the form "kind:argument":
+//
+//	field:db.password     the field at a dotted path of a JSON document
+//	key:DB_PASSWORD       the value of a KEY=value line of a bundle
+//	template:{{.user}}    a text/template executed on a JSON document
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Check returns an error if spec does not describe a transform.
+func Check(spec string) error {
+	kind, arg, err := parse(spec)
+	if err != nil {
+		return err
+	}
+	if kind == "template" {
+		_, err = newTemplate(arg)
+	}
+	return err
+}
+
+// Apply returns the result of the transform described by spec on data.
+func Apply(spec string, data []byte) ([]byte, error) {
+	kind, arg, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "field":
+		return field(data, arg)
+	case "key":
+		return key(data, arg)
+	default:
+		return render(data, arg)
+	}
+}
+
+// parse splits a spec into its kind and argument.
+func parse(spec string) (kind, arg string, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid transform %q", spec)
+	}
+	switch parts[0] {
+	case "field", "key", "template":
+		return parts[0], parts[1], nil
+	default:
+		return "", "", fmt.Errorf("Unknown transform %q", parts[0])
+	}
+}
+
+// decode parses data as a JSON document.
+func decode(data []byte) (doc interface{}, err error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&doc); err != nil {
+		return nil, errors.New("Decrypted data is not a JSON document")
+	}
+	return doc, nil
+}
+
+// field returns the field at a dotted path of a JSON document. Array
+// elements are selected by their index. Strings are returned as they
+// are and other values as JSON.
+func field(data []byte, path string) ([]byte, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[step]; !ok {
+				return nil, fmt.Errorf("No field %s", path)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("No field %s", path)
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("No field %s", path)
+		}
+	}
+
+	if s, ok := doc.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(doc)
+}
+
+// key returns the value of the line "name=value" of a credentials
+// bundle. Blank lines, comments starting with # and an "export " prefix
+// are ignored, and values may be quoted.
+func key(data []byte, name string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != name {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("No key %s", name)
+}
+
+func newTemplate(text string) (*template.Template, error) {
+	return template.New("transform").Option("missingkey=error").Parse(text)
+}
+
+// render executes a template on a JSON document.
+func render(data []byte, text string) ([]byte, error) {
+	tmpl, err := newTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, doc); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,152 @@
+// Package watermark hides a mark identifying a decryption (who asked
+// for it and when) in decrypted text, so that text that leaks later can
+// be traced back to the decryption it came from. The mark is written
+// with zero-width characters, which are not displayed, and is
+// authenticated with a key so that it cannot be forged.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package watermark
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Mark identifies a decryption.
+type Mark struct {
+	Name string
+	Time time.Time
+}
+
+const (
+	zero  = '\u200b' // zero width space
+	one   = '\u200c' // zero width non-joiner
+	frame = '\u2060' // word joiner, around the mark
+
+	tagSize = 8
+)
+
+// tag authenticates the encoded form of a mark.
+func tag(payload, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("redoctober watermark"))
+	mac.Write(payload)
+	return mac.Sum(nil)[:tagSize]
+}
+
+// encode returns the zero-width form of a mark.
+func encode(m Mark, key []byte) string {
+	payload := make([]byte, 8, 8+len(m.Name)+tagSize)
+	binary.BigEndian.PutUint64(payload, uint64(m.Time.Unix()))
+	payload = append(payload, m.Name...)
+	payload = append(payload, tag(payload, key)...)
+
+	var out strings.Builder
+	out.WriteRune(frame)
+	for _, b := range payload {
+		for i := 7; i >= 0; i-- {
+			if b&(1<<uint(i)) != 0 {
+				out.WriteRune(one)
+			} else {
+				out.WriteRune(zero)
+			}
+		}
+	}
+	out.WriteRune(frame)
+	return out.String()
+}
+
+// IsText returns true if data is text that can be marked: valid UTF-8
+// without control characters other than tabs and line breaks.
+func IsText(data []byte) bool {
+	if len(data) == 0 || !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// Embed returns data with the mark hidden in it. JSON data stays valid
+// JSON: the mark goes at the start of its first string. Other text is
+// marked after its first character. Data that is not text, and JSON
+// without strings, is returned unchanged with ok false.
+func Embed(data []byte, m Mark, key []byte) (marked []byte, ok bool) {
+	if !IsText(data) {
+		return data, false
+	}
+
+	at := 0
+	if json.Valid(data) {
+		// the first quote of valid JSON opens a string
+		if at = bytes.IndexByte(data, '"') + 1; at == 0 {
+			return data, false
+		}
+	} else {
+		_, at = utf8.DecodeRune(data)
+	}
+
+	mark := encode(m, key)
+	marked = make([]byte, 0, len(data)+len(mark))
+	marked = append(marked, data[:at]...)
+	marked = append(marked, mark...)
+	marked = append(marked, data[at:]...)
+	return marked, true
+}
+
+// Extract finds the mark hidden in data by Embed and checks it against
+// key.
+func Extract(data []byte, key []byte) (m Mark, err error) {
+	text := string(data)
+	start := strings.IndexRune(text, frame)
+	if start < 0 {
+		return m, errors.New("No watermark found")
+	}
+	text = text[start+utf8.RuneLen(frame):]
+	end := strings.IndexRune(text, frame)
+	if end < 0 {
+		return m, errors.New("Watermark is truncated")
+	}
+
+	var payload []byte
+	var b byte
+	bits := 0
+	for _, r := range text[:end] {
+		switch r {
+		case zero:
+			b <<= 1
+		case one:
+			b = b<<1 | 1
+		default:
+			return m, errors.New("Watermark is corrupted")
+		}
+		if bits++; bits == 8 {
+			payload = append(payload, b)
+			b, bits = 0, 0
+		}
+	}
+	if bits != 0 || len(payload) < 8+tagSize {
+		return m, errors.New("Watermark is truncated")
+	}
+
+	body, sum := payload[:len(payload)-tagSize], payload[len(payload)-tagSize:]
+	if !hmac.Equal(sum, tag(body, key)) {
+		return m, errors.New("Watermark signature mismatch")
+	}
+
+	m.Time = time.Unix(int64(binary.BigEndian.Uint64(body)), 0)
+	m.Name = string(body[8:])
+	return m, nil
+}
@@ -0,0 +1,84 @@
+// watermark_test.go: tests for watermark.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package watermark
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var key = []byte("0123456789abcdef")
+
+func TestEmbed(t *testing.T) {
+	m := Mark{Name: "Alice", Time: time.Unix(1500000000, 0)}
+
+	for _, in := range []string{
+		"Hello Jello",
+		"é",
+		"line one\nline two\n",
+		`{"password":"hunter2","port":5432}`,
+	} {
+		marked, ok := Embed([]byte(in), m, key)
+		if !ok {
+			t.Fatalf("%q was not marked", in)
+		}
+		if bytes.Equal(marked, []byte(in)) {
+			t.Fatalf("%q is unchanged", in)
+		}
+		if json.Valid([]byte(in)) && !json.Valid(marked) {
+			t.Fatalf("Marked JSON is not valid: %q", marked)
+		}
+
+		// the mark is invisible
+		visible := strings.Map(func(r rune) rune {
+			switch r {
+			case zero, one, frame:
+				return -1
+			}
+			return r
+		}, string(marked))
+		if visible != in {
+			t.Fatalf("Marked text reads %q", visible)
+		}
+
+		found, err := Extract(marked, key)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if found.Name != m.Name || !found.Time.Equal(m.Time) {
+			t.Fatalf("Wrong mark found: %+v", found)
+		}
+
+		if _, err = Extract(marked, []byte("fedcba9876543210")); err == nil {
+			t.Fatalf("Mark verified with the wrong key")
+		}
+	}
+
+	for _, in := range []string{"", "\x00\x01binary", "[1,2,3]"} {
+		if marked, ok := Embed([]byte(in), m, key); ok || !bytes.Equal(marked, []byte(in)) {
+			t.Fatalf("%q should not be marked", in)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	marked, _ := Embed([]byte("Hello Jello"), Mark{Name: "Bob", Time: time.Now()}, key)
+
+	if _, err := Extract([]byte("Hello Jello"), key); err == nil {
+		t.Fatalf("Mark found in unmarked text")
+	}
+	if _, err := Extract(marked[:20], key); err == nil {
+		t.Fatalf("Truncated mark verified")
+	}
+
+	// flip one bit of the mark
+	tampered := strings.Replace(string(marked), string(zero), string(one), 1)
+	if _, err := Extract([]byte(tampered), key); err == nil {
+		t.Fatalf("Tampered mark verified")
+	}
+}
@@ -0,0 +1,105 @@
+// Package window describes time windows with cron-like expressions,
+// such as business hours or a change window, so that policies can
+// allow actions only within them.
+//
+// An expression has the five fields of a crontab line, separated by
+// spaces: minute (0-59), hour (0-23), day of the month (1-31), month
+// (1-12) and day of the week (0-6, Sunday being 0). A time is within
+// the window when it matches every field. Each field is "*", a number,
+// a range "a-b", any of these followed by a step "/n", or a list of
+// them separated by commas:
+//
+//	* 9-17 * * 1-5        weekdays from 9:00 to 17:59
+//	0-29 22 * * 6         Saturdays from 22:00 to 22:29
+//
+// Unlike cron, the day of the month and the day of the week must both
+// match when both are restricted.
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package window
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a parsed time window. Each field is the set of the values
+// it matches, as bits.
+type Window struct {
+	fields [5]uint64
+}
+
+// bounds are the smallest and largest values of each field.
+var bounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Parse parses a cron-like expression.
+func Parse(expr string) (Window, error) {
+	var w Window
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(w.fields) {
+		return w, fmt.Errorf("Time window %q must have 5 fields", expr)
+	}
+	for i, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			set, err := parsePart(part, bounds[i][0], bounds[i][1])
+			if err != nil {
+				return w, fmt.Errorf("Time window %q: %v", expr, err)
+			}
+			w.fields[i] |= set
+		}
+	}
+	return w, nil
+}
+
+// parsePart parses an element of a list of a field, with values from
+// min to max.
+func parsePart(part string, min, max int) (uint64, error) {
+	step := 1
+	if i := strings.Index(part, "/"); i >= 0 {
+		var err error
+		if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+			return 0, fmt.Errorf("Invalid step in %q", part)
+		}
+		part = part[:i]
+	}
+
+	lo, hi := min, max
+	if part != "*" {
+		ends := strings.SplitN(part, "-", 2)
+		var err error
+		if lo, err = strconv.Atoi(ends[0]); err != nil {
+			return 0, fmt.Errorf("Invalid value %q", part)
+		}
+		hi = lo
+		if len(ends) == 2 {
+			if hi, err = strconv.Atoi(ends[1]); err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Value %q not within %d-%d", part, min, max)
+		}
+	}
+
+	var set uint64
+	for v := lo; v <= hi; v += step {
+		set |= 1 << uint(v)
+	}
+	return set, nil
+}
+
+// Contains returns true if t, in its own location, is within the
+// window.
+func (w Window) Contains(t time.Time) bool {
+	values := [5]int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())}
+	for i, v := range values {
+		if w.fields[i]&(1<<uint(v)) == 0 {
+			return false
+		}
+	}
+	return true
+}
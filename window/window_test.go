@@ -0,0 +1,62 @@
+// window_test.go: tests for window.go
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package window
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContains(t *testing.T) {
+	// a Wednesday
+	at := func(hour, minute int) time.Time {
+		return time.Date(2017, 7, 12, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, c := range []struct {
+		expr string
+		t    time.Time
+		in   bool
+	}{
+		{"* * * * *", at(3, 0), true},
+		{"* 9-17 * * 1-5", at(9, 0), true},
+		{"* 9-17 * * 1-5", at(17, 59), true},
+		{"* 9-17 * * 1-5", at(18, 0), false},
+		{"* 9-17 * * 1-5", at(3, 0), false},
+		{"* 9-17 * * 0,6", at(12, 0), false},
+		{"0-29 22 * * 3", at(22, 15), true},
+		{"0-29 22 * * 3", at(22, 30), false},
+		{"*/15 * * * *", at(4, 45), true},
+		{"*/15 * * * *", at(4, 46), false},
+		{"* * 12 7 *", at(0, 0), true},
+		{"* * 13 7 *", at(0, 0), false},
+		{"* 8-20/4 * * *", at(16, 10), true},
+		{"* 8-20/4 * * *", at(10, 10), false},
+	} {
+		w, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if w.Contains(c.t) != c.in {
+			t.Fatalf("%s: wrong result for %v", c.expr, c.t)
+		}
+	}
+
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"* 17-9 * * *",
+		"*/0 * * * *",
+		"* mon * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("%s: no error", expr)
+		}
+	}
+}